@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/AlexAkulov/clickhouse-backup/config"
 	// "github.com/AlexAkulov/clickhouse-backup/internal/logfmt"
@@ -71,10 +75,30 @@ func main() {
 		{
 			Name:        "create",
 			Usage:       "Create new backup",
-			UsageText:   "clickhouse-backup create [-t, --tables=<db>.<table>] [-s, --schema] <backup_name>",
+			UsageText:   "clickhouse-backup create [-t, --tables=<db>.<table>] [-s, --schema] [--modified-since=<time>] [--note=<text>] [--tag=<tag>] [--shard=<i>/<n>] [--engines=<engine>] [--expect-metadata-version=<db>.<table>=<version>] [--partitions=<db>.<table>=<partition_id>] [--diff-from=<backup_name>] [--force] [--dry-run] <backup_name>",
 			Description: "Create new backup",
 			Action: func(c *cli.Context) error {
-				return backup.CreateBackup(getConfig(c), c.Args().First(), c.String("t"), c.Bool("s"), version)
+				selector, err := getTableSelector(c)
+				if err != nil {
+					return err
+				}
+				if c.Bool("dry-run") {
+					tables, err := backup.CreateBackupDryRun(getConfig(c), c.String("t"), c.String("modified-since"), selector, c.Bool("s"))
+					if err != nil {
+						return err
+					}
+					backup.PrintDryRun(os.Stdout, tables)
+					return nil
+				}
+				ctx, cancel := newSignalContext()
+				defer cancel()
+				if diffFrom := c.String("diff-from"); diffFrom != "" {
+					if c.Bool("s") || c.String("modified-since") != "" || len(c.StringSlice("partitions")) > 0 {
+						return fmt.Errorf("--diff-from can't be used with --schema, --modified-since or --partitions")
+					}
+					return backup.CreateIncrementalBackup(ctx, getConfig(c), c.Args().First(), diffFrom, getCreateOptions(c, selector))
+				}
+				return backup.CreateBackup(ctx, getConfig(c), c.Args().First(), getCreateOptions(c, selector))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -86,16 +110,72 @@ func main() {
 					Hidden: false,
 					Usage:  "Backup schemas only",
 				},
+				cli.StringFlag{
+					Name:   "modified-since",
+					Hidden: false,
+					Usage:  "Backup only tables with parts modified after this time (RFC3339 or '2006-01-02 15:04:05')",
+				},
+				cli.StringFlag{
+					Name:   "note",
+					Hidden: false,
+					Usage:  "Human readable note saved in backup metadata, e.g. 'pre-migration-v42'",
+				},
+				cli.StringSliceFlag{
+					Name:   "tag",
+					Hidden: false,
+					Usage:  "Tag saved in backup metadata and shown by list, e.g. 'daily', can be repeated",
+				},
+				cli.StringFlag{
+					Name:   "shard",
+					Hidden: false,
+					Usage:  "Backup only tables of shard <i> of <n>, shards are numbered from 0 and tables are assigned by hash of name, use different backup names for shards",
+				},
+				cli.StringSliceFlag{
+					Name:   "engines",
+					Hidden: false,
+					Usage:  "Backup only tables with engine matched by glob, e.g. '*MergeTree', leading '!' excludes engine, e.g. '!Distributed', can be repeated or comma separated",
+				},
+				cli.BoolFlag{
+					Name:   "force",
+					Hidden: false,
+					Usage:  "Ignore min_backup_interval",
+				},
+				cli.StringSliceFlag{
+					Name:   "expect-metadata-version",
+					Hidden: false,
+					Usage:  "Fail if metadata_version.txt of table differs before FREEZE, <db>.<table>=<version>, can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:   "partitions",
+					Hidden: false,
+					Usage:  "Freeze only listed partitions of table instead of whole table, <db>.<table>=<partition_id>[,<partition_id>], can be repeated",
+				},
+				cli.StringFlag{
+					Name:   "diff-from",
+					Hidden: false,
+					Usage:  "Create incremental backup, only partitions with parts changed since this local backup are frozen",
+				},
+				cli.BoolFlag{
+					Name:   "dry-run",
+					Hidden: false,
+					Usage:  "Print tables which would be backed up with their size, nothing is frozen or written",
+				},
 			),
 		},
 		{
 			Name:        "create_remote",
 			Usage:       "Create and upload",
-			UsageText:   "clickhouse-backup create_remote [-t, --tables=<db>.<table>] [--diff-from=<backup_name>] [--delete] <backup_name>",
+			UsageText:   "clickhouse-backup create_remote [-t, --tables=<db>.<table>] [--diff-from=<backup_name>] [--modified-since=<time>] [--note=<text>] [--tag=<tag>] [--shard=<i>/<n>] [--engines=<engine>] [--expect-metadata-version=<db>.<table>=<version>] [--partitions=<db>.<table>=<partition_id>] [--full] [--delete] [--force] <backup_name>",
 			Description: "Create and upload",
 			Action: func(c *cli.Context) error {
+				selector, err := getTableSelector(c)
+				if err != nil {
+					return err
+				}
 				b := backup.NewBackuper(getConfig(c))
-				return b.CreateToRemote(c.Args().First(), c.String("t"), c.String("diff-from"), c.Bool("s"), version)
+				ctx, cancel := newSignalContext()
+				defer cancel()
+				return b.CreateToRemote(ctx, c.Args().First(), c.String("diff-from"), c.Bool("full"), getCreateOptions(c, selector))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -111,15 +191,60 @@ func main() {
 					Hidden: false,
 					Usage:  "Schemas only",
 				},
+				cli.StringFlag{
+					Name:   "modified-since",
+					Hidden: false,
+					Usage:  "Backup only tables with parts modified after this time (RFC3339 or '2006-01-02 15:04:05')",
+				},
+				cli.StringFlag{
+					Name:   "note",
+					Hidden: false,
+					Usage:  "Human readable note saved in backup metadata, e.g. 'pre-migration-v42'",
+				},
+				cli.StringSliceFlag{
+					Name:   "tag",
+					Hidden: false,
+					Usage:  "Tag saved in backup metadata and shown by list, e.g. 'daily', can be repeated",
+				},
+				cli.StringFlag{
+					Name:   "shard",
+					Hidden: false,
+					Usage:  "Backup only tables of shard <i> of <n>, shards are numbered from 0 and tables are assigned by hash of name, use different backup names for shards",
+				},
+				cli.StringSliceFlag{
+					Name:   "engines",
+					Hidden: false,
+					Usage:  "Backup only tables with engine matched by glob, e.g. '*MergeTree', leading '!' excludes engine, e.g. '!Distributed', can be repeated or comma separated",
+				},
+				cli.BoolFlag{
+					Name:   "force",
+					Hidden: false,
+					Usage:  "Ignore min_backup_interval",
+				},
+				cli.StringSliceFlag{
+					Name:   "expect-metadata-version",
+					Hidden: false,
+					Usage:  "Fail if metadata_version.txt of table differs before FREEZE, <db>.<table>=<version>, can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:   "partitions",
+					Hidden: false,
+					Usage:  "Freeze only listed partitions of table instead of whole table, <db>.<table>=<partition_id>[,<partition_id>], can be repeated",
+				},
+				cli.BoolFlag{
+					Name:   "full",
+					Hidden: false,
+					Usage:  "Upload full backup even if auto_incremental is enabled",
+				},
 			),
 		},
 		{
 			Name:      "upload",
 			Usage:     "Upload backup to remote storage",
-			UsageText: "clickhouse-backup upload [-t, --tables=<db>.<table>] [-s, --schema] [--diff-from=<backup_name>] <backup_name>",
+			UsageText: "clickhouse-backup upload [-t, --tables=<db>.<table>] [-s, --schema] [--diff-from=<backup_name>] [--full] <backup_name>",
 			Action: func(c *cli.Context) error {
 				b := backup.NewBackuper(getConfig(c))
-				return b.Upload(c.Args().First(), c.String("t"), c.String("diff-from"), c.Bool("s"))
+				return b.Upload(c.Args().First(), c.String("t"), c.String("diff-from"), c.Bool("s"), c.Bool("full"))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -135,17 +260,30 @@ func main() {
 					Hidden: false,
 					Usage:  "Upload schemas only",
 				},
+				cli.BoolFlag{
+					Name:   "full",
+					Hidden: false,
+					Usage:  "Upload full backup even if auto_incremental is enabled",
+				},
 			),
 		},
 		{
 			Name:      "list",
 			Usage:     "Print list of backups",
-			UsageText: "clickhouse-backup list [all|local|remote] [latest|penult]",
+			UsageText: "clickhouse-backup list [all|local|remote] [latest|penult] [--tag=<tag>] [--created-after=<time>] [--created-before=<time>] [--offset=<n>] [--limit=<n>]",
 			Action: func(c *cli.Context) error {
 				cfg := getConfig(c)
+				paged := c.String("tag") != "" || c.String("created-after") != "" || c.String("created-before") != "" || c.Int("offset") != 0 || c.Int("limit") != 0
+				if paged && c.Args().Get(0) != "local" {
+					return fmt.Errorf("--tag, --created-after, --created-before, --offset and --limit are supported only by 'list local'")
+				}
 				switch c.Args().Get(0) {
 				case "local":
-					return backup.PrintLocalBackups(cfg, c.Args().Get(1))
+					opts, err := backup.NewListOptions(c.String("tag"), c.String("created-after"), c.String("created-before"), false)
+					if err != nil {
+						return err
+					}
+					return backup.PrintLocalBackupsPage(cfg, c.Args().Get(1), c.Int("offset"), c.Int("limit"), opts)
 				case "remote":
 					return backup.PrintRemoteBackups(cfg, c.Args().Get(1))
 				case "all", "":
@@ -156,15 +294,41 @@ func main() {
 				}
 				return nil
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "tag",
+					Hidden: false,
+					Usage:  "List only local backups with this tag",
+				},
+				cli.StringFlag{
+					Name:   "created-after",
+					Hidden: false,
+					Usage:  "List only local backups created at or after this time (RFC3339 or '2006-01-02 15:04:05')",
+				},
+				cli.StringFlag{
+					Name:   "created-before",
+					Hidden: false,
+					Usage:  "List only local backups created before this time (RFC3339 or '2006-01-02 15:04:05')",
+				},
+				cli.IntFlag{
+					Name:   "offset",
+					Hidden: false,
+					Usage:  "Skip this number of matched local backups",
+				},
+				cli.IntFlag{
+					Name:   "limit",
+					Hidden: false,
+					Usage:  "List at most this number of matched local backups, 0 means without limit",
+				},
+			),
 		},
 		{
 			Name:      "download",
 			Usage:     "Download backup from remote storage",
-			UsageText: "clickhouse-backup download [-t, --tables=<db>.<table>] [-s, --schema] <backup_name>",
+			UsageText: "clickhouse-backup download [-t, --tables=<db>.<table>] [-s, --schema] [--ignore-signature] <backup_name>",
 			Action: func(c *cli.Context) error {
 				b := backup.NewBackuper(getConfig(c))
-				return b.Download(c.Args().First(), c.String("t"), c.Bool("s"))
+				return b.Download(c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("ignore-signature"))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -176,14 +340,22 @@ func main() {
 					Hidden: false,
 					Usage:  "Download schema only",
 				},
+				cli.BoolFlag{
+					Name:   "ignore-signature",
+					Hidden: false,
+					Usage:  "Download backup even if metadata doesn't match metadata.json.sig and metadata.json.sha256 on remote storage",
+				},
 			),
 		},
 		{
 			Name:      "restore",
 			Usage:     "Create schema and restore data from backup",
-			UsageText: "clickhouse-backup restore  [-t, --tables=<db>.<table>] [-s, --schema] [-d, --data] [--rm, --drop] <backup_name>",
+			UsageText: "clickhouse-backup restore  [-t, --tables=<db>.<table>] [-s, --schema] [-d, --data] [--rm, --drop] [--only-missing] [--storage-policy=<policy>] [--on-cluster=<cluster>] [--ignore-signature] [--map-table=<db>.<table>:<db>.<new_table>] [--schema-diff [--apply]] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return backup.Restore(getConfig(c), c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"), c.Bool("rm"))
+				if c.Bool("schema-diff") {
+					return backup.RestoreSchemaDiff(getConfig(c), c.Args().First(), c.String("t"), c.Bool("apply"))
+				}
+				return backup.Restore(getConfig(c), c.Args().First(), getRestoreOptions(c))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -203,17 +375,66 @@ func main() {
 				cli.BoolFlag{
 					Name:   "rm, drop",
 					Hidden: false,
-					Usage:  "Drop table before restore",
+					Usage:  "Drop existing tables of restore before they are created, without it restore fails when table exists. Database with engine changed since backup is recreated when all its tables are restored, it is never recreated with --on-cluster",
+				},
+				cli.BoolFlag{
+					Name:   "only-missing",
+					Hidden: false,
+					Usage:  "Restore only tables which don't exist in clickhouse",
+				},
+				cli.StringFlag{
+					Name:   "storage-policy",
+					Hidden: false,
+					Usage:  "Rewrite storage_policy of restored tables, 'default' removes the setting",
+				},
+				cli.StringFlag{
+					Name:   "on-cluster",
+					Hidden: false,
+					Usage:  "Create databases and tables ON CLUSTER, data is restored on local node only",
+				},
+				cli.BoolFlag{
+					Name:   "ignore-signature",
+					Hidden: false,
+					Usage:  "Restore backup even if metadata doesn't match metadata.json.sig",
+				},
+				cli.StringSliceFlag{
+					Name:   "map-table",
+					Hidden: false,
+					Usage:  "Restore table under new name, <db>.<table>:<db>.<new_table>, can be repeated, ZooKeeper path of Replicated table must contain table name, {table} or {uuid}",
+				},
+				cli.BoolFlag{
+					Name:   "schema-diff",
+					Hidden: false,
+					Usage:  "Print ALTER queries which bring columns of existing tables to schema from backup instead of restore",
+				},
+				cli.BoolFlag{
+					Name:   "apply",
+					Hidden: false,
+					Usage:  "Execute ALTER queries generated by --schema-diff",
+				},
+				cli.Float64Flag{
+					Name:   "drop-part-fraction",
+					Hidden: true,
+					Usage:  "Fault injection testing only, skip attaching this fraction of parts, requires " + backup.AllowFaultInjectionEnv + "=true",
 				},
 			),
 		},
 		{
 			Name:      "restore_remote",
 			Usage:     "Download and restore",
-			UsageText: "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] <backup_name>",
+			UsageText: "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] [--only-missing] [--storage-policy=<policy>] [--on-cluster=<cluster>] [--ignore-signature] [--map-table=<db>.<table>:<db>.<new_table>] [--streaming [--keep-local]] <backup_name>",
 			Action: func(c *cli.Context) error {
 				b := backup.NewBackuper(getConfig(c))
-				return b.RestoreFromRemote(c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"), c.Bool("rm"))
+				if c.Bool("streaming") {
+					if c.Bool("s") || c.Bool("d") || c.Bool("only-missing") || c.String("storage-policy") != "" || c.String("on-cluster") != "" || len(c.StringSlice("map-table")) > 0 {
+						return fmt.Errorf("--streaming can't be used with --schema, --data, --only-missing, --storage-policy, --on-cluster and --map-table")
+					}
+					return b.RestoreFromRemoteStreaming(c.Args().First(), getRestoreOptions(c), c.Bool("keep-local"))
+				}
+				if c.Bool("keep-local") {
+					return fmt.Errorf("--keep-local can be used only with --streaming, restore_remote always keeps downloaded backup")
+				}
+				return b.RestoreFromRemote(c.Args().First(), getRestoreOptions(c))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -233,10 +454,157 @@ func main() {
 				cli.BoolFlag{
 					Name:   "rm, drop",
 					Hidden: false,
-					Usage:  "Drop table before restore",
+					Usage:  "Drop existing tables of restore before they are created, without it restore fails when table exists. Database with engine changed since backup is recreated when all its tables are restored, it is never recreated with --on-cluster",
+				},
+				cli.BoolFlag{
+					Name:   "only-missing",
+					Hidden: false,
+					Usage:  "Restore only tables which don't exist in clickhouse",
+				},
+				cli.StringFlag{
+					Name:   "storage-policy",
+					Hidden: false,
+					Usage:  "Rewrite storage_policy of restored tables, 'default' removes the setting",
+				},
+				cli.StringFlag{
+					Name:   "on-cluster",
+					Hidden: false,
+					Usage:  "Create databases and tables ON CLUSTER, data is restored on local node only",
+				},
+				cli.BoolFlag{
+					Name:   "ignore-signature",
+					Hidden: false,
+					Usage:  "Restore backup even if metadata doesn't match metadata.json.sig",
+				},
+				cli.StringSliceFlag{
+					Name:   "map-table",
+					Hidden: false,
+					Usage:  "Restore table under new name, <db>.<table>:<db>.<new_table>, can be repeated, ZooKeeper path of Replicated table must contain table name, {table} or {uuid}",
+				},
+				cli.BoolFlag{
+					Name:   "streaming",
+					Hidden: false,
+					Usage:  "Download and attach parts one by one without downloading whole backup, full backups only",
+				},
+				cli.BoolFlag{
+					Name:   "keep-local",
+					Hidden: false,
+					Usage:  "With --streaming keep local backup with downloaded schema after restore, it is removed by default",
 				},
 			),
 		},
+		{
+			Name:      "restore_parts",
+			Usage:     "List or restore specific parts of table from local backup",
+			UsageText: "clickhouse-backup restore_parts -t, --table=<db>.<table> <backup_name> [<part_name> ...]",
+			Description: "Without part names print parts of table stored in backup, " +
+				"otherwise copy only these parts to 'detached' and attach them to existing table",
+			Action: func(c *cli.Context) error {
+				tableParts := strings.SplitN(c.String("t"), ".", 2)
+				if len(tableParts) != 2 || c.Args().First() == "" {
+					log.Errorf("Table and backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				if c.NArg() == 1 {
+					return backup.PrintBackupParts(getConfig(c), c.Args().First(), tableParts[0], tableParts[1])
+				}
+				return backup.RestoreParts(getConfig(c), c.Args().First(), tableParts[0], tableParts[1], c.Args().Tail())
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, t",
+					Hidden: false,
+				},
+			),
+		},
+		{
+			Name:      "prune_metadata",
+			Usage:     "Remove table metadata and shadow directories of local backup which are not listed in metadata.json",
+			UsageText: "clickhouse-backup prune_metadata <backup_name>",
+			Action: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					log.Errorf("Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				_, err := backup.PruneBackupMetadata(getConfig(c), c.Args().First())
+				return err
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:      "dump_schema",
+			Usage:     "Print CREATE queries of local backup as SQL script",
+			UsageText: "clickhouse-backup dump_schema <backup_name>",
+			Action: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					log.Errorf("Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				return backup.DumpSchema(getConfig(c), c.Args().First(), os.Stdout)
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:      "validate",
+			Usage:     "Check metadata of local backup without ClickHouse connection",
+			UsageText: "clickhouse-backup validate <backup_name>",
+			Action: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					log.Errorf("Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				findings, err := backup.StaticValidateBackup(getConfig(c), c.Args().First())
+				if err != nil {
+					return err
+				}
+				for _, finding := range findings {
+					fmt.Println(finding)
+				}
+				if len(findings) > 0 {
+					return fmt.Errorf("%d problems found", len(findings))
+				}
+				return nil
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:      "compare_remote",
+			Usage:     "Compare local backup with its copy on remote storage",
+			UsageText: "clickhouse-backup compare_remote <backup_name>",
+			Description: "Tables, parts and their sizes must be the same and all data files of remote copy must exist, " +
+				"local backup can be safely deleted only when nothing is reported",
+			Action: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					log.Errorf("Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				findings, err := backup.CompareBackupLocalRemote(getConfig(c), c.Args().First())
+				if err != nil {
+					return err
+				}
+				for _, finding := range findings {
+					fmt.Println(finding)
+				}
+				if len(findings) > 0 {
+					return fmt.Errorf("%d differences found", len(findings))
+				}
+				return nil
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:      "verify",
+			Usage:     "Verify metadata of local backup against metadata.json.sha256 and metadata.json.sig, part files against files.txt",
+			UsageText: "clickhouse-backup verify <backup_name>",
+			Action: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					log.Errorf("Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				return backup.VerifyBackupLocal(getConfig(c), c.Args().First())
+			},
+			Flags: cliapp.Flags,
+		},
 		{
 			Name:      "delete",
 			Usage:     "Delete specific backup",
@@ -268,6 +636,39 @@ func main() {
 			},
 			Flags: cliapp.Flags,
 		},
+		{
+			Name:  "clean",
+			Usage: "Remove data in 'shadow' folder and local backups abandoned by create",
+			Action: func(c *cli.Context) error {
+				return backup.Clean(getConfig(c))
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:      "watch",
+			Usage:     "Create backups by cron schedule until interrupted",
+			UsageText: "clickhouse-backup watch --schedule=<cron> [-t, --tables=<db>.<table>]",
+			Action: func(c *cli.Context) error {
+				if c.String("schedule") == "" {
+					log.Errorf("Schedule must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				ctx, cancel := newSignalContext()
+				defer cancel()
+				return backup.WatchBackups(ctx, getConfig(c), c.String("schedule"), c.String("t"), version)
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "schedule",
+					Hidden: false,
+					Usage:  "Cron expression in local time, e.g. '0 3 * * *' or @daily, backups are uploaded when remote_storage is set",
+				},
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+			),
+		},
 		{
 			Name:  "server",
 			Usage: "Run API server",
@@ -304,3 +705,67 @@ func getConfigPath(ctx *cli.Context) string {
 	}
 	return defaultConfigPath
 }
+
+// newSignalContext - context which is cancelled by SIGINT or SIGTERM, so operation can clean up before exit
+func newSignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Warnf("%s received, cancelling", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func getTableSelector(ctx *cli.Context) (backup.TableSelector, error) {
+	var shardSelector backup.TableSelector
+	if ctx.String("shard") != "" {
+		var err error
+		if shardSelector, err = backup.ShardSelector(ctx.String("shard")); err != nil {
+			return nil, err
+		}
+	}
+	engineSelector, err := backup.EngineSelector(ctx.StringSlice("engines"))
+	if err != nil {
+		return nil, err
+	}
+	return backup.ChainSelectors(shardSelector, engineSelector), nil
+}
+
+// getCreateOptions - options of create and create_remote, flags which are absent in command are zero
+func getCreateOptions(ctx *cli.Context, selector backup.TableSelector) backup.CreateOptions {
+	return backup.CreateOptions{
+		TablePattern:          ctx.String("t"),
+		ModifiedSince:         ctx.String("modified-since"),
+		Note:                  ctx.String("note"),
+		Tags:                  ctx.StringSlice("tag"),
+		Selector:              selector,
+		ExpectMetadataVersion: ctx.StringSlice("expect-metadata-version"),
+		Partitions:            ctx.StringSlice("partitions"),
+		SchemaOnly:            ctx.Bool("s"),
+		Force:                 ctx.Bool("force"),
+		Version:               version,
+	}
+}
+
+// getRestoreOptions - options of restore and restore_remote, flags which are absent in command are zero
+func getRestoreOptions(ctx *cli.Context) backup.RestoreOptions {
+	return backup.RestoreOptions{
+		TablePattern:     ctx.String("t"),
+		SchemaOnly:       ctx.Bool("s"),
+		DataOnly:         ctx.Bool("d"),
+		DropTable:        ctx.Bool("rm"),
+		OnlyMissing:      ctx.Bool("only-missing"),
+		StoragePolicy:    ctx.String("storage-policy"),
+		OnCluster:        ctx.String("on-cluster"),
+		IgnoreSignature:  ctx.Bool("ignore-signature"),
+		TableMapping:     ctx.StringSlice("map-table"),
+		DropPartFraction: ctx.Float64("drop-part-fraction"),
+	}
+}
@@ -2,29 +2,22 @@ package config
 
 import (
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/compress"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/kelseyhightower/envconfig"
 	yaml "gopkg.in/yaml.v2"
 )
 
-// ArchiveExtensions - list of availiable compression formats and associated file extensions
-var ArchiveExtensions = map[string]string{
-	"tar":    "tar",
-	"lz4":    "tar.lz4",
-	"bzip2":  "tar.bz2",
-	"gzip":   "tar.gz",
-	"sz":     "tar.sz",
-	"xz":     "tar.xz",
-	"br":     "tar.br",
-	"brotli": "tar.br",
-	"zstd":   "tar.zstd",
-}
+var ioPriorityRE = regexp.MustCompile(`^(idle|best-effort(:[0-7])?)$`)
 
 // Config - config file format
 type Config struct {
@@ -41,13 +34,43 @@ type Config struct {
 
 // GeneralConfig - general setting section
 type GeneralConfig struct {
-	RemoteStorage       string `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
-	MaxFileSize         int64  `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
-	DisableProgressBar  bool   `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
-	BackupsToKeepLocal  int    `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
-	BackupsToKeepRemote int    `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
-	LogLevel            string `yaml:"log_level" envconfig:"LOG_LEVEL"`
-	AllowEmptyBackups   bool   `yaml:"allow_empty_backups" envconfig:"ALLOW_EMPTY_BACKUPS"`
+	RemoteStorage             string   `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
+	MaxFileSize               int64    `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
+	DisableProgressBar        bool     `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
+	BackupsToKeepLocal        int      `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
+	BackupsToKeepRemote       int      `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
+	BackupsKeepDuration       string   `yaml:"backups_keep_duration" envconfig:"BACKUPS_KEEP_DURATION"`
+	BackupsKeepDurationRemote string   `yaml:"backups_keep_duration_remote" envconfig:"BACKUPS_KEEP_DURATION_REMOTE"`
+	LogLevel                  string   `yaml:"log_level" envconfig:"LOG_LEVEL"`
+	AllowEmptyBackups         bool     `yaml:"allow_empty_backups" envconfig:"ALLOW_EMPTY_BACKUPS"`
+	ContinueOnError           bool     `yaml:"continue_on_error" envconfig:"CONTINUE_ON_ERROR"`
+	MinBackupInterval         string   `yaml:"min_backup_interval" envconfig:"MIN_BACKUP_INTERVAL"`
+	Quiet                     bool     `yaml:"quiet" envconfig:"QUIET"`
+	SkipUnwritableDisks       bool     `yaml:"skip_unwritable_disks" envconfig:"SKIP_UNWRITABLE_DISKS"`
+	FlushBuffersBeforeBackup  bool     `yaml:"flush_buffers_before_backup" envconfig:"FLUSH_BUFFERS_BEFORE_BACKUP"`
+	ShadowLayout              string   `yaml:"shadow_layout" envconfig:"SHADOW_LAYOUT"`
+	ExcludePartFiles          []string `yaml:"exclude_part_files" envconfig:"EXCLUDE_PART_FILES"`
+	FollowSymlinks            bool     `yaml:"follow_symlinks" envconfig:"FOLLOW_SYMLINKS"`
+	MetadataSigningKey        string   `yaml:"metadata_signing_key" envconfig:"METADATA_SIGNING_KEY"`
+	DataOnlyBackup            bool     `yaml:"data_only_backup" envconfig:"DATA_ONLY_BACKUP"`
+	IOPriority                string   `yaml:"io_priority" envconfig:"IO_PRIORITY"`
+	ForceCopyOverHardlink     bool     `yaml:"force_copy_over_hardlink" envconfig:"FORCE_COPY_OVER_HARDLINK"`
+	VerifyCopiedParts         bool     `yaml:"verify_copied_parts" envconfig:"VERIFY_COPIED_PARTS"`
+	ExpandDependencies        bool     `yaml:"expand_dependencies" envconfig:"EXPAND_DEPENDENCIES"`
+	FreezeRateLimit           float64  `yaml:"freeze_rate_limit" envconfig:"FREEZE_RATE_LIMIT"`
+	AutoIncremental           bool     `yaml:"auto_incremental" envconfig:"AUTO_INCREMENTAL"`
+	AutoIncrementalMaxChain   int      `yaml:"auto_incremental_max_chain" envconfig:"AUTO_INCREMENTAL_MAX_CHAIN"`
+	BackupClusters            bool     `yaml:"backup_clusters" envconfig:"BACKUP_CLUSTERS"`
+	TempDir                   string   `yaml:"temp_dir" envconfig:"TEMP_DIR"`
+	BackupConcurrency         int      `yaml:"backup_concurrency" envconfig:"BACKUP_CONCURRENCY"`
+	UploadConcurrency         int      `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
+	DownloadConcurrency       int      `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
+	SkipDatabases             []string `yaml:"skip_databases" envconfig:"SKIP_DATABASES"`
+	CheckFreeSpace            bool     `yaml:"check_free_space" envconfig:"CHECK_FREE_SPACE"`
+	BackupNonMergeTreeData    bool     `yaml:"backup_non_merge_tree_data" envconfig:"BACKUP_NON_MERGE_TREE_DATA"`
+	BackupDir                 string   `yaml:"backup_dir" envconfig:"BACKUP_DIR"`
+	EncryptionKey             string   `yaml:"encryption_key" envconfig:"ENCRYPTION_KEY"`
+	EncryptionKeyFile         string   `yaml:"encryption_key_file" envconfig:"ENCRYPTION_KEY_FILE"`
 }
 
 // GCSConfig - GCS settings section
@@ -71,6 +94,8 @@ type AzureBlobConfig struct {
 	CompressionLevel      int    `yaml:"compression_level" envconfig:"AZBLOB_COMPRESSION_LEVEL"`
 	CompressionFormat     string `yaml:"compression_format" envconfig:"AZBLOB_COMPRESSION_FORMAT"`
 	SSEKey                string `yaml:"sse_key" envconfig:"AZBLOB_SSE_KEY"`
+	BufferSize            int    `yaml:"buffer_size" envconfig:"AZBLOB_BUFFER_SIZE"`
+	MaxBuffers            int    `yaml:"max_buffers" envconfig:"AZBLOB_MAX_BUFFERS"`
 }
 
 // S3Config - s3 settings section
@@ -121,7 +146,7 @@ type SFTPConfig struct {
 	Port              uint   `yaml:"port" envconfig:"SFTP_PORT"`
 	Username          string `yaml:"username" envconfig:"SFTP_USERNAME"`
 	Password          string `yaml:"password" envconfig:"SFTP_PASSWORD"`
-	Key               string `yaml:"key" envconfig:"SFTP_PASSWORD"`
+	Key               string `yaml:"key" envconfig:"SFTP_KEY"`
 	Path              string `yaml:"path" envconfig:"SFTP_PATH"`
 	CompressionFormat string `yaml:"compression_format" envconfig:"SFTP_COMPRESSION_FORMAT"`
 	CompressionLevel  int    `yaml:"compression_level" envconfig:"SFTP_COMPRESSION_LEVEL"`
@@ -134,6 +159,8 @@ type ClickHouseConfig struct {
 	Host                    string            `yaml:"host" envconfig:"CLICKHOUSE_HOST"`
 	Port                    uint              `yaml:"port" envconfig:"CLICKHOUSE_PORT"`
 	DiskMapping             map[string]string `yaml:"disk_mapping" envconfig:"CLICKHOUSE_DISK_MAPPING"`
+	RestoreDiskMapping      map[string]string `yaml:"restore_disk_mapping" envconfig:"CLICKHOUSE_RESTORE_DISK_MAPPING"`
+	RestoreDatabaseMapping  map[string]string `yaml:"restore_database_mapping" envconfig:"CLICKHOUSE_RESTORE_DATABASE_MAPPING"`
 	SkipTables              []string          `yaml:"skip_tables" envconfig:"CLICKHOUSE_SKIP_TABLES"`
 	Timeout                 string            `yaml:"timeout" envconfig:"CLICKHOUSE_TIMEOUT"`
 	FreezeByPart            bool              `yaml:"freeze_by_part" envconfig:"CLICKHOUSE_FREEZE_BY_PART"`
@@ -142,6 +169,12 @@ type ClickHouseConfig struct {
 	SyncReplicatedTables    bool              `yaml:"sync_replicated_tables" envconfig:"CLICKHOUSE_SYNC_REPLICATED_TABLES"`
 	SkipSyncReplicaTimeouts bool              `yaml:"skip_sync_replica_timeouts" envconfig:"CLICKHOUSE_SKIP_SYNC_REPLICA_TIMEOUTS"`
 	LogSQLQueries           bool              `yaml:"log_sql_queries" envconfig:"CLICKHOUSE_LOG_SQL_QUERIES"`
+	SnapshotDataPath        string            `yaml:"snapshot_data_path" envconfig:"CLICKHOUSE_SNAPSHOT_DATA_PATH"`
+	CheckDiskIdentity       string            `yaml:"check_disk_identity" envconfig:"CLICKHOUSE_CHECK_DISK_IDENTITY"`
+	QueryCommentPrefix      string            `yaml:"query_comment_prefix" envconfig:"CLICKHOUSE_QUERY_COMMENT_PREFIX"`
+	MaxConcurrentQueries    int               `yaml:"max_concurrent_queries" envconfig:"CLICKHOUSE_MAX_CONCURRENT_QUERIES"`
+	UserFilesPath           string            `yaml:"user_files_path" envconfig:"CLICKHOUSE_USER_FILES_PATH"`
+	ConnectTimeout          string            `yaml:"connect_timeout" envconfig:"CLICKHOUSE_CONNECT_TIMEOUT"`
 }
 
 type APIConfig struct {
@@ -159,22 +192,71 @@ type APIConfig struct {
 func (cfg *Config) GetArchiveExtension() string {
 	switch cfg.General.RemoteStorage {
 	case "s3":
-		return ArchiveExtensions[cfg.S3.CompressionFormat]
+		return compress.Extension(cfg.S3.CompressionFormat)
 	case "gcs":
-		return ArchiveExtensions[cfg.GCS.CompressionFormat]
+		return compress.Extension(cfg.GCS.CompressionFormat)
 	case "cos":
-		return ArchiveExtensions[cfg.COS.CompressionFormat]
+		return compress.Extension(cfg.COS.CompressionFormat)
 	case "ftp":
-		return ArchiveExtensions[cfg.FTP.CompressionFormat]
+		return compress.Extension(cfg.FTP.CompressionFormat)
 	case "sftp":
-		return ArchiveExtensions[cfg.SFTP.CompressionFormat]
+		return compress.Extension(cfg.SFTP.CompressionFormat)
 	case "azblob":
-		return ArchiveExtensions[cfg.AzureBlob.CompressionFormat]
+		return compress.Extension(cfg.AzureBlob.CompressionFormat)
 	default:
 		return ""
 	}
 }
 
+// GetTempDir - directory for temporary files of all operations, OS temp dir when temp_dir is empty
+func (cfg *Config) GetTempDir() string {
+	if cfg.General.TempDir != "" {
+		return cfg.General.TempDir
+	}
+	return os.TempDir()
+}
+
+// checkTempDir - temporary files are created during operations, so temp_dir must be writable directory at start
+func checkTempDir(tempDir string) error {
+	info, err := os.Stat(tempDir)
+	if err != nil {
+		return fmt.Errorf("bad temp_dir: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("bad temp_dir: '%s' is not a directory", tempDir)
+	}
+	file, err := ioutil.TempFile(tempDir, ".clickhouse-backup-check-*")
+	if err != nil {
+		return fmt.Errorf("temp_dir '%s' is not writable: %v", tempDir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// GetEncryptionKey - 256 bit key of general.encryption_key or general.encryption_key_file, both are 64 hex characters,
+// nil is returned when encryption is disabled
+func (cfg *Config) GetEncryptionKey() ([]byte, error) {
+	hexKey := cfg.General.EncryptionKey
+	if cfg.General.EncryptionKeyFile != "" {
+		if hexKey != "" {
+			return nil, fmt.Errorf("general.encryption_key and general.encryption_key_file can't be used together")
+		}
+		body, err := ioutil.ReadFile(cfg.General.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read general.encryption_key_file: %v", err)
+		}
+		hexKey = strings.TrimSpace(string(body))
+	}
+	if hexKey == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 64 hex characters of 256 bit key")
+	}
+	return key, nil
+}
+
 func (cfg *Config) GetCompressionFormat() string {
 	switch cfg.General.RemoteStorage {
 	case "s3":
@@ -217,12 +299,93 @@ func ValidateConfig(cfg *Config) error {
 	if cfg.GetCompressionFormat() == "lz4" {
 		return fmt.Errorf("clickhouse already compressed data by lz4")
 	}
-	if _, ok := ArchiveExtensions[cfg.GetCompressionFormat()]; !ok {
-		return fmt.Errorf("'%s' is unsupported compression format", cfg.GetCompressionFormat())
+	if err := compress.Validate(cfg.GetCompressionFormat()); err != nil {
+		return err
 	}
 	if _, err := time.ParseDuration(cfg.ClickHouse.Timeout); err != nil {
 		return err
 	}
+	if cfg.General.BackupDir != "" && !filepath.IsAbs(cfg.General.BackupDir) {
+		return fmt.Errorf("general.backup_dir must be absolute path, got '%s'", cfg.General.BackupDir)
+	}
+	if _, err := time.ParseDuration(cfg.ClickHouse.ConnectTimeout); err != nil {
+		return fmt.Errorf("invalid clickhouse.connect_timeout: %v", err)
+	}
+	if cfg.ClickHouse.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("max_concurrent_queries should be >= 0")
+	}
+	if cfg.General.IOPriority != "" && !ioPriorityRE.MatchString(cfg.General.IOPriority) {
+		return fmt.Errorf("wrong io_priority '%s', use idle, best-effort or best-effort:<0-7>", cfg.General.IOPriority)
+	}
+	if cfg.General.RemoteStorage == "azblob" && (cfg.AzureBlob.BufferSize < 1 || cfg.AzureBlob.MaxBuffers < 1) {
+		return fmt.Errorf("azblob.buffer_size and azblob.max_buffers should be > 0")
+	}
+	if _, err := cfg.GetEncryptionKey(); err != nil {
+		return err
+	}
+	if cfg.General.FreezeRateLimit < 0 {
+		return fmt.Errorf("freeze_rate_limit can't be negative")
+	}
+	if cfg.General.BackupConcurrency < 1 {
+		return fmt.Errorf("backup_concurrency should be > 0")
+	}
+	targetDatabases := map[string]struct{}{}
+	for database, target := range cfg.ClickHouse.RestoreDatabaseMapping {
+		if database == "" || target == "" {
+			return fmt.Errorf("bad restore_database_mapping '%s: %s', database names can't be empty", database, target)
+		}
+		if _, exists := targetDatabases[target]; exists {
+			return fmt.Errorf("several databases are mapped to '%s' by restore_database_mapping", target)
+		}
+		targetDatabases[target] = struct{}{}
+	}
+	if cfg.General.UploadConcurrency < 1 {
+		return fmt.Errorf("upload_concurrency should be > 0")
+	}
+	if cfg.General.DownloadConcurrency < 1 {
+		return fmt.Errorf("download_concurrency should be > 0")
+	}
+	if cfg.General.RemoteStorage == "ftp" && (cfg.General.UploadConcurrency > 1 || cfg.General.DownloadConcurrency > 1) {
+		return fmt.Errorf("upload_concurrency and download_concurrency > 1 are not possible with ftp, all transfers use one ftp connection")
+	}
+	if cfg.General.AutoIncrementalMaxChain < 0 {
+		return fmt.Errorf("auto_incremental_max_chain should be >= 0")
+	}
+	for _, pattern := range cfg.General.ExcludePartFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad exclude_part_files pattern '%s': %v", pattern, err)
+		}
+	}
+	switch cfg.General.ShadowLayout {
+	case "table", "disk":
+	default:
+		return fmt.Errorf("'%s' is unsupported shadow_layout, use table or disk", cfg.General.ShadowLayout)
+	}
+	switch cfg.ClickHouse.CheckDiskIdentity {
+	case "none", "warn", "strict":
+	default:
+		return fmt.Errorf("'%s' is unsupported check_disk_identity, use none, warn or strict", cfg.ClickHouse.CheckDiskIdentity)
+	}
+	if cfg.General.BackupsKeepDuration != "" {
+		if d, err := time.ParseDuration(cfg.General.BackupsKeepDuration); err != nil || d <= 0 {
+			return fmt.Errorf("bad backups_keep_duration: '%s', expected positive duration, e.g. 168h", cfg.General.BackupsKeepDuration)
+		}
+	}
+	if cfg.General.BackupsKeepDurationRemote != "" {
+		if d, err := time.ParseDuration(cfg.General.BackupsKeepDurationRemote); err != nil || d <= 0 {
+			return fmt.Errorf("bad backups_keep_duration_remote: '%s', expected positive duration, e.g. 720h", cfg.General.BackupsKeepDurationRemote)
+		}
+	}
+	if cfg.General.MinBackupInterval != "" {
+		if _, err := time.ParseDuration(cfg.General.MinBackupInterval); err != nil {
+			return fmt.Errorf("bad min_backup_interval: %v", err)
+		}
+	}
+	if cfg.General.TempDir != "" {
+		if err := checkTempDir(cfg.General.TempDir); err != nil {
+			return err
+		}
+	}
 	if _, err := time.ParseDuration(cfg.COS.Timeout); err != nil {
 		return err
 	}
@@ -265,29 +428,39 @@ func PrintDefaultConfig() {
 func DefaultConfig() *Config {
 	return &Config{
 		General: GeneralConfig{
-			RemoteStorage:       "s3",
-			MaxFileSize:         1024 * 1024 * 1024 * 1024, // 1TB
-			BackupsToKeepLocal:  0,
-			BackupsToKeepRemote: 0,
-			LogLevel:            "info",
+			RemoteStorage:           "s3",
+			MaxFileSize:             1024 * 1024 * 1024 * 1024, // 1TB
+			BackupsToKeepLocal:      0,
+			BackupsToKeepRemote:     0,
+			LogLevel:                "info",
+			ShadowLayout:            "table",
+			BackupConcurrency:       1,
+			UploadConcurrency:       1,
+			DownloadConcurrency:     1,
+			AutoIncrementalMaxChain: 7,
+			SkipDatabases:           []string{"system", "INFORMATION_SCHEMA", "information_schema"},
 		},
 		ClickHouse: ClickHouseConfig{
-			Username: "default",
-			Password: "",
-			Host:     "localhost",
-			Port:     9000,
-			SkipTables: []string{
-				"system.*",
-			},
+			Username:                "default",
+			Password:                "",
+			Host:                    "localhost",
+			Port:                    9000,
+			SkipTables:              []string{},
 			Timeout:                 "5m",
+			ConnectTimeout:          "10s",
 			SyncReplicatedTables:    true,
 			SkipSyncReplicaTimeouts: true,
 			LogSQLQueries:           false,
+			CheckDiskIdentity:       "warn",
+			QueryCommentPrefix:      "clickhouse-backup",
+			MaxConcurrentQueries:    16,
 		},
 		AzureBlob: AzureBlobConfig{
 			EndpointSuffix:    "core.windows.net",
 			CompressionLevel:  1,
 			CompressionFormat: "tar",
+			BufferSize:        2 * 1024 * 1024,
+			MaxBuffers:        3,
 		},
 		S3: S3Config{
 			Region:                  "us-east-1",
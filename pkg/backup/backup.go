@@ -1,6 +1,7 @@
 package backup
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,11 +10,14 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/AlexAkulov/clickhouse-backup/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/utils"
 	apexLog "github.com/apex/log"
 	"github.com/google/uuid"
 )
@@ -23,19 +27,45 @@ const (
 	TimeFormatForBackup = "2006-01-02T15-04-05"
 	hashfile            = "parts.hash"
 	MetaFileName        = "metadata.json"
+	// MaxDescriptionLength - max length of backup note
+	MaxDescriptionLength = 1024
 )
 
 var (
 	// ErrUnknownClickhouseDataPath -
 	ErrUnknownClickhouseDataPath = errors.New("clickhouse data path is unknown, you can set data_path in config file")
+	// ErrBackupIntervalNotElapsed - last backup is younger than general.min_backup_interval
+	ErrBackupIntervalNotElapsed = errors.New("min_backup_interval is not elapsed since last backup")
+	// ErrInvalidBackupName - backup name can't be used as directory name inside backup directory
+	ErrInvalidBackupName = errors.New("invalid backup name")
+	// ErrBackupBroken - local backup can't be used, see BackupLocal.Broken for the reason
+	ErrBackupBroken = errors.New("backup is broken")
+	// ErrBaseBackupNotFound - base of incremental backup doesn't exist locally
+	ErrBaseBackupNotFound = errors.New("base backup is not found")
+	// ErrUnsafeRemovePath - directory doesn't look like local backup, it is not removed
+	ErrUnsafeRemovePath = errors.New("refuse to remove directory which is not a backup")
+	// ErrTableAlreadyExists - restore doesn't overwrite existing tables without --drop
+	ErrTableAlreadyExists = errors.New("table already exists, use --drop to overwrite")
 )
 
+// TableSelector - custom table selection for CreateBackup, receives all tables from system.tables
+// tables matched by clickhouse.skip_tables have Skip flag
+type TableSelector func([]clickhouse.Table) ([]clickhouse.Table, error)
+
 type BackupLocal struct {
 	metadata.BackupMetadata
 	Legacy bool
 	Broken string
+	// InProgress - create is running or was abandoned, backup is neither complete nor broken
+	InProgress *InProgressMarker
 }
 
+// BrokenPartiallyDeleted - deletion of backup was interrupted, it must be deleted again
+const BrokenPartiallyDeleted = "partially deleted, run delete again"
+
+// BrokenMetadataMissing - backup directory has no metadata.json and is not legacy backup
+const BrokenMetadataMissing = MetaFileName + " missing"
+
 func addTable(tables []clickhouse.Table, table clickhouse.Table) []clickhouse.Table {
 	for _, t := range tables {
 		if (t.Database == table.Database) && (t.Name == table.Name) {
@@ -54,22 +84,45 @@ func addBackupTable(tables clickhouse.BackupTables, table metadata.TableMetadata
 	return append(tables, table)
 }
 
-func filterTablesByPattern(tables []clickhouse.Table, tablePattern string) []clickhouse.Table {
+// filterTablesByPattern - tables matched by tablePattern, tables of skipDatabases are dropped even when matched
+func filterTablesByPattern(tables []clickhouse.Table, tablePattern string, skipDatabases []string) []clickhouse.Table {
+	tables = filterSkippedDatabases(tables, skipDatabases)
 	if tablePattern == "" {
 		return tables
 	}
-	tablePatterns := strings.Split(tablePattern, ",")
+	matcher := newTableMatcher(tablePattern)
 	var result []clickhouse.Table
 	for _, t := range tables {
-		for _, pattern := range tablePatterns {
-			if matched, _ := filepath.Match(pattern, fmt.Sprintf("%s.%s", t.Database, t.Name)); matched {
-				result = addTable(result, t)
-			}
+		if matcher.match(fmt.Sprintf("%s.%s", t.Database, t.Name)) {
+			result = addTable(result, t)
 		}
 	}
 	return result
 }
 
+// filterSkippedDatabases - drop tables of general.skip_databases, INFORMATION_SCHEMA is matched case-insensitively
+func filterSkippedDatabases(tables []clickhouse.Table, skipDatabases []string) []clickhouse.Table {
+	if len(skipDatabases) == 0 {
+		return tables
+	}
+	result := make([]clickhouse.Table, 0, len(tables))
+	for _, t := range tables {
+		if !isSkippedDatabase(t.Database, skipDatabases) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func isSkippedDatabase(database string, skipDatabases []string) bool {
+	for _, skipped := range skipDatabases {
+		if database == skipped || strings.EqualFold(skipped, "information_schema") && strings.EqualFold(database, skipped) {
+			return true
+		}
+	}
+	return false
+}
+
 func filterTablesByParams(tables []clickhouse.Table, tablePatterns []clickhouse.TableParams) []clickhouse.Table {
 	if len(tablePatterns) == 1 && tablePatterns[0].Name == "" {
 		for i := 0; i < len(tables); i++ {
@@ -91,192 +144,393 @@ func filterTablesByParams(tables []clickhouse.Table, tablePatterns []clickhouse.
 	return result
 }
 
-// NewBackupName - return default backup name
-func NewBackupName() string {
-	return time.Now().UTC().Format(TimeFormatForBackup)
+// parseModifiedSince - accept RFC3339, "2006-01-02 15:04:05" or "2006-01-02", time without zone is UTC
+func parseModifiedSince(modifiedSince string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, modifiedSince); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse modified-since '%s', use RFC3339, '2006-01-02 15:04:05' or '2006-01-02'", modifiedSince)
 }
 
-// CreateBackup - create new backup of all tables matched by tablePattern
-// If backupName is empty string will use default backup name
-func CreateBackup(cfg *config.Config, backupName, tablePattern string, schemaOnly bool, version string) error {
-	if backupName == "" {
-		backupName = NewBackupName()
+// filterTablesByModifiedSince - keep only tables with active parts newer than since, dormant and empty tables are skipped
+func filterTablesByModifiedSince(ch *clickhouse.ClickHouse, tables []clickhouse.Table, since time.Time) ([]clickhouse.Table, error) {
+	modifiedTables, err := ch.GetTablesModifiedSince(since)
+	if err != nil {
+		return nil, err
 	}
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "create",
-	})
-	ch := &clickhouse.ClickHouse{
-		Config: &cfg.ClickHouse,
+	result := []clickhouse.Table{}
+	for _, t := range tables {
+		if _, ok := modifiedTables[metadata.TableTitle{Database: t.Database, Table: t.Name}]; ok {
+			result = append(result, t)
+		}
 	}
-	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	return result, nil
+}
+
+// createBackupDirs - create backup dir on all clickhouse disks or general.backup_dir when it is set,
+// unwritable disks except default are skipped when general.skip_unwritable_disks is enabled
+func createBackupDirs(cfg *config.Config, ch *clickhouse.ClickHouse, disks []clickhouse.Disk, log *apexLog.Entry) ([]clickhouse.Disk, []string, error) {
+	if cfg.General.BackupDir != "" {
+		// all disks share general.backup_dir, parts are copied to it when it is on another filesystem
+		if err := ch.MkdirAll(cfg.General.BackupDir); err != nil {
+			return nil, nil, fmt.Errorf("can't create general.backup_dir '%s': %v", cfg.General.BackupDir, err)
+		}
+		if !isBackupDirWritable(cfg.General.BackupDir) {
+			return nil, nil, fmt.Errorf("general.backup_dir '%s' is not writable", cfg.General.BackupDir)
+		}
+		return disks, nil, nil
 	}
-	defer ch.Close()
+	writableDisks := make([]clickhouse.Disk, 0, len(disks))
+	var skippedDisks []string
+	for _, disk := range disks {
+		backupDir := path.Join(disk.Path, "backup")
+		if err := ch.Mkdir(backupDir); err != nil {
+			if !cfg.General.SkipUnwritableDisks || disk.Name == "default" {
+				return nil, nil, fmt.Errorf("can't create '%s' on disk '%s': %v", backupDir, disk.Name, err)
+			}
+			log.WithField("disk", disk.Name).Warnf("can't create '%s', disk skipped: %v", backupDir, err)
+			skippedDisks = append(skippedDisks, disk.Name)
+			continue
+		}
+		writableDisks = append(writableDisks, disk)
+	}
+	return writableDisks, skippedDisks, nil
+}
 
-	allDatabases, err := ch.GetDatabases()
-	if err != nil {
-		return fmt.Errorf("cat't get database engines from clickhouse: %v", err)
+// expandAndFilterTables - add dependencies of selected tables by general.expand_dependencies
+// and keep only tables modified after since when it is not zero
+func expandAndFilterTables(cfg *config.Config, ch *clickhouse.ClickHouse, allTables, tables []clickhouse.Table, since time.Time, log *apexLog.Entry) ([]clickhouse.Table, map[metadata.TableTitle][]string, error) {
+	var sourceTables map[metadata.TableTitle][]string
+	if cfg.General.ExpandDependencies {
+		tables, sourceTables = expandDependencies(allTables, tables, log)
+	}
+	if !since.IsZero() {
+		var err error
+		if tables, err = filterTablesByModifiedSince(ch, tables, since); err != nil {
+			return nil, nil, err
+		}
+		log.Infof("%d tables modified since %s", len(tables), since.Format(time.RFC3339))
 	}
+	return tables, sourceTables, nil
+}
 
-	allTables, err := ch.GetTables()
-	if err != nil {
-		return fmt.Errorf("cat't get tables from clickhouse: %v", err)
+// getSkippedTableDisk - return name of skipped disk which contains table data
+func getSkippedTableDisk(disks []clickhouse.Disk, table *clickhouse.Table, skippedDisks []string) string {
+	if len(skippedDisks) == 0 {
+		return ""
+	}
+	for diskName := range clickhouse.GetDisksByPaths(disks, table.DataPaths) {
+		for _, skipped := range skippedDisks {
+			if diskName == skipped {
+				return diskName
+			}
+		}
 	}
-	tables := filterTablesByPattern(allTables, tablePattern)
-	i := 0
-	for _, table := range tables {
-		if table.Skip {
+	return ""
+}
+
+// flushBuffers - flush Buffer and Distributed tables which write into tables selected for backup
+// return true when at least one table was flushed
+func flushBuffers(ch *clickhouse.ClickHouse, allTables, tables []clickhouse.Table, log *apexLog.Entry) (bool, error) {
+	backupTables := map[metadata.TableTitle]struct{}{}
+	for _, t := range tables {
+		if !t.Skip {
+			backupTables[metadata.TableTitle{Database: t.Database, Table: t.Name}] = struct{}{}
+		}
+	}
+	flushed := false
+	for i := range allTables {
+		engine, database, table, ok := clickhouse.ParseEngineTarget(allTables[i].CreateTableQuery)
+		if !ok {
 			continue
 		}
-		i++
+		if database == "" {
+			database = allTables[i].Database
+		}
+		if _, ok := backupTables[metadata.TableTitle{Database: database, Table: table}]; !ok {
+			continue
+		}
+		if err := ch.FlushTable(&allTables[i]); err != nil {
+			return flushed, err
+		}
+		log.WithField("table", fmt.Sprintf("%s.%s", allTables[i].Database, allTables[i].Name)).Debugf("%s flushed", engine)
+		flushed = true
 	}
-	if i == 0 && !cfg.General.AllowEmptyBackups {
-		return fmt.Errorf("no tables for backup")
+	return flushed, nil
+}
+
+// NewBackupName - return default backup name
+func NewBackupName() string {
+	return time.Now().UTC().Format(TimeFormatForBackup)
+}
+
+// validateBackupName - reject names which could escape backup directory of disk
+func validateBackupName(backupName string) error {
+	if backupName == "." || strings.Contains(backupName, "..") || strings.ContainsAny(backupName, "/\\") {
+		return fmt.Errorf("%w '%s': path separators and '..' are not allowed", ErrInvalidBackupName, backupName)
+	}
+	for _, r := range backupName {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w '%s': control characters are not allowed", ErrInvalidBackupName, backupName)
+		}
 	}
+	return nil
+}
 
-	disks, err := ch.GetDisks()
+// checkMinBackupInterval - protect from backup storms when create command is retried
+func checkMinBackupInterval(cfg *config.Config) error {
+	if cfg.General.MinBackupInterval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(cfg.General.MinBackupInterval)
+	if err != nil || interval <= 0 {
+		return err
+	}
+	backupList, err := GetLocalBackups(cfg)
 	if err != nil {
 		return err
 	}
-	// create backup dir on all clickhouse disks
-	for _, disk := range disks {
-		if err := ch.Mkdir(path.Join(disk.Path, "backup")); err != nil {
-			return err
+	for i := len(backupList) - 1; i >= 0; i-- {
+		if backupList[i].Legacy || backupList[i].Broken != "" || backupList[i].InProgress != nil {
+			continue
 		}
+		if since := time.Since(backupList[i].CreationDate); since < interval {
+			return fmt.Errorf("%w: '%s' was created %s ago, use --force to create new backup", ErrBackupIntervalNotElapsed, backupList[i].BackupName, utils.HumanizeDuration(since))
+		}
+		break
 	}
-	defaultPath, err := ch.GetDefaultPath()
+	return nil
+}
+
+// CreateOptions - options of CreateBackup, CreateIncrementalBackup and CreateToRemote,
+// zero value creates backup of data and schema of all tables
+type CreateOptions struct {
+	TablePattern string
+	// ModifiedSince - only tables with parts modified after this time are backed up, see parseModifiedSince for format
+	ModifiedSince string
+	// Note - stored verbatim in metadata.json as backup description
+	Note string
+	// Tags - stored in metadata.json and shown by list, e.g. "daily"
+	Tags []string
+	// Selector - applied to all tables before TablePattern when it is not nil
+	Selector TableSelector
+	// Progress - called when each table is finished when it is not nil
+	Progress ProgressFunc
+	// ExpectMetadataVersion - list of <db>.<table>=<version>, backup fails if metadata_version.txt of table differs before FREEZE
+	ExpectMetadataVersion []string
+	// Partitions - list of <db>.<table>=<partition_id>[,<partition_id>], only these partitions of table are frozen,
+	// tables without partitions are frozen whole
+	Partitions []string
+	SchemaOnly bool
+	// Force - min_backup_interval is ignored
+	Force bool
+	// Version - version of clickhouse-backup stored in metadata.json
+	Version string
+}
+
+// CreateBackup - create new backup of all tables matched by opts.TablePattern
+// If backupName is empty string will use default backup name
+// When ctx is cancelled backup is removed and ctx.Err() is returned
+func CreateBackup(ctx context.Context, cfg *config.Config, backupName string, opts CreateOptions) error {
+	return createBackupByPattern(ctx, cfg, backupName, "", opts)
+}
+
+// CreateIncrementalBackup - create backup of all tables matched by tablePattern which contains only partitions
+// with parts changed since local backup baseBackupName, unchanged parts are hardlinked from base backup and marked
+// as required, metadata.json has required_backup=baseBackupName. ErrBaseBackupNotFound is returned when base backup
+// doesn't exist. ModifiedSince, Partitions and SchemaOnly of opts can't be used, other options are the same as of CreateBackup
+func CreateIncrementalBackup(ctx context.Context, cfg *config.Config, backupName, baseBackupName string, opts CreateOptions) error {
+	if baseBackupName == "" {
+		return fmt.Errorf("base backup name is required")
+	}
+	if opts.ModifiedSince != "" || len(opts.Partitions) > 0 || opts.SchemaOnly {
+		return fmt.Errorf("modified since, partitions and schema only can't be used for incremental backup")
+	}
+	return createBackupByPattern(ctx, cfg, backupName, baseBackupName, opts)
+}
+
+func createBackupByPattern(ctx context.Context, cfg *config.Config, backupName, baseBackupName string, opts CreateOptions) error {
+	if backupName == "" {
+		backupName = NewBackupName()
+	}
+	if err := validateBackupName(backupName); err != nil {
+		return err
+	}
+	if len(opts.Note) > MaxDescriptionLength {
+		return fmt.Errorf("note is too long, %d bytes allowed", MaxDescriptionLength)
+	}
+	tags, err := normalizeTags(opts.Tags)
 	if err != nil {
 		return err
 	}
-	backupPath := path.Join(defaultPath, "backup", backupName)
-	if _, err := os.Stat(path.Join(backupPath, "metadata.json")); err == nil || !os.IsNotExist(err) {
-		return fmt.Errorf("'%s' already exists", backupName)
+	if opts.SchemaOnly && cfg.General.DataOnlyBackup {
+		return fmt.Errorf("schema only backup is not possible with data_only_backup")
 	}
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		if err = ch.Mkdir(backupPath); err != nil {
-			log.Errorf("can't create diretory %s: %v", backupPath, err)
-		}
+	expectedMetadataVersions, err := parseExpectedMetadataVersions(opts.ExpectMetadataVersion)
+	if err != nil {
+		return err
 	}
-	diskMap := map[string]string{}
-	for _, disk := range disks {
-		diskMap[disk.Name] = disk.Path
+	if opts.SchemaOnly && len(expectedMetadataVersions) > 0 {
+		return fmt.Errorf("expected metadata version can't be checked for schema only backup")
 	}
-	var backupDataSize, backupMetadataSize int64
-
-	var t []metadata.TableTitle
-	for _, table := range tables {
-		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
-		if table.Skip {
-			continue
+	tablePartitions, err := parseTablePartitions(opts.Partitions)
+	if err != nil {
+		return err
+	}
+	if opts.SchemaOnly && len(tablePartitions) > 0 {
+		return fmt.Errorf("partitions can't be used for schema only backup")
+	}
+	if len(tablePartitions) > 0 && cfg.ClickHouse.SnapshotDataPath != "" {
+		return fmt.Errorf("partitions can't be used with snapshot_data_path")
+	}
+	if baseBackupName != "" {
+		if baseBackupName == backupName {
+			return fmt.Errorf("backup can't be incremental of itself")
 		}
-		backupPath := path.Join(defaultPath, "backup", backupName)
-		var realSize map[string]int64
-		var partitions map[string][]metadata.Part
-		if !schemaOnly {
-			log.Debug("create data")
-			partitions, realSize, err = AddTableToBackup(ch, backupName, &table)
-			if err != nil {
-				log.Error(err.Error())
-				if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
-					log.Error(removeBackupErr.Error())
-				}
-				// continue
-				return err
-			}
-			backupDataSize += table.TotalBytes.Int64
-		}
-		log.Debug("create metadata")
-		metadataSize, err := createMetadata(ch, backupPath, metadata.TableMetadata{
-			Table:      table.Name,
-			Database:   table.Database,
-			Query:      table.CreateTableQuery,
-			TotalBytes: table.TotalBytes.Int64,
-			Size:       realSize,
-			Parts:      partitions,
-		})
-		if err != nil {
-			if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
-				log.Error(removeBackupErr.Error())
-			}
-			return err
-			// continue
+		if cfg.ClickHouse.SnapshotDataPath != "" {
+			return fmt.Errorf("incremental backup can't be created with snapshot_data_path")
 		}
-		backupMetadataSize += int64(metadataSize)
-		t = append(t, metadata.TableTitle{
-			Database: table.Database,
-			Table:    table.Name,
-		})
-		log.Infof("done")
 	}
-	backupMetadata := metadata.BackupMetadata{
-		// TODO: надо помечать какие таблички зафейлились либо фейлить весь бэкап
-		BackupName:              backupName,
-		Disks:                   diskMap,
-		ClickhouseBackupVersion: version,
-		CreationDate:            time.Now().UTC(),
-		// Tags: ,
-		ClickHouseVersion: ch.GetVersionDescribe(),
-		DataSize:          backupDataSize,
-		MetadataSize:      backupMetadataSize,
-		// CompressedSize: ,
-		Tables:    t,
-		Databases: []metadata.DatabasesMeta{},
+	var since time.Time
+	if opts.ModifiedSince != "" {
+		if since, err = parseModifiedSince(opts.ModifiedSince); err != nil {
+			return err
+		}
 	}
-	for _, database := range allDatabases {
-		backupMetadata.Databases = append(backupMetadata.Databases, metadata.DatabasesMeta(database))
+	if !opts.Force {
+		if err := checkMinBackupInterval(cfg); err != nil {
+			return err
+		}
 	}
-	content, err := json.MarshalIndent(&backupMetadata, "", "\t")
-	if err != nil {
-		_ = RemoveBackupLocal(cfg, backupName)
-		return fmt.Errorf("can't marshal backup metafile json: %v", err)
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
 	}
-	backupMetaFile := path.Join(defaultPath, "backup", backupName, "metadata.json")
-	if err := ioutil.WriteFile(backupMetaFile, content, 0640); err != nil {
-		_ = RemoveBackupLocal(cfg, backupName)
-		return err
+	ch.SetQueryComment("create", backupName)
+	if err := ch.Connect(); err != nil {
+		if errors.Is(err, clickhouse.ErrConnectTimeout) {
+			return err
+		}
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
-	if err := ch.Chown(backupMetaFile); err != nil {
-		log.Warnf("can't chown %s: %v", backupMetaFile, err)
+	defer ch.Close()
+	var base *incrementalBase
+	if baseBackupName != "" {
+		var defaultPath string
+		if err := ch.WithConnectTimeout(func() (err error) {
+			defaultPath, err = ch.GetDefaultPath()
+			return err
+		}); err != nil {
+			if errors.Is(err, clickhouse.ErrConnectTimeout) {
+				return err
+			}
+			return ErrUnknownClickhouseDataPath
+		}
+		if base, err = getIncrementalBase(localBackupsPath(cfg, defaultPath), baseBackupName); err != nil {
+			return err
+		}
 	}
-	log.Info("done")
-
-	// Clean
-	if err := RemoveOldBackupsLocal(cfg, true); err != nil {
+	var allTables []clickhouse.Table
+	if err := ch.WithConnectTimeout(func() (err error) {
+		allTables, err = ch.GetTables()
 		return err
+	}); err != nil {
+		if errors.Is(err, clickhouse.ErrConnectTimeout) {
+			return err
+		}
+		return fmt.Errorf("cat't get tables from clickhouse: %v", err)
 	}
-	return nil
+	if opts.Selector != nil {
+		if allTables, err = opts.Selector(allTables); err != nil {
+			return fmt.Errorf("can't select tables: %v", err)
+		}
+	}
+	tables := filterTablesByPattern(allTables, opts.TablePattern, cfg.General.SkipDatabases)
+	return createBackup(ctx, cfg, ch, backupName, allTables, tables, opts.SchemaOnly, since, opts.Note, tags, expectedMetadataVersions, tablePartitions, base, opts.Progress, opts.Version)
 }
 
-func CreateBackupforAgent(cfg *config.Config, backupName string, backup_tables []clickhouse.TableParams, version string) error {
+// CreateBackupforAgent - create new backup of tables listed in backup_tables, every table can be schema only
+func CreateBackupforAgent(ctx context.Context, cfg *config.Config, backupName string, backup_tables []clickhouse.TableParams, force bool, version string) error {
 	if len(backup_tables) == 0 {
 		return fmt.Errorf("backup_tables is empty")
 	}
+	if cfg.General.DataOnlyBackup {
+		for _, table := range backup_tables {
+			if table.SchemaOnly {
+				return fmt.Errorf("schema only backup of '%s' is not possible with data_only_backup", table.Name)
+			}
+		}
+	}
 	if backupName == "" {
 		backupName = NewBackupName()
 	}
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "create",
-	})
+	if err := validateBackupName(backupName); err != nil {
+		return err
+	}
+	if !force {
+		if err := checkMinBackupInterval(cfg); err != nil {
+			return err
+		}
+	}
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
+	ch.SetQueryComment("create", backupName)
 	if err := ch.Connect(); err != nil {
+		if errors.Is(err, clickhouse.ErrConnectTimeout) {
+			return err
+		}
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
 	defer ch.Close()
+	var allTables []clickhouse.Table
+	if err := ch.WithConnectTimeout(func() (err error) {
+		allTables, err = ch.GetTables()
+		return err
+	}); err != nil {
+		if errors.Is(err, clickhouse.ErrConnectTimeout) {
+			return err
+		}
+		return fmt.Errorf("cat't get tables from clickhouse: %v", err)
+	}
+	tables := filterTablesByParams(filterSkippedDatabases(allTables, cfg.General.SkipDatabases), backup_tables)
+	return createBackup(ctx, cfg, ch, backupName, allTables, tables, false, time.Time{}, "", []string{}, nil, nil, nil, nil, version)
+}
 
-	allDatabases, err := ch.GetDatabases()
-	if err != nil {
+// createBackup - freeze selected tables, write their metadata and metadata.json of backup,
+// table is backed up without data when schemaOnly or its own SchemaOnly is set
+// If since is not zero only tables with parts modified after this time will be backed up
+func createBackup(ctx context.Context, cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, allTables, tables []clickhouse.Table, schemaOnly bool, since time.Time, note string, tags []string, expectedMetadataVersions map[metadata.TableTitle]string, tablePartitions map[metadata.TableTitle][]string, base *incrementalBase, progress ProgressFunc, version string) (err error) {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "create",
+	})
+	if cfg.ClickHouse.SnapshotDataPath != "" {
+		if err := checkSnapshotDataPath(cfg.ClickHouse.SnapshotDataPath); err != nil {
+			return err
+		}
+	}
+
+	var allDatabases []clickhouse.Database
+	if err := ch.WithConnectTimeout(func() (err error) {
+		allDatabases, err = ch.GetDatabases()
+		return err
+	}); err != nil {
+		if errors.Is(err, clickhouse.ErrConnectTimeout) {
+			return err
+		}
 		return fmt.Errorf("cat't get database engines from clickhouse: %v", err)
 	}
 
-	allTables, err := ch.GetTables()
+	tables, sourceTables, err := expandAndFilterTables(cfg, ch, allTables, tables, since, log)
 	if err != nil {
-		return fmt.Errorf("cat't get tables from clickhouse: %v", err)
+		return err
+	}
+	modifiedSince := ""
+	if !since.IsZero() {
+		modifiedSince = since.Format(time.RFC3339)
 	}
-	tables := filterTablesByParams(allTables, backup_tables)
 	i := 0
 	for _, table := range tables {
 		if table.Skip {
@@ -287,121 +541,248 @@ func CreateBackupforAgent(cfg *config.Config, backupName string, backup_tables [
 	if i == 0 && !cfg.General.AllowEmptyBackups {
 		return fmt.Errorf("no tables for backup")
 	}
+	events := getEventHandler()
+	event := BackupEvent{BackupName: backupName, TablesTotal: i}
+	startBackup := time.Now()
+	events.OnBackupStart(event)
+	defer func() {
+		event.Duration = time.Since(startBackup)
+		if err != nil {
+			events.OnBackupError(event, err)
+		} else {
+			events.OnBackupDone(event)
+		}
+	}()
+	var tablesDone int64
+	if err := checkExpectedTablesSelected(tables, expectedMetadataVersions); err != nil {
+		return err
+	}
+	if err := checkPartitionTablesSelected(tables, tablePartitions); err != nil {
+		return err
+	}
 
 	disks, err := ch.GetDisks()
 	if err != nil {
 		return err
 	}
-	// create backup dir on all clickhouse disks
-	for _, disk := range disks {
-		if err := ch.Mkdir(path.Join(disk.Path, "backup")); err != nil {
-			return err
+	writableDisks, skippedDisks, err := createBackupDirs(cfg, ch, disks, log)
+	if err != nil {
+		return err
+	}
+	if cfg.General.CheckFreeSpace {
+		required := getRequiredDiskSpace(disks, tables, schemaOnly, skippedDisks)
+		checkErr := checkFreeSpace(writableDisks, required, getAvailableSpace)
+		if cfg.General.BackupDir != "" {
+			checkErr = checkBackupDirFreeSpace(cfg.General.BackupDir, writableDisks, required, getAvailableSpace)
+		}
+		if checkErr != nil {
+			return checkErr
 		}
 	}
 	defaultPath, err := ch.GetDefaultPath()
 	if err != nil {
 		return err
 	}
-	backupPath := path.Join(defaultPath, "backup", backupName)
-	if _, err := os.Stat(path.Join(backupPath, "metadata.json")); err == nil || !os.IsNotExist(err) {
-		return fmt.Errorf("'%s' already exists", backupName)
+	backupPath := path.Join(localBackupsPath(cfg, defaultPath), backupName)
+	if err := createBackupDir(backupPath, backupName, ch.Chown); err != nil {
+		return err
 	}
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		if err = ch.Mkdir(backupPath); err != nil {
-			log.Errorf("can't create diretory %s: %v", backupPath, err)
+	// backup without metadata.json is reported as broken by list, so it is removed on any error until metadata is written
+	backupDone := false
+	defer func() {
+		if !backupDone {
+			if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
+				log.Error(removeBackupErr.Error())
+			}
 		}
-	}
+		if err := removeInProgressMarker(backupPath); err != nil {
+			log.Warnf("can't remove %s: %v", InProgressFileName, err)
+		}
+	}()
 	diskMap := map[string]string{}
-	for _, disk := range disks {
+	for _, disk := range writableDisks {
 		diskMap[disk.Name] = disk.Path
 	}
-	var backupDataSize, backupMetadataSize int64
+	// sizes - sum of sizes of backed up tables, see addTableBackupResult
+	sizes := metadata.BackupMetadata{}
 
-	var t []metadata.TableTitle
-	for _, table := range tables {
-		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
-		if table.Skip {
-			continue
+	if cfg.General.BackupClusters {
+		if err := saveClusters(ch, backupPath); err != nil {
+			log.Warnf("can't save clusters: %v", err)
 		}
-		backupPath := path.Join(defaultPath, "backup", backupName)
-		var realSize map[string]int64
-		var partitions map[string][]metadata.Part
-		if !table.SchemaOnly {
-			log.Debug("create data")
-			partitions, realSize, err = AddTableToBackup(ch, backupName, &table)
-			if err != nil {
-				log.Error(err.Error())
-				if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
-					log.Error(removeBackupErr.Error())
-				}
-				// continue
-				return err
-			}
-			backupDataSize += table.TotalBytes.Int64
-		}
-		log.Debug("create metadata")
-		metadataSize, err := createMetadata(ch, backupPath, metadata.TableMetadata{
-			Table:      table.Name,
-			Database:   table.Database,
-			Query:      table.CreateTableQuery,
-			TotalBytes: table.TotalBytes.Int64,
-			Size:       realSize,
-			Parts:      partitions,
-		})
-		if err != nil {
-			if removeBackupErr := RemoveBackupLocal(cfg, backupName); removeBackupErr != nil {
-				log.Error(removeBackupErr.Error())
+	}
+	buffersFlushed := false
+	if cfg.General.FlushBuffersBeforeBackup && !schemaOnly {
+		if buffersFlushed, err = flushBuffers(ch, allTables, tables, log); err != nil {
+			return err
+		}
+	}
+	tb := &tableBackuper{
+		cfg:                      cfg,
+		ch:                       ch,
+		backupName:               backupName,
+		backupPath:               backupPath,
+		schemaOnly:               schemaOnly,
+		disks:                    disks,
+		skippedDisks:             skippedDisks,
+		sourceTables:             sourceTables,
+		expectedMetadataVersions: expectedMetadataVersions,
+		partitions:               tablePartitions,
+		base:                     base,
+	}
+	reporter := newProgressReporter(progress, i)
+	// uid and gid of clickhouse are already cached by Chown of backup directory, so workers don't race on them
+	results, errs := runTableWorkers(ctx, tables, cfg.General.BackupConcurrency, cfg.General.ContinueOnError, func(ctx context.Context, table clickhouse.Table) (tableBackupResult, error) {
+		result, err := tb.backupTable(ctx, table, tableLog(log, table))
+		reporter.tableDone(table)
+		if err == nil && result.done {
+			events.OnTableDone(BackupEvent{
+				BackupName:  backupName,
+				Table:       fmt.Sprintf("%s.%s", table.Database, table.Name),
+				TablesTotal: i,
+				TablesDone:  int(atomic.AddInt64(&tablesDone, 1)),
+				Bytes:       result.dataSize,
+				Duration:    time.Since(startBackup),
+			})
+		}
+		return result, err
+	})
+	if err := ctx.Err(); err != nil {
+		log.Warn("cancelled")
+		return err
+	}
+	if !cfg.General.ContinueOnError {
+		for i, err := range errs {
+			if err != nil && !errors.Is(err, context.Canceled) {
+				tableLog(log, tables[i]).Error(err.Error())
 			}
+		}
+		if err := firstTableError(errs); err != nil {
 			return err
-			// continue
 		}
-		backupMetadataSize += int64(metadataSize)
-		t = append(t, metadata.TableTitle{
-			Database: table.Database,
-			Table:    table.Name,
-		})
-		log.Infof("done")
+	}
+	var t, failedTables []metadata.TableTitle
+	hashes := partsHash{}
+	for i, table := range tables {
+		title := metadata.TableTitle{Database: table.Database, Table: table.Name}
+		if errs[i] != nil {
+			// general.continue_on_error - remove data of table from backup, other tables are kept
+			tableLog(log, table).Error(errs[i].Error())
+			removeTableFromBackup(cfg, backupPath, diskMap, backupName, cfg.General.ShadowLayout, table.Database, table.Name, tableLog(log, table))
+			failedTables = append(failedTables, title)
+			continue
+		}
+		if !results[i].done {
+			continue
+		}
+		addTableBackupResult(&sizes, results[i])
+		event.TablesDone++
+		event.Bytes += results[i].dataSize
+		if results[i].parts != nil {
+			hashes[partsHashKey(table.Database, table.Name)] = getPartHashes(results[i].parts)
+		}
+		t = append(t, title)
+	}
+	if err := writePartsHash(ch, backupPath, hashes); err != nil {
+		return err
+	}
+	if err := writeFilesManifest(cfg, backupPath, backupName, diskMap, ch.Chown); err != nil {
+		return err
+	}
+	requiredBackup := ""
+	if base != nil {
+		requiredBackup = base.name
+	}
+	macros, err := ch.GetMacros()
+	if err != nil {
+		log.Warnf("%v", err)
+	}
+	buildInfo, err := ch.GetBuildInfo()
+	if err != nil {
+		log.Warnf("%v", err)
 	}
 	backupMetadata := metadata.BackupMetadata{
-		// TODO: надо помечать какие таблички зафейлились либо фейлить весь бэкап
 		BackupName:              backupName,
+		RequiredBackup:          requiredBackup,
 		Disks:                   diskMap,
 		ClickhouseBackupVersion: version,
 		CreationDate:            time.Now().UTC(),
-		// Tags: ,
-		ClickHouseVersion: ch.GetVersionDescribe(),
-		DataSize:          backupDataSize,
-		MetadataSize:      backupMetadataSize,
-		// CompressedSize: ,
-		Tables:    t,
-		Databases: []metadata.DatabasesMeta{},
-	}
-	for _, database := range allDatabases {
-		backupMetadata.Databases = append(backupMetadata.Databases, metadata.DatabasesMeta(database))
+		ClickHouseVersion:       ch.GetVersionDescribe(),
+		ClickHouseRevision:      buildInfo.Revision,
+		ClickHouseBuildFlags:    buildInfo.Flags,
+		Macros:                  macros,
+		SkippedDisks:            skippedDisks,
+		DiskIDs:                 getDiskIDs(ch, writableDisks, log),
+		BuffersFlushed:          buffersFlushed,
+		ShadowLayout:            cfg.General.ShadowLayout,
+		DataSize:                sizes.DataSize,
+		TotalBytes:              sizes.TotalBytes,
+		MetadataSize:            sizes.MetadataSize,
+		CompressedSize:          sizes.CompressedSize,
+		ModifiedSince:           modifiedSince,
+		Description:             note,
+		Tags:                    tags,
+		DataOnly:                cfg.General.DataOnlyBackup,
+		Tables:                  t,
+		FailedTables:            failedTables,
+		Databases:               []metadata.DatabasesMeta{},
+	}
+	if !cfg.General.DataOnlyBackup {
+		for _, database := range allDatabases {
+			backupMetadata.Databases = append(backupMetadata.Databases, metadata.DatabasesMeta(database))
+		}
 	}
 	content, err := json.MarshalIndent(&backupMetadata, "", "\t")
 	if err != nil {
-		_ = RemoveBackupLocal(cfg, backupName)
 		return fmt.Errorf("can't marshal backup metafile json: %v", err)
 	}
-	backupMetaFile := path.Join(defaultPath, "backup", backupName, "metadata.json")
+	backupMetaFile := path.Join(localBackupsPath(cfg, defaultPath), backupName, "metadata.json")
 	if err := ioutil.WriteFile(backupMetaFile, content, 0640); err != nil {
-		_ = RemoveBackupLocal(cfg, backupName)
 		return err
 	}
 	if err := ch.Chown(backupMetaFile); err != nil {
 		log.Warnf("can't chown %s: %v", backupMetaFile, err)
 	}
+	if err := checksumBackupLocal(ch, path.Join(localBackupsPath(cfg, defaultPath), backupName)); err != nil {
+		return err
+	}
+	if err := signBackupLocal(cfg, ch, path.Join(localBackupsPath(cfg, defaultPath), backupName)); err != nil {
+		return err
+	}
+	backupDone = true
+	logFrozenSize(cfg, log, sizes.DataSize)
 	log.Info("done")
 
 	// Clean
 	if err := RemoveOldBackupsLocal(cfg, true); err != nil {
 		return err
 	}
+	if len(failedTables) > 0 {
+		names := make([]string, len(failedTables))
+		for i, title := range failedTables {
+			names[i] = fmt.Sprintf("'%s.%s'", title.Database, title.Table)
+		}
+		return fmt.Errorf("'%s' is created without %d failed tables: %s", backupName, len(failedTables), strings.Join(names, ", "))
+	}
 	return nil
 }
 
-func AddTableToBackup(ch *clickhouse.ClickHouse, backupName string, table *clickhouse.Table) (map[string][]metadata.Part, map[string]int64, error) {
+// removeTableFromBackup - remove metadata and data of table which failed with general.continue_on_error
+func removeTableFromBackup(cfg *config.Config, backupPath string, diskMap map[string]string, backupName, shadowLayout, database, table string, log *apexLog.Entry) {
+	paths := []string{path.Join(backupPath, "metadata", clickhouse.TablePathEncode(database), fmt.Sprintf("%s.json", clickhouse.TablePathEncode(table)))}
+	for diskName, diskPath := range diskMap {
+		paths = append(paths, backupShadowPath(localBackupsPath(cfg, diskPath), backupName, shadowLayout, diskName, database, table))
+	}
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			log.Warnf("can't remove %s: %v", p, err)
+		}
+	}
+}
+
+// AddTableToBackup - freeze table and move shadow increment to backup
+// When partitions is not empty only these partitions are frozen, otherwise whole table
+func AddTableToBackup(ctx context.Context, cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, table *clickhouse.Table, expectedMetadataVersion string, partitions []string) (map[string][]metadata.Part, map[string]int64, error) {
 	log := apexLog.WithFields(apexLog.Fields{
 		"backup":    backupName,
 		"operation": "create",
@@ -444,30 +825,59 @@ func AddTableToBackup(ch *clickhouse.ClickHouse, backupName string, table *click
 		log.WithField("engine", table.Engine).Debug("skipped")
 		return nil, nil, nil
 	}
+	if err := checkMetadataVersion(table, expectedMetadataVersion); err != nil {
+		return nil, nil, err
+	}
+	if ch.Config.SnapshotDataPath != "" {
+		if len(partitions) > 0 {
+			return nil, nil, fmt.Errorf("partitions can't be used with snapshot_data_path")
+		}
+		return addTableFromSnapshot(cfg, ch, backupName, table, diskList)
+	}
 	backupID := strings.ReplaceAll(uuid.New().String(), "-", "")
-	if err := ch.FreezeTable(table, backupID); err != nil {
+	if err := freezeLimiter.Wait(ctx, cfg.General.FreezeRateLimit); err != nil {
+		return nil, nil, err
+	}
+	if len(partitions) > 0 {
+		if err := ch.FreezeTablePartitions(table, backupID, partitions); err != nil {
+			return nil, nil, err
+		}
+	} else if err := ch.FreezeTable(table, backupID); err != nil {
 		return nil, nil, err
 	}
 	log.Debug("freezed")
 	realSize := map[string]int64{}
-	partitions := map[string][]metadata.Part{}
+	diskParts := map[string][]metadata.Part{}
 	for _, disk := range diskList {
+		if err := ctx.Err(); err != nil {
+			if cleanErr := ch.CleanShadow(backupID); cleanErr != nil {
+				log.Warnf("can't clean shadow %s: %v", backupID, cleanErr)
+			}
+			return nil, nil, err
+		}
 		shadowPath := path.Join(disk.Path, "shadow", backupID)
 		if _, err := os.Stat(shadowPath); err != nil && os.IsNotExist(err) {
 			continue
 		}
-		backupPath := path.Join(disk.Path, "backup", backupName)
-		encodedTablePath := path.Join(clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Name))
-		backupShadowPath := path.Join(backupPath, "shadow", encodedTablePath, disk.Name)
-		if err := ch.MkdirAll(backupShadowPath); err != nil && !os.IsExist(err) {
+		backupPartsPath := backupShadowPath(localBackupsPath(cfg, disk.Path), backupName, cfg.General.ShadowLayout, disk.Name, table.Database, table.Name)
+		if err := ch.MkdirAll(backupPartsPath); err != nil && !os.IsExist(err) {
 			return nil, nil, err
 		}
-		parts, size, err := moveShadow(shadowPath, backupShadowPath)
+		var parts []metadata.Part
+		var size int64
+		err = withIOPriority(cfg.General.IOPriority, func() error {
+			var moveErr error
+			parts, size, moveErr = moveShadow(shadowPath, backupPartsPath, cfg.General.ExcludePartFiles, cfg.General.FollowSymlinks, cfg.General.ForceCopyOverHardlink, cfg.General.VerifyCopiedParts)
+			if moveErr != nil {
+				return moveErr
+			}
+			return chownTree(backupPartsPath, ch.Chown)
+		})
 		if err != nil {
 			return nil, nil, err
 		}
 		realSize[disk.Name] = size
-		partitions[disk.Name] = parts
+		diskParts[disk.Name] = parts
 		log.WithField("disk", disk.Name).Debug("shadow moved")
 		// realSize[diskPath] = size
 		// fix 19.15.3.6
@@ -489,17 +899,51 @@ func AddTableToBackup(ch *clickhouse.ClickHouse, backupName string, table *click
 		// }
 		// badDBPath := path.Join(path.Join(backupShadowPath, table.Database))
 		if err := os.RemoveAll(shadowPath); err != nil {
-			return partitions, realSize, err
+			return diskParts, realSize, err
 		}
 	}
 	if err := ch.CleanShadow(backupID); err != nil {
-		return partitions, realSize, err
+		return diskParts, realSize, err
 	}
 	log.Debug("done")
-	return partitions, realSize, nil
+	return diskParts, realSize, nil
+}
+
+// ensureCreateTableQuery - create_table_query of system.tables may be empty when user lacks grants or table
+// is being altered, query is fetched again with SHOW CREATE TABLE, backup without schema can't be restored
+func ensureCreateTableQuery(table *clickhouse.Table, showCreateTable func(database, name string) string) error {
+	if strings.TrimSpace(table.CreateTableQuery) != "" {
+		return nil
+	}
+	table.CreateTableQuery = showCreateTable(table.Database, table.Name)
+	if strings.TrimSpace(table.CreateTableQuery) == "" {
+		return fmt.Errorf("can't get create query of '%s.%s', check SHOW TABLES grant of clickhouse user", table.Database, table.Name)
+	}
+	return nil
 }
 
-func createMetadata(ch *clickhouse.ClickHouse, backupPath string, table metadata.TableMetadata) (int, error) {
+// checkCreateTableQuery - table without create query is skipped with warning when allow_empty_backups is enabled,
+// otherwise backup fails, false is returned when table must not be backed up
+func checkCreateTableQuery(cfg *config.Config, table *clickhouse.Table, showCreateTable func(database, name string) string, log *apexLog.Entry) (bool, error) {
+	if err := ensureCreateTableQuery(table, showCreateTable); err != nil {
+		if !cfg.General.AllowEmptyBackups {
+			return false, err
+		}
+		log.Warnf("%v, table skipped", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// createMetadata - write table metadata file, with dataOnly only table identity and parts are stored
+func createMetadata(ch *clickhouse.ClickHouse, backupPath string, dataOnly bool, table metadata.TableMetadata) (int, error) {
+	if dataOnly {
+		table.Query = ""
+		table.Projections = nil
+		table.DataOnly = true
+	} else if strings.TrimSpace(table.Query) == "" {
+		return 0, fmt.Errorf("can't write metadata of '%s.%s' without create query", table.Database, table.Table)
+	}
 	// parts, err := ch.GetPartitions(table.Database, table.Table)
 	// if err != nil {
 	// 	return 0, err
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureCreateTableQuery(t *testing.T) {
+	showCreateTable := func(database, name string) string {
+		if name == "restored" {
+			return "CREATE TABLE db.restored (`id` UInt64) ENGINE = MergeTree ORDER BY id"
+		}
+		return ""
+	}
+	table := clickhouse.Table{Database: "db", Name: "t", CreateTableQuery: "CREATE TABLE db.t (`id` UInt64) ENGINE = Memory"}
+	assert.NoError(t, ensureCreateTableQuery(&table, showCreateTable))
+	assert.Equal(t, "CREATE TABLE db.t (`id` UInt64) ENGINE = Memory", table.CreateTableQuery)
+
+	table = clickhouse.Table{Database: "db", Name: "restored"}
+	assert.NoError(t, ensureCreateTableQuery(&table, showCreateTable))
+	assert.Equal(t, "CREATE TABLE db.restored (`id` UInt64) ENGINE = MergeTree ORDER BY id", table.CreateTableQuery)
+
+	table = clickhouse.Table{Database: "db", Name: "empty", CreateTableQuery: " "}
+	assert.Error(t, ensureCreateTableQuery(&table, showCreateTable))
+}
+
+func TestCheckCreateTableQuery(t *testing.T) {
+	showCreateTable := func(database, name string) string { return "" }
+	handler := memory.New()
+	log := apexLog.NewEntry(&apexLog.Logger{Handler: handler, Level: apexLog.InfoLevel})
+	cfg := config.DefaultConfig()
+
+	table := clickhouse.Table{Database: "db", Name: "empty", Engine: "Unusual"}
+	ok, err := checkCreateTableQuery(cfg, &table, showCreateTable, log)
+	assert.False(t, ok)
+	assert.Error(t, err)
+	assert.Empty(t, handler.Entries)
+
+	cfg.General.AllowEmptyBackups = true
+	ok, err = checkCreateTableQuery(cfg, &table, showCreateTable, log)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	require.Len(t, handler.Entries, 1)
+	assert.Equal(t, apexLog.WarnLevel, handler.Entries[0].Level)
+	assert.Contains(t, handler.Entries[0].Message, "'db.empty'")
+
+	table = clickhouse.Table{Database: "db", Name: "t", CreateTableQuery: "CREATE TABLE db.t (`id` UInt64) ENGINE = Memory"}
+	ok, err = checkCreateTableQuery(cfg, &table, showCreateTable, log)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	_, err = createMetadata(nil, "", false, metadata.TableMetadata{Database: "db", Table: "empty", Query: " "})
+	assert.Error(t, err)
+}
+
+func TestRemoveTableFromBackup(t *testing.T) {
+	diskPath, err := ioutil.TempDir("", "clickhouse-backup-failed-table")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(diskPath) })
+	backupPath := filepath.Join(diskPath, "backup", "b1")
+	diskMap := map[string]string{"default": diskPath}
+	for _, table := range []string{"failed", "ok"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(backupShadowPath(filepath.Join(diskPath, "backup"), "b1", clickhouse.ShadowLayoutTable, "default", "db", table), "all_1_1_0"), 0750))
+		require.NoError(t, os.MkdirAll(filepath.Join(backupPath, "metadata", "db"), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, "metadata", "db", table+".json"), []byte("{}"), 0640))
+	}
+	removeTableFromBackup(config.DefaultConfig(), backupPath, diskMap, "b1", clickhouse.ShadowLayoutTable, "db", "failed", apexLog.WithField("test", t.Name()))
+	assert.NoFileExists(t, filepath.Join(backupPath, "metadata", "db", "failed.json"))
+	assert.NoDirExists(t, backupShadowPath(filepath.Join(diskPath, "backup"), "b1", clickhouse.ShadowLayoutTable, "default", "db", "failed"))
+	assert.FileExists(t, filepath.Join(backupPath, "metadata", "db", "ok.json"))
+	assert.DirExists(t, backupShadowPath(filepath.Join(diskPath, "backup"), "b1", clickhouse.ShadowLayoutTable, "default", "db", "ok"))
+}
+
+func TestValidateBackupName(t *testing.T) {
+	for _, name := range []string{NewBackupName(), "2021-01-02T03-04-05", "shard_1.daily", "pre-migration v42"} {
+		assert.NoError(t, validateBackupName(name), name)
+	}
+	for _, name := range []string{"../evil", "foo/bar", "..", ".", "/abs", "foo\\bar", "foo\nbar", "foo\x00"} {
+		err := validateBackupName(name)
+		assert.Error(t, err, name)
+		assert.True(t, errors.Is(err, ErrInvalidBackupName), name)
+	}
+}
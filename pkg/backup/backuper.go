@@ -5,6 +5,7 @@ import (
 
 	"github.com/AlexAkulov/clickhouse-backup/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
 )
 
@@ -53,6 +54,22 @@ func (b *Backuper) init() error {
 	return nil
 }
 
+// mapBackupDisks - add disks of tables which are mapped by clickhouse.restore_disk_mapping to DiskMap
+func (b *Backuper) mapBackupDisks(tables []metadata.TableMetadata) error {
+	disks, err := b.ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	aliases, err := mapBackupDisks(getTablesDisks(tables), disks, b.cfg.ClickHouse.RestoreDiskMapping)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		b.DiskMap[alias.Name] = alias.Path
+	}
+	return nil
+}
+
 func NewBackuper(cfg *config.Config) *Backuper {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+)
+
+// ChecksumFileName - sidecar of metadata.json with its SHA256, same layout as sha256sum
+const ChecksumFileName = "metadata.json.sha256"
+
+// checksumBackupLocal - write SHA256 of metadata.json of backup, it is written always unlike metadata.json.sig
+func checksumBackupLocal(ch *clickhouse.ClickHouse, backupPath string) error {
+	if err := writeMetadataChecksum(backupPath); err != nil {
+		return err
+	}
+	return ch.Chown(path.Join(backupPath, ChecksumFileName))
+}
+
+func writeMetadataChecksum(backupPath string) error {
+	sum, err := fileSHA256(path.Join(backupPath, MetaFileName))
+	if err != nil {
+		return fmt.Errorf("can't calculate checksum of %s: %v", MetaFileName, err)
+	}
+	body := fmt.Sprintf("%s  %s\n", sum, MetaFileName)
+	if err := ioutil.WriteFile(path.Join(backupPath, ChecksumFileName), []byte(body), 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", ChecksumFileName, err)
+	}
+	return nil
+}
+
+func verifyMetadataChecksum(backupPath string) error {
+	body, err := ioutil.ReadFile(path.Join(backupPath, ChecksumFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s not found, backup was created by older version", ChecksumFileName)
+		}
+		return err
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) != 2 || fields[1] != MetaFileName {
+		return fmt.Errorf("can't parse %s", ChecksumFileName)
+	}
+	sum, err := fileSHA256(path.Join(backupPath, MetaFileName))
+	if err != nil {
+		return fmt.Errorf("can't calculate checksum of %s: %v", MetaFileName, err)
+	}
+	if sum != fields[0] {
+		return fmt.Errorf("checksum of %s doesn't match %s, backup is corrupted", MetaFileName, ChecksumFileName)
+	}
+	return nil
+}
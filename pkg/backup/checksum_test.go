@@ -0,0 +1,28 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyMetadataChecksum(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "clickhouse-backup-checksum")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, MetaFileName), []byte(`{"backup_name":"test"}`), 0640))
+
+	assert.Error(t, verifyMetadataChecksum(backupPath), "backup without checksum")
+	require.NoError(t, writeMetadataChecksum(backupPath))
+	assert.NoError(t, verifyMetadataChecksum(backupPath))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, MetaFileName), []byte(`{"backup_name":"tost"}`), 0640))
+	assert.Error(t, verifyMetadataChecksum(backupPath))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, ChecksumFileName), []byte("garbage"), 0640))
+	assert.Error(t, verifyMetadataChecksum(backupPath))
+}
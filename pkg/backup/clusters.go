@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+
+	apexLog "github.com/apex/log"
+)
+
+// ClustersFileName - hosts of system.clusters saved by general.backup_clusters, informational only,
+// clusters are defined by remote_servers config and are never restored
+const ClustersFileName = "clusters.json"
+
+func saveClusters(ch *clickhouse.ClickHouse, backupPath string) error {
+	clusters, err := ch.GetClusters()
+	if err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(clusters, "", "\t")
+	if err != nil {
+		return err
+	}
+	clustersFile := path.Join(backupPath, ClustersFileName)
+	if err := ioutil.WriteFile(clustersFile, body, 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", ClustersFileName, err)
+	}
+	return ch.Chown(clustersFile)
+}
+
+// downloadClusters - copy ClustersFileName of remote backup if it exists, backups created without
+// general.backup_clusters don't contain it and storages report missing file differently, so read errors are ignored
+func (b *Backuper) downloadClusters(backupName string) error {
+	reader, err := b.dst.GetFileReader(path.Join(backupName, ClustersFileName))
+	if err != nil {
+		apexLog.Debugf("%s is not downloaded: %v", ClustersFileName, err)
+		return nil
+	}
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		apexLog.Debugf("%s is not downloaded: %v", ClustersFileName, err)
+		return nil
+	}
+	clustersFile := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, ClustersFileName)
+	if err := ioutil.WriteFile(clustersFile, body, 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", ClustersFileName, err)
+	}
+	return b.ch.Chown(clustersFile)
+}
+
+// readClusters - return nil when backup was created without general.backup_clusters
+func readClusters(backupPath string) ([]clickhouse.ClusterHost, error) {
+	body, err := ioutil.ReadFile(path.Join(backupPath, ClustersFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var clusters []clickhouse.ClusterHost
+	if err := json.Unmarshal(body, &clusters); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", ClustersFileName, err)
+	}
+	return clusters, nil
+}
+
+// checkDistributedClusters - warn about Distributed tables which reference clusters missing in system.clusters,
+// such tables are created successfully but every query to them fails
+func checkDistributedClusters(ch *clickhouse.ClickHouse, backupPath string, tables RestoreTables) {
+	macros, err := ch.GetMacros()
+	if err != nil {
+		apexLog.Warnf("can't check clusters of Distributed tables: %v", err)
+		return
+	}
+	current, err := ch.GetClusters()
+	if err != nil {
+		apexLog.Warnf("can't check clusters of Distributed tables: %v", err)
+		return
+	}
+	backupClusters, err := readClusters(backupPath)
+	if err != nil {
+		apexLog.Warnf("can't read clusters of backup: %v", err)
+	}
+	for _, table := range tables {
+		if warning := missingClusterWarning(table.Database, table.Table, table.Query, macros, current, backupClusters); warning != "" {
+			apexLog.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).Warn(warning)
+		}
+	}
+}
+
+// missingClusterWarning - empty when query is not Distributed table or its cluster exists
+func missingClusterWarning(database, table, query string, macros map[string]string, current, backupClusters []clickhouse.ClusterHost) string {
+	cluster, ok := clickhouse.ParseDistributedCluster(query)
+	if !ok {
+		return ""
+	}
+	for name, value := range macros {
+		cluster = strings.ReplaceAll(cluster, "{"+name+"}", value)
+	}
+	for _, host := range current {
+		if host.Cluster == cluster {
+			return ""
+		}
+	}
+	warning := fmt.Sprintf("Distributed table references cluster '%s' which is not found in system.clusters, add it to remote_servers or queries to '%s.%s' will fail", cluster, database, table)
+	var hosts []string
+	for _, host := range backupClusters {
+		if host.Cluster == cluster {
+			hosts = append(hosts, fmt.Sprintf("%s:%d", host.HostName, host.Port))
+		}
+	}
+	if len(hosts) > 0 {
+		sort.Strings(hosts)
+		warning += fmt.Sprintf(", backup was created with hosts %s", strings.Join(hosts, ", "))
+	}
+	return warning
+}
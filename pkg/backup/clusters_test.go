@@ -0,0 +1,26 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingClusterWarning(t *testing.T) {
+	query := "CREATE TABLE db.dist (id UInt64) ENGINE = Distributed('{cluster}', 'db', 'local', rand())"
+	macros := map[string]string{"cluster": "main"}
+	current := []clickhouse.ClusterHost{{Cluster: "main", ShardNum: 1, ReplicaNum: 1, HostName: "ch-1", Port: 9000}}
+	backupClusters := []clickhouse.ClusterHost{
+		{Cluster: "main", ShardNum: 2, ReplicaNum: 1, HostName: "old-2", Port: 9000},
+		{Cluster: "main", ShardNum: 1, ReplicaNum: 1, HostName: "old-1", Port: 9000},
+	}
+
+	assert.Empty(t, missingClusterWarning("db", "dist", query, macros, current, backupClusters))
+	assert.Empty(t, missingClusterWarning("db", "local", "CREATE TABLE db.local (id UInt64) ENGINE = MergeTree ORDER BY id", macros, nil, nil))
+
+	warning := missingClusterWarning("db", "dist", query, macros, nil, backupClusters)
+	assert.Contains(t, warning, "cluster 'main' which is not found")
+	assert.Contains(t, warning, "old-1:9000, old-2:9000")
+	assert.NotContains(t, missingClusterWarning("db", "dist", query, macros, nil, nil), "backup was created")
+}
@@ -0,0 +1,219 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+)
+
+// CompareBackupLocalRemote - compare local backup with its copy on remote storage: tables, parts and their sizes
+// must be the same and every data file referenced by remote metadata must exist and be non-empty.
+// Archives are compressed, so content of files is not compared. Empty result means local copy can be deleted
+func CompareBackupLocalRemote(cfg *config.Config, backupName string) ([]ValidationFinding, error) {
+	if backupName == "" {
+		return nil, fmt.Errorf("backup name is required")
+	}
+	if cfg.General.RemoteStorage == "none" {
+		return nil, fmt.Errorf("remote_storage is 'none'")
+	}
+	b := NewBackuper(cfg)
+	b.ch.SetQueryComment("compare", backupName)
+	if err := b.ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer b.ch.Close()
+	if err := b.init(); err != nil {
+		return nil, err
+	}
+	localBackup, err := getLocalBackup(cfg, backupName)
+	if err != nil {
+		return nil, err
+	}
+	if localBackup.Legacy {
+		return nil, fmt.Errorf("'%s' is old format backup and can't be compared", backupName)
+	}
+	if localBackup.Broken != "" {
+		return nil, fmt.Errorf("'%s' is %s", backupName, localBackup.Broken)
+	}
+	remoteBackups, err := b.dst.BackupList()
+	if err != nil {
+		return nil, err
+	}
+	var remoteBackup *new_storage.Backup
+	for i := range remoteBackups {
+		if remoteBackups[i].BackupName == backupName {
+			remoteBackup = &remoteBackups[i]
+		}
+	}
+	if remoteBackup == nil {
+		return []ValidationFinding{{Problem: "backup is not found on remote storage"}}, nil
+	}
+	if remoteBackup.Legacy {
+		return nil, fmt.Errorf("'%s' is old format backup on remote storage and can't be compared", backupName)
+	}
+	if remoteBackup.Broken != "" {
+		return []ValidationFinding{{Problem: fmt.Sprintf("remote copy is %s", remoteBackup.Broken)}}, nil
+	}
+	localTables := RestoreTables{}
+	if len(localBackup.Tables) > 0 {
+		localTables, err = parseSchemaPattern(path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, "metadata"), "*", false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	remoteTables := map[metadata.TableTitle]metadata.TableMetadata{}
+	for _, title := range remoteBackup.Tables {
+		table, err := b.getRemoteTableMetadata(backupName, title, nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't read metadata of '%s.%s' on remote storage: %v", title.Database, title.Table, err)
+		}
+		remoteTables[title] = table
+	}
+	remoteFiles := map[string]int64{}
+	remoteShadowPath := path.Join(backupName, "shadow")
+	if err := b.dst.Walk(remoteShadowPath, true, func(f new_storage.RemoteFile) error {
+		remoteFiles[path.Join("shadow", strings.TrimPrefix(f.Name(), "/"))] = f.Size()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return compareBackups(localTables, remoteBackup.BackupMetadata, remoteTables, remoteFiles), nil
+}
+
+// compareBackups - remoteFiles are sizes of remote data files by path relative to backup, e.g. "shadow/db/table/default_1.tar"
+func compareBackups(localTables []metadata.TableMetadata, remoteBackup metadata.BackupMetadata, remoteTables map[metadata.TableTitle]metadata.TableMetadata, remoteFiles map[string]int64) []ValidationFinding {
+	var findings []ValidationFinding
+	var remoteDirs map[string]struct{}
+	if remoteBackup.DataFormat == "directory" {
+		remoteDirs = parentDirs(remoteFiles)
+	}
+	localTitles := map[metadata.TableTitle]struct{}{}
+	for _, local := range localTables {
+		title := metadata.TableTitle{Database: local.Database, Table: local.Table}
+		localTitles[title] = struct{}{}
+		tableName := fmt.Sprintf("%s.%s", local.Database, local.Table)
+		addFinding := func(format string, args ...interface{}) {
+			findings = append(findings, ValidationFinding{Table: tableName, Problem: fmt.Sprintf(format, args...)})
+		}
+		remote, ok := remoteTables[title]
+		if !ok {
+			addFinding("table is missing on remote storage")
+			continue
+		}
+		if local.Query != remote.Query {
+			addFinding("query differs from remote copy")
+		}
+		for _, disk := range unionKeys(local.Parts, remote.Parts) {
+			missing, extra := diffPartNames(local.Parts[disk], remote.Parts[disk])
+			if len(missing) > 0 {
+				addFinding("parts %s on disk '%s' are missing on remote storage", strings.Join(missing, ", "), disk)
+			}
+			if len(extra) > 0 {
+				addFinding("parts %s on disk '%s' exist only on remote storage", strings.Join(extra, ", "), disk)
+			}
+			if local.Size[disk] != remote.Size[disk] {
+				addFinding("size on disk '%s' is %d bytes locally and %d bytes on remote storage", disk, local.Size[disk], remote.Size[disk])
+			}
+		}
+		remoteTablePath := path.Join("shadow", clickhouse.TablePathEncode(remote.Database), clickhouse.TablePathEncode(remote.Table))
+		for _, disk := range unionKeys(remote.Parts, nil) {
+			parts := remote.Parts[disk]
+			if remoteBackup.DataFormat == "directory" {
+				partsPath := clickhouse.ShadowPath(remoteBackup.ShadowLayout, disk, remote.Database, remote.Table)
+				for _, part := range parts {
+					if !part.Required && !hasKey(remoteDirs, path.Join(partsPath, part.Name)) {
+						addFinding("part '%s' on disk '%s' has no files on remote storage", part.Name, disk)
+					}
+				}
+				continue
+			}
+			uploadedParts := 0
+			for _, part := range parts {
+				if !part.Required {
+					uploadedParts++
+				}
+			}
+			if uploadedParts > 0 && len(remote.Files[disk]) == 0 {
+				addFinding("%d parts on disk '%s' have no data files on remote storage", uploadedParts, disk)
+			}
+			for _, file := range remote.Files[disk] {
+				size, ok := remoteFiles[path.Join(remoteTablePath, file)]
+				switch {
+				case !ok:
+					addFinding("file '%s' is missing on remote storage", file)
+				case size == 0:
+					addFinding("file '%s' is empty on remote storage", file)
+				}
+			}
+		}
+	}
+	for _, title := range remoteBackup.Tables {
+		if _, ok := localTitles[title]; !ok {
+			findings = append(findings, ValidationFinding{Table: fmt.Sprintf("%s.%s", title.Database, title.Table), Problem: "table exists only on remote storage"})
+		}
+	}
+	return findings
+}
+
+func unionKeys(a, b map[string][]metadata.Part) []string {
+	keys := map[string]struct{}{}
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// diffPartNames - names of local parts missing in remote and names of remote parts missing in local
+func diffPartNames(local, remote []metadata.Part) (missing, extra []string) {
+	remoteNames := map[string]struct{}{}
+	for _, part := range remote {
+		remoteNames[part.Name] = struct{}{}
+	}
+	localNames := map[string]struct{}{}
+	for _, part := range local {
+		localNames[part.Name] = struct{}{}
+		if _, ok := remoteNames[part.Name]; !ok {
+			missing = append(missing, part.Name)
+		}
+	}
+	for _, part := range remote {
+		if _, ok := localNames[part.Name]; !ok {
+			extra = append(extra, part.Name)
+		}
+	}
+	return missing, extra
+}
+
+// parentDirs - all directories which contain files at any depth, so presence of part files is checked
+// without scanning all files for every part
+func parentDirs(files map[string]int64) map[string]struct{} {
+	dirs := map[string]struct{}{}
+	for name := range files {
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, ok := dirs[dir]; ok {
+				break
+			}
+			dirs[dir] = struct{}{}
+		}
+	}
+	return dirs
+}
+
+func hasKey(set map[string]struct{}, key string) bool {
+	_, ok := set[key]
+	return ok
+}
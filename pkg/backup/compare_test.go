@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareBackups(t *testing.T) {
+	title := metadata.TableTitle{Database: "db", Table: "t"}
+	local := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Query:    "CREATE TABLE db.t (id UInt64) ENGINE = MergeTree ORDER BY id",
+		Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}},
+		Size:     map[string]int64{"default": 100},
+	}
+	remote := local
+	remote.Parts = map[string][]metadata.Part{"default": {{Name: "all_1_1_0", Required: true}, {Name: "all_2_2_0"}}}
+	remote.Files = map[string][]string{"default": {"default_1.tar"}}
+	remoteBackup := metadata.BackupMetadata{BackupName: "backup", DataFormat: "tar", Tables: []metadata.TableTitle{title}}
+	remoteFiles := map[string]int64{"shadow/db/t/default_1.tar": 50}
+
+	assert.Empty(t, compareBackups([]metadata.TableMetadata{local}, remoteBackup, map[metadata.TableTitle]metadata.TableMetadata{title: remote}, remoteFiles))
+
+	assert.Equal(t, []ValidationFinding{
+		{Table: "db.t", Problem: "file 'default_1.tar' is empty on remote storage"},
+	}, compareBackups([]metadata.TableMetadata{local}, remoteBackup, map[metadata.TableTitle]metadata.TableMetadata{title: remote}, map[string]int64{"shadow/db/t/default_1.tar": 0}))
+
+	changed := remote
+	changed.Parts = map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_3_3_0"}}}
+	changed.Size = map[string]int64{"default": 90}
+	assert.Equal(t, []ValidationFinding{
+		{Table: "db.t", Problem: "parts all_2_2_0 on disk 'default' are missing on remote storage"},
+		{Table: "db.t", Problem: "parts all_3_3_0 on disk 'default' exist only on remote storage"},
+		{Table: "db.t", Problem: "size on disk 'default' is 100 bytes locally and 90 bytes on remote storage"},
+		{Table: "db.t", Problem: "file 'default_1.tar' is missing on remote storage"},
+	}, compareBackups([]metadata.TableMetadata{local}, remoteBackup, map[metadata.TableTitle]metadata.TableMetadata{title: changed}, nil))
+
+	other := metadata.TableMetadata{Database: "db", Table: "other"}
+	remoteBackup.Tables = append(remoteBackup.Tables, metadata.TableTitle{Database: "db", Table: "remote_only"})
+	assert.Equal(t, []ValidationFinding{
+		{Table: "db.t", Problem: "table is missing on remote storage"},
+		{Table: "db.other", Problem: "table is missing on remote storage"},
+		{Table: "db.remote_only", Problem: "table exists only on remote storage"},
+	}, compareBackups([]metadata.TableMetadata{local, other}, remoteBackup, map[metadata.TableTitle]metadata.TableMetadata{}, nil))
+}
+
+func TestCompareBackupsDirectory(t *testing.T) {
+	title := metadata.TableTitle{Database: "db", Table: "t"}
+	local := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}, {Name: "all_3_3_0"}}},
+	}
+	remote := local
+	remote.Parts = map[string][]metadata.Part{"default": {{Name: "all_1_1_0", Required: true}, {Name: "all_2_2_0"}, {Name: "all_3_3_0"}}}
+	remoteBackup := metadata.BackupMetadata{BackupName: "backup", DataFormat: "directory", Tables: []metadata.TableTitle{title}}
+	remoteFiles := map[string]int64{
+		"shadow/db/t/default/all_2_2_0/data.bin":            10,
+		"shadow/db/t/default/all_3_3_0/p.proj/data.bin":     10,
+		"shadow/db/t/default/all_3_3_0_other/checksums.txt": 10,
+	}
+	assert.Empty(t, compareBackups([]metadata.TableMetadata{local}, remoteBackup, map[metadata.TableTitle]metadata.TableMetadata{title: remote}, remoteFiles))
+
+	delete(remoteFiles, "shadow/db/t/default/all_3_3_0/p.proj/data.bin")
+	assert.Equal(t, []ValidationFinding{
+		{Table: "db.t", Problem: "part 'all_3_3_0' on disk 'default' has no files on remote storage"},
+	}, compareBackups([]metadata.TableMetadata{local}, remoteBackup, map[metadata.TableTitle]metadata.TableMetadata{title: remote}, remoteFiles))
+}
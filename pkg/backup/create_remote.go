@@ -1,15 +1,19 @@
 package backup
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
-func (b *Backuper) CreateToRemote(backupName, tablePattern, diffFrom string, schemaOnly bool, version string) error {
+// CreateToRemote - create backup and upload it, diffFrom and full are passed to Upload
+func (b *Backuper) CreateToRemote(ctx context.Context, backupName, diffFrom string, full bool, opts CreateOptions) error {
 	if backupName == "" {
 		backupName = NewBackupName()
 	}
-	if err := CreateBackup(b.cfg, backupName, tablePattern, schemaOnly, version); err != nil {
+	if err := CreateBackup(ctx, b.cfg, backupName, opts); err != nil {
 		return err
 	}
-	if err := b.Upload(backupName, tablePattern, diffFrom, schemaOnly); err != nil {
+	if err := b.Upload(backupName, opts.TablePattern, diffFrom, opts.SchemaOnly, full); err != nil {
 		return err
 	}
 	if err := RemoveOldBackupsLocal(b.cfg, false); err != nil {
@@ -0,0 +1,222 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+)
+
+// tableBackuper - state of one backup shared by workers which back up tables
+type tableBackuper struct {
+	cfg                      *config.Config
+	ch                       *clickhouse.ClickHouse
+	backupName               string
+	backupPath               string
+	schemaOnly               bool
+	disks                    []clickhouse.Disk
+	skippedDisks             []string
+	sourceTables             map[metadata.TableTitle][]string
+	expectedMetadataVersions map[metadata.TableTitle]string
+	partitions               map[metadata.TableTitle][]string
+	// base - when not nil only partitions changed since base backup are frozen
+	base *incrementalBase
+}
+
+// tableBackupResult - sizes of table in backup, done is false when table is skipped
+type tableBackupResult struct {
+	done         bool
+	dataSize     int64
+	metadataSize int64
+	// totalBytes - total_bytes of system.tables, it differs from bytes on disk
+	totalBytes int64
+	// parts - parts of table in backup with hashes from system.parts, written to parts.hash
+	parts map[string][]metadata.Part
+}
+
+// newTableBackupResult - data size of table is real size of parts moved to backup on all disks,
+// total_bytes of system.tables is counted separately, it differs from bytes on disk
+func newTableBackupResult(parts map[string][]metadata.Part, realSize map[string]int64, totalBytes int64, schemaOnly bool) tableBackupResult {
+	result := tableBackupResult{done: true, parts: parts}
+	if !schemaOnly {
+		result.dataSize = sumDiskSizes(realSize)
+		result.totalBytes = totalBytes
+	}
+	return result
+}
+
+// sumDiskSizes - real size of table in backup, Size of table metadata holds bytes of parts on each disk
+func sumDiskSizes(sizes map[string]int64) int64 {
+	total := int64(0)
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// addTableBackupResult - add sizes of backed up table to sizes of backup metadata
+func addTableBackupResult(backupMetadata *metadata.BackupMetadata, result tableBackupResult) {
+	backupMetadata.DataSize += result.dataSize
+	backupMetadata.TotalBytes += result.totalBytes
+	backupMetadata.MetadataSize += result.metadataSize
+	// local backup is not compressed
+	backupMetadata.CompressedSize += result.dataSize
+}
+
+// backupTable - freeze table, move its parts to backup and write its metadata
+func (tb *tableBackuper) backupTable(ctx context.Context, table clickhouse.Table, log *apexLog.Entry) (tableBackupResult, error) {
+	if err := ctx.Err(); err != nil {
+		return tableBackupResult{}, err
+	}
+	tableSchemaOnly := tb.schemaOnly || table.SchemaOnly
+	if diskName := getSkippedTableDisk(tb.disks, &table, tb.skippedDisks); diskName != "" && !tableSchemaOnly {
+		log.WithField("disk", diskName).Warn("table data is on skipped disk, table skipped")
+		return tableBackupResult{}, nil
+	}
+	if !tb.cfg.General.DataOnlyBackup {
+		if ok, err := checkCreateTableQuery(tb.cfg, &table, tb.ch.ShowCreateTable, log); !ok {
+			return tableBackupResult{}, err
+		}
+	}
+	title := metadata.TableTitle{Database: table.Database, Table: table.Name}
+	var realSize map[string]int64
+	var partitions map[string][]metadata.Part
+	var dump *metadata.DataDump
+	metadataVersion := ""
+	if !tableSchemaOnly {
+		metadataVersion = getMetadataVersion(table.DataPaths)
+		log.Debug("create data")
+		var liveParts map[string][]metadata.Part
+		var err error
+		if strings.HasSuffix(table.Engine, "MergeTree") && tb.ch.Config.SnapshotDataPath == "" {
+			if liveParts, err = tb.ch.GetPartitions(table.Database, table.Name); err != nil {
+				if tb.base != nil {
+					return tableBackupResult{}, fmt.Errorf("can't get parts: %v", err)
+				}
+				log.Warnf("can't get parts hashes, table will be frozen whole by next incremental backup: %v", err)
+			}
+		}
+		if tb.base != nil && strings.HasSuffix(table.Engine, "MergeTree") {
+			partitions, realSize, err = tb.addTableIncremental(ctx, &table, liveParts)
+		} else if tb.cfg.General.BackupNonMergeTreeData && isDumpableEngine(table.Engine) {
+			partitions, realSize, dump, err = addTableDump(tb.cfg, tb.ch, tb.backupName, &table, tb.disks)
+		} else {
+			partitions, realSize, err = AddTableToBackup(ctx, tb.cfg, tb.ch, tb.backupName, &table, tb.expectedMetadataVersions[title], tb.partitions[title])
+			setPartHashes(partitions, liveParts)
+		}
+		if err != nil {
+			return tableBackupResult{}, err
+		}
+	}
+	result := newTableBackupResult(partitions, realSize, table.TotalBytes.Int64, tableSchemaOnly)
+	log.Debug("create metadata")
+	metadataSize, err := createMetadata(tb.ch, tb.backupPath, tb.cfg.General.DataOnlyBackup, metadata.TableMetadata{
+		Table:           table.Name,
+		Database:        table.Database,
+		Query:           table.CreateTableQuery,
+		Projections:     clickhouse.ParseProjections(table.CreateTableQuery),
+		TotalBytes:      table.TotalBytes.Int64,
+		Size:            realSize,
+		Parts:           partitions,
+		MetadataVersion: metadataVersion,
+		SourceTables:    tb.sourceTables[title],
+		Dump:            dump,
+	})
+	if err != nil {
+		return tableBackupResult{}, err
+	}
+	result.metadataSize = int64(metadataSize)
+	logTableDone(tb.cfg, log)
+	return result, nil
+}
+
+// runTableWorkers - call backupTable for every not skipped table by concurrency workers,
+// results and errors are returned in order of tables. Without continueOnError the first error cancels the rest of tables
+func runTableWorkers(ctx context.Context, tables []clickhouse.Table, concurrency int, continueOnError bool, backupTable func(ctx context.Context, table clickhouse.Table) (tableBackupResult, error)) ([]tableBackupResult, []error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]tableBackupResult, len(tables))
+	errs := make([]error, len(tables))
+	workersCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range tables {
+		if tables[i].Skip {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i], errs[i] = backupTable(workersCtx, tables[i])
+			if errs[i] != nil && !continueOnError {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// firstTableError - error of table which caused cancellation of others, context.Canceled of cancelled workers is skipped
+func firstTableError(errs []error) error {
+	var cancelled error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if cancelled == nil {
+			cancelled = err
+		}
+	}
+	return cancelled
+}
+
+func tableLog(log *apexLog.Entry, table clickhouse.Table) *apexLog.Entry {
+	return log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
+}
+
+// ProgressFunc - called by CreateBackup once with done=0 before tables are backed up and after each table is finished,
+// total is number of not skipped tables, currentTable is <db>.<table> of finished table
+type ProgressFunc func(done, total int, currentTable string)
+
+// progressReporter - serialize calls of ProgressFunc from workers
+type progressReporter struct {
+	mu       sync.Mutex
+	progress ProgressFunc
+	done     int
+	total    int
+}
+
+func newProgressReporter(progress ProgressFunc, total int) *progressReporter {
+	r := &progressReporter{progress: progress, total: total}
+	if progress != nil {
+		progress(0, total, "")
+	}
+	return r
+}
+
+func (r *progressReporter) tableDone(table clickhouse.Table) {
+	if r.progress == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done++
+	r.progress(r.done, r.total, fmt.Sprintf("%s.%s", table.Database, table.Name))
+}
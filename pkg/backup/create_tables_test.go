@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newWorkerTables(n int) []clickhouse.Table {
+	tables := make([]clickhouse.Table, n)
+	for i := range tables {
+		tables[i] = clickhouse.Table{Database: "db", Name: fmt.Sprintf("t%d", i)}
+	}
+	return tables
+}
+
+func TestRunTableWorkers(t *testing.T) {
+	tables := newWorkerTables(20)
+	tables[3].Skip = true
+	var running, maxRunning int32
+	results, errs := runTableWorkers(context.Background(), tables, 4, false, func(ctx context.Context, table clickhouse.Table) (tableBackupResult, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return tableBackupResult{done: true, dataSize: int64(len(table.Name))}, nil
+	})
+	assert.LessOrEqual(t, maxRunning, int32(4))
+	require.Len(t, results, 20)
+	for i := range tables {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, i != 3, results[i].done, tables[i].Name)
+	}
+	assert.Equal(t, int64(len("t10")), results[10].dataSize)
+}
+
+func TestRunTableWorkersError(t *testing.T) {
+	tables := newWorkerTables(10)
+	backupTable := func(ctx context.Context, table clickhouse.Table) (tableBackupResult, error) {
+		if err := ctx.Err(); err != nil {
+			return tableBackupResult{}, err
+		}
+		if table.Name == "t2" {
+			return tableBackupResult{}, fmt.Errorf("freeze failed")
+		}
+		return tableBackupResult{done: true}, nil
+	}
+
+	_, errs := runTableWorkers(context.Background(), tables, 1, false, backupTable)
+	assert.EqualError(t, firstTableError(errs), "freeze failed")
+	assert.NoError(t, errs[1])
+	for _, err := range errs[3:] {
+		assert.True(t, errors.Is(err, context.Canceled))
+	}
+
+	results, errs := runTableWorkers(context.Background(), tables, 3, true, backupTable)
+	assert.EqualError(t, errs[2], "freeze failed")
+	for i := range tables {
+		if i != 2 {
+			assert.NoError(t, errs[i])
+			assert.True(t, results[i].done)
+		}
+	}
+	assert.Nil(t, firstTableError(make([]error, 3)))
+}
+
+func TestProgressReporter(t *testing.T) {
+	type call struct {
+		done, total int
+		table       string
+	}
+	var calls []call
+	reporter := newProgressReporter(func(done, total int, currentTable string) {
+		calls = append(calls, call{done, total, currentTable})
+	}, 19)
+	tables := newWorkerTables(20)
+	tables[3].Skip = true
+	runTableWorkers(context.Background(), tables, 4, false, func(ctx context.Context, table clickhouse.Table) (tableBackupResult, error) {
+		reporter.tableDone(table)
+		return tableBackupResult{done: true}, nil
+	})
+	require.Len(t, calls, 20)
+	assert.Equal(t, call{0, 19, ""}, calls[0])
+	for i, c := range calls[1:] {
+		assert.Equal(t, i+1, c.done)
+		assert.Equal(t, 19, c.total)
+		assert.NotEqual(t, "db.t3", c.table)
+	}
+
+	// nil callback is ignored
+	newProgressReporter(nil, 1).tableDone(tables[0])
+}
+
+func TestBackupMetadataSizes(t *testing.T) {
+	shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+	parts, size, err := moveShadow(shadowPath, backupPartsPath, nil, false, false, false)
+	require.NoError(t, err)
+	// total_bytes of system.tables is reported by ClickHouse and differs from bytes of frozen files
+	table := clickhouse.Table{Database: "db", Name: "t", TotalBytes: sql.NullInt64{Int64: 1000, Valid: true}}
+	realSize := map[string]int64{"default": size, "hdd": 7}
+	diskParts := map[string][]metadata.Part{"default": parts}
+
+	result := newTableBackupResult(diskParts, realSize, table.TotalBytes.Int64, false)
+	result.metadataSize = 100
+	assert.Equal(t, diskParts, result.parts)
+	schemaOnlyResult := newTableBackupResult(nil, nil, 500, true)
+	schemaOnlyResult.metadataSize = 50
+
+	sizes := metadata.BackupMetadata{}
+	addTableBackupResult(&sizes, result)
+	addTableBackupResult(&sizes, schemaOnlyResult)
+	body, err := json.Marshal(sizes)
+	require.NoError(t, err)
+	var written map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &written))
+	movedSize := float64(len("checksums") + len("data") + 7)
+	assert.Equal(t, movedSize, written["data_size"])
+	assert.NotContains(t, written, "frozen_size")
+	assert.Equal(t, movedSize, written["compressed_size"])
+	// schema only table has no data, its total_bytes is not counted
+	assert.Equal(t, float64(1000), written["total_bytes"])
+	assert.Equal(t, float64(150), written["metadata_size"])
+}
@@ -2,8 +2,12 @@ package backup
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
@@ -12,10 +16,23 @@ import (
 	apexLog "github.com/apex/log"
 )
 
-//
+// DeletingMetaFileName - metadata.json is renamed to it before backup data is removed,
+// backup with this file is partially deleted and can't be restored
+const DeletingMetaFileName = "metadata.json.deleting"
+
+// RemoveOldBackupsLocal - remove backups above backups_to_keep_local and older than backups_keep_duration,
+// when both are set backup is removed only if it violates both, partially deleted backups and backups abandoned
+// by create are always removed
 func RemoveOldBackupsLocal(cfg *config.Config, keepLastBackup bool) error {
 	keep := cfg.General.BackupsToKeepLocal
-	if keep == 0 {
+	var keepDuration time.Duration
+	if cfg.General.BackupsKeepDuration != "" {
+		var err error
+		if keepDuration, err = time.ParseDuration(cfg.General.BackupsKeepDuration); err != nil {
+			return fmt.Errorf("bad backups_keep_duration: %v", err)
+		}
+	}
+	if keep == 0 && keepDuration <= 0 {
 		return nil
 	}
 	if keepLastBackup && keep < 0 {
@@ -25,16 +42,140 @@ func RemoveOldBackupsLocal(cfg *config.Config, keepLastBackup bool) error {
 	if err != nil {
 		return err
 	}
-	backupsToDelete := GetBackupsToDelete(backupList, keep)
+	var backupsToDelete, completeBackups []BackupLocal
+	for _, backup := range backupList {
+		if backup.Broken == BrokenPartiallyDeleted {
+			backupsToDelete = append(backupsToDelete, backup)
+			continue
+		}
+		if backup.InProgress != nil {
+			if backup.InProgress.Stale {
+				backupsToDelete = append(backupsToDelete, backup)
+			}
+			continue
+		}
+		completeBackups = append(completeBackups, backup)
+	}
+	backupsToDelete = append(backupsToDelete, getExpiredBackups(completeBackups, keep, keepDuration, keepLastBackup, time.Now())...)
+	var removed, partiallyRemoved []string
+	var lastErr error
 	for _, backup := range backupsToDelete {
+		switch {
+		case backup.Legacy:
+			apexLog.WithField("backup", backup.BackupName).Info("old format backup is expired")
+		case backup.Broken != "" && backup.Broken != BrokenPartiallyDeleted:
+			apexLog.WithField("backup", backup.BackupName).WithField("broken", backup.Broken).Warn("broken backup is expired")
+		case backup.InProgress != nil:
+			apexLog.WithField("backup", backup.BackupName).Warn(backup.InProgress.String())
+		}
 		if err := RemoveBackupLocal(cfg, backup.BackupName); err != nil {
+			apexLog.WithField("backup", backup.BackupName).Errorf("partially removed: %v", err)
+			partiallyRemoved = append(partiallyRemoved, backup.BackupName)
+			lastErr = err
+			continue
+		}
+		removed = append(removed, backup.BackupName)
+	}
+	if len(backupsToDelete) > 0 {
+		apexLog.WithField("operation", "clean").
+			WithField("removed", strings.Join(removed, ",")).
+			WithField("partially_removed", strings.Join(partiallyRemoved, ",")).
+			Info("old local backups removed")
+	}
+	if lastErr != nil {
+		return fmt.Errorf("can't remove %s, run delete again: %v", strings.Join(partiallyRemoved, ","), lastErr)
+	}
+	return nil
+}
+
+// Clean - remove data in 'shadow' folder of all disks and local backups abandoned by create,
+// shadow is kept while any backup is being created, it contains frozen parts of that backup
+func Clean(cfg *config.Config) error {
+	backupList, err := GetLocalBackups(cfg)
+	if err != nil {
+		return err
+	}
+	var creating []string
+	for _, backup := range backupList {
+		if backup.InProgress == nil {
+			continue
+		}
+		if !backup.InProgress.Stale {
+			creating = append(creating, backup.BackupName)
+			continue
+		}
+		apexLog.WithField("backup", backup.BackupName).Warn(backup.InProgress.String())
+		if err := RemoveBackupLocal(cfg, backup.BackupName); err != nil {
+			return fmt.Errorf("can't remove abandoned backup '%s': %v", backup.BackupName, err)
+		}
+	}
+	if len(creating) > 0 {
+		apexLog.WithField("operation", "clean").Warnf("shadow is not cleaned, %s is being created", strings.Join(creating, ","))
+		return nil
+	}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	ch.SetQueryComment("clean", "")
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		shadowPath := path.Join(disk.Path, "shadow")
+		entries, err := ioutil.ReadDir(shadowPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 			return err
 		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(path.Join(shadowPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+		apexLog.WithField("operation", "clean").WithField("path", shadowPath).Info("done")
 	}
 	return nil
 }
 
+// getExpiredBackups - backups above keep newest ones and older than keepDuration, zero keep or keepDuration disables its check,
+// negative keep doesn't keep any backup by count, e.g. backups_to_keep_local: -1 removes local backups after create_remote
+// legacy and broken backups are counted as others, the newest backup is never expired when keepLast is set
+func getExpiredBackups(backups []BackupLocal, keep int, keepDuration time.Duration, keepLast bool, now time.Time) []BackupLocal {
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].CreationDate.After(backups[j].CreationDate)
+	})
+	expired := []BackupLocal{}
+	for i, backup := range backups {
+		if i == 0 && keepLast {
+			continue
+		}
+		if keep > 0 && i < keep {
+			continue
+		}
+		if keepDuration > 0 && now.Sub(backup.CreationDate) <= keepDuration {
+			continue
+		}
+		expired = append(expired, backup)
+	}
+	return expired
+}
+
+// RemoveBackupLocal - remove backup from all disks, ErrUnsafeRemovePath is returned and nothing is removed
+// when directory of backup on any disk doesn't look like backup
 func RemoveBackupLocal(cfg *config.Config, backupName string) error {
+	if backupName == "" {
+		return fmt.Errorf("%w: backup name is empty", ErrUnsafeRemovePath)
+	}
+	if err := validateBackupName(backupName); err != nil {
+		return err
+	}
 	backupList, err := GetLocalBackups(cfg)
 	if err != nil {
 		return err
@@ -42,6 +183,7 @@ func RemoveBackupLocal(cfg *config.Config, backupName string) error {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
+	ch.SetQueryComment("delete", backupName)
 	if err := ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
@@ -51,11 +193,29 @@ func RemoveBackupLocal(cfg *config.Config, backupName string) error {
 	if err != nil {
 		return err
 	}
+	defaultPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return err
+	}
 	for _, backup := range backupList {
 		if backup.BackupName == backupName {
+			for _, disk := range disks {
+				if err := checkBackupRemovable(localBackupsPath(cfg, disk.Path), path.Join(localBackupsPath(cfg, disk.Path), backupName), backupName); err != nil {
+					return err
+				}
+			}
+			// metadata.json goes first, interrupted deletion leaves backup which is listed as broken and never restored
+			backupPath := path.Join(localBackupsPath(cfg, defaultPath), backupName)
+			if err := markBackupDeleting(backupPath); err != nil {
+				return err
+			}
+			// default disk contains the marker and is removed last
+			sort.SliceStable(disks, func(i, j int) bool {
+				return disks[i].Path != defaultPath && disks[j].Path == defaultPath
+			})
 			for _, disk := range disks {
 				apexLog.WithField("path", disk.Path).Debugf("remove '%s'", backupName)
-				err := os.RemoveAll(path.Join(disk.Path, "backup", backupName))
+				err := os.RemoveAll(path.Join(localBackupsPath(cfg, disk.Path), backupName))
 				if err != nil {
 					return err
 				}
@@ -70,6 +230,52 @@ func RemoveBackupLocal(cfg *config.Config, backupName string) error {
 	return fmt.Errorf("'%s' is not found on local storage", backupName)
 }
 
+// checkBackupRemovable - backupPath must be backupName directly inside backupsPath and contain metadata.json,
+// deletion marker, in progress marker or shadow directory. Missing and empty directories are removable,
+// they are left by interrupted deletion on disks without metadata
+func checkBackupRemovable(backupsPath, backupPath, backupName string) error {
+	if backupName == "" || path.Clean(backupPath) != path.Join(path.Clean(backupsPath), backupName) || path.Base(backupPath) != backupName {
+		return fmt.Errorf("%w: '%s' is not backup '%s' inside '%s'", ErrUnsafeRemovePath, backupPath, backupName, backupsPath)
+	}
+	entries, err := ioutil.ReadDir(backupPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case MetaFileName, DeletingMetaFileName, InProgressFileName:
+			if entry.Mode().IsRegular() {
+				return nil
+			}
+		case "shadow":
+			if entry.IsDir() {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: '%s' has neither %s nor shadow directory", ErrUnsafeRemovePath, backupPath, MetaFileName)
+}
+
+// markBackupDeleting - atomically rename metadata.json to DeletingMetaFileName, keep existing marker
+func markBackupDeleting(backupPath string) error {
+	deletingFile := path.Join(backupPath, DeletingMetaFileName)
+	if _, err := os.Stat(deletingFile); err == nil {
+		return nil
+	}
+	err := os.Rename(path.Join(backupPath, MetaFileName), deletingFile)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	// legacy backup without metadata.json
+	return ioutil.WriteFile(deletingFile, nil, 0640)
+}
+
 func RemoveBackupRemote(cfg *config.Config, backupName string) error {
 	if cfg.General.RemoteStorage == "none" {
 		fmt.Println("RemoveBackupRemote aborted: RemoteStorage set to \"none\"")
@@ -95,3 +301,116 @@ func RemoveBackupRemote(cfg *config.Config, backupName string) error {
 	}
 	return fmt.Errorf("'%s' is not found on remote storage", backupName)
 }
+
+// RemoveOldBackupsRemote - remove remote backups above backups_to_keep_remote and older than backups_keep_duration_remote,
+// when both are set backup is removed only if it violates both. Backups required by kept remote backups
+// or by local incremental backups are never removed
+func RemoveOldBackupsRemote(cfg *config.Config) error {
+	if cfg.General.RemoteStorage == "none" {
+		return nil
+	}
+	bd, err := new_storage.NewBackupDestination(cfg)
+	if err != nil {
+		return err
+	}
+	if err := bd.Connect(); err != nil {
+		return fmt.Errorf("can't connect to remote storage: %v", err)
+	}
+	return removeOldBackupsRemote(cfg, bd)
+}
+
+func removeOldBackupsRemote(cfg *config.Config, bd *new_storage.BackupDestination) error {
+	keep := cfg.General.BackupsToKeepRemote
+	var keepDuration time.Duration
+	if cfg.General.BackupsKeepDurationRemote != "" {
+		var err error
+		if keepDuration, err = time.ParseDuration(cfg.General.BackupsKeepDurationRemote); err != nil {
+			return fmt.Errorf("bad backups_keep_duration_remote: %v", err)
+		}
+	}
+	if keep < 1 && keepDuration <= 0 {
+		return nil
+	}
+	remoteBackups, err := bd.BackupList()
+	if err != nil {
+		return err
+	}
+	localBackups, err := GetLocalBackups(cfg)
+	if err != nil {
+		return err
+	}
+	var localRequired []string
+	for _, backup := range localBackups {
+		if backup.RequiredBackup != "" {
+			localRequired = append(localRequired, backup.RequiredBackup)
+		}
+	}
+	var removed []string
+	for _, backup := range getExpiredRemoteBackups(remoteBackups, keep, keepDuration, localRequired, time.Now()) {
+		if err := bd.RemoveBackup(backup); err != nil {
+			return fmt.Errorf("can't remove '%s' from remote storage, removed %s: %v", backup.BackupName, strings.Join(removed, ","), err)
+		}
+		apexLog.WithField("operation", "delete").
+			WithField("location", "remote").
+			WithField("backup", backup.BackupName).
+			WithField("creation_date", backup.CreationDate.Format(time.RFC3339)).
+			Info("done")
+		removed = append(removed, backup.BackupName)
+	}
+	if len(removed) > 0 {
+		apexLog.WithField("operation", "clean").
+			WithField("removed", strings.Join(removed, ",")).
+			Info("old remote backups removed")
+	}
+	return nil
+}
+
+// getExpiredRemoteBackups - remote backups above keep newest ones and older than keepDuration by creation date,
+// zero keep or keepDuration disables its check. Backup is kept when it is in chain of RequiredBackup
+// of kept remote backup or of local backup from required list
+func getExpiredRemoteBackups(backups []new_storage.Backup, keep int, keepDuration time.Duration, required []string, now time.Time) []new_storage.Backup {
+	creationDate := func(backup new_storage.Backup) time.Time {
+		// legacy and broken backups have no metadata.json
+		if backup.CreationDate.IsZero() {
+			return backup.UploadDate
+		}
+		return backup.CreationDate
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return creationDate(backups[i]).After(creationDate(backups[j]))
+	})
+	requiredBy := map[string]string{}
+	for _, backup := range backups {
+		requiredBy[backup.BackupName] = backup.RequiredBackup
+	}
+	protected := map[string]struct{}{}
+	protect := func(name string) {
+		for name != "" {
+			if _, ok := protected[name]; ok {
+				return
+			}
+			protected[name] = struct{}{}
+			name = requiredBy[name]
+		}
+	}
+	for _, name := range required {
+		protect(name)
+	}
+	var candidates []new_storage.Backup
+	for i, backup := range backups {
+		if (keep < 1 || i >= keep) && (keepDuration <= 0 || now.Sub(creationDate(backup)) > keepDuration) {
+			candidates = append(candidates, backup)
+			continue
+		}
+		protect(backup.RequiredBackup)
+	}
+	expired := []new_storage.Backup{}
+	for _, backup := range candidates {
+		if _, ok := protected[backup.BackupName]; ok {
+			apexLog.WithField("backup", backup.BackupName).Info("remote backup is expired, but it is required by incremental backup, kept")
+			continue
+		}
+		expired = append(expired, backup)
+	}
+	return expired
+}
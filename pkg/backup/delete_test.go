@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRetentionBackups(now time.Time) []BackupLocal {
+	// b0 is the newest, b5 is the oldest, shuffled to check sorting
+	ages := map[string]time.Duration{
+		"b3": 72 * time.Hour,
+		"b0": time.Hour,
+		"b5": 240 * time.Hour,
+		"b1": 24 * time.Hour,
+		"b4": 120 * time.Hour,
+		"b2": 48 * time.Hour,
+	}
+	var backups []BackupLocal
+	for _, name := range []string{"b3", "b0", "b5", "b1", "b4", "b2"} {
+		backups = append(backups, BackupLocal{BackupMetadata: metadata.BackupMetadata{BackupName: name, CreationDate: now.Add(-ages[name])}})
+	}
+	backups[1].Legacy = true
+	backups[4].Broken = "can't parse metadata.json"
+	return backups
+}
+
+func expiredNames(backups []BackupLocal) []string {
+	names := []string{}
+	for _, b := range backups {
+		names = append(names, b.BackupName)
+	}
+	return names
+}
+
+func TestGetExpiredBackups(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		keep         int
+		keepDuration time.Duration
+		keepLast     bool
+		expected     []string
+	}{
+		{keep: 3, expected: []string{"b3", "b4", "b5"}},
+		{keep: 10, expected: []string{}},
+		{keepDuration: 60 * time.Hour, expected: []string{"b3", "b4", "b5"}},
+		{keepDuration: 30 * time.Minute, keepLast: true, expected: []string{"b1", "b2", "b3", "b4", "b5"}},
+		// both limits, backup is removed only when it is above both
+		{keep: 2, keepDuration: 100 * time.Hour, expected: []string{"b4", "b5"}},
+		{keep: 5, keepDuration: 30 * time.Hour, expected: []string{"b5"}},
+		{keep: -1, expected: []string{"b0", "b1", "b2", "b3", "b4", "b5"}},
+		{keep: -1, keepLast: true, expected: []string{"b1", "b2", "b3", "b4", "b5"}},
+	}
+	for _, tc := range testCases {
+		expired := getExpiredBackups(newRetentionBackups(now), tc.keep, tc.keepDuration, tc.keepLast, now)
+		assert.Equal(t, tc.expected, expiredNames(expired), fmt.Sprintf("keep=%d duration=%s keepLast=%v", tc.keep, tc.keepDuration, tc.keepLast))
+	}
+}
+
+func TestGetExpiredRemoteBackups(t *testing.T) {
+	now := time.Now()
+	newRemoteBackups := func() []new_storage.Backup {
+		var backups []new_storage.Backup
+		for _, local := range newRetentionBackups(now) {
+			backups = append(backups, new_storage.Backup{BackupMetadata: local.BackupMetadata})
+		}
+		// b2 is increment of b4, legacy b0 has only upload date
+		backups[5].RequiredBackup = "b4"
+		backups[1].CreationDate = time.Time{}
+		backups[1].UploadDate = now
+		return backups
+	}
+	remoteNames := func(backups []new_storage.Backup) []string {
+		names := []string{}
+		for _, b := range backups {
+			names = append(names, b.BackupName)
+		}
+		return names
+	}
+	testCases := []struct {
+		keep         int
+		keepDuration time.Duration
+		required     []string
+		expected     []string
+	}{
+		{keep: 3, expected: []string{"b3", "b5"}},
+		{keep: 1, expected: []string{"b1", "b2", "b3", "b4", "b5"}},
+		{keep: 10, expected: []string{}},
+		{keepDuration: 60 * time.Hour, expected: []string{"b3", "b5"}},
+		{keep: 5, keepDuration: 30 * time.Hour, expected: []string{"b5"}},
+		// local increment of b2 keeps whole chain of it
+		{keep: 1, required: []string{"b2"}, expected: []string{"b1", "b3", "b5"}},
+	}
+	for _, tc := range testCases {
+		expired := getExpiredRemoteBackups(newRemoteBackups(), tc.keep, tc.keepDuration, tc.required, now)
+		assert.Equal(t, tc.expected, remoteNames(expired), fmt.Sprintf("keep=%d duration=%s required=%v", tc.keep, tc.keepDuration, tc.required))
+	}
+}
+
+func TestCheckBackupRemovable(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-delete")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "with_metadata"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, "with_metadata", MetaFileName), []byte("{}"), 0640))
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "with_shadow", "shadow"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "deleting"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, "deleting", DeletingMetaFileName), nil, 0640))
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "empty"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "not_backup", "store"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "shadow_file"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, "shadow_file", "shadow"), nil, 0640))
+
+	for _, name := range []string{"with_metadata", "with_shadow", "deleting", "empty", "missing"} {
+		assert.NoError(t, checkBackupRemovable(backupsPath, filepath.Join(backupsPath, name), name), name)
+	}
+	for _, name := range []string{"not_backup", "shadow_file"} {
+		err := checkBackupRemovable(backupsPath, filepath.Join(backupsPath, name), name)
+		assert.True(t, errors.Is(err, ErrUnsafeRemovePath), name)
+		assert.DirExists(t, filepath.Join(backupsPath, name))
+	}
+	// path doesn't end with backup name inside backups directory
+	for _, tc := range []struct{ backupPath, backupName string }{
+		{backupsPath, ""},
+		{filepath.Dir(backupsPath), filepath.Base(backupsPath)},
+		{filepath.Join(backupsPath, "with_metadata", "shadow"), "shadow"},
+		{filepath.Join(backupsPath, "with_metadata"), "with_shadow"},
+	} {
+		err := checkBackupRemovable(backupsPath, tc.backupPath, tc.backupName)
+		assert.True(t, errors.Is(err, ErrUnsafeRemovePath), tc.backupPath)
+	}
+}
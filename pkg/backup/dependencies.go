@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+)
+
+// getSourceTables - existing tables which hold data of View, MaterializedView or Merge table
+func getSourceTables(allTables map[metadata.TableTitle]clickhouse.Table, table clickhouse.Table) []metadata.TableTitle {
+	var result []metadata.TableTitle
+	add := func(title metadata.TableTitle) {
+		if title.Database == "" {
+			title.Database = table.Database
+		}
+		if _, ok := allTables[title]; !ok {
+			return
+		}
+		if title.Database == table.Database && title.Table == table.Name {
+			return
+		}
+		for _, t := range result {
+			if t == title {
+				return
+			}
+		}
+		result = append(result, title)
+	}
+	switch table.Engine {
+	case "View", "MaterializedView", "LiveView":
+		for _, title := range clickhouse.ParseViewSources(table.CreateTableQuery) {
+			add(title)
+		}
+		if table.Engine == "MaterializedView" {
+			add(metadata.TableTitle{Table: ".inner." + table.Name})
+			if table.UUID != "" {
+				add(metadata.TableTitle{Table: ".inner_id." + table.UUID})
+			}
+		}
+	case "Merge":
+		database, databaseIsRegexp, tablesRegexp, ok := clickhouse.ParseMergeEngine(table.CreateTableQuery)
+		if !ok {
+			return nil
+		}
+		if database == "" {
+			database = table.Database
+		}
+		tablesRE, err := regexp.Compile(tablesRegexp)
+		if err != nil {
+			return nil
+		}
+		var databaseRE *regexp.Regexp
+		if databaseIsRegexp {
+			if databaseRE, err = regexp.Compile(database); err != nil {
+				return nil
+			}
+		}
+		var matched []metadata.TableTitle
+		for title := range allTables {
+			if databaseRE != nil && !databaseRE.MatchString(title.Database) || databaseRE == nil && title.Database != database {
+				continue
+			}
+			if tablesRE.MatchString(title.Table) {
+				matched = append(matched, title)
+			}
+		}
+		sort.Slice(matched, func(i, j int) bool {
+			if matched[i].Database != matched[j].Database {
+				return matched[i].Database < matched[j].Database
+			}
+			return matched[i].Table < matched[j].Table
+		})
+		for _, title := range matched {
+			add(title)
+		}
+	}
+	return result
+}
+
+// expandDependencies - add source tables of selected View, MaterializedView and Merge tables recursively,
+// added tables inherit SchemaOnly of table which requires them, return source tables of every selected table
+func expandDependencies(allTables, tables []clickhouse.Table, log *apexLog.Entry) ([]clickhouse.Table, map[metadata.TableTitle][]string) {
+	allTablesMap := map[metadata.TableTitle]clickhouse.Table{}
+	for _, t := range allTables {
+		allTablesMap[metadata.TableTitle{Database: t.Database, Table: t.Name}] = t
+	}
+	selected := map[metadata.TableTitle]struct{}{}
+	for _, t := range tables {
+		selected[metadata.TableTitle{Database: t.Database, Table: t.Name}] = struct{}{}
+	}
+	sources := map[metadata.TableTitle][]string{}
+	added := 0
+	for i := 0; i < len(tables); i++ {
+		if tables[i].Skip {
+			continue
+		}
+		for _, title := range getSourceTables(allTablesMap, tables[i]) {
+			key := metadata.TableTitle{Database: tables[i].Database, Table: tables[i].Name}
+			sources[key] = append(sources[key], fmt.Sprintf("%s.%s", title.Database, title.Table))
+			if _, ok := selected[title]; ok {
+				continue
+			}
+			source := allTablesMap[title]
+			source.SchemaOnly = tables[i].SchemaOnly
+			tables = append(tables, source)
+			selected[title] = struct{}{}
+			added++
+			log.WithField("table", fmt.Sprintf("%s.%s", title.Database, title.Table)).Infof("added as source of '%s.%s'", tables[i].Database, tables[i].Name)
+		}
+	}
+	if added > 0 {
+		log.Infof("%d tables added by expand_dependencies", added)
+	}
+	return tables, sources
+}
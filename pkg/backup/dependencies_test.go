@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandDependencies(t *testing.T) {
+	allTables := []clickhouse.Table{
+		{Database: "db", Name: "events_1", Engine: "MergeTree"},
+		{Database: "db", Name: "events_2", Engine: "MergeTree"},
+		{Database: "db", Name: "users", Engine: "MergeTree"},
+		{Database: "db", Name: "merged", Engine: "Merge", CreateTableQuery: "CREATE TABLE db.merged (`id` UInt64) ENGINE = Merge('db', '^events_')"},
+		{Database: "db", Name: "v", Engine: "View", CreateTableQuery: "CREATE VIEW db.v (`id` UInt64) AS SELECT id FROM db.merged JOIN users USING id"},
+		{Database: "db", Name: "mv", Engine: "MaterializedView", UUID: "abc", CreateTableQuery: "CREATE MATERIALIZED VIEW db.mv (`id` UInt64) AS SELECT id FROM db.users"},
+		{Database: "db", Name: ".inner_id.abc", Engine: "MergeTree"},
+	}
+	tables, sources := expandDependencies(allTables, []clickhouse.Table{allTables[4]}, apexLog.WithField("operation", "create"))
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name)
+	}
+	assert.Equal(t, []string{"v", "merged", "users", "events_1", "events_2"}, names)
+	assert.Equal(t, []string{"db.merged", "db.users"}, sources[metadata.TableTitle{Database: "db", Table: "v"}])
+	assert.Equal(t, []string{"db.events_1", "db.events_2"}, sources[metadata.TableTitle{Database: "db", Table: "merged"}])
+
+	tables, _ = expandDependencies(allTables, []clickhouse.Table{allTables[5]}, apexLog.WithField("operation", "create"))
+	assert.Len(t, tables, 3)
+	assert.Equal(t, ".inner_id.abc", tables[2].Name)
+}
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+// diskIDFileName - marker file inside backup directory of each disk, it is bound to physical volume instead of disk name
+const diskIDFileName = ".disk_id"
+
+func readDiskID(disk clickhouse.Disk) (string, error) {
+	content, err := ioutil.ReadFile(path.Join(disk.Path, "backup", diskIDFileName))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// getDiskIDs - return identifiers of disks, marker file is created on first backup
+func getDiskIDs(ch *clickhouse.ClickHouse, disks []clickhouse.Disk, log *apexLog.Entry) map[string]string {
+	diskIDs := make(map[string]string, len(disks))
+	for _, disk := range disks {
+		id, err := readDiskID(disk)
+		if os.IsNotExist(err) {
+			id = uuid.New().String()
+			markerPath := path.Join(disk.Path, "backup", diskIDFileName)
+			// with general.backup_dir backup directory of disk holds only the marker and isn't created by create
+			if err = ch.Mkdir(path.Dir(markerPath)); err == nil {
+				err = ioutil.WriteFile(markerPath, []byte(id+"\n"), 0640)
+			}
+			if err == nil {
+				err = ch.Chown(markerPath)
+			}
+		}
+		if err != nil {
+			log.WithField("disk", disk.Name).Warnf("can't get disk identity: %v", err)
+			continue
+		}
+		diskIDs[disk.Name] = id
+	}
+	return diskIDs
+}
+
+// checkDiskIDs - compare path and identity of disks recorded in backup with current clickhouse disks
+// mismatch is logged when clickhouse.check_disk_identity is 'warn' and returned as error when it is 'strict'
+func checkDiskIDs(cfg *config.Config, ch *clickhouse.ClickHouse, backupMetadata metadata.BackupMetadata) error {
+	if cfg.ClickHouse.CheckDiskIdentity == "none" || len(backupMetadata.DiskIDs) == 0 {
+		return nil
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	currentDisks := make(map[string]clickhouse.Disk, len(disks))
+	for _, disk := range disks {
+		currentDisks[disk.Name] = disk
+	}
+	var mismatches []string
+	for diskName, backupDiskID := range backupMetadata.DiskIDs {
+		disk, ok := currentDisks[diskName]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("disk '%s' is not found", diskName))
+			continue
+		}
+		if backupPath, ok := backupMetadata.Disks[diskName]; ok && backupPath != disk.Path {
+			mismatches = append(mismatches, fmt.Sprintf("disk '%s' has path '%s', but backup was created with '%s'", diskName, disk.Path, backupPath))
+			continue
+		}
+		diskID, err := readDiskID(disk)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if diskID != backupDiskID {
+			mismatches = append(mismatches, fmt.Sprintf("disk '%s' has identity '%s', but backup was created with '%s'", diskName, diskID, backupDiskID))
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	if cfg.ClickHouse.CheckDiskIdentity == "strict" {
+		return fmt.Errorf("'%s' was created on other disks: %s", backupMetadata.BackupName, strings.Join(mismatches, "; "))
+	}
+	for _, mismatch := range mismatches {
+		apexLog.Warnf("'%s' was created on other disks: %s", backupMetadata.BackupName, mismatch)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// getTablesDisks - sorted names of disks which contain parts of tables
+func getTablesDisks(tables []metadata.TableMetadata) []string {
+	diskSet := map[string]struct{}{}
+	for _, t := range tables {
+		for disk, parts := range t.Parts {
+			if len(parts) > 0 {
+				diskSet[disk] = struct{}{}
+			}
+		}
+	}
+	disks := make([]string, 0, len(diskSet))
+	for disk := range diskSet {
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+	return disks
+}
+
+// mapBackupDisks - return aliases for disks of backup which are absent in clickhouse, alias has name of backup disk
+// and path of disk from clickhouse.restore_disk_mapping, so parts of backup disk are read from and restored to mapped disk.
+// All absent and not mapped disks are reported in one error
+func mapBackupDisks(backupDisks []string, disks []clickhouse.Disk, restoreDiskMapping map[string]string) ([]clickhouse.Disk, error) {
+	diskByName := map[string]clickhouse.Disk{}
+	for _, disk := range disks {
+		diskByName[disk.Name] = disk
+	}
+	var aliases []clickhouse.Disk
+	var missing []string
+	for _, name := range backupDisks {
+		if _, ok := diskByName[name]; ok {
+			continue
+		}
+		target, ok := restoreDiskMapping[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		disk, ok := diskByName[target]
+		if !ok {
+			return nil, fmt.Errorf("disk '%s' is mapped to '%s' by restore_disk_mapping, but '%s' is not found in clickhouse", name, target, target)
+		}
+		disk.Name = name
+		aliases = append(aliases, disk)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("disks %s of backup are not found in clickhouse, map them to existing disks with restore_disk_mapping config, e.g. '%s: default', or add nonexistent disks to disk_mapping config", strings.Join(missing, ", "), missing[0])
+	}
+	return aliases, nil
+}
@@ -0,0 +1,40 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapBackupDisks(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/", Type: "local"},
+		{Name: "cold", Path: "/mnt/cold/", Type: "local"},
+	}
+	tables := []metadata.TableMetadata{
+		{Database: "db", Table: "t1", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}, "hdd": {{Name: "all_2_2_0"}}}},
+		{Database: "db", Table: "t2", Parts: map[string][]metadata.Part{"ssd": {{Name: "all_1_1_0"}}, "empty": {}}},
+	}
+	backupDisks := getTablesDisks(tables)
+	assert.Equal(t, []string{"default", "hdd", "ssd"}, backupDisks)
+
+	_, err := mapBackupDisks(backupDisks, disks, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hdd, ssd")
+
+	_, err = mapBackupDisks(backupDisks, disks, map[string]string{"hdd": "cold", "ssd": "nvme"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "'nvme' is not found")
+
+	aliases, err := mapBackupDisks(backupDisks, disks, map[string]string{"hdd": "cold", "ssd": "default"})
+	require.NoError(t, err)
+	assert.Equal(t, []clickhouse.Disk{
+		{Name: "hdd", Path: "/mnt/cold/", Type: "local"},
+		{Name: "ssd", Path: "/var/lib/clickhouse/", Type: "local"},
+	}, aliases)
+	dstDataPaths := clickhouse.GetDisksByPaths(disks, []string{"/var/lib/clickhouse/data/db/t1/", "/mnt/cold/data/db/t1/"})
+	assert.Equal(t, "/mnt/cold/data/db/t1/", dstDataPaths[clickhouse.GetDiskByPath(disks, aliases[0].Path)])
+}
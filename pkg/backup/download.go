@@ -1,12 +1,13 @@
 package backup
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/config"
@@ -35,14 +36,16 @@ func legacyDownload(cfg *config.Config, defaultDataPath, backupName string) erro
 		return err
 	}
 	if err := bd.CompressedStreamDownload(backupName,
-		path.Join(defaultDataPath, "backup", backupName)); err != nil {
+		path.Join(localBackupsPath(cfg, defaultDataPath), backupName)); err != nil {
 		return err
 	}
 	log.Info("done")
 	return nil
 }
 
-func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly bool) error {
+// Download - metadata.json and tables metadata are checked against metadata.json.sha256 and metadata.json.sig
+// of remote backup before they are saved, backup with modified metadata is refused unless ignoreSignature is set
+func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly, ignoreSignature bool) error {
 	log := apexLog.WithFields(apexLog.Fields{
 		"backup":    backupName,
 		"operation": "download",
@@ -58,12 +61,18 @@ func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly b
 	if err != nil {
 		return err
 	}
+	resume := false
 	for i := range localBackups {
 		if backupName == localBackups[i].BackupName {
-			return ErrBackupIsAlreadyExists
+			// metadata.json is written last, backup without it is left by interrupted download
+			if localBackups[i].Broken != BrokenMetadataMissing || localBackups[i].InProgress != nil {
+				return ErrBackupIsAlreadyExists
+			}
+			resume = true
 		}
 	}
 	startDownload := time.Now()
+	b.ch.SetQueryComment("download", backupName)
 	if err := b.ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
@@ -100,11 +109,23 @@ func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly b
 		log.Debugf("'%s' is old-format backup", backupName)
 		return legacyDownload(b.cfg, b.DefaultDataPath, backupName)
 	}
+	verifier, err := b.loadRemoteMetadataVerifier(backupName, ignoreSignature)
+	if err != nil {
+		return err
+	}
+	if err := b.verifyRemoteBackupMetadata(&remoteBackup, verifier); err != nil {
+		return err
+	}
+	if !schemaOnly {
+		if err := checkBackupEncryption(b.cfg, remoteBackup.BackupMetadata); err != nil {
+			return err
+		}
+	}
 	tableMetadataForDownload := []metadata.TableMetadata{}
 	tablesForDownload := parseTablePatternForDownload(remoteBackup.Tables, tablePattern)
 
 	if !schemaOnly && remoteBackup.RequiredBackup != "" {
-		err := b.Download(remoteBackup.RequiredBackup, tablePattern, schemaOnly)
+		err := b.Download(remoteBackup.RequiredBackup, tablePattern, schemaOnly, ignoreSignature)
 		if err != nil && err != ErrBackupIsAlreadyExists {
 			return err
 		}
@@ -112,31 +133,30 @@ func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly b
 
 	dataSize := int64(0)
 	metadataSize := int64(0)
-	err = os.MkdirAll(path.Join(b.DefaultDataPath, "backup", backupName), 0750)
+	err = os.MkdirAll(path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName), 0750)
 	if err != nil {
 		return err
 	}
+	if err := b.downloadClusters(backupName); err != nil {
+		return err
+	}
+	if resume {
+		log.Info("resume interrupted download, downloaded tables are skipped")
+	}
+	var manifest, downloadedFiles []manifestFile
+	if !schemaOnly {
+		manifest = b.downloadFilesManifest(backupName)
+	}
 	for _, t := range tablesForDownload {
 		log := log.WithField("table", fmt.Sprintf("%s.%s", t.Database, t.Table))
-		remoteTableMetadata := path.Join(backupName, "metadata", clickhouse.TablePathEncode(t.Database), fmt.Sprintf("%s.json", clickhouse.TablePathEncode(t.Table)))
-		log.Debug(remoteTableMetadata)
-		tmReader, err := b.dst.GetFileReader(remoteTableMetadata)
+		tableMetadata, err := b.getRemoteTableMetadata(backupName, t, verifier)
 		if err != nil {
 			return err
 		}
-		tmBody, err := ioutil.ReadAll(tmReader)
-		if err != nil {
-			return err
-		}
-		tmReader.Close()
-		var tableMetadata metadata.TableMetadata
-		if err := json.Unmarshal(tmBody, &tableMetadata); err != nil {
-			return err
-		}
 		tableMetadataForDownload = append(tableMetadataForDownload, tableMetadata)
 
 		// save metadata
-		metadataLocalFile := path.Join(b.DefaultDataPath, "backup", backupName, "metadata", clickhouse.TablePathEncode(t.Database), fmt.Sprintf("%s.json", clickhouse.TablePathEncode(t.Table)))
+		metadataLocalFile := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, "metadata", clickhouse.TablePathEncode(t.Database), fmt.Sprintf("%s.json", clickhouse.TablePathEncode(t.Table)))
 		size, err := tableMetadata.Save(metadataLocalFile, schemaOnly)
 		if err != nil {
 			return err
@@ -146,26 +166,28 @@ func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly b
 	}
 
 	if !schemaOnly {
-		for _, t := range tableMetadataForDownload {
-			for disk := range t.Parts {
-				if _, ok := b.DiskMap[disk]; !ok {
-					return fmt.Errorf("table '%s.%s' require disk '%s' that not found in clickhouse, you can add nonexistent disks to disk_mapping config", t.Database, t.Table, disk)
-				}
-			}
+		if err := b.mapBackupDisks(tableMetadataForDownload); err != nil {
+			return err
 		}
 		for _, tableMetadata := range tableMetadataForDownload {
 			if tableMetadata.MetadataOnly {
 				continue
 			}
-			dataSize += tableMetadata.TotalBytes
+			tableSize := sumDiskSizes(tableMetadata.Size)
+			dataSize += tableSize
 			start := time.Now()
-			if err := b.downloadTableData(remoteBackup.BackupMetadata, tableMetadata); err != nil {
+			if err := b.downloadTableData(remoteBackup.BackupMetadata, tableMetadata, manifest); err != nil {
+				return err
+			}
+			tableFiles, err := b.checkDownloadedTable(remoteBackup.BackupMetadata, tableMetadata, manifest)
+			if err != nil {
 				return err
 			}
+			downloadedFiles = append(downloadedFiles, tableFiles...)
 			log.
 				WithField("table", fmt.Sprintf("%s.%s", tableMetadata.Database, tableMetadata.Table)).
 				WithField("duration", utils.HumanizeDuration(time.Since(start))).
-				WithField("size", utils.FormatBytes(metadataSize+tableMetadata.TotalBytes)).
+				WithField("size", utils.FormatBytes(metadataSize+tableSize)).
 				Info("done")
 		}
 	}
@@ -173,14 +195,27 @@ func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly b
 	backupMetadata.Tables = tablesForDownload
 	backupMetadata.DataSize = dataSize
 	backupMetadata.MetadataSize = metadataSize
-	backupMetadata.CompressedSize = 0
+	backupMetadata.CompressedSize = dataSize // local backup is not compressed
 	backupMetadata.DataFormat = ""
 	backupMetadata.RequiredBackup = ""
+	// data of local backup is decrypted
+	backupMetadata.Encryption = ""
 
-	backupMetafileLocalPath := path.Join(b.DefaultDataPath, "backup", backupName, "metadata.json")
+	if manifest != nil {
+		if err := saveFilesManifest(path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, FilesManifestName), downloadedFiles, b.ch.Chown); err != nil {
+			return err
+		}
+	}
+	backupMetafileLocalPath := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, "metadata.json")
 	if err := backupMetadata.Save(backupMetafileLocalPath); err != nil {
 		return err
 	}
+	if err := checksumBackupLocal(b.ch, path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName)); err != nil {
+		return err
+	}
+	if err := signBackupLocal(b.cfg, b.ch, path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName)); err != nil {
+		return err
+	}
 	log.
 		WithField("duration", utils.HumanizeDuration(time.Since(startDownload))).
 		WithField("size", utils.FormatBytes(dataSize+metadataSize)).
@@ -188,45 +223,155 @@ func (b *Backuper) Download(backupName string, tablePattern string, schemaOnly b
 	return nil
 }
 
-func (b *Backuper) downloadTableData(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata) error {
-	uuid := path.Join(clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table))
+// verifyRemoteBackupMetadata - check metadata.json of remote backup, remoteBackup is filled from checked content
+func (b *Backuper) verifyRemoteBackupMetadata(remoteBackup *new_storage.Backup, verifier *remoteMetadataVerifier) error {
+	body, err := b.readRemoteFile(path.Join(remoteBackup.BackupName, MetaFileName))
+	if err != nil {
+		return fmt.Errorf("can't read %s of '%s': %v", MetaFileName, remoteBackup.BackupName, err)
+	}
+	if err := verifier.verify(MetaFileName, body); err != nil {
+		return err
+	}
+	var backupMetadata metadata.BackupMetadata
+	if err := json.Unmarshal(body, &backupMetadata); err != nil {
+		return fmt.Errorf("can't parse %s of '%s': %v", MetaFileName, remoteBackup.BackupName, err)
+	}
+	remoteBackup.BackupMetadata = backupMetadata
+	return nil
+}
+
+// getRemoteTableMetadata - read metadata of one table from remote backup, content is checked by verifier when it is not nil
+func (b *Backuper) getRemoteTableMetadata(backupName string, t metadata.TableTitle, verifier *remoteMetadataVerifier) (metadata.TableMetadata, error) {
+	var tableMetadata metadata.TableMetadata
+	relativeTableMetadata := path.Join("metadata", clickhouse.TablePathEncode(t.Database), fmt.Sprintf("%s.json", clickhouse.TablePathEncode(t.Table)))
+	remoteTableMetadata := path.Join(backupName, relativeTableMetadata)
+	apexLog.Debug(remoteTableMetadata)
+	tmBody, err := b.readRemoteFile(remoteTableMetadata)
+	if err != nil {
+		return tableMetadata, err
+	}
+	if err := verifier.verify(relativeTableMetadata, tmBody); err != nil {
+		return tableMetadata, err
+	}
+	if err := json.Unmarshal(tmBody, &tableMetadata); err != nil {
+		return tableMetadata, err
+	}
+	return tableMetadata, nil
+}
+
+// downloadTableData - download parts of table to local backup, disks with all files of table from files.txt
+// already downloaded are skipped, so interrupted download is resumed. Downloaded files are owned by clickhouse user
+func (b *Backuper) downloadTableData(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata, manifest []manifestFile) error {
 	if remoteBackup.DataFormat != "directory" {
+		type archive struct {
+			remoteFile string
+			localDir   string
+		}
+		var archives []archive
 		for disk := range table.Files {
+			if b.isTableDataDownloaded(remoteBackup, table, disk, manifest) {
+				continue
+			}
 			diskPath := b.DiskMap[disk]
-			tableLocalDir := path.Join(diskPath, "backup", remoteBackup.BackupName, "shadow", uuid, disk)
+			tableLocalDir := backupShadowPath(localBackupsPath(b.cfg, diskPath), remoteBackup.BackupName, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
 			for _, archiveFile := range table.Files[disk] {
 				tableRemoteFile := path.Join(remoteBackup.BackupName, "shadow", clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table), archiveFile)
-				if err := b.dst.CompressedStreamDownload(tableRemoteFile, tableLocalDir); err != nil {
-					return err
-				}
+				archives = append(archives, archive{remoteFile: tableRemoteFile, localDir: tableLocalDir})
 			}
 		}
+		// archives of one disk contain different parts, so they are unpacked into table directory at the same time
+		err := runTransfers(context.Background(), len(archives), b.cfg.General.DownloadConcurrency, func(i int) error {
+			return b.dst.CompressedStreamDownload(archives[i].remoteFile, archives[i].localDir, remoteBackup.DataFormat, remoteBackup.Encryption != "")
+		})
+		if err != nil {
+			return err
+		}
 	} else {
 		for disk := range table.Parts {
-			tableRemotePath := path.Join(remoteBackup.BackupName, "shadow", uuid, disk)
+			if b.isTableDataDownloaded(remoteBackup, table, disk, manifest) {
+				continue
+			}
+			tableRemotePath := path.Join(remoteBackup.BackupName, clickhouse.ShadowPath(remoteBackup.ShadowLayout, disk, table.Database, table.Table))
 			diskPath := b.DiskMap[disk]
-			tableLocalDir := path.Join(diskPath, "backup", remoteBackup.BackupName, "shadow", uuid, disk)
-			if err := b.dst.DownloadPath(0, tableRemotePath, tableLocalDir); err != nil {
+			tableLocalDir := backupShadowPath(localBackupsPath(b.cfg, diskPath), remoteBackup.BackupName, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
+			if err := b.dst.DownloadPath(0, tableRemotePath, tableLocalDir, remoteBackup.Encryption != ""); err != nil {
 				return err
 			}
 		}
 	}
 	// Create symlink for exsists parts
+	var requiredBackup *BackupLocal
 	for disk, parts := range table.Parts {
 		for _, p := range parts {
 			if !p.Required {
 				continue
 			}
-			existsPath := path.Join(b.DiskMap[disk], "backup", remoteBackup.RequiredBackup, "shadow", uuid, disk, p.Name)
-			newPath := path.Join(b.DiskMap[disk], "backup", remoteBackup.BackupName, "shadow", uuid, disk, p.Name)
+			if requiredBackup == nil {
+				var err error
+				if requiredBackup, err = getLocalBackup(b.cfg, remoteBackup.RequiredBackup); err != nil {
+					return err
+				}
+			}
+			existsPath := path.Join(backupShadowPath(localBackupsPath(b.cfg, b.DiskMap[disk]), remoteBackup.RequiredBackup, requiredBackup.ShadowLayout, disk, table.Database, table.Table), p.Name)
+			newPath := path.Join(backupShadowPath(localBackupsPath(b.cfg, b.DiskMap[disk]), remoteBackup.BackupName, remoteBackup.ShadowLayout, disk, table.Database, table.Table), p.Name)
 			if err := duplicatePart(existsPath, newPath); err != nil {
 				return fmt.Errorf("can't to add exists part: %s", err)
 			}
 		}
 	}
+	for _, disk := range getTablesDisks([]metadata.TableMetadata{table}) {
+		tableLocalDir := backupShadowPath(localBackupsPath(b.cfg, b.DiskMap[disk]), remoteBackup.BackupName, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
+		if _, err := os.Stat(tableLocalDir); os.IsNotExist(err) {
+			continue
+		}
+		if err := chownTree(tableLocalDir, b.ch.Chown); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// isTableDataDownloaded - all files of table on disk from files.txt exist locally with their sizes
+func (b *Backuper) isTableDataDownloaded(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata, disk string, manifest []manifestFile) bool {
+	files := tableManifestFiles(manifest, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
+	if len(files) == 0 {
+		return false
+	}
+	backupPath := path.Join(localBackupsPath(b.cfg, b.DiskMap[disk]), remoteBackup.BackupName)
+	for _, file := range files {
+		if problem, err := checkManifestFile(backupPath, file); err != nil || problem != "" {
+			return false
+		}
+	}
+	apexLog.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).WithField("disk", disk).Info("already downloaded, skipped")
+	return true
+}
+
+// checkDownloadedTable - compare downloaded files of table with sizes from files.txt of remote backup,
+// files of table are returned for files.txt of local backup
+func (b *Backuper) checkDownloadedTable(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata, manifest []manifestFile) ([]manifestFile, error) {
+	var tableFiles []manifestFile
+	var problems []string
+	for _, disk := range getTablesDisks([]metadata.TableMetadata{table}) {
+		files := tableManifestFiles(manifest, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
+		backupPath := path.Join(localBackupsPath(b.cfg, b.DiskMap[disk]), remoteBackup.BackupName)
+		for _, file := range files {
+			problem, err := checkManifestFile(backupPath, file)
+			if err != nil {
+				return nil, err
+			}
+			if problem != "" {
+				problems = append(problems, problem)
+			}
+		}
+		tableFiles = append(tableFiles, files...)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("downloaded files of '%s.%s' are damaged: %s", table.Database, table.Table, strings.Join(problems, ", "))
+	}
+	return tableFiles, nil
+}
+
 func duplicatePart(exists, new string) error {
 	ex, err := os.Open(exists)
 	if err != nil {
@@ -241,7 +386,8 @@ func duplicatePart(exists, new string) error {
 		return err
 	}
 	for _, f := range files {
-		if err := os.Link(path.Join(exists, f), path.Join(new, f)); err != nil {
+		// part is already linked by interrupted download
+		if err := os.Link(path.Join(exists, f), path.Join(new, f)); err != nil && !os.IsExist(err) {
 			return err
 		}
 	}
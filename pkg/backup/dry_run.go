@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/utils"
+
+	apexLog "github.com/apex/log"
+)
+
+// DryRunTable - table selected by create, SkipReason is not empty when table would not be backed up
+type DryRunTable struct {
+	Database   string   `json:"database"`
+	Name       string   `json:"name"`
+	Engine     string   `json:"engine"`
+	TotalBytes int64    `json:"total_bytes"`
+	Disks      []string `json:"disks"`
+	SchemaOnly bool     `json:"schema_only"`
+	SkipReason string   `json:"skip_reason,omitempty"`
+}
+
+// CreateBackupDryRun - select tables the same way as CreateBackup and report them,
+// nothing is frozen or written, so it is safe to run on production
+func CreateBackupDryRun(cfg *config.Config, tablePattern, modifiedSince string, selector TableSelector, schemaOnly bool) ([]DryRunTable, error) {
+	var since time.Time
+	if modifiedSince != "" {
+		var err error
+		if since, err = parseModifiedSince(modifiedSince); err != nil {
+			return nil, err
+		}
+	}
+	log := apexLog.WithFields(apexLog.Fields{
+		"operation": "create_dry_run",
+	})
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	ch.SetQueryComment("create_dry_run", "")
+	if err := ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+	allTables, err := ch.GetTables()
+	if err != nil {
+		return nil, fmt.Errorf("cat't get tables from clickhouse: %v", err)
+	}
+	if selector != nil {
+		if allTables, err = selector(allTables); err != nil {
+			return nil, fmt.Errorf("can't select tables: %v", err)
+		}
+	}
+	tables, _, err := expandAndFilterTables(cfg, ch, allTables, filterTablesByPattern(allTables, tablePattern, cfg.General.SkipDatabases), since, log)
+	if err != nil {
+		return nil, err
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return nil, err
+	}
+	var skippedDisks []string
+	for _, disk := range disks {
+		if !isBackupDirWritable(localBackupsPath(cfg, disk.Path)) {
+			if cfg.General.BackupDir != "" {
+				return nil, fmt.Errorf("general.backup_dir '%s' is not writable", cfg.General.BackupDir)
+			}
+			if !cfg.General.SkipUnwritableDisks || disk.Name == "default" {
+				return nil, fmt.Errorf("can't create '%s' on disk '%s': not writable", path.Join(disk.Path, "backup"), disk.Name)
+			}
+			skippedDisks = append(skippedDisks, disk.Name)
+		}
+	}
+	return dryRunTables(tables, disks, skippedDisks, schemaOnly, cfg.General.BackupNonMergeTreeData), nil
+}
+
+// dryRunTables - report what createBackup would do with each table
+func dryRunTables(tables []clickhouse.Table, disks []clickhouse.Disk, skippedDisks []string, schemaOnly, dumpNonMergeTree bool) []DryRunTable {
+	result := make([]DryRunTable, 0, len(tables))
+	for i := range tables {
+		table := &tables[i]
+		tableSchemaOnly := schemaOnly || table.SchemaOnly
+		r := DryRunTable{
+			Database:   table.Database,
+			Name:       table.Name,
+			Engine:     table.Engine,
+			TotalBytes: table.TotalBytes.Int64,
+			SchemaOnly: tableSchemaOnly || !strings.HasSuffix(table.Engine, "MergeTree") && !(dumpNonMergeTree && isDumpableEngine(table.Engine)),
+		}
+		for disk := range clickhouse.GetDisksByPaths(disks, table.DataPaths) {
+			r.Disks = append(r.Disks, disk)
+		}
+		sort.Strings(r.Disks)
+		if table.Skip {
+			r.SkipReason = "matched by skip_tables"
+		} else if diskName := getSkippedTableDisk(disks, table, skippedDisks); diskName != "" && !tableSchemaOnly {
+			r.SkipReason = fmt.Sprintf("data is on unwritable disk '%s'", diskName)
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// isBackupDirWritable - directory of local backups or its parent when it doesn't exist yet is writable
+func isBackupDirWritable(backupsPath string) bool {
+	dir := backupsPath
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		dir = path.Dir(backupsPath)
+	}
+	return syscall.Access(dir, 0x2) == nil
+}
+
+// PrintDryRun - print tables reported by CreateBackupDryRun and total size of backed up tables
+func PrintDryRun(out io.Writer, tables []DryRunTable) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.DiscardEmptyColumns)
+	total := int64(0)
+	count := 0
+	for _, t := range tables {
+		status := "data"
+		if t.SchemaOnly {
+			status = "schema only"
+		}
+		if t.SkipReason != "" {
+			status = "skip, " + t.SkipReason
+		} else {
+			count++
+			if !t.SchemaOnly {
+				total += t.TotalBytes
+			}
+		}
+		fmt.Fprintf(w, "%s.%s\t%s\t%s\t%s\t%s\n", t.Database, t.Name, t.Engine, utils.FormatBytes(t.TotalBytes), strings.Join(t.Disks, ","), status)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d tables, %s would be backed up\n", count, utils.FormatBytes(total))
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunTables(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/"},
+		{Name: "cold", Path: "/mnt/cold/"},
+	}
+	tables := []clickhouse.Table{
+		{Database: "db", Name: "events", Engine: "MergeTree", TotalBytes: sql.NullInt64{Int64: 100, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/data/db/events/"}},
+		{Database: "db", Name: "archive", Engine: "ReplicatedMergeTree", TotalBytes: sql.NullInt64{Int64: 200, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/data/db/archive/", "/mnt/cold/data/db/archive/"}},
+		{Database: "db", Name: "events_mv", Engine: "MaterializedView"},
+		{Database: "db", Name: "tmp", Engine: "MergeTree", Skip: true},
+	}
+	result := dryRunTables(tables, disks, []string{"cold"}, false, false)
+	require.Len(t, result, 4)
+
+	assert.Equal(t, "events", result[0].Name)
+	assert.Equal(t, int64(100), result[0].TotalBytes)
+	assert.Equal(t, []string{"default"}, result[0].Disks)
+	assert.False(t, result[0].SchemaOnly)
+	assert.Empty(t, result[0].SkipReason)
+
+	assert.Equal(t, []string{"cold", "default"}, result[1].Disks)
+	assert.Contains(t, result[1].SkipReason, "cold")
+
+	assert.True(t, result[2].SchemaOnly)
+	assert.Empty(t, result[2].SkipReason)
+
+	assert.Contains(t, result[3].SkipReason, "skip_tables")
+
+	out := &bytes.Buffer{}
+	PrintDryRun(out, result)
+	assert.Contains(t, out.String(), "2 tables, 100B would be backed up")
+}
+
+func TestDryRunTablesSchemaOnly(t *testing.T) {
+	disks := []clickhouse.Disk{{Name: "cold", Path: "/mnt/cold/"}}
+	tables := []clickhouse.Table{
+		{Database: "db", Name: "archive", Engine: "MergeTree", DataPaths: []string{"/mnt/cold/data/db/archive/"}},
+	}
+	result := dryRunTables(tables, disks, []string{"cold"}, true, false)
+	require.Len(t, result, 1)
+	assert.True(t, result[0].SchemaOnly)
+	assert.Empty(t, result[0].SkipReason)
+}
@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+// dumpPartName - pseudo part in shadow of backup with dump of not MergeTree table,
+// it is uploaded and downloaded like any other part
+const dumpPartName = "dump"
+
+// dumpableEngines - data of these engines can't be frozen, but can be read by SELECT and written back by INSERT
+var dumpableEngines = []string{"Log", "TinyLog", "StripeLog", "Memory"}
+
+func isDumpableEngine(engine string) bool {
+	for _, e := range dumpableEngines {
+		if engine == e {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpFileName - name of file in user_files_path, unique for concurrent operations
+func dumpFileName(database, table string) string {
+	id := strings.ReplaceAll(uuid.New().String(), "-", "")
+	return fmt.Sprintf("clickhouse-backup.%s.%s.%s.%s", id, clickhouse.TablePathEncode(database), clickhouse.TablePathEncode(table), strings.ToLower(clickhouse.DumpFormat))
+}
+
+func getDefaultDisk(disks []clickhouse.Disk) (clickhouse.Disk, error) {
+	for _, disk := range disks {
+		if disk.Name == "default" {
+			return disk, nil
+		}
+	}
+	return clickhouse.Disk{}, fmt.Errorf("can't find default disk")
+}
+
+// addTableDump - ClickHouse writes rows of table to user_files_path, the file is moved to dump part on default disk.
+// Empty table produces no file and no parts
+func addTableDump(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, table *clickhouse.Table, disks []clickhouse.Disk) (map[string][]metadata.Part, map[string]int64, *metadata.DataDump, error) {
+	log := apexLog.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name))
+	disk, err := getDefaultDisk(disks)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	structure, err := ch.GetTableStructure(table.Database, table.Name)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("can't get structure of '%s.%s': %v", table.Database, table.Name, err)
+	}
+	userFilesPath, err := ch.GetUserFilesPath()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ch.MkdirAll(userFilesPath); err != nil {
+		return nil, nil, nil, err
+	}
+	fileName := dumpFileName(table.Database, table.Name)
+	dumpPath := path.Join(userFilesPath, fileName)
+	defer func() {
+		if err := os.Remove(dumpPath); err != nil && !os.IsNotExist(err) {
+			log.Warnf("can't remove '%s': %v", dumpPath, err)
+		}
+	}()
+	if err := ch.DumpTable(table.Database, table.Name, fileName, clickhouse.DumpFormat, structure); err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := os.Stat(dumpPath)
+	if os.IsNotExist(err) {
+		log.Debug("table is empty, nothing dumped")
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	partPath := path.Join(backupShadowPath(localBackupsPath(cfg, disk.Path), backupName, cfg.General.ShadowLayout, disk.Name, table.Database, table.Name), dumpPartName)
+	if err := ch.MkdirAll(partPath); err != nil {
+		return nil, nil, nil, err
+	}
+	dump := &metadata.DataDump{
+		Disk:      disk.Name,
+		Part:      dumpPartName,
+		File:      "data." + strings.ToLower(clickhouse.DumpFormat),
+		Format:    clickhouse.DumpFormat,
+		Structure: structure,
+	}
+	dstFile := path.Join(partPath, dump.File)
+	if err := moveFile(dumpPath, dstFile, info, cfg.General.VerifyCopiedParts); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ch.Chown(dstFile); err != nil {
+		return nil, nil, nil, err
+	}
+	log.WithField("size", info.Size()).Debug("dumped")
+	return map[string][]metadata.Part{disk.Name: {{Name: dumpPartName}}},
+		map[string]int64{disk.Name: info.Size()}, dump, nil
+}
+
+// restoreTableDump - link dump file of backup to user_files_path and insert its rows to dst table,
+// rows are appended, restore of not empty table duplicates them
+func restoreTableDump(cfg *config.Config, ch *clickhouse.ClickHouse, backupName, shadowLayout string, table metadata.TableMetadata, dst metadata.TableTitle, diskMap map[string]string) error {
+	dump := table.Dump
+	srcFile := path.Join(backupShadowPath(localBackupsPath(cfg, diskMap[dump.Disk]), backupName, shadowLayout, dump.Disk, table.Database, table.Table), dump.Part, dump.File)
+	userFilesPath, err := ch.GetUserFilesPath()
+	if err != nil {
+		return err
+	}
+	if err := ch.MkdirAll(userFilesPath); err != nil {
+		return err
+	}
+	fileName := dumpFileName(dst.Database, dst.Table)
+	dumpPath := path.Join(userFilesPath, fileName)
+	if err := os.Link(srcFile, dumpPath); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+		if err := copyPartFile(srcFile, dumpPath, false); err != nil {
+			return err
+		}
+		if err := ch.Chown(dumpPath); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err := os.Remove(dumpPath); err != nil {
+			apexLog.Warnf("can't remove '%s': %v", dumpPath, err)
+		}
+	}()
+	return ch.RestoreDump(dst.Database, dst.Table, fileName, dump.Format, dump.Structure)
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// offlineBackupPath - path of local backup when ClickHouse is not available to get default disk path,
+// disk_mapping.default is used when it is set
+func offlineBackupPath(cfg *config.Config, backupName string) string {
+	defaultDataPath := "/var/lib/clickhouse"
+	if diskPath, ok := cfg.ClickHouse.DiskMapping["default"]; ok {
+		defaultDataPath = diskPath
+	}
+	return path.Join(localBackupsPath(cfg, defaultDataPath), backupName)
+}
+
+// DumpSchema - write CREATE queries of databases and tables from local backup as runnable SQL script,
+// only backup files are read, ClickHouse connection is not required
+func DumpSchema(cfg *config.Config, backupName string, w io.Writer) error {
+	if backupName == "" {
+		return fmt.Errorf("backup name is required")
+	}
+	return dumpSchema(offlineBackupPath(cfg, backupName), w)
+}
+
+func dumpSchema(backupPath string, w io.Writer) error {
+	if _, err := os.Stat(path.Join(backupPath, DeletingMetaFileName)); err == nil {
+		return fmt.Errorf("'%s' is %s", path.Base(backupPath), BrokenPartiallyDeleted)
+	}
+	body, err := ioutil.ReadFile(path.Join(backupPath, MetaFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("'%s' is not found or is old format backup without %s", path.Base(backupPath), MetaFileName)
+		}
+		return err
+	}
+	var backupMetadata metadata.BackupMetadata
+	if err := json.Unmarshal(body, &backupMetadata); err != nil {
+		return fmt.Errorf("can't parse %s: %v", MetaFileName, err)
+	}
+	if backupMetadata.DataOnly {
+		return fmt.Errorf("'%s' is data only backup and doesn't contain schema", backupMetadata.BackupName)
+	}
+	tables, err := parseSchemaPattern(path.Join(backupPath, "metadata"), "*", false)
+	if err != nil {
+		return err
+	}
+	databases := make([]metadata.DatabasesMeta, len(backupMetadata.Databases))
+	copy(databases, backupMetadata.Databases)
+	sort.SliceStable(databases, func(i, j int) bool {
+		if databaseEngineOrder(databases[i].Engine) != databaseEngineOrder(databases[j].Engine) {
+			return databaseEngineOrder(databases[i].Engine) < databaseEngineOrder(databases[j].Engine)
+		}
+		return databases[i].Name < databases[j].Name
+	})
+
+	if _, err := fmt.Fprintf(w, "-- clickhouse-backup schema dump\n-- backup: %s\n-- created: %s\n\n", backupMetadata.BackupName, backupMetadata.CreationDate.Format(time.RFC3339)); err != nil {
+		return err
+	}
+	for _, database := range databases {
+		query := database.Query
+		if query == "" {
+			query = fmt.Sprintf("CREATE DATABASE `%s` ENGINE = %s", database.Name, database.Engine)
+		}
+		if _, err := fmt.Fprintf(w, "%s;\n\n", strings.TrimSpace(clickhouse.RemoveDatabaseUUID(query))); err != nil {
+			return err
+		}
+	}
+	for _, table := range tables {
+		if table.Query == "" {
+			continue
+		}
+		// same as restore, inner table of materialized view is created before view
+		query := strings.Replace(table.Query, "CREATE MATERIALIZED VIEW", "ATTACH MATERIALIZED VIEW", 1)
+		if _, err := fmt.Fprintf(w, "%s;\n\n", strings.TrimSpace(query)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
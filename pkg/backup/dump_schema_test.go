@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpSchema(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "clickhouse-backup-dump")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(backupPath, "metadata", "db"), 0750))
+	writeJSON := func(file string, v interface{}) {
+		body, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, file), body, 0640))
+	}
+	writeJSON(MetaFileName, metadata.BackupMetadata{
+		BackupName:   "test",
+		CreationDate: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		Databases: []metadata.DatabasesMeta{
+			{Name: "db", Engine: "Atomic", Query: "CREATE DATABASE db UUID 'abc' ENGINE = Atomic"},
+		},
+	})
+	writeJSON("metadata/db/dist.json", metadata.TableMetadata{Database: "db", Table: "dist", Query: "CREATE TABLE db.dist (`id` UInt64) ENGINE = Distributed('cluster', 'db', 'table')"})
+	writeJSON("metadata/db/table.json", metadata.TableMetadata{Database: "db", Table: "table", Query: "CREATE TABLE db.table (`id` UInt64) ENGINE = MergeTree ORDER BY id"})
+
+	var buf bytes.Buffer
+	require.NoError(t, dumpSchema(backupPath, &buf))
+	assert.Equal(t, "-- clickhouse-backup schema dump\n-- backup: test\n-- created: 2021-06-01T10:00:00Z\n\n"+
+		"CREATE DATABASE db ENGINE = Atomic;\n\n"+
+		"CREATE TABLE db.table (`id` UInt64) ENGINE = MergeTree ORDER BY id;\n\n"+
+		"CREATE TABLE db.dist (`id` UInt64) ENGINE = Distributed('cluster', 'db', 'table');\n\n", buf.String())
+
+	writeJSON(MetaFileName, metadata.BackupMetadata{BackupName: "test", DataOnly: true})
+	assert.Error(t, dumpSchema(backupPath, &buf))
+}
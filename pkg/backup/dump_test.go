@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDumpableEngine(t *testing.T) {
+	for _, engine := range []string{"Log", "TinyLog", "StripeLog", "Memory"} {
+		assert.True(t, isDumpableEngine(engine), engine)
+	}
+	for _, engine := range []string{"MergeTree", "Distributed", "Dictionary", "View", "Set", "Join", "Buffer"} {
+		assert.False(t, isDumpableEngine(engine), engine)
+	}
+}
+
+func TestDumpFileName(t *testing.T) {
+	name := dumpFileName("db-1", "table.1")
+	assert.True(t, strings.HasPrefix(name, "clickhouse-backup."))
+	assert.True(t, strings.HasSuffix(name, ".db%2D1.table%2E1.native"))
+	assert.NotEqual(t, name, dumpFileName("db-1", "table.1"))
+	assert.NotContains(t, name, "/")
+}
+
+func TestDryRunTablesDump(t *testing.T) {
+	disks := []clickhouse.Disk{{Name: "default", Path: "/var/lib/clickhouse/"}}
+	tables := []clickhouse.Table{
+		{Database: "db", Name: "dim", Engine: "TinyLog", DataPaths: []string{"/var/lib/clickhouse/data/db/dim/"}},
+		{Database: "db", Name: "dict", Engine: "Dictionary"},
+	}
+	result := dryRunTables(tables, disks, nil, false, true)
+	require.Len(t, result, 2)
+	assert.False(t, result[0].SchemaOnly)
+	assert.True(t, result[1].SchemaOnly)
+
+	result = dryRunTables(tables, disks, nil, false, false)
+	assert.True(t, result[0].SchemaOnly)
+}
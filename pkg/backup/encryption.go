@@ -0,0 +1,28 @@
+package backup
+
+import (
+	"fmt"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+)
+
+// checkBackupEncryption - data of encrypted remote backup can't be downloaded without key,
+// error is returned before any data file is downloaded instead of failing on the first archive
+func checkBackupEncryption(cfg *config.Config, backup metadata.BackupMetadata) error {
+	if backup.Encryption == "" {
+		return nil
+	}
+	if backup.Encryption != new_storage.EncryptionAlgorithm {
+		return fmt.Errorf("'%s' is encrypted by unsupported algorithm '%s'", backup.BackupName, backup.Encryption)
+	}
+	key, err := cfg.GetEncryptionKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("%w: '%s' is encrypted by %s", new_storage.ErrEncryptionKeyRequired, backup.BackupName, backup.Encryption)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package backup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBackupEncryption(t *testing.T) {
+	cfg := config.DefaultConfig()
+	assert.NoError(t, checkBackupEncryption(cfg, metadata.BackupMetadata{BackupName: "plain"}))
+	encrypted := metadata.BackupMetadata{BackupName: "encrypted", Encryption: new_storage.EncryptionAlgorithm}
+	err := checkBackupEncryption(cfg, encrypted)
+	assert.True(t, errors.Is(err, new_storage.ErrEncryptionKeyRequired))
+	assert.Contains(t, err.Error(), "'encrypted' is encrypted by aes-256-gcm")
+	cfg.General.EncryptionKey = strings.Repeat("ab", 32)
+	assert.NoError(t, checkBackupEncryption(cfg, encrypted))
+	assert.Error(t, checkBackupEncryption(cfg, metadata.BackupMetadata{BackupName: "other", Encryption: "chacha20"}))
+	cfg.General.EncryptionKey = "abcd"
+	assert.Error(t, checkBackupEncryption(cfg, encrypted))
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+)
+
+// EngineSelector - TableSelector which keeps only tables with engine matched by globs, e.g. "*MergeTree",
+// globs with leading "!" exclude engines, e.g. "!Distributed", every item can be comma separated list.
+// It is applied together with table pattern, so table must match both
+func EngineSelector(engines []string) (TableSelector, error) {
+	var patterns []string
+	for _, engine := range engines {
+		for _, pattern := range strings.Split(engine, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := filepath.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+				return nil, fmt.Errorf("invalid engine pattern '%s': %v", pattern, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	matcher := newTableMatcher(strings.Join(patterns, ","))
+	return func(tables []clickhouse.Table) ([]clickhouse.Table, error) {
+		var result []clickhouse.Table
+		for _, t := range tables {
+			if matcher.match(t.Engine) {
+				result = append(result, t)
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// ChainSelectors - TableSelector which applies selectors one after another, nil selectors are ignored
+func ChainSelectors(selectors ...TableSelector) TableSelector {
+	var chain []TableSelector
+	for _, selector := range selectors {
+		if selector != nil {
+			chain = append(chain, selector)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return func(tables []clickhouse.Table) ([]clickhouse.Table, error) {
+		var err error
+		for _, selector := range chain {
+			if tables, err = selector(tables); err != nil {
+				return nil, err
+			}
+		}
+		return tables, nil
+	}
+}
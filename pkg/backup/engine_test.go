@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngineSelector(t *testing.T) {
+	tables := []clickhouse.Table{
+		{Database: "db", Name: "events", Engine: "MergeTree"},
+		{Database: "db", Name: "events_replicated", Engine: "ReplicatedMergeTree"},
+		{Database: "db", Name: "events_distributed", Engine: "Distributed"},
+		{Database: "db", Name: "log", Engine: "TinyLog"},
+	}
+	names := func(engines ...string) []string {
+		selector, err := EngineSelector(engines)
+		require.NoError(t, err)
+		if selector == nil {
+			return nil
+		}
+		selected, err := selector(tables)
+		require.NoError(t, err)
+		var result []string
+		for _, table := range selected {
+			result = append(result, table.Name)
+		}
+		return result
+	}
+	assert.Nil(t, names())
+	assert.Nil(t, names(""))
+	assert.Equal(t, []string{"events", "events_replicated"}, names("*MergeTree"))
+	assert.Equal(t, []string{"events_replicated"}, names("Replicated*"))
+	assert.Equal(t, []string{"events", "events_replicated", "log"}, names("!Distributed"))
+	assert.Equal(t, []string{"events", "log"}, names("MergeTree,TinyLog"))
+	assert.Equal(t, []string{"events", "log"}, names("MergeTree", "TinyLog"))
+	assert.Equal(t, []string{"events"}, names("*MergeTree", "!Replicated*"))
+
+	_, err := EngineSelector([]string{"[MergeTree"})
+	assert.Error(t, err)
+}
+
+func TestChainSelectors(t *testing.T) {
+	assert.Nil(t, ChainSelectors(nil, nil))
+	tables := []clickhouse.Table{
+		{Database: "db", Name: "events", Engine: "MergeTree"},
+		{Database: "db", Name: "events_distributed", Engine: "Distributed"},
+	}
+	engineSelector, err := EngineSelector([]string{"*MergeTree"})
+	require.NoError(t, err)
+	nameSelector := func(tables []clickhouse.Table) ([]clickhouse.Table, error) {
+		return filterTablesByPattern(tables, "db.events*", nil), nil
+	}
+	selected, err := ChainSelectors(nil, nameSelector, engineSelector)(tables)
+	require.NoError(t, err)
+	assert.Equal(t, tables[:1], selected)
+}
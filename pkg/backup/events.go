@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackupEvent - state of backup passed to EventHandler
+type BackupEvent struct {
+	BackupName string
+	// Table - "<db>.<table>", set only for OnTableDone
+	Table       string
+	TablesTotal int
+	TablesDone  int
+	// Bytes - data size of table for OnTableDone, of all finished tables for OnBackupDone and OnBackupError
+	Bytes int64
+	// Duration - time since OnBackupStart
+	Duration time.Duration
+}
+
+// EventHandler - receives lifecycle events of CreateBackup for external monitoring,
+// OnTableDone is called from table workers and must be safe for concurrent use
+type EventHandler interface {
+	OnBackupStart(event BackupEvent)
+	OnTableDone(event BackupEvent)
+	OnBackupDone(event BackupEvent)
+	OnBackupError(event BackupEvent, err error)
+}
+
+// NopEventHandler - default EventHandler, ignores all events
+type NopEventHandler struct{}
+
+func (NopEventHandler) OnBackupStart(BackupEvent)        {}
+func (NopEventHandler) OnTableDone(BackupEvent)          {}
+func (NopEventHandler) OnBackupDone(BackupEvent)         {}
+func (NopEventHandler) OnBackupError(BackupEvent, error) {}
+
+var (
+	eventHandlerMu sync.RWMutex
+	eventHandler   EventHandler = NopEventHandler{}
+)
+
+// SetEventHandler - set handler of events of all following backups, nil restores NopEventHandler
+func SetEventHandler(handler EventHandler) {
+	if handler == nil {
+		handler = NopEventHandler{}
+	}
+	eventHandlerMu.Lock()
+	defer eventHandlerMu.Unlock()
+	eventHandler = handler
+}
+
+func getEventHandler() EventHandler {
+	eventHandlerMu.RLock()
+	defer eventHandlerMu.RUnlock()
+	return eventHandler
+}
+
+// EventCounters - totals of events counted by CounterEventHandler
+type EventCounters struct {
+	BackupsStarted int64
+	BackupsDone    int64
+	BackupsFailed  int64
+	TablesDone     int64
+	BytesDone      int64
+}
+
+// CounterEventHandler - EventHandler which only counts events, counters can be read at any time and scraped by monitoring
+type CounterEventHandler struct {
+	counters EventCounters
+}
+
+func (h *CounterEventHandler) OnBackupStart(BackupEvent) {
+	atomic.AddInt64(&h.counters.BackupsStarted, 1)
+}
+
+func (h *CounterEventHandler) OnTableDone(event BackupEvent) {
+	atomic.AddInt64(&h.counters.TablesDone, 1)
+	atomic.AddInt64(&h.counters.BytesDone, event.Bytes)
+}
+
+func (h *CounterEventHandler) OnBackupDone(BackupEvent) {
+	atomic.AddInt64(&h.counters.BackupsDone, 1)
+}
+
+func (h *CounterEventHandler) OnBackupError(BackupEvent, error) {
+	atomic.AddInt64(&h.counters.BackupsFailed, 1)
+}
+
+// Counters - current values of counters
+func (h *CounterEventHandler) Counters() EventCounters {
+	return EventCounters{
+		BackupsStarted: atomic.LoadInt64(&h.counters.BackupsStarted),
+		BackupsDone:    atomic.LoadInt64(&h.counters.BackupsDone),
+		BackupsFailed:  atomic.LoadInt64(&h.counters.BackupsFailed),
+		TablesDone:     atomic.LoadInt64(&h.counters.TablesDone),
+		BytesDone:      atomic.LoadInt64(&h.counters.BytesDone),
+	}
+}
@@ -0,0 +1,28 @@
+package backup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterEventHandler(t *testing.T) {
+	events := &CounterEventHandler{}
+	events.OnBackupStart(BackupEvent{BackupName: "b1", TablesTotal: 2})
+	events.OnTableDone(BackupEvent{BackupName: "b1", Table: "db.t1", Bytes: 100})
+	events.OnTableDone(BackupEvent{BackupName: "b1", Table: "db.t2", Bytes: 50})
+	events.OnBackupDone(BackupEvent{BackupName: "b1", TablesDone: 2, Bytes: 150})
+	events.OnBackupStart(BackupEvent{BackupName: "b2"})
+	events.OnBackupError(BackupEvent{BackupName: "b2"}, errors.New("failed"))
+	assert.Equal(t, EventCounters{BackupsStarted: 2, BackupsDone: 1, BackupsFailed: 1, TablesDone: 2, BytesDone: 150}, events.Counters())
+}
+
+func TestSetEventHandler(t *testing.T) {
+	defer SetEventHandler(nil)
+	events := &CounterEventHandler{}
+	SetEventHandler(events)
+	assert.Equal(t, events, getEventHandler())
+	SetEventHandler(nil)
+	assert.Equal(t, NopEventHandler{}, getEventHandler())
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"os"
+	"path"
+	"sort"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+)
+
+const partChecksumsFileName = "checksums.txt"
+
+// getLiveChecksums - SHA256 of checksums.txt of active parts of table, ATTACH PART assigns new block numbers,
+// so already restored part is recognized by content of checksums.txt and not only by name
+func getLiveChecksums(ch *clickhouse.ClickHouse, database, table string) (map[string]string, error) {
+	parts, err := ch.GetActiveParts(database, table)
+	if err != nil {
+		return nil, err
+	}
+	checksums := map[string]string{}
+	for _, part := range parts {
+		sum, err := fileSHA256(path.Join(part.Path, partChecksumsFileName))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				apexLog.Warnf("can't read %s of part '%s': %v", partChecksumsFileName, part.Name, err)
+			}
+			continue
+		}
+		checksums[sum] = part.Name
+	}
+	return checksums, nil
+}
+
+// partExists - checksums.txt of part in partPath is the same as of one of active parts
+func partExists(partPath string, liveChecksums map[string]string) bool {
+	if len(liveChecksums) == 0 {
+		return false
+	}
+	sum, err := fileSHA256(path.Join(partPath, partChecksumsFileName))
+	if err != nil {
+		return false
+	}
+	_, ok := liveChecksums[sum]
+	return ok
+}
+
+// skipExistingParts - remove parts which are already active in destination table from table.Parts and return them,
+// partsPath returns directory with parts of disk in backup
+func skipExistingParts(table *metadata.TableMetadata, partsPath func(disk string) string, liveChecksums map[string]string) []string {
+	var skipped []string
+	if len(liveChecksums) == 0 {
+		return skipped
+	}
+	for disk, parts := range table.Parts {
+		kept := make([]metadata.Part, 0, len(parts))
+		for _, part := range parts {
+			if partExists(path.Join(partsPath(disk), part.Name), liveChecksums) {
+				skipped = append(skipped, disk+"/"+part.Name)
+				continue
+			}
+			kept = append(kept, part)
+		}
+		table.Parts[disk] = kept
+	}
+	sort.Strings(skipped)
+	return skipped
+}
+
+func countParts(table metadata.TableMetadata) int {
+	count := 0
+	for _, parts := range table.Parts {
+		count += len(parts)
+	}
+	return count
+}
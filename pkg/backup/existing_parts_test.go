@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipExistingParts(t *testing.T) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-existing-parts")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	writePart := func(dir, name, checksums string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir, name), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, dir, name, partChecksumsFileName), []byte(checksums), 0640))
+	}
+	writePart("backup", "all_1_1_0", "part1")
+	writePart("backup", "all_2_2_0", "part2")
+	writePart("backup", "all_3_3_0", "part3")
+	// all_1_1_0 was attached with new block number, all_2_2_0 has the same name but another data
+	writePart("live", "all_4_4_0", "part1")
+	writePart("live", "all_2_2_0", "other")
+	liveChecksums := map[string]string{}
+	for _, name := range []string{"all_4_4_0", "all_2_2_0"} {
+		sum, err := fileSHA256(filepath.Join(root, "live", name, partChecksumsFileName))
+		require.NoError(t, err)
+		liveChecksums[sum] = name
+	}
+
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "table",
+		Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}, {Name: "all_3_3_0"}, {Name: "all_5_5_0"}},
+		},
+	}
+	partsPath := func(disk string) string { return filepath.Join(root, "backup") }
+	skipped := skipExistingParts(&table, partsPath, liveChecksums)
+	assert.Equal(t, []string{"default/all_1_1_0"}, skipped)
+	assert.Equal(t, []metadata.Part{{Name: "all_2_2_0"}, {Name: "all_3_3_0"}, {Name: "all_5_5_0"}}, table.Parts["default"])
+	assert.Equal(t, 3, countParts(table))
+
+	assert.Empty(t, skipExistingParts(&table, partsPath, nil))
+	assert.Equal(t, 3, countParts(table))
+}
@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// AllowFaultInjectionEnv - restore --drop-part-fraction is refused unless this variable is "true"
+const AllowFaultInjectionEnv = "CLICKHOUSE_BACKUP_ALLOW_FAULT_INJECTION"
+
+// checkDropPartFraction - fault injection loses data on purpose, so it requires explicit opt-in by environment
+func checkDropPartFraction(fraction float64) error {
+	if fraction == 0 {
+		return nil
+	}
+	if fraction < 0 || fraction > 1 {
+		return fmt.Errorf("drop part fraction must be from 0 to 1, got %v", fraction)
+	}
+	if os.Getenv(AllowFaultInjectionEnv) != "true" {
+		return fmt.Errorf("drop part fraction is for fault injection testing only, set %s=true to allow it", AllowFaultInjectionEnv)
+	}
+	return nil
+}
+
+// dropParts - remove fraction of parts from table, part is dropped by FNV-1a hash of backup, table and part names,
+// so the same backup always loses the same parts. Return names of dropped parts as "disk/part"
+func dropParts(backupName string, table *metadata.TableMetadata, fraction float64) []string {
+	var dropped []string
+	if fraction == 0 {
+		return dropped
+	}
+	for disk, parts := range table.Parts {
+		kept := make([]metadata.Part, 0, len(parts))
+		for _, part := range parts {
+			h := fnv.New64a()
+			h.Write([]byte(fmt.Sprintf("%s/%s.%s/%s", backupName, table.Database, table.Table, part.Name)))
+			if float64(h.Sum64())/math.MaxUint64 < fraction {
+				dropped = append(dropped, fmt.Sprintf("%s/%s", disk, part.Name))
+				continue
+			}
+			kept = append(kept, part)
+		}
+		table.Parts[disk] = kept
+	}
+	sort.Strings(dropped)
+	return dropped
+}
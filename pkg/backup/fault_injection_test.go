@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFaultInjectionTable() metadata.TableMetadata {
+	parts := make([]metadata.Part, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		parts = append(parts, metadata.Part{Name: fmt.Sprintf("all_%d_%d_0", i, i)})
+	}
+	return metadata.TableMetadata{
+		Database: "db",
+		Table:    "table",
+		Parts:    map[string][]metadata.Part{"default": parts},
+	}
+}
+
+func TestDropParts(t *testing.T) {
+	table := newFaultInjectionTable()
+	dropped := dropParts("backup", &table, 0.1)
+	assert.InDelta(t, 100, len(dropped), 40)
+	assert.Len(t, table.Parts["default"], 1000-len(dropped))
+
+	again := newFaultInjectionTable()
+	assert.Equal(t, dropped, dropParts("backup", &again, 0.1))
+
+	table = newFaultInjectionTable()
+	assert.Empty(t, dropParts("backup", &table, 0))
+	assert.Len(t, table.Parts["default"], 1000)
+}
+
+func TestCheckDropPartFraction(t *testing.T) {
+	os.Unsetenv(AllowFaultInjectionEnv)
+	assert.NoError(t, checkDropPartFraction(0))
+	assert.Error(t, checkDropPartFraction(0.01))
+	os.Setenv(AllowFaultInjectionEnv, "true")
+	defer os.Unsetenv(AllowFaultInjectionEnv)
+	assert.NoError(t, checkDropPartFraction(0.01))
+	assert.Error(t, checkDropPartFraction(1.5))
+}
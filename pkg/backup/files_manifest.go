@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+)
+
+// FilesManifestName - every part file of backup with its size, "<size>  <disk>  <path>" per line,
+// path is relative to backup directory of disk
+const FilesManifestName = "files.txt"
+
+type manifestFile struct {
+	Disk string
+	Path string
+	Size int64
+}
+
+// writeFilesManifest - walk shadow of backup on every disk after all tables are moved,
+// files of tables removed by general.continue_on_error are not listed
+func writeFilesManifest(cfg *config.Config, backupPath, backupName string, diskMap map[string]string, chown func(string) error) error {
+	manifestPath := path.Join(backupPath, FilesManifestName)
+	f, err := os.OpenFile(manifestPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("can't create %s: %v", FilesManifestName, err)
+	}
+	w := bufio.NewWriter(f)
+	diskNames := make([]string, 0, len(diskMap))
+	for diskName := range diskMap {
+		diskNames = append(diskNames, diskName)
+	}
+	sort.Strings(diskNames)
+	walked := map[string]struct{}{}
+	for _, diskName := range diskNames {
+		diskBackupPath := path.Join(localBackupsPath(cfg, diskMap[diskName]), backupName)
+		// all disks share one directory with general.backup_dir
+		if _, ok := walked[diskBackupPath]; ok {
+			continue
+		}
+		walked[diskBackupPath] = struct{}{}
+		shadowPath := path.Join(diskBackupPath, "shadow")
+		err = filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && filePath == shadowPath {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			relativePath, err := filepath.Rel(diskBackupPath, filePath)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%d  %s  %s\n", info.Size(), diskName, filepath.ToSlash(relativePath))
+			return err
+		})
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("can't write %s: %v", FilesManifestName, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("can't write %s: %v", FilesManifestName, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("can't write %s: %v", FilesManifestName, err)
+	}
+	return chown(manifestPath)
+}
+
+func readFilesManifest(backupPath string) ([]manifestFile, error) {
+	f, err := os.Open(path.Join(backupPath, FilesManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s not found, backup was created by older version", FilesManifestName)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return parseFilesManifest(f)
+}
+
+func parseFilesManifest(r io.Reader) ([]manifestFile, error) {
+	var files []manifestFile
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "  ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("can't parse %s: malformed line '%s'", FilesManifestName, line)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse %s: malformed line '%s'", FilesManifestName, line)
+		}
+		files = append(files, manifestFile{Disk: fields[1], Path: fields[2], Size: size})
+	}
+	return files, scanner.Err()
+}
+
+// verifyFilesManifest - every file of files.txt exists with recorded size, problems are sorted
+func verifyFilesManifest(cfg *config.Config, backupPath, backupName string, diskMap map[string]string) ([]string, error) {
+	files, err := readFilesManifest(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, file := range files {
+		diskPath, ok := diskMap[file.Disk]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("'%s' is on unknown disk '%s'", file.Path, file.Disk))
+			continue
+		}
+		problem, err := checkManifestFile(path.Join(localBackupsPath(cfg, diskPath), backupName), file)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checkManifestFile - empty problem when file exists inside backupPath with size from files.txt
+func checkManifestFile(backupPath string, file manifestFile) (string, error) {
+	info, err := os.Stat(path.Join(backupPath, file.Path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		return fmt.Sprintf("'%s' on disk '%s' is missing", file.Path, file.Disk), nil
+	}
+	if info.Size() != file.Size {
+		return fmt.Sprintf("'%s' on disk '%s' has size %d, expected %d", file.Path, file.Disk, info.Size(), file.Size), nil
+	}
+	return "", nil
+}
+
+// tableManifestFiles - files of table on disk, directory of table depends on shadow layout of backup
+func tableManifestFiles(files []manifestFile, shadowLayout, disk, database, table string) []manifestFile {
+	prefix := clickhouse.ShadowPath(shadowLayout, disk, database, table) + "/"
+	var result []manifestFile
+	for _, file := range files {
+		if strings.HasPrefix(file.Path, prefix) {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// saveFilesManifest - write files.txt of downloaded backup which lists only downloaded tables
+func saveFilesManifest(manifestPath string, files []manifestFile, chown func(string) error) error {
+	var body strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&body, "%d  %s  %s\n", file.Size, file.Disk, file.Path)
+	}
+	if err := ioutil.WriteFile(manifestPath, []byte(body.String()), 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", FilesManifestName, err)
+	}
+	return chown(manifestPath)
+}
+
+// downloadFilesManifest - read FilesManifestName of remote backup, nil is returned for backups uploaded without it,
+// storages report missing file differently, so read errors are ignored
+func (b *Backuper) downloadFilesManifest(backupName string) []manifestFile {
+	reader, err := b.dst.GetFileReader(path.Join(backupName, FilesManifestName))
+	if err != nil {
+		apexLog.Debugf("%s is not downloaded: %v", FilesManifestName, err)
+		return nil
+	}
+	defer reader.Close()
+	files, err := parseFilesManifest(reader)
+	if err != nil {
+		apexLog.Warnf("%s is not used: %v", FilesManifestName, err)
+		return nil
+	}
+	return files
+}
+
+// VerifyBackupFiles - check part files of local backup against files.txt without ClickHouse connection,
+// missing and truncated files are reported, disks are taken from metadata.json
+func VerifyBackupFiles(cfg *config.Config, backupName string) error {
+	if backupName == "" {
+		return fmt.Errorf("backup name is required")
+	}
+	return verifyBackupFiles(cfg, offlineBackupPath(cfg, backupName), backupName)
+}
+
+func verifyBackupFiles(cfg *config.Config, backupPath, backupName string) error {
+	body, err := ioutil.ReadFile(path.Join(backupPath, MetaFileName))
+	if err != nil {
+		return err
+	}
+	var backupMetadata metadata.BackupMetadata
+	if err := json.Unmarshal(body, &backupMetadata); err != nil {
+		return fmt.Errorf("can't parse %s: %v", MetaFileName, err)
+	}
+	problems, err := verifyFilesManifest(cfg, backupPath, backupName, backupMetadata.Disks)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("backup files are damaged: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
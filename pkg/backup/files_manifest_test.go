@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	diskMap := map[string]string{"default": path.Join(root, "default"), "hdd": path.Join(root, "hdd")}
+	backupPath := path.Join(diskMap["default"], "backup", "b1")
+	files := map[string]string{
+		path.Join(backupPath, "shadow", "db", "t1", "default", "all_1_1_0", "data.bin"):                 "data",
+		path.Join(backupPath, "shadow", "db", "t1", "default", "all_1_1_0", "checksums.txt"):            "checksums",
+		path.Join(diskMap["hdd"], "backup", "b1", "shadow", "db", "t1", "hdd", "all_2_2_0", "data.bin"): "hdd data",
+		path.Join(backupPath, "metadata", "db", "t1.json"):                                              "{}",
+	}
+	for filePath, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0750))
+		require.NoError(t, ioutil.WriteFile(filePath, []byte(content), 0640))
+	}
+	body, err := json.Marshal(metadata.BackupMetadata{BackupName: "b1", Disks: diskMap})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(backupPath, MetaFileName), body, 0640))
+
+	var chowned []string
+	cfg := config.DefaultConfig()
+	require.NoError(t, writeFilesManifest(cfg, backupPath, "b1", diskMap, func(name string) error {
+		chowned = append(chowned, name)
+		return nil
+	}))
+	assert.Equal(t, []string{path.Join(backupPath, FilesManifestName)}, chowned)
+	manifest, err := readFilesManifest(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, []manifestFile{
+		{Disk: "default", Path: "shadow/db/t1/default/all_1_1_0/checksums.txt", Size: 9},
+		{Disk: "default", Path: "shadow/db/t1/default/all_1_1_0/data.bin", Size: 4},
+		{Disk: "hdd", Path: "shadow/db/t1/hdd/all_2_2_0/data.bin", Size: 8},
+	}, manifest)
+	assert.NoError(t, verifyBackupFiles(cfg, backupPath, "b1"))
+
+	require.NoError(t, os.Truncate(path.Join(backupPath, "shadow", "db", "t1", "default", "all_1_1_0", "data.bin"), 1))
+	require.NoError(t, os.Remove(path.Join(diskMap["hdd"], "backup", "b1", "shadow", "db", "t1", "hdd", "all_2_2_0", "data.bin")))
+	problems, err := verifyFilesManifest(cfg, backupPath, "b1", diskMap)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"'shadow/db/t1/default/all_1_1_0/data.bin' on disk 'default' has size 1, expected 4",
+		"'shadow/db/t1/hdd/all_2_2_0/data.bin' on disk 'hdd' is missing",
+	}, problems)
+	assert.Error(t, verifyBackupFiles(cfg, backupPath, "b1"))
+
+	require.NoError(t, os.Remove(path.Join(backupPath, FilesManifestName)))
+	_, err = readFilesManifest(backupPath)
+	assert.EqualError(t, err, "files.txt not found, backup was created by older version")
+}
+
+func TestTableManifestFiles(t *testing.T) {
+	files := []manifestFile{
+		{Disk: "default", Path: "shadow/db/t1/default/all_1_1_0/data.bin", Size: 4},
+		{Disk: "hdd", Path: "shadow/db/t1/hdd/all_2_2_0/data.bin", Size: 8},
+		{Disk: "default", Path: "shadow/db/t10/default/all_1_1_0/data.bin", Size: 2},
+	}
+	assert.Equal(t, files[:1], tableManifestFiles(files, "", "default", "db", "t1"))
+	assert.Equal(t, files[1:2], tableManifestFiles(files, "", "hdd", "db", "t1"))
+	assert.Empty(t, tableManifestFiles(files, "", "default", "db", "t2"))
+	assert.Empty(t, tableManifestFiles(nil, "", "default", "db", "t1"))
+
+	root, err := ioutil.TempDir("", "clickhouse-backup-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.MkdirAll(path.Join(root, "shadow/db/t1/default/all_1_1_0"), 0750))
+	require.NoError(t, ioutil.WriteFile(path.Join(root, files[0].Path), []byte("data"), 0640))
+	problem, err := checkManifestFile(root, files[0])
+	require.NoError(t, err)
+	assert.Empty(t, problem)
+	problem, err = checkManifestFile(root, manifestFile{Disk: "default", Path: files[0].Path, Size: 5})
+	require.NoError(t, err)
+	assert.Contains(t, problem, "has size 4, expected 5")
+	problem, err = checkManifestFile(root, files[2])
+	require.NoError(t, err)
+	assert.Contains(t, problem, "is missing")
+
+	// downloaded backup keeps only files of downloaded tables
+	require.NoError(t, saveFilesManifest(path.Join(root, FilesManifestName), files[:2], func(string) error { return nil }))
+	saved, err := readFilesManifest(root)
+	require.NoError(t, err)
+	assert.Equal(t, files[:2], saved)
+}
+
+func TestDuplicatePartResumed(t *testing.T) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	exists := path.Join(root, "base", "all_1_1_0")
+	require.NoError(t, os.MkdirAll(exists, 0750))
+	require.NoError(t, ioutil.WriteFile(path.Join(exists, "data.bin"), []byte("data"), 0640))
+	newPath := path.Join(root, "increment", "all_1_1_0")
+	require.NoError(t, duplicatePart(exists, newPath))
+	require.NoError(t, duplicatePart(exists, newPath))
+	assert.FileExists(t, path.Join(newPath, "data.bin"))
+}
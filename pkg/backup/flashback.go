@@ -33,7 +33,7 @@ func CopyPartHashes(cfg config.Config, tablePattern string, backupName string) e
 	if err != nil {
 		return fmt.Errorf("can't get tables from clickhouse: %v", err)
 	}
-	backupTables := filterTablesByPattern(allTables, tablePattern)
+	backupTables := filterTablesByPattern(allTables, tablePattern, cfg.General.SkipDatabases)
 	if len(backupTables) == 0 {
 		return fmt.Errorf("there are no tables in clickhouse, create something to freeze")
 	}
@@ -55,7 +55,7 @@ func CopyPartHashes(cfg config.Config, tablePattern string, backupName string) e
 	if err != nil {
 		return err
 	}
-	hashPartsPath := path.Join(dataPath, "backup", backupName, hashfile)
+	hashPartsPath := path.Join(localBackupsPath(&cfg, dataPath), backupName, hashfile)
 	return ioutil.WriteFile(hashPartsPath, byteArray, 0644)
 }
 
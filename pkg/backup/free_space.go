@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/utils"
+)
+
+// getRequiredDiskSpace - total_bytes of tables with data by disk, size of table on several disks
+// is unknown by disk, so it is counted on each of them
+func getRequiredDiskSpace(disks []clickhouse.Disk, tables []clickhouse.Table, schemaOnly bool, skippedDisks []string) map[string]int64 {
+	required := map[string]int64{}
+	if schemaOnly {
+		return required
+	}
+	for i := range tables {
+		if tables[i].Skip || tables[i].SchemaOnly || getSkippedTableDisk(disks, &tables[i], skippedDisks) != "" {
+			continue
+		}
+		for diskName := range clickhouse.GetDisksByPaths(disks, tables[i].DataPaths) {
+			required[diskName] += tables[i].TotalBytes.Int64
+		}
+	}
+	return required
+}
+
+// checkFreeSpace - fail before FREEZE when available space of disk is less than size of tables on it,
+// object storage disks keep only metadata locally and are not checked
+func checkFreeSpace(disks []clickhouse.Disk, required map[string]int64, getAvailable func(path string) (uint64, error)) error {
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, disk := range disks {
+			if disk.Name != name || disk.IsObjectStorage() {
+				continue
+			}
+			available, err := getAvailable(disk.Path)
+			if err != nil {
+				return fmt.Errorf("can't get free space of disk '%s': %v", disk.Name, err)
+			}
+			if uint64(required[name]) > available {
+				return fmt.Errorf("insufficient space on disk %s: need %s have %s", disk.Name, utils.FormatBytes(required[name]), utils.FormatBytes(int64(available)))
+			}
+		}
+	}
+	return nil
+}
+
+// checkBackupDirFreeSpace - with general.backup_dir parts of all local disks are moved to one directory,
+// so its available space must be enough for sum of them
+func checkBackupDirFreeSpace(backupDir string, disks []clickhouse.Disk, required map[string]int64, getAvailable func(path string) (uint64, error)) error {
+	total := int64(0)
+	for _, disk := range disks {
+		if !disk.IsObjectStorage() {
+			total += required[disk.Name]
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	available, err := getAvailable(backupDir)
+	if err != nil {
+		return fmt.Errorf("can't get free space of '%s': %v", backupDir, err)
+	}
+	if uint64(total) > available {
+		return fmt.Errorf("insufficient space in %s: need %s have %s", backupDir, utils.FormatBytes(total), utils.FormatBytes(int64(available)))
+	}
+	return nil
+}
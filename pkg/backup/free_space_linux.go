@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package backup
+
+import "syscall"
+
+// getAvailableSpace - bytes available for unprivileged user on filesystem of path
+func getAvailableSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package backup
+
+import "fmt"
+
+// getAvailableSpace - statfs is used only on Linux
+func getAvailableSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("check_free_space is supported only on Linux")
+}
@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFreeSpace(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/"},
+		{Name: "cold", Path: "/mnt/cold/"},
+		{Name: "s3", Path: "/var/lib/clickhouse/disks/s3/", Type: "s3"},
+	}
+	tables := []clickhouse.Table{
+		{Name: "t1", TotalBytes: sql.NullInt64{Int64: 100, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/data/db/t1/"}},
+		{Name: "t2", TotalBytes: sql.NullInt64{Int64: 200, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/data/db/t2/", "/mnt/cold/data/db/t2/"}},
+		{Name: "t3", TotalBytes: sql.NullInt64{Int64: 1000, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/data/db/t3/"}, Skip: true},
+		{Name: "t4", TotalBytes: sql.NullInt64{Int64: 1000, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/data/db/t4/"}, SchemaOnly: true},
+		{Name: "t5", TotalBytes: sql.NullInt64{Int64: 5000, Valid: true}, DataPaths: []string{"/var/lib/clickhouse/disks/s3/data/db/t5/"}},
+	}
+	required := getRequiredDiskSpace(disks, tables, false, nil)
+	assert.Equal(t, map[string]int64{"default": 300, "cold": 200, "s3": 5000}, required)
+	assert.Empty(t, getRequiredDiskSpace(disks, tables, true, nil))
+	assert.Equal(t, map[string]int64{"default": 100}, getRequiredDiskSpace(disks, tables, false, []string{"cold", "s3"}))
+
+	available := map[string]uint64{"/var/lib/clickhouse/": 300, "/mnt/cold/": 199}
+	getAvailable := func(path string) (uint64, error) { return available[path], nil }
+	err := checkFreeSpace(disks, required, getAvailable)
+	assert.EqualError(t, err, "insufficient space on disk cold: need 200B have 199B")
+
+	available["/mnt/cold/"] = 200
+	assert.NoError(t, checkFreeSpace(disks, required, getAvailable))
+
+	assert.Error(t, checkFreeSpace(disks, required, func(path string) (uint64, error) { return 0, errors.New("statfs failed") }))
+
+	// general.backup_dir holds parts of default and cold, s3 is not counted
+	available["/backup/"] = 499
+	assert.EqualError(t, checkBackupDirFreeSpace("/backup/", disks, required, getAvailable), "insufficient space in /backup/: need 500B have 499B")
+	available["/backup/"] = 500
+	assert.NoError(t, checkBackupDirFreeSpace("/backup/", disks, required, getAvailable))
+	assert.NoError(t, checkBackupDirFreeSpace("/backup/", disks, map[string]int64{"s3": 5000}, getAvailable))
+}
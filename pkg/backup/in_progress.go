@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// InProgressFileName - marker which exists in backup directory while create is running,
+// monitoring can check it without parsing logs
+const InProgressFileName = ".in-progress"
+
+// InProgressMarker - content of InProgressFileName, pid alone identifies process only on the same host,
+// in containers pid is reused after restart, so hostname and start time of process are recorded too
+type InProgressMarker struct {
+	BackupName string    `json:"backup_name"`
+	StartTime  time.Time `json:"start_time"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	// ProcessStartTime - start time of process from /proc/<pid>/stat, empty when /proc is not available
+	ProcessStartTime string `json:"process_start_time,omitempty"`
+	// Stale - process which created marker is not alive, backup is abandoned, it is not stored in marker
+	Stale bool `json:"stale"`
+}
+
+func (m InProgressMarker) String() string {
+	if m.Stale {
+		return fmt.Sprintf("in progress, abandoned by pid %d on %s", m.PID, m.Hostname)
+	}
+	return fmt.Sprintf("in progress, pid %d on %s", m.PID, m.Hostname)
+}
+
+// newInProgressMarker - marker of current process
+func newInProgressMarker(backupName string) InProgressMarker {
+	hostname, _ := os.Hostname()
+	pid := os.Getpid()
+	return InProgressMarker{
+		BackupName:       backupName,
+		StartTime:        time.Now().UTC(),
+		Hostname:         hostname,
+		PID:              pid,
+		ProcessStartTime: getProcessStartTime(pid),
+	}
+}
+
+// isMarkerProcessAlive - marker of other host or of process which started at other time is stale,
+// e.g. container was restarted and its new process got the same pid
+func isMarkerProcessAlive(m InProgressMarker) bool {
+	if hostname, err := os.Hostname(); err != nil || m.Hostname != hostname {
+		return false
+	}
+	if !isProcessAlive(m.PID) {
+		return false
+	}
+	return m.ProcessStartTime == "" || m.ProcessStartTime == getProcessStartTime(m.PID)
+}
+
+// createBackupDir - create directory of new backup and take in-progress marker as lock, both are created
+// exclusively, so concurrent create with the same name fails with "already exists" or "is already being created".
+// Directory without metadata.json and marker of alive process is left by failed create and is reused
+func createBackupDir(backupPath, backupName string, chown func(string) error) error {
+	if err := os.Mkdir(backupPath, 0750); err == nil {
+		if err := chown(backupPath); err != nil {
+			return err
+		}
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("can't create directory %s: %v", backupPath, err)
+	} else if isBackupComplete(backupPath) {
+		return fmt.Errorf("'%s' already exists", backupName)
+	}
+	if err := writeInProgressMarker(backupPath, backupName, chown); err != nil {
+		return err
+	}
+	// concurrent create could finish between Mkdir and marker
+	if isBackupComplete(backupPath) {
+		if err := removeInProgressMarker(backupPath); err != nil {
+			return err
+		}
+		return fmt.Errorf("'%s' already exists", backupName)
+	}
+	return nil
+}
+
+func isBackupComplete(backupPath string) bool {
+	_, err := os.Stat(path.Join(backupPath, MetaFileName))
+	return err == nil || !os.IsNotExist(err)
+}
+
+// writeInProgressMarker - create marker exclusively, marker of alive process means that backup is already being created,
+// marker of abandoned create is replaced
+func writeInProgressMarker(backupPath, backupName string, chown func(string) error) error {
+	body, err := json.Marshal(newInProgressMarker(backupName))
+	if err != nil {
+		return err
+	}
+	markerFile := path.Join(backupPath, InProgressFileName)
+	f, err := os.OpenFile(markerFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if os.IsExist(err) {
+		existing, readErr := readInProgressMarker(backupPath)
+		if readErr != nil {
+			// marker is being written by concurrent create
+			return fmt.Errorf("'%s' is already being created: %v", backupName, readErr)
+		}
+		if existing != nil && !existing.Stale {
+			return fmt.Errorf("'%s' is already being created by pid %d on %s since %s", backupName, existing.PID, existing.Hostname, existing.StartTime.Format(time.RFC3339))
+		}
+		if err := removeInProgressMarker(backupPath); err != nil {
+			return err
+		}
+		f, err = os.OpenFile(markerFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if os.IsExist(err) {
+			return fmt.Errorf("'%s' is already being created", backupName)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't write %s: %v", InProgressFileName, err)
+	}
+	if _, err := f.Write(body); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("can't write %s: %v", InProgressFileName, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("can't write %s: %v", InProgressFileName, err)
+	}
+	return chown(markerFile)
+}
+
+// readInProgressMarker - return nil when backup is not in progress
+func readInProgressMarker(backupPath string) (*InProgressMarker, error) {
+	body, err := ioutil.ReadFile(path.Join(backupPath, InProgressFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	marker := InProgressMarker{}
+	if err := json.Unmarshal(body, &marker); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", InProgressFileName, err)
+	}
+	marker.Stale = !isMarkerProcessAlive(marker)
+	return &marker, nil
+}
+
+func removeInProgressMarker(backupPath string) error {
+	if err := os.Remove(path.Join(backupPath, InProgressFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isProcessAlive - signal 0 checks existence of process, EPERM means that process exists but belongs to other user
+func isProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// getProcessStartTime - starttime field of /proc/<pid>/stat in clock ticks since boot, empty when it can't be read.
+// comm field can contain spaces and parentheses, so fields are counted after the last ')'
+func getProcessStartTime(pid int) string {
+	body, err := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return ""
+	}
+	stat := string(body)
+	i := strings.LastIndex(stat, ")")
+	if i < 0 {
+		return ""
+	}
+	// fields after comm start from 3rd field state, starttime is 22nd field
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestInProgressMarker(t *testing.T, backupPath string, pid int) {
+	marker := newInProgressMarker(filepath.Base(backupPath))
+	marker.PID = pid
+	marker.ProcessStartTime = getProcessStartTime(pid)
+	writeTestInProgressMarkerBody(t, backupPath, marker)
+}
+
+func writeTestInProgressMarkerBody(t *testing.T, backupPath string, marker InProgressMarker) {
+	body, err := json.Marshal(marker)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(backupPath, 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, InProgressFileName), body, 0640))
+}
+
+func TestReadInProgressMarker(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-in-progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+
+	marker, err := readInProgressMarker(filepath.Join(backupsPath, "complete"))
+	require.NoError(t, err)
+	assert.Nil(t, marker)
+
+	writeTestInProgressMarker(t, filepath.Join(backupsPath, "running"), os.Getpid())
+	marker, err = readInProgressMarker(filepath.Join(backupsPath, "running"))
+	require.NoError(t, err)
+	require.NotNil(t, marker)
+	assert.Equal(t, "running", marker.BackupName)
+	assert.NotEmpty(t, marker.ProcessStartTime)
+	assert.False(t, marker.Stale)
+
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	writeTestInProgressMarker(t, filepath.Join(backupsPath, "abandoned"), cmd.Process.Pid)
+	marker, err = readInProgressMarker(filepath.Join(backupsPath, "abandoned"))
+	require.NoError(t, err)
+	require.NotNil(t, marker)
+	assert.True(t, marker.Stale)
+
+	// pid is alive, but marker is written by other container or by process which had the same pid before restart
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	for name, marker := range map[string]InProgressMarker{
+		"other_host":    {BackupName: "other_host", StartTime: time.Now().UTC(), Hostname: hostname + "-other", PID: os.Getpid(), ProcessStartTime: getProcessStartTime(os.Getpid())},
+		"pid_reused":    {BackupName: "pid_reused", StartTime: time.Now().UTC(), Hostname: hostname, PID: os.Getpid(), ProcessStartTime: "1"},
+		"without_start": {BackupName: "without_start", StartTime: time.Now().UTC(), Hostname: hostname, PID: os.Getpid()},
+	} {
+		writeTestInProgressMarkerBody(t, filepath.Join(backupsPath, name), marker)
+		marker, err := readInProgressMarker(filepath.Join(backupsPath, name))
+		require.NoError(t, err)
+		require.NotNil(t, marker)
+		assert.Equal(t, name != "without_start", marker.Stale, name)
+	}
+
+	backups, err := readLocalBackupSummaries(backupsPath)
+	require.NoError(t, err)
+	page, total, err := pageBackupSummaries(backups, 0, 0, ListOptions{})
+	require.NoError(t, err)
+	require.Equal(t, len(backups), total)
+	var summary BackupSummary
+	for _, b := range page {
+		if b.BackupName == "abandoned" {
+			summary = b
+		}
+	}
+	assert.False(t, summary.Legacy)
+	assert.Empty(t, summary.Broken)
+	require.NotNil(t, summary.InProgress)
+	assert.True(t, summary.InProgress.Stale)
+
+	require.NoError(t, removeInProgressMarker(filepath.Join(backupsPath, "abandoned")))
+	require.NoError(t, removeInProgressMarker(filepath.Join(backupsPath, "abandoned")))
+}
+
+func TestCreateBackupDirConcurrent(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-in-progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+	chown := func(string) error { return nil }
+	backupPath := filepath.Join(backupsPath, "same")
+
+	start := make(chan struct{})
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			<-start
+			errs <- createBackupDir(backupPath, "same", chown)
+		}()
+	}
+	close(start)
+	var failed []error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	require.Len(t, failed, 1)
+	assert.Contains(t, failed[0].Error(), "is already being created")
+
+	require.NoError(t, removeInProgressMarker(backupPath))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, MetaFileName), []byte("{}"), 0640))
+	assert.EqualError(t, createBackupDir(backupPath, "same", chown), "'same' already exists")
+}
+
+func TestCreateBackupDirReuse(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-in-progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+	chown := func(string) error { return nil }
+
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	writeTestInProgressMarker(t, filepath.Join(backupsPath, "abandoned"), cmd.Process.Pid)
+	require.NoError(t, createBackupDir(filepath.Join(backupsPath, "abandoned"), "abandoned", chown))
+	marker, err := readInProgressMarker(filepath.Join(backupsPath, "abandoned"))
+	require.NoError(t, err)
+	require.NotNil(t, marker)
+	assert.Equal(t, os.Getpid(), marker.PID)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, "failed"), 0750))
+	require.NoError(t, createBackupDir(filepath.Join(backupsPath, "failed"), "failed", chown))
+}
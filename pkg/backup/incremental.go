@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// partsHash - content of parts.hash, parts of every table in backup by "<db>.<table>" and disk
+// with hashes from system.parts, it is used to find parts which are not changed since base backup
+type partsHash map[string]map[string][]metadata.Part
+
+func partsHashKey(database, table string) string {
+	return database + "." + table
+}
+
+// incrementalBase - local backup used as base of CreateIncrementalBackup
+type incrementalBase struct {
+	name         string
+	shadowLayout string
+	parts        partsHash
+}
+
+// setPartHashes - copy partition id and hashes of live parts to parts of backup with the same name
+func setPartHashes(parts, liveParts map[string][]metadata.Part) {
+	live := map[string]metadata.Part{}
+	for _, diskParts := range liveParts {
+		for _, part := range diskParts {
+			live[part.Name] = part
+		}
+	}
+	for _, diskParts := range parts {
+		for i := range diskParts {
+			if livePart, ok := live[diskParts[i].Name]; ok {
+				diskParts[i].PartitionID = livePart.PartitionID
+				diskParts[i].HashOfAllFiles = livePart.HashOfAllFiles
+				diskParts[i].HashOfUncompressedFiles = livePart.HashOfUncompressedFiles
+				diskParts[i].UncompressedHashOfCompressedFiles = livePart.UncompressedHashOfCompressedFiles
+			}
+		}
+	}
+}
+
+// getPartHashes - only name, partition id and hashes of parts are kept in parts.hash,
+// parts without hash can't be compared and are not stored
+func getPartHashes(parts map[string][]metadata.Part) map[string][]metadata.Part {
+	result := map[string][]metadata.Part{}
+	for disk, diskParts := range parts {
+		for _, part := range diskParts {
+			if part.HashOfAllFiles == "" {
+				continue
+			}
+			result[disk] = append(result[disk], metadata.Part{
+				Name:                              part.Name,
+				PartitionID:                       part.PartitionID,
+				HashOfAllFiles:                    part.HashOfAllFiles,
+				HashOfUncompressedFiles:           part.HashOfUncompressedFiles,
+				UncompressedHashOfCompressedFiles: part.UncompressedHashOfCompressedFiles,
+			})
+		}
+	}
+	return result
+}
+
+func writePartsHash(ch *clickhouse.ClickHouse, backupPath string, hashes partsHash) error {
+	body, err := json.MarshalIndent(hashes, "", " ")
+	if err != nil {
+		return fmt.Errorf("can't marshal %s: %v", hashfile, err)
+	}
+	hashesPath := path.Join(backupPath, hashfile)
+	if err := ioutil.WriteFile(hashesPath, body, 0640); err != nil {
+		return fmt.Errorf("can't create %s: %v", hashfile, err)
+	}
+	return ch.Chown(hashesPath)
+}
+
+func readPartsHash(backupPath string) (partsHash, error) {
+	body, err := ioutil.ReadFile(path.Join(backupPath, hashfile))
+	if err != nil {
+		return nil, err
+	}
+	hashes := partsHash{}
+	if err := json.Unmarshal(body, &hashes); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", hashfile, err)
+	}
+	return hashes, nil
+}
+
+// getIncrementalBase - read parts.hash of local backup baseBackupName, ErrBaseBackupNotFound is returned
+// when backup doesn't exist, backups which can't be used as base return error with reason
+func getIncrementalBase(backupsPath, baseBackupName string) (*incrementalBase, error) {
+	backups, err := readLocalBackups(backupsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range backups {
+		if backup.BackupName != baseBackupName {
+			continue
+		}
+		switch {
+		case backup.Legacy:
+			return nil, fmt.Errorf("'%s' is old format backup and can't be base of incremental backup", baseBackupName)
+		case backup.Broken != "":
+			return nil, fmt.Errorf("'%s' is %s and can't be base of incremental backup", baseBackupName, backup.Broken)
+		case backup.InProgress != nil:
+			return nil, fmt.Errorf("'%s' is in progress and can't be base of incremental backup", baseBackupName)
+		}
+		hashes, err := readPartsHash(path.Join(backupsPath, baseBackupName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("'%s' has no %s and can't be base of incremental backup, create full backup", baseBackupName, hashfile)
+			}
+			return nil, err
+		}
+		return &incrementalBase{
+			name:         baseBackupName,
+			shadowLayout: backup.ShadowLayout,
+			parts:        hashes,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrBaseBackupNotFound, baseBackupName)
+}
+
+// findPart - disk of part with the same name and hash in base backup
+func (base *incrementalBase) findPart(database, table string, part metadata.Part) (string, bool) {
+	if part.HashOfAllFiles == "" {
+		return "", false
+	}
+	for disk, parts := range base.parts[partsHashKey(database, table)] {
+		for _, basePart := range parts {
+			if basePart.Name == part.Name && basePart.HashOfAllFiles == part.HashOfAllFiles {
+				return disk, true
+			}
+		}
+	}
+	return "", false
+}
+
+// changedPartitions - sorted ids of partitions with parts which are absent in base backup,
+// ok is false when table is not in base backup at all and must be frozen whole
+func (base *incrementalBase) changedPartitions(database, table string, liveParts map[string][]metadata.Part) ([]string, bool) {
+	if _, ok := base.parts[partsHashKey(database, table)]; !ok {
+		return nil, false
+	}
+	changed := map[string]struct{}{}
+	for _, parts := range liveParts {
+		for _, part := range parts {
+			if _, ok := base.findPart(database, table, part); !ok {
+				changed[part.PartitionID] = struct{}{}
+			}
+		}
+	}
+	partitions := make([]string, 0, len(changed))
+	for partitionID := range changed {
+		partitions = append(partitions, partitionID)
+	}
+	sort.Strings(partitions)
+	return partitions, true
+}
+
+// addTableIncremental - freeze only partitions changed since base backup, unchanged parts are hardlinked
+// from base backup and marked as required, so upload doesn't send them again
+func (tb *tableBackuper) addTableIncremental(ctx context.Context, table *clickhouse.Table, liveParts map[string][]metadata.Part) (map[string][]metadata.Part, map[string]int64, error) {
+	title := metadata.TableTitle{Database: table.Database, Table: table.Name}
+	changed, ok := tb.base.changedPartitions(table.Database, table.Name, liveParts)
+	if !ok {
+		return AddTableToBackup(ctx, tb.cfg, tb.ch, tb.backupName, table, tb.expectedMetadataVersions[title], nil)
+	}
+	parts := map[string][]metadata.Part{}
+	realSize := map[string]int64{}
+	if len(changed) > 0 {
+		frozenParts, frozenSize, err := AddTableToBackup(ctx, tb.cfg, tb.ch, tb.backupName, table, tb.expectedMetadataVersions[title], changed)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts, realSize = frozenParts, frozenSize
+	} else if err := checkMetadataVersion(table, tb.expectedMetadataVersions[title]); err != nil {
+		return nil, nil, err
+	}
+	setPartHashes(parts, liveParts)
+	inBackup := map[string]struct{}{}
+	for _, diskParts := range parts {
+		for i := range diskParts {
+			inBackup[diskParts[i].Name] = struct{}{}
+			if _, ok := tb.base.findPart(table.Database, table.Name, diskParts[i]); ok {
+				diskParts[i].Required = true
+			}
+		}
+	}
+	diskPaths := map[string]string{}
+	for _, disk := range tb.disks {
+		diskPaths[disk.Name] = disk.Path
+	}
+	for _, diskParts := range liveParts {
+		for _, part := range diskParts {
+			if _, ok := inBackup[part.Name]; ok {
+				continue
+			}
+			baseDisk, ok := tb.base.findPart(table.Database, table.Name, part)
+			if !ok {
+				continue
+			}
+			diskPath, ok := diskPaths[baseDisk]
+			if !ok {
+				return nil, nil, fmt.Errorf("disk '%s' of base backup '%s' is not found", baseDisk, tb.base.name)
+			}
+			basePartPath := path.Join(backupShadowPath(localBackupsPath(tb.cfg, diskPath), tb.base.name, tb.base.shadowLayout, baseDisk, table.Database, table.Name), part.Name)
+			partPath := path.Join(backupShadowPath(localBackupsPath(tb.cfg, diskPath), tb.backupName, tb.cfg.General.ShadowLayout, baseDisk, table.Database, table.Name), part.Name)
+			if err := duplicatePart(basePartPath, partPath); err != nil {
+				return nil, nil, fmt.Errorf("can't link part '%s' from base backup '%s': %v", part.Name, tb.base.name, err)
+			}
+			parts[baseDisk] = append(parts[baseDisk], metadata.Part{
+				Name:                              part.Name,
+				Required:                          true,
+				PartitionID:                       part.PartitionID,
+				HashOfAllFiles:                    part.HashOfAllFiles,
+				HashOfUncompressedFiles:           part.HashOfUncompressedFiles,
+				UncompressedHashOfCompressedFiles: part.UncompressedHashOfCompressedFiles,
+				MetadataVersion:                   getMetadataVersion([]string{partPath}),
+			})
+		}
+	}
+	return parts, realSize, nil
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetIncrementalBase(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-incremental")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+	writeFile := func(name, fileName, body string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, name), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, name, fileName), []byte(body), 0640))
+	}
+	writeFile("base", MetaFileName, `{"backup_name":"base","shadow_layout":"disk"}`)
+	writeFile("base", hashfile, `{"db.t":{"default":[{"name":"all_1_1_0","hash_of_all_files":"a"}]}}`)
+	writeFile("old", MetaFileName, `{"backup_name":"old"}`)
+
+	base, err := getIncrementalBase(backupsPath, "base")
+	require.NoError(t, err)
+	assert.Equal(t, "base", base.name)
+	assert.Equal(t, "disk", base.shadowLayout)
+	disk, ok := base.findPart("db", "t", metadata.Part{Name: "all_1_1_0", HashOfAllFiles: "a"})
+	assert.True(t, ok)
+	assert.Equal(t, "default", disk)
+	_, ok = base.findPart("db", "t", metadata.Part{Name: "all_1_1_0", HashOfAllFiles: "b"})
+	assert.False(t, ok)
+	_, ok = base.findPart("db", "t", metadata.Part{Name: "all_1_1_0"})
+	assert.False(t, ok)
+
+	_, err = getIncrementalBase(backupsPath, "old")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrBaseBackupNotFound))
+	_, err = getIncrementalBase(backupsPath, "absent")
+	assert.True(t, errors.Is(err, ErrBaseBackupNotFound))
+}
+
+func TestChangedPartitions(t *testing.T) {
+	base := &incrementalBase{parts: partsHash{"db.t": {"default": {
+		{Name: "202101_1_1_0", PartitionID: "202101", HashOfAllFiles: "a"},
+		{Name: "202102_2_2_0", PartitionID: "202102", HashOfAllFiles: "b"},
+	}}}}
+	live := map[string][]metadata.Part{"default": {
+		{Name: "202101_1_1_0", PartitionID: "202101", HashOfAllFiles: "a"},
+		{Name: "202102_2_2_0", PartitionID: "202102", HashOfAllFiles: "b"},
+		{Name: "202102_3_3_0", PartitionID: "202102", HashOfAllFiles: "c"},
+		{Name: "202103_4_4_0", PartitionID: "202103", HashOfAllFiles: "d"},
+	}}
+	partitions, ok := base.changedPartitions("db", "t", live)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"202102", "202103"}, partitions)
+
+	partitions, ok = base.changedPartitions("db", "t", map[string][]metadata.Part{"default": live["default"][:2]})
+	assert.True(t, ok)
+	assert.Empty(t, partitions)
+
+	_, ok = base.changedPartitions("db", "other", live)
+	assert.False(t, ok)
+}
+
+func TestPartHashes(t *testing.T) {
+	parts := map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}}
+	setPartHashes(parts, map[string][]metadata.Part{"default": {{Name: "all_1_1_0", PartitionID: "all", HashOfAllFiles: "a", Size: 10}}})
+	assert.Equal(t, "a", parts["default"][0].HashOfAllFiles)
+	assert.Equal(t, "all", parts["default"][0].PartitionID)
+	assert.Empty(t, parts["default"][1].HashOfAllFiles)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_1_1_0", PartitionID: "all", HashOfAllFiles: "a"}}}, getPartHashes(parts))
+}
+
+func TestAddTableIncrementalUnchanged(t *testing.T) {
+	diskPath, err := ioutil.TempDir("", "clickhouse-backup-incremental")
+	require.NoError(t, err)
+	defer os.RemoveAll(diskPath)
+	cfg := config.DefaultConfig()
+	cfg.General.ShadowLayout = clickhouse.ShadowLayoutDisk
+	basePartPath := filepath.Join(backupShadowPath(filepath.Join(diskPath, "backup"), "base", clickhouse.ShadowLayoutDisk, "default", "db", "t"), "all_1_1_0")
+	require.NoError(t, os.MkdirAll(basePartPath, 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(basePartPath, "checksums.txt"), []byte("checksums"), 0640))
+
+	tb := &tableBackuper{
+		cfg:        cfg,
+		backupName: "increment",
+		disks:      []clickhouse.Disk{{Name: "default", Path: diskPath}},
+		base: &incrementalBase{
+			name:         "base",
+			shadowLayout: clickhouse.ShadowLayoutDisk,
+			parts:        partsHash{"db.t": {"default": {{Name: "all_1_1_0", PartitionID: "all", HashOfAllFiles: "a"}}}},
+		},
+	}
+	live := map[string][]metadata.Part{"default": {{Name: "all_1_1_0", PartitionID: "all", HashOfAllFiles: "a"}}}
+	parts, realSize, err := tb.addTableIncremental(context.Background(), &clickhouse.Table{Database: "db", Name: "t", Engine: "MergeTree"}, live)
+	require.NoError(t, err)
+	assert.Empty(t, realSize)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_1_1_0", Required: true, PartitionID: "all", HashOfAllFiles: "a"}}}, parts)
+	body, err := ioutil.ReadFile(filepath.Join(backupShadowPath(filepath.Join(diskPath, "backup"), "increment", clickhouse.ShadowLayoutDisk, "default", "db", "t"), "all_1_1_0", "checksums.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "checksums", string(body))
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package backup
+
+import (
+	"runtime"
+	"syscall"
+
+	apexLog "github.com/apex/log"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+func getIOPriority() (int, error) {
+	prio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(prio), nil
+}
+
+func setIOPriority(prio int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// withIOPriority - run fn on OS thread with I/O scheduling class like `ionice -c`, previous class is restored after fn
+func withIOPriority(priority string, fn func() error) error {
+	if priority == "" {
+		return fn()
+	}
+	class, level, err := parseIOPriority(priority)
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	oldPrio, err := getIOPriority()
+	if err != nil {
+		apexLog.Warnf("can't get io priority: %v", err)
+		return fn()
+	}
+	if err := setIOPriority(class<<ioprioClassShift | level); err != nil {
+		apexLog.Warnf("can't set io priority '%s': %v", priority, err)
+		return fn()
+	}
+	defer func() {
+		if err := setIOPriority(oldPrio); err != nil {
+			apexLog.Warnf("can't restore io priority: %v", err)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithIOPriority(t *testing.T) {
+	before, err := getIOPriority()
+	require.NoError(t, err)
+	err = withIOPriority("best-effort:7", func() error {
+		prio, err := getIOPriority()
+		require.NoError(t, err)
+		assert.Equal(t, ioprioClassBestEffort<<ioprioClassShift|7, prio)
+		return nil
+	})
+	require.NoError(t, err)
+	after, err := getIOPriority()
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.Error(t, withIOPriority("best-effort:8", func() error { return nil }))
+}
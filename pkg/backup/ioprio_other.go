@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package backup
+
+// withIOPriority - I/O scheduling classes are supported only on Linux, fn runs with default priority
+func withIOPriority(priority string, fn func() error) error {
+	return fn()
+}
@@ -22,13 +22,21 @@ func addRestoreTable(tables RestoreTables, table metadata.TableMetadata) Restore
 	return append(tables, table)
 }
 
+// escapeTablePattern - escape table name for use as exact match in filepath.Match pattern
+func escapeTablePattern(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 func parseSchemaPattern(metadataPath string, tablePattern string, dropTable bool) (RestoreTables, error) {
 	result := RestoreTables{}
-	tablePatterns := []string{"*"}
-
-	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
-	}
+	matcher := newTableMatcher(tablePattern)
 	if err := filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -53,31 +61,27 @@ func parseSchemaPattern(metadataPath string, tablePattern string, dropTable bool
 		}
 		database, _ := url.PathUnescape(parts[0])
 		table, _ := url.PathUnescape(parts[1])
-		tableName := fmt.Sprintf("%s.%s", database, table)
-		for _, p := range tablePatterns {
-			if matched, _ := filepath.Match(p, tableName); !matched {
-				continue
-			}
-			data, err := ioutil.ReadFile(filePath)
-			if err != nil {
-				return err
-			}
-			if legacy {
-				result = addRestoreTable(result, metadata.TableMetadata{
-					Database: database,
-					Table:    table,
-					Query:    strings.Replace(string(data), "ATTACH", "CREATE", 1),
-					// Path:     filePath,
-				})
-				return nil
-			}
-			var t metadata.TableMetadata
-			if err := json.Unmarshal(data, &t); err != nil {
-				return err
-			}
-			result = addRestoreTable(result, t)
+		if !matcher.match(fmt.Sprintf("%s.%s", database, table)) {
 			return nil
 		}
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if legacy {
+			result = addRestoreTable(result, metadata.TableMetadata{
+				Database: database,
+				Table:    table,
+				Query:    strings.Replace(string(data), "ATTACH", "CREATE", 1),
+				// Path:     filePath,
+			})
+			return nil
+		}
+		var t metadata.TableMetadata
+		if err := json.Unmarshal(data, &t); err != nil {
+			return err
+		}
+		result = addRestoreTable(result, t)
 		return nil
 	}); err != nil {
 		return nil, err
@@ -115,17 +119,11 @@ func getOrderByEngine(query string, dropTable bool) int64 {
 }
 
 func parseTablePatternForRestoreData(tables []metadata.TableMetadata, tablePattern string) clickhouse.BackupTables {
-	tablePatterns := []string{"*"}
-	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
-	}
+	matcher := newTableMatcher(tablePattern)
 	result := clickhouse.BackupTables{}
 	for _, t := range tables {
-		for _, pattern := range tablePatterns {
-			tableName := fmt.Sprintf("%s.%s", t.Database, t.Table)
-			if matched, _ := filepath.Match(pattern, tableName); matched {
-				result = addBackupTable(result, t)
-			}
+		if matcher.match(fmt.Sprintf("%s.%s", t.Database, t.Table)) {
+			result = addBackupTable(result, t)
 		}
 	}
 	result.Sort()
@@ -133,18 +131,11 @@ func parseTablePatternForRestoreData(tables []metadata.TableMetadata, tablePatte
 }
 
 func parseTablePatternForDownload(tables []metadata.TableTitle, tablePattern string) []metadata.TableTitle {
-	tablePatterns := []string{"*"}
-	if tablePattern != "" {
-		tablePatterns = strings.Split(tablePattern, ",")
-	}
+	matcher := newTableMatcher(tablePattern)
 	result := []metadata.TableTitle{}
 	for _, t := range tables {
-		for _, pattern := range tablePatterns {
-			tableName := fmt.Sprintf("%s.%s", t.Database, t.Table)
-			if matched, _ := filepath.Match(pattern, tableName); matched {
-				result = append(result, t)
-				break
-			}
+		if matcher.match(fmt.Sprintf("%s.%s", t.Database, t.Table)) {
+			result = append(result, t)
 		}
 	}
 	return result
@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// ListOptions - filtering and sorting for ListBackupsPaged, zero value returns all backups from oldest to newest
+type ListOptions struct {
+	Tag           string    // one of backup tags
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	NewestFirst   bool
+}
+
+// BackupSummary - short description of local backup without tables list
+type BackupSummary struct {
+	BackupName     string            `json:"backup_name"`
+	CreationDate   time.Time         `json:"creation_date"`
+	Tags           []string          `json:"tags,omitempty"`
+	Description    string            `json:"description,omitempty"`
+	DataFormat     string            `json:"data_format"`
+	RequiredBackup string            `json:"required_backup,omitempty"`
+	DataSize       int64             `json:"data_size,omitempty"`
+	MetadataSize   int64             `json:"metadata_size"`
+	CompressedSize int64             `json:"compressed_size,omitempty"`
+	FailedTables   int               `json:"failed_tables,omitempty"`
+	Legacy         bool              `json:"legacy,omitempty"`
+	Broken         string            `json:"broken,omitempty"`
+	InProgress     *InProgressMarker `json:"in_progress,omitempty"`
+}
+
+// NewListOptions - parse dates of ListOptions, they accept the same formats as --modified-since, empty string means no limit
+func NewListOptions(tag, createdAfter, createdBefore string, newestFirst bool) (ListOptions, error) {
+	opts := ListOptions{Tag: tag, NewestFirst: newestFirst}
+	var err error
+	if createdAfter != "" {
+		if opts.CreatedAfter, err = parseModifiedSince(createdAfter); err != nil {
+			return opts, fmt.Errorf("bad created after: %v", err)
+		}
+	}
+	if createdBefore != "" {
+		if opts.CreatedBefore, err = parseModifiedSince(createdBefore); err != nil {
+			return opts, fmt.Errorf("bad created before: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+func (s BackupSummary) match(opts ListOptions) bool {
+	if opts.Tag != "" && !hasTag(s.Tags, opts.Tag) {
+		return false
+	}
+	if !opts.CreatedAfter.IsZero() && s.CreationDate.Before(opts.CreatedAfter) {
+		return false
+	}
+	if !opts.CreatedBefore.IsZero() && !s.CreationDate.Before(opts.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// newBackupSummary - summary fields of local backup, it is returned without tables list
+func newBackupSummary(b BackupLocal) BackupSummary {
+	return BackupSummary{
+		BackupName:     b.BackupName,
+		CreationDate:   b.CreationDate,
+		Tags:           b.Tags,
+		Description:    b.Description,
+		DataFormat:     b.DataFormat,
+		RequiredBackup: b.RequiredBackup,
+		DataSize:       b.DataSize,
+		MetadataSize:   b.MetadataSize,
+		CompressedSize: b.CompressedSize,
+		FailedTables:   len(b.FailedTables),
+		Legacy:         b.Legacy,
+		Broken:         b.Broken,
+		InProgress:     b.InProgress,
+	}
+}
+
+// ListBackupsPaged - return page of local backups matched by opts and total count of matched backups
+// filtering and sorting are applied before offset and limit, limit <= 0 means without limit
+func ListBackupsPaged(cfg *config.Config, offset, limit int, opts ListOptions) ([]BackupSummary, int, error) {
+	backupsPath, err := getLocalBackupsPath(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	summaries, err := readLocalBackupSummaries(backupsPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pageBackupSummaries(summaries, offset, limit, opts)
+}
+
+// readLocalBackupSummaries - same as readLocalBackups, but tables and databases lists of metadata.json are skipped
+func readLocalBackupSummaries(backupsPath string) ([]BackupSummary, error) {
+	result := []BackupSummary{}
+	if err := walkLocalBackups(backupsPath, decodeBackupSummary, func(backup BackupLocal) {
+		result = append(result, newBackupSummary(backup))
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreationDate.Before(result[j].CreationDate)
+	})
+	return result, nil
+}
+
+// decodeBackupSummary - unmarshal metadata.json without tables and databases lists,
+// fields of outer struct shadow the embedded ones, so json skips the lists without allocation
+func decodeBackupSummary(body []byte, backupMetadata *metadata.BackupMetadata) error {
+	var summary struct {
+		metadata.BackupMetadata
+		Tables    []struct{} `json:"tables"`
+		Databases []struct{} `json:"databases"`
+	}
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return err
+	}
+	*backupMetadata = summary.BackupMetadata
+	return nil
+}
+
+// pageBackupSummaries - see ListBackupsPaged, backups are expected in order of readLocalBackupSummaries
+func pageBackupSummaries(backups []BackupSummary, offset, limit int, opts ListOptions) ([]BackupSummary, int, error) {
+	if offset < 0 {
+		return nil, 0, fmt.Errorf("offset can't be negative")
+	}
+	matched := make([]BackupSummary, 0, len(backups))
+	for _, backup := range backups {
+		if backup.match(opts) {
+			matched = append(matched, backup)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].CreationDate.Equal(matched[j].CreationDate) {
+			return matched[i].BackupName < matched[j].BackupName
+		}
+		if opts.NewestFirst {
+			return matched[i].CreationDate.After(matched[j].CreationDate)
+		}
+		return matched[i].CreationDate.Before(matched[j].CreationDate)
+	})
+	total := len(matched)
+	if offset >= total {
+		return []BackupSummary{}, total, nil
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return matched[offset:end], total, nil
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageBackupSummaries(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2021, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	backups := []BackupLocal{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "b1", CreationDate: day(1), Tags: []string{"daily"}}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "b2", CreationDate: day(2)}, Broken: BrokenPartiallyDeleted},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "b3", CreationDate: day(3), Tags: []string{"daily"}, FailedTables: []metadata.TableTitle{{Database: "db", Table: "t1"}}}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "b4", CreationDate: day(4), Tags: []string{"daily"}}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "b5", CreationDate: day(5)}, InProgress: &InProgressMarker{PID: 1}},
+	}
+	summaries := make([]BackupSummary, len(backups))
+	for i := range backups {
+		summaries[i] = newBackupSummary(backups[i])
+	}
+	names := func(page []BackupSummary) []string {
+		result := make([]string, 0, len(page))
+		for _, b := range page {
+			result = append(result, b.BackupName)
+		}
+		return result
+	}
+
+	page, total, err := pageBackupSummaries(summaries, 0, 0, ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, []string{"b1", "b2", "b3", "b4", "b5"}, names(page))
+
+	// filter and sort are applied before offset and limit
+	page, total, err = pageBackupSummaries(summaries, 1, 1, ListOptions{Tag: "daily", NewestFirst: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, []string{"b3"}, names(page))
+	assert.Equal(t, 1, page[0].FailedTables)
+
+	page, total, err = pageBackupSummaries(summaries, 0, 10, ListOptions{CreatedAfter: day(2), CreatedBefore: day(5)})
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, []string{"b2", "b3", "b4"}, names(page))
+	assert.Equal(t, BrokenPartiallyDeleted, page[0].Broken)
+
+	page, total, err = pageBackupSummaries(summaries, 5, 1, ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, total)
+	assert.Empty(t, page)
+
+	_, _, err = pageBackupSummaries(summaries, -1, 1, ListOptions{})
+	assert.Error(t, err)
+}
+
+func TestReadLocalBackupSummaries(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-summaries")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+	writeMetadata := func(name, body string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, name), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, name, MetaFileName), []byte(body), 0640))
+	}
+	writeMetadata("full", `{"backup_name":"full","creation_date":"2021-01-02T00:00:00Z","tags":["daily"],"data_size":1024,"compressed_size":256,`+
+		`"databases":[{"name":"db","engine":"Atomic","query":"CREATE DATABASE db"}],`+
+		`"tables":[{"database":"db","table":"t1"},{"database":"db","table":"t2"}],`+
+		`"failed_tables":[{"database":"db","table":"t3"}]}`)
+	writeMetadata("corrupted", `{"backup_name":"corrupted","tables":{}`)
+	writeMetadata("old", `{"backup_name":"old","creation_date":"2021-01-01T00:00:00Z","tables":[]}`)
+
+	summaries, err := readLocalBackupSummaries(backupsPath)
+	require.NoError(t, err)
+	require.Len(t, summaries, 3)
+	byName := map[string]BackupSummary{}
+	for _, s := range summaries {
+		byName[s.BackupName] = s
+	}
+	assert.Equal(t, BackupSummary{
+		BackupName:     "full",
+		CreationDate:   time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		Tags:           []string{"daily"},
+		DataSize:       1024,
+		CompressedSize: 256,
+		FailedTables:   1,
+	}, byName["full"])
+	assert.Contains(t, byName["corrupted"].Broken, "metadata.json unparseable")
+	assert.Empty(t, byName["old"].Broken)
+	assert.Equal(t, []string{"old", "full"}, []string{summaries[0].BackupName, summaries[1].BackupName})
+
+	summaries, err = readLocalBackupSummaries(filepath.Join(backupsPath, "absent"))
+	require.NoError(t, err)
+	assert.Empty(t, summaries)
+}
+
+func TestNewListOptions(t *testing.T) {
+	opts, err := NewListOptions("daily", "2021-01-02", "2021-01-03T00:00:00Z", true)
+	require.NoError(t, err)
+	assert.Equal(t, ListOptions{
+		Tag:           "daily",
+		CreatedAfter:  time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		CreatedBefore: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+		NewestFirst:   true,
+	}, opts)
+
+	_, err = NewListOptions("", "yesterday", "", false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// parseExpectedMetadataVersions - parse list of "<db>.<table>=<metadata_version>"
+func parseExpectedMetadataVersions(specs []string) (map[metadata.TableTitle]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	result := map[metadata.TableTitle]string{}
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid expected metadata version '%s', expected <db>.<table>=<version>", spec)
+		}
+		fields := strings.SplitN(spec[:i], ".", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid expected metadata version '%s', expected <db>.<table>=<version>", spec)
+		}
+		version := spec[i+1:]
+		if _, err := strconv.ParseUint(version, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid expected metadata version '%s': %v", spec, err)
+		}
+		result[metadata.TableTitle{Database: fields[0], Table: fields[1]}] = version
+	}
+	return result, nil
+}
+
+// checkExpectedTablesSelected - every table with expected metadata version must be in backup,
+// otherwise the assertion would be silently ignored
+func checkExpectedTablesSelected(tables []clickhouse.Table, expected map[metadata.TableTitle]string) error {
+	selected := map[metadata.TableTitle]struct{}{}
+	for _, t := range tables {
+		if !t.Skip {
+			selected[metadata.TableTitle{Database: t.Database, Table: t.Name}] = struct{}{}
+		}
+	}
+	for title := range expected {
+		if _, ok := selected[title]; !ok {
+			return fmt.Errorf("metadata version of '%s.%s' is expected, but table is not selected for backup", title.Database, title.Table)
+		}
+	}
+	return nil
+}
+
+// checkMetadataVersion - compare metadata_version.txt of table with expected value,
+// it is changed by every ALTER of Replicated*MergeTree table
+func checkMetadataVersion(table *clickhouse.Table, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	actual := getMetadataVersion(table.DataPaths)
+	if actual == "" {
+		return fmt.Errorf("'%s.%s' has no %s, metadata version can't be checked", table.Database, table.Name, clickhouse.MetadataVersionFileName)
+	}
+	if actual != expected {
+		return fmt.Errorf("metadata version of '%s.%s' is %s, expected %s, table schema was changed", table.Database, table.Name, actual, expected)
+	}
+	return nil
+}
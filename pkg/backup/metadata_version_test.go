@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExpectedMetadataVersions(t *testing.T) {
+	expected, err := parseExpectedMetadataVersions([]string{"db.t1=3", "db.t.2=10"})
+	require.NoError(t, err)
+	assert.Equal(t, map[metadata.TableTitle]string{
+		{Database: "db", Table: "t1"}:  "3",
+		{Database: "db", Table: "t.2"}: "10",
+	}, expected)
+
+	expected, err = parseExpectedMetadataVersions(nil)
+	require.NoError(t, err)
+	assert.Nil(t, expected)
+
+	for _, spec := range []string{"db.t1", "t1=3", ".t1=3", "db.=3", "db.t1=", "db.t1=x"} {
+		_, err := parseExpectedMetadataVersions([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCheckExpectedTablesSelected(t *testing.T) {
+	tables := []clickhouse.Table{{Database: "db", Name: "t1"}, {Database: "db", Name: "t2", Skip: true}}
+	assert.NoError(t, checkExpectedTablesSelected(tables, map[metadata.TableTitle]string{{Database: "db", Table: "t1"}: "1"}))
+	assert.Error(t, checkExpectedTablesSelected(tables, map[metadata.TableTitle]string{{Database: "db", Table: "t2"}: "1"}))
+	assert.Error(t, checkExpectedTablesSelected(tables, map[metadata.TableTitle]string{{Database: "db", Table: "t3"}: "1"}))
+}
+
+func TestCheckMetadataVersion(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "clickhouse-backup-metadata-version")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dataPath) })
+	table := &clickhouse.Table{Database: "db", Name: "t1", DataPaths: []string{dataPath}}
+
+	assert.NoError(t, checkMetadataVersion(table, ""))
+	assert.Error(t, checkMetadataVersion(table, "2"))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dataPath, clickhouse.MetadataVersionFileName), []byte("2\n"), 0640))
+	assert.NoError(t, checkMetadataVersion(table, "2"))
+	assert.Error(t, checkMetadataVersion(table, "3"))
+}
@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+var partitionIDRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseTablePartitions - parse list of "<db>.<table>=<partition_id>[,<partition_id>]",
+// partitions of the same table from several items are merged
+func parseTablePartitions(specs []string) (map[metadata.TableTitle][]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	result := map[metadata.TableTitle][]string{}
+	seen := map[string]struct{}{}
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid partitions '%s', expected <db>.<table>=<partition_id>[,<partition_id>]", spec)
+		}
+		fields := strings.SplitN(spec[:i], ".", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid partitions '%s', expected <db>.<table>=<partition_id>[,<partition_id>]", spec)
+		}
+		title := metadata.TableTitle{Database: fields[0], Table: fields[1]}
+		for _, partitionID := range strings.Split(spec[i+1:], ",") {
+			partitionID = strings.TrimSpace(partitionID)
+			if !partitionIDRE.MatchString(partitionID) {
+				return nil, fmt.Errorf("invalid partition id '%s' in '%s'", partitionID, spec)
+			}
+			key := spec[:i] + "=" + partitionID
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				result[title] = append(result[title], partitionID)
+			}
+		}
+	}
+	return result, nil
+}
+
+// checkPartitionTablesSelected - every table with partitions filter must be in backup with data,
+// otherwise the filter would be silently ignored
+func checkPartitionTablesSelected(tables []clickhouse.Table, partitions map[metadata.TableTitle][]string) error {
+	selected := map[metadata.TableTitle]struct{}{}
+	for _, t := range tables {
+		if !t.Skip && !t.SchemaOnly {
+			selected[metadata.TableTitle{Database: t.Database, Table: t.Name}] = struct{}{}
+		}
+	}
+	for title := range partitions {
+		if _, ok := selected[title]; !ok {
+			return fmt.Errorf("partitions of '%s.%s' are set, but table data is not selected for backup", title.Database, title.Table)
+		}
+	}
+	return nil
+}
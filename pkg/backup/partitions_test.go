@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTablePartitions(t *testing.T) {
+	partitions, err := parseTablePartitions([]string{"db.t1=202101,202102", "db.t.2=all", "db.t1=202102, 202103"})
+	require.NoError(t, err)
+	assert.Equal(t, map[metadata.TableTitle][]string{
+		{Database: "db", Table: "t1"}:  {"202101", "202102", "202103"},
+		{Database: "db", Table: "t.2"}: {"all"},
+	}, partitions)
+
+	partitions, err = parseTablePartitions(nil)
+	require.NoError(t, err)
+	assert.Nil(t, partitions)
+
+	for _, spec := range []string{"db.t1", "t1=202101", ".t1=202101", "db.=202101", "db.t1=", "db.t1=202101,", "db.t1=2021'01"} {
+		_, err := parseTablePartitions([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCheckPartitionTablesSelected(t *testing.T) {
+	tables := []clickhouse.Table{{Database: "db", Name: "t1"}, {Database: "db", Name: "t2", Skip: true}, {Database: "db", Name: "t3", SchemaOnly: true}}
+	assert.NoError(t, checkPartitionTablesSelected(tables, nil))
+	assert.NoError(t, checkPartitionTablesSelected(tables, map[metadata.TableTitle][]string{{Database: "db", Table: "t1"}: {"1"}}))
+	assert.Error(t, checkPartitionTablesSelected(tables, map[metadata.TableTitle][]string{{Database: "db", Table: "t2"}: {"1"}}))
+	assert.Error(t, checkPartitionTablesSelected(tables, map[metadata.TableTitle][]string{{Database: "db", Table: "t3"}: {"1"}}))
+	assert.Error(t, checkPartitionTablesSelected(tables, map[metadata.TableTitle][]string{{Database: "db", Table: "t4"}: {"1"}}))
+}
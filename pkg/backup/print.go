@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"text/tabwriter"
@@ -18,6 +19,15 @@ import (
 	"github.com/AlexAkulov/clickhouse-backup/utils"
 )
 
+// compressionInfo - uncompressed data size and compression ratio when backup is stored compressed
+func compressionInfo(backup metadata.BackupMetadata) string {
+	info := fmt.Sprintf("data %s", utils.FormatBytes(backup.DataSize))
+	if backup.CompressedSize > 0 && backup.CompressedSize != backup.DataSize {
+		info = fmt.Sprintf("%s, compressed %s (%.1fx)", info, utils.FormatBytes(backup.CompressedSize), float64(backup.DataSize)/float64(backup.CompressedSize))
+	}
+	return info
+}
+
 func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format string) error {
 	switch format {
 	case "latest", "last", "l":
@@ -52,7 +62,7 @@ func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format str
 				description = backup.Broken
 				size = "???"
 			}
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, uploadDate, "remote", required, description)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, compressionInfo(backup.BackupMetadata), uploadDate, "remote", required, description, strings.Join(backup.Tags, ","), backup.Description)
 		}
 	default:
 		return fmt.Errorf("'%s' undefined", format)
@@ -60,7 +70,7 @@ func printBackupsRemote(w io.Writer, backupList []new_storage.Backup, format str
 	return nil
 }
 
-func printBackupsLocal(w io.Writer, backupList []BackupLocal, format string) error {
+func printBackupsLocal(w io.Writer, backupList []BackupSummary, format string) error {
 	switch format {
 	case "latest", "last", "l":
 		if len(backupList) < 1 {
@@ -90,11 +100,18 @@ func printBackupsLocal(w io.Writer, backupList []BackupLocal, format string) err
 			if backup.RequiredBackup != "" {
 				required = "+" + backup.RequiredBackup
 			}
+			if backup.FailedTables > 0 {
+				description = fmt.Sprintf("partial, %d tables failed", backup.FailedTables)
+			}
 			if backup.Broken != "" {
 				description = backup.Broken
 				size = "???"
 			}
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, creationDate, "local", required, description)
+			if backup.InProgress != nil {
+				description = backup.InProgress.String()
+				size = "???"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", backup.BackupName, size, compressionInfo(metadata.BackupMetadata{DataSize: backup.DataSize, CompressedSize: backup.CompressedSize}), creationDate, "local", required, description, strings.Join(backup.Tags, ","), backup.Description)
 		}
 	default:
 		return fmt.Errorf("'%s' undefined", format)
@@ -104,42 +121,118 @@ func printBackupsLocal(w io.Writer, backupList []BackupLocal, format string) err
 
 // PrintLocalBackups - print all backups stored locally
 func PrintLocalBackups(cfg *config.Config, format string) error {
+	return PrintLocalBackupsPage(cfg, format, 0, 0, ListOptions{})
+}
+
+// PrintLocalBackupsPage - print page of backups stored locally, see ListBackupsPaged
+func PrintLocalBackupsPage(cfg *config.Config, format string, offset, limit int, opts ListOptions) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.DiscardEmptyColumns)
 	defer w.Flush()
-	backupList, err := GetLocalBackups(cfg)
+	page, _, err := ListBackupsPaged(cfg, offset, limit, opts)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return printBackupsLocal(w, backupList, format)
+	return printBackupsLocal(w, page, format)
+}
+
+// PrintBackupParts - print parts of table stored in local backup
+func PrintBackupParts(cfg *config.Config, backupName, database, table string) error {
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+	_, tableMetadata, err := getBackupTableMetadata(cfg, ch, backupName, database, table)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.DiscardEmptyColumns)
+	defer w.Flush()
+	disks := make([]string, 0, len(tableMetadata.Parts))
+	for disk := range tableMetadata.Parts {
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+	for _, disk := range disks {
+		for _, part := range tableMetadata.Parts[disk] {
+			fmt.Fprintf(w, "%s\t%s\n", part.Name, disk)
+		}
+	}
+	return nil
 }
 
 // GetLocalBackups - return slice of all backups stored locally
 func GetLocalBackups(cfg *config.Config) ([]BackupLocal, error) {
+	backupsPath, err := getLocalBackupsPath(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return readLocalBackups(backupsPath)
+}
+
+// getLocalBackupsPath - directory of local backups on default disk
+func getLocalBackupsPath(cfg *config.Config) (string, error) {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
 	if err := ch.Connect(); err != nil {
-		return nil, fmt.Errorf("can't connect to clickhouse: %w", err)
+		return "", fmt.Errorf("can't connect to clickhouse: %w", err)
 	}
 	defer ch.Close()
 
 	dataPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return "", err
+	}
+	return localBackupsPath(cfg, dataPath), nil
+}
+
+// ListBackupsLocal - return all backups stored locally from newest to oldest
+func ListBackupsLocal(cfg *config.Config) ([]BackupLocal, error) {
+	backups, err := GetLocalBackups(cfg)
 	if err != nil {
 		return nil, err
 	}
+	for i, j := 0, len(backups)-1; i < j; i, j = i+1, j-1 {
+		backups[i], backups[j] = backups[j], backups[i]
+	}
+	return backups, nil
+}
+
+// readLocalBackups - read metadata.json of every backup in backupsPath, sorted from oldest to newest,
+// backups with unreadable metadata.json are returned with Broken reason
+func readLocalBackups(backupsPath string) ([]BackupLocal, error) {
 	result := []BackupLocal{}
-	backupsPath := path.Join(dataPath, "backup")
+	decode := func(body []byte, backupMetadata *metadata.BackupMetadata) error {
+		return json.Unmarshal(body, backupMetadata)
+	}
+	if err := walkLocalBackups(backupsPath, decode, func(backup BackupLocal) {
+		result = append(result, backup)
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreationDate.Before(result[j].CreationDate)
+	})
+	return result, nil
+}
+
+// walkLocalBackups - call fn for every backup in backupsPath, metadata.json is read by decode,
+// backups with unreadable metadata.json are passed with Broken reason, missing backupsPath has no backups
+func walkLocalBackups(backupsPath string, decode func(body []byte, backupMetadata *metadata.BackupMetadata) error, fn func(backup BackupLocal)) error {
 	d, err := os.Open(backupsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return result, nil
+			return nil
 		}
-		return nil, err
+		return err
 	}
 	defer d.Close()
 	names, err := d.Readdirnames(-1)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	for _, name := range names {
 		info, err := os.Stat(path.Join(backupsPath, name))
@@ -152,8 +245,40 @@ func GetLocalBackups(cfg *config.Config) ([]BackupLocal, error) {
 		backupMetafilePath := path.Join(backupsPath, name, "metadata.json")
 		backupMetadataBody, err := ioutil.ReadFile(backupMetafilePath)
 		if os.IsNotExist(err) {
+			if deletingBody, err := ioutil.ReadFile(path.Join(backupsPath, name, DeletingMetaFileName)); err == nil {
+				backupMetadata := metadata.BackupMetadata{}
+				if err := decode(deletingBody, &backupMetadata); err != nil {
+					backupMetadata.CreationDate = info.ModTime()
+				}
+				backupMetadata.BackupName = name
+				fn(BackupLocal{
+					BackupMetadata: backupMetadata,
+					Broken:         BrokenPartiallyDeleted,
+				})
+				continue
+			}
+			if marker, err := readInProgressMarker(path.Join(backupsPath, name)); err == nil && marker != nil {
+				fn(BackupLocal{
+					BackupMetadata: metadata.BackupMetadata{
+						BackupName:   name,
+						CreationDate: marker.StartTime,
+					},
+					InProgress: marker,
+				})
+				continue
+			}
+			if !isLegacyBackup(path.Join(backupsPath, name)) {
+				fn(BackupLocal{
+					BackupMetadata: metadata.BackupMetadata{
+						BackupName:   name,
+						CreationDate: info.ModTime(),
+					},
+					Broken: BrokenMetadataMissing,
+				})
+				continue
+			}
 			// Legacy backup
-			result = append(result, BackupLocal{
+			fn(BackupLocal{
 				BackupMetadata: metadata.BackupMetadata{
 					BackupName:   name,
 					CreationDate: info.ModTime(),
@@ -162,25 +287,49 @@ func GetLocalBackups(cfg *config.Config) ([]BackupLocal, error) {
 			})
 			continue
 		}
+		if err != nil {
+			fn(BackupLocal{
+				BackupMetadata: metadata.BackupMetadata{
+					BackupName:   name,
+					CreationDate: info.ModTime(),
+				},
+				Broken: fmt.Sprintf("can't read %s: %v", MetaFileName, err),
+			})
+			continue
+		}
 		var backupMetadata metadata.BackupMetadata
-		if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
-			return nil, err
+		if err := decode(backupMetadataBody, &backupMetadata); err != nil {
+			fn(BackupLocal{
+				BackupMetadata: metadata.BackupMetadata{
+					BackupName:   name,
+					CreationDate: info.ModTime(),
+				},
+				Broken: fmt.Sprintf("%s unparseable: %v", MetaFileName, err),
+			})
+			continue
 		}
-		result = append(result, BackupLocal{
+		fn(BackupLocal{
 			BackupMetadata: backupMetadata,
 			Legacy:         false,
 		})
 	}
-	sort.SliceStable(result, func(i, j int) bool {
-		return result[i].CreationDate.Before(result[j].CreationDate)
-	})
-	return result, nil
+	return nil
+}
+
+// isLegacyBackup - backups created before metadata.json was introduced have only shadow directory,
+// directory without metadata.json and with metadata/<db>/<table>.json files is left by failed create or download
+func isLegacyBackup(backupPath string) bool {
+	if info, err := os.Stat(path.Join(backupPath, "shadow")); err != nil || !info.IsDir() {
+		return false
+	}
+	tableMetadata, err := filepath.Glob(path.Join(backupPath, "metadata", "*", "*.json"))
+	return err == nil && len(tableMetadata) == 0
 }
 
 func PrintAllBackups(cfg *config.Config, format string) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.DiscardEmptyColumns)
 	defer w.Flush()
-	localBackups, err := GetLocalBackups(cfg)
+	localBackups, _, err := ListBackupsPaged(cfg, 0, 0, ListOptions{})
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -207,6 +356,19 @@ func PrintRemoteBackups(cfg *config.Config, format string) error {
 	return printBackupsRemote(w, backupList, format)
 }
 
+// GetLocalBackup - find local backup by name, broken backup is returned together with error wrapping ErrBackupBroken
+// so caller can decide to delete it
+func GetLocalBackup(cfg *config.Config, backupName string) (BackupLocal, error) {
+	backup, err := getLocalBackup(cfg, backupName)
+	if err != nil {
+		return BackupLocal{}, err
+	}
+	if backup.Broken != "" {
+		return *backup, fmt.Errorf("%w: '%s' is %s", ErrBackupBroken, backupName, backup.Broken)
+	}
+	return *backup, nil
+}
+
 func getLocalBackup(cfg *config.Config, backupName string) (*BackupLocal, error) {
 	if backupName == "" {
 		return nil, fmt.Errorf("backup name is required")
@@ -223,7 +385,8 @@ func getLocalBackup(cfg *config.Config, backupName string) (*BackupLocal, error)
 	return nil, fmt.Errorf("backup '%s' is not found", backupName)
 }
 
-// GetRemoteBackups - get all backups stored on remote storage
+// GetRemoteBackups - get all backups stored on remote storage sorted by upload date with metadata.json of every backup,
+// backups with missing or unreadable metadata.json are returned with Broken reason like local ones
 func GetRemoteBackups(cfg *config.Config) ([]new_storage.Backup, error) {
 	if cfg.General.RemoteStorage == "none" {
 		return nil, fmt.Errorf("remote_storage is 'none'")
@@ -243,7 +406,8 @@ func GetRemoteBackups(cfg *config.Config) ([]new_storage.Backup, error) {
 	return backupList, err
 }
 
-// getTables - get all tables for use by PrintTables and API
+// getTables - get all tables for use by PrintTables and API, tables of general.skip_databases are marked as skipped
+// as well as tables matched by clickhouse.skip_tables
 func GetTables(cfg config.Config) ([]clickhouse.Table, error) {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
@@ -258,6 +422,11 @@ func GetTables(cfg config.Config) ([]clickhouse.Table, error) {
 	if err != nil {
 		return []clickhouse.Table{}, fmt.Errorf("can't get tables: %v", err)
 	}
+	for i := range allTables {
+		if isSkippedDatabase(allTables[i].Database, cfg.General.SkipDatabases) {
+			allTables[i].Skip = true
+		}
+	}
 	return allTables, nil
 }
 
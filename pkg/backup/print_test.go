@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionInfo(t *testing.T) {
+	assert.Equal(t, "data 1.00KiB", compressionInfo(metadata.BackupMetadata{DataSize: 1024, CompressedSize: 1024}))
+	assert.Equal(t, "data 1.00KiB", compressionInfo(metadata.BackupMetadata{DataSize: 1024}))
+	assert.Equal(t, "data 1.00KiB, compressed 256B (4.0x)", compressionInfo(metadata.BackupMetadata{DataSize: 1024, CompressedSize: 256}))
+}
+
+func TestReadLocalBackups(t *testing.T) {
+	backupsPath, err := ioutil.TempDir("", "clickhouse-backup-list")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupsPath)
+	writeMetadata := func(name, fileName, body string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(backupsPath, name), 0750))
+		if fileName != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, name, fileName), []byte(body), 0640))
+		}
+	}
+	writeMetadata("old", MetaFileName, `{"backup_name":"old","creation_date":"2021-01-01T00:00:00Z"}`)
+	writeMetadata("new", MetaFileName, `{"backup_name":"new","creation_date":"2021-01-03T00:00:00Z"}`)
+	writeMetadata("corrupted", MetaFileName, `{"backup_name":`)
+	writeMetadata(filepath.Join("legacy", "shadow", "db", "t1"), "", "")
+	writeMetadata(filepath.Join("partial", "metadata", "db"), "t1.json", `{"table":"t1"}`)
+	writeMetadata("empty", "", "")
+	writeMetadata("deleting", DeletingMetaFileName, `{"backup_name":"deleting","creation_date":"2021-01-02T00:00:00Z"}`)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupsPath, "file.txt"), []byte("not a backup"), 0640))
+
+	backups, err := readLocalBackups(backupsPath)
+	require.NoError(t, err)
+	require.Len(t, backups, 7)
+	byName := map[string]BackupLocal{}
+	for _, b := range backups {
+		byName[b.BackupName] = b
+	}
+	assert.Empty(t, byName["old"].Broken)
+	assert.False(t, byName["old"].Legacy)
+	assert.Contains(t, byName["corrupted"].Broken, "metadata.json unparseable")
+	assert.True(t, byName["legacy"].Legacy)
+	assert.Empty(t, byName["legacy"].Broken)
+	assert.False(t, byName["partial"].Legacy)
+	assert.Equal(t, BrokenMetadataMissing, byName["partial"].Broken)
+	assert.Equal(t, BrokenMetadataMissing, byName["empty"].Broken)
+	assert.Equal(t, BrokenPartiallyDeleted, byName["deleting"].Broken)
+	assert.Equal(t, []string{"old", "deleting", "new"}, []string{backups[0].BackupName, backups[1].BackupName, backups[2].BackupName})
+
+	backups, err = readLocalBackups(filepath.Join(backupsPath, "absent"))
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+}
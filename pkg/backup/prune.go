@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+)
+
+// PruneBackupMetadata - remove table metadata files and shadow directories of local backup
+// which are not referenced by tables list of metadata.json, return removed paths
+func PruneBackupMetadata(cfg *config.Config, backupName string) ([]string, error) {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "prune",
+	})
+	backup, err := getLocalBackup(cfg, backupName)
+	if err != nil {
+		return nil, err
+	}
+	if backup.Legacy {
+		return nil, fmt.Errorf("'%s' is old format backup and doesn't contain tables list", backupName)
+	}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	ch.SetQueryComment("prune", backupName)
+	if err := ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+	defaultPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return nil, ErrUnknownClickhouseDataPath
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return nil, err
+	}
+	removed, metadataRemoved, err := pruneBackup(cfg, backup.BackupMetadata, defaultPath, disks)
+	for _, removedPath := range removed {
+		log.WithField("path", removedPath).Info("orphaned, removed")
+	}
+	if err != nil {
+		return removed, err
+	}
+	if metadataRemoved {
+		if err := signBackupLocal(cfg, ch, path.Join(localBackupsPath(cfg, defaultPath), backupName)); err != nil {
+			return removed, err
+		}
+	}
+	log.WithField("removed", len(removed)).Info("done")
+	return removed, nil
+}
+
+// pruneBackup - reconcile metadata and shadow directories of backup with backupMetadata.Tables
+func pruneBackup(cfg *config.Config, backupMetadata metadata.BackupMetadata, defaultPath string, disks []clickhouse.Disk) ([]string, bool, error) {
+	var removed []string
+	tables := map[string]struct{}{}
+	for _, t := range backupMetadata.Tables {
+		tables[path.Join(clickhouse.TablePathEncode(t.Database), clickhouse.TablePathEncode(t.Table))] = struct{}{}
+	}
+
+	metadataPath := path.Join(localBackupsPath(cfg, defaultPath), backupMetadata.BackupName, "metadata")
+	metadataFiles, err := filepath.Glob(path.Join(metadataPath, "*", "*.json"))
+	if err != nil {
+		return nil, false, err
+	}
+	for _, metadataFile := range metadataFiles {
+		relativePath, err := filepath.Rel(metadataPath, metadataFile)
+		if err != nil {
+			return removed, false, err
+		}
+		if _, ok := tables[strings.TrimSuffix(filepath.ToSlash(relativePath), ".json")]; ok {
+			continue
+		}
+		if err := os.Remove(metadataFile); err != nil {
+			return removed, len(removed) > 0, err
+		}
+		removed = append(removed, metadataFile)
+		removeEmptyDirs(filepath.Dir(metadataFile), metadataPath)
+	}
+	metadataRemoved := len(removed) > 0
+
+	for _, disk := range disks {
+		backupPath := path.Join(localBackupsPath(cfg, disk.Path), backupMetadata.BackupName)
+		referenced := map[string]struct{}{}
+		for _, t := range backupMetadata.Tables {
+			referenced[backupShadowPath(localBackupsPath(cfg, disk.Path), backupMetadata.BackupName, backupMetadata.ShadowLayout, disk.Name, t.Database, t.Table)] = struct{}{}
+		}
+		shadowDirs, err := filepath.Glob(path.Join(backupPath, shadowGlob(backupMetadata.ShadowLayout, disk.Name)))
+		if err != nil {
+			return removed, metadataRemoved, err
+		}
+		for _, shadowDir := range shadowDirs {
+			if _, ok := referenced[shadowDir]; ok {
+				continue
+			}
+			if err := os.RemoveAll(shadowDir); err != nil {
+				return removed, metadataRemoved, err
+			}
+			removed = append(removed, shadowDir)
+			removeEmptyDirs(filepath.Dir(shadowDir), path.Join(backupPath, "shadow"))
+		}
+	}
+	return removed, metadataRemoved, nil
+}
+
+// shadowGlob - pattern which matches table directories of disk for clickhouse.ShadowPath layout
+func shadowGlob(layout, diskName string) string {
+	if layout == clickhouse.ShadowLayoutDisk {
+		return path.Join("shadow", diskName, "*", "*")
+	}
+	return path.Join("shadow", "*", "*", diskName)
+}
+
+// removeEmptyDirs - remove dir and its parents up to root while they are empty
+func removeEmptyDirs(dir, root string) {
+	for dir != root && len(dir) > len(root) {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
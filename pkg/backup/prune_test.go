@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneBackup(t *testing.T) {
+	diskPath, err := ioutil.TempDir("", "clickhouse-backup-prune")
+	require.NoError(t, err)
+	defer os.RemoveAll(diskPath)
+	backupPath := filepath.Join(diskPath, "backup", "test")
+	for _, dir := range []string{
+		"metadata/db",
+		"metadata/orphan",
+		"shadow/db/table/default/all_1_1_0",
+		"shadow/db/dropped/default/all_1_1_0",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(backupPath, dir), 0750))
+	}
+	for _, file := range []string{"metadata/db/table.json", "metadata/db/dropped.json", "metadata/orphan/table.json"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, file), []byte("{}"), 0640))
+	}
+	backupMetadata := metadata.BackupMetadata{
+		BackupName: "test",
+		Tables:     []metadata.TableTitle{{Database: "db", Table: "table"}},
+	}
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}}
+
+	removed, metadataRemoved, err := pruneBackup(config.DefaultConfig(), backupMetadata, diskPath, disks)
+	require.NoError(t, err)
+	assert.True(t, metadataRemoved)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(backupPath, "metadata/db/dropped.json"),
+		filepath.Join(backupPath, "metadata/orphan/table.json"),
+		filepath.Join(backupPath, "shadow/db/dropped/default"),
+	}, removed)
+	assert.FileExists(t, filepath.Join(backupPath, "metadata/db/table.json"))
+	assert.DirExists(t, filepath.Join(backupPath, "shadow/db/table/default/all_1_1_0"))
+	_, err = os.Stat(filepath.Join(backupPath, "metadata/orphan"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(backupPath, "shadow/db/dropped"))
+	assert.True(t, os.IsNotExist(err))
+
+	removed, metadataRemoved, err = pruneBackup(config.DefaultConfig(), backupMetadata, diskPath, disks)
+	require.NoError(t, err)
+	assert.False(t, metadataRemoved)
+	assert.Empty(t, removed)
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter - space events at least 1/rate seconds apart, safe for concurrent use
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// freezeLimiter - general.freeze_rate_limit is shared by all backups created by this process
+var freezeLimiter = &rateLimiter{}
+
+// reserve - return delay before event is allowed, rate <= 0 means unlimited
+func (l *rateLimiter) reserve(rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(time.Second) / rate))
+	return delay
+}
+
+// Wait - block until event is allowed, ctx.Err() is returned when ctx is done before
+func (l *rateLimiter) Wait(ctx context.Context, rate float64) error {
+	delay := l.reserve(rate)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{}
+	assert.Equal(t, time.Duration(0), l.reserve(0))
+	assert.Equal(t, time.Duration(0), l.reserve(10))
+	assert.InDelta(t, float64(100*time.Millisecond), float64(l.reserve(10)), float64(10*time.Millisecond))
+	assert.InDelta(t, float64(200*time.Millisecond), float64(l.reserve(10)), float64(10*time.Millisecond))
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	l := &rateLimiter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, l.Wait(ctx, 0.1))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	assert.Equal(t, context.Canceled, l.Wait(ctx, 0.1))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, context.Canceled, l.Wait(ctx, 0))
+}
@@ -2,6 +2,7 @@ package backup
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -25,28 +26,97 @@ func (rt RestoreTables) Sort(dropTable bool) {
 	})
 }
 
-// Restore - restore tables matched by tablePattern from backupName
-func Restore(cfg *config.Config, backupName string, tablePattern string, schemaOnly bool, dataOnly bool, dropTable bool) error {
+// RestoreOptions - options of Restore and RestoreFromRemote, zero value restores schema and data of all tables
+type RestoreOptions struct {
+	TablePattern string
+	SchemaOnly   bool
+	DataOnly     bool
+	// DropTable - drop existing tables of restore before they are created, see dropChangedDatabases for databases
+	DropTable bool
+	// OnlyMissing - only tables which are absent in clickhouse are restored
+	OnlyMissing bool
+	// StoragePolicy - storage_policy of tables is rewritten, 'default' removes the setting
+	StoragePolicy string
+	// OnCluster - databases and tables are created ON CLUSTER, data is restored on local node only
+	OnCluster string
+	// IgnoreSignature - backup with modified metadata is restored when metadata_signing_key is configured
+	IgnoreSignature bool
+	// TableMapping - tables are restored under new names, see parseTableMapping for format
+	TableMapping []string
+	// DropPartFraction - fraction of parts which are not attached on purpose for fault injection, see checkDropPartFraction
+	DropPartFraction float64
+}
+
+// Restore - restore tables matched by opts.TablePattern from backupName
+// When clickhouse.restore_database_mapping is set databases and their tables are restored under new database names
+func Restore(cfg *config.Config, backupName string, opts RestoreOptions) error {
+	if err := checkDropPartFraction(opts.DropPartFraction); err != nil {
+		return err
+	}
+	tablesMap, err := parseTableMapping(opts.TableMapping)
+	if err != nil {
+		return err
+	}
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
+	ch.SetQueryComment("restore", backupName)
 	if err := ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
 	defer ch.Close()
+	if opts.OnCluster != "" {
+		if err := ch.CheckCluster(opts.OnCluster); err != nil {
+			return err
+		}
+	}
 	defaultDataPath, err := ch.GetDefaultPath()
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
 	}
-	backupMetafileLocalPath := path.Join(defaultDataPath, "backup", backupName, "metadata.json")
+	if _, err := GetLocalBackup(cfg, backupName); errors.Is(err, ErrBackupBroken) {
+		return fmt.Errorf("can't restore: %v", err)
+	}
+	backupMetafileLocalPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata.json")
 	backupMetadataBody, err := ioutil.ReadFile(backupMetafileLocalPath)
 	if err == nil {
 		backupMetadata := metadata.BackupMetadata{}
 		if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
 			return err
 		}
-		for _, database := range backupMetadata.Databases {
-			if err := ch.CreateDatabaseFromQuery(database.Query); err != nil {
+		if cfg.General.MetadataSigningKey != "" {
+			if err := verifyBackupSignature(cfg.General.MetadataSigningKey, path.Join(localBackupsPath(cfg, defaultDataPath), backupName)); err != nil {
+				if !opts.IgnoreSignature {
+					return fmt.Errorf("can't restore '%s': %v", backupName, err)
+				}
+				apexLog.Warnf("'%s' %v, restore forced", backupName, err)
+			}
+		}
+		if backupMetadata.DataOnly {
+			if opts.SchemaOnly || opts.DropTable || opts.OnlyMissing {
+				return fmt.Errorf("'%s' is data only backup, tables must exist and only data can be restored", backupName)
+			}
+			opts.DataOnly = true
+		}
+		checkMacros(ch, backupMetadata)
+		if opts.DataOnly || !opts.SchemaOnly {
+			if err := checkDiskIDs(cfg, ch, backupMetadata); err != nil {
+				return err
+			}
+		}
+		databases, err := mapDatabases(backupMetadata.Databases, cfg.ClickHouse.RestoreDatabaseMapping)
+		if err != nil {
+			return err
+		}
+		// tables of data only restore must exist, so databases are not created
+		if opts.SchemaOnly || (opts.SchemaOnly == opts.DataOnly) {
+			if opts.DropTable {
+				metadataPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata")
+				if err := dropChangedDatabases(ch, metadataPath, opts.TablePattern, tablesMap, cfg.ClickHouse.RestoreDatabaseMapping, databases, opts.OnCluster); err != nil {
+					return err
+				}
+			}
+			if err := restoreDatabases(ch, databases, opts.OnCluster); err != nil {
 				return err
 			}
 		}
@@ -57,24 +127,131 @@ func Restore(cfg *config.Config, backupName string, tablePattern string, schemaO
 	} else if !os.IsNotExist(err) { // Legacy backups don't contain metadata.json
 		return err
 	}
+	if opts.OnlyMissing {
+		metadataPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata")
+		missingTablesPattern, err := getMissingTablesPattern(ch, metadataPath, opts.TablePattern, tablesMap, cfg.ClickHouse.RestoreDatabaseMapping)
+		if err != nil {
+			return err
+		}
+		if missingTablesPattern == "" {
+			apexLog.Infof("all tables from '%s' already exist, nothing to do", backupName)
+			return nil
+		}
+		opts.TablePattern = missingTablesPattern
+	}
 
-	if schemaOnly || (schemaOnly == dataOnly) {
-		if err := RestoreSchema(cfg, backupName, tablePattern, dropTable); err != nil {
+	if opts.SchemaOnly || (opts.SchemaOnly == opts.DataOnly) {
+		if err := RestoreSchema(cfg, backupName, opts.TablePattern, opts.DropTable, opts.StoragePolicy, opts.OnCluster, tablesMap); err != nil {
 			return err
 		}
 	}
-	if dataOnly || (schemaOnly == dataOnly) {
-		if err := RestoreData(cfg, backupName, tablePattern); err != nil {
+	if opts.DataOnly || (opts.SchemaOnly == opts.DataOnly) {
+		if err := RestoreData(cfg, backupName, opts.TablePattern, tablesMap, opts.DropPartFraction); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// parseTableMapping - parse '<db>.<table>:<db>.<new_table>' items, database of new name can be omitted
+func parseTableMapping(tableMapping []string) (map[metadata.TableTitle]metadata.TableTitle, error) {
+	result := map[metadata.TableTitle]metadata.TableTitle{}
+	targets := map[metadata.TableTitle]struct{}{}
+	for _, item := range tableMapping {
+		names := strings.SplitN(item, ":", 2)
+		src := strings.SplitN(names[0], ".", 2)
+		if len(names) != 2 || len(src) != 2 || src[0] == "" || src[1] == "" || names[1] == "" {
+			return nil, fmt.Errorf("invalid table mapping '%s', expected <db>.<table>:<db>.<new_table>", item)
+		}
+		dst := strings.SplitN(names[1], ".", 2)
+		if len(dst) == 1 {
+			dst = []string{src[0], dst[0]}
+		}
+		if dst[0] == "" || dst[1] == "" {
+			return nil, fmt.Errorf("invalid table mapping '%s', expected <db>.<table>:<db>.<new_table>", item)
+		}
+		srcTable := metadata.TableTitle{Database: src[0], Table: src[1]}
+		dstTable := metadata.TableTitle{Database: dst[0], Table: dst[1]}
+		if _, exists := result[srcTable]; exists {
+			return nil, fmt.Errorf("table '%s' is mapped more than once", names[0])
+		}
+		if _, exists := targets[dstTable]; exists {
+			return nil, fmt.Errorf("several tables are mapped to '%s.%s'", dstTable.Database, dstTable.Table)
+		}
+		result[srcTable] = dstTable
+		targets[dstTable] = struct{}{}
+	}
+	return result, nil
+}
+
+// mapTable - name under which backup table will be restored, mapping of table takes precedence over mapping of its database,
+// unmapped tables keep original name
+func mapTable(tablesMap map[metadata.TableTitle]metadata.TableTitle, databasesMap map[string]string, database, table string) metadata.TableTitle {
+	title := metadata.TableTitle{Database: database, Table: table}
+	if dst, ok := tablesMap[title]; ok {
+		return dst
+	}
+	if dstDatabase, ok := databasesMap[database]; ok {
+		title.Database = dstDatabase
+	}
+	return title
+}
+
+// mapDatabases - databases of backup under names from restore_database_mapping, CREATE queries are rewritten
+func mapDatabases(databases []metadata.DatabasesMeta, databasesMap map[string]string) ([]metadata.DatabasesMeta, error) {
+	result := make([]metadata.DatabasesMeta, len(databases))
+	for i, database := range databases {
+		result[i] = database
+		dstDatabase, ok := databasesMap[database.Name]
+		if !ok {
+			continue
+		}
+		apexLog.Infof("database '%s' will be restored as '%s'", database.Name, dstDatabase)
+		result[i].Name = dstDatabase
+		if database.Query == "" {
+			continue
+		}
+		query, err := clickhouse.RenameDatabaseInQuery(database.Query, database.Name, dstDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("can't restore database '%s' as '%s': %v", database.Name, dstDatabase, err)
+		}
+		result[i].Query = query
+	}
+	return result, nil
+}
+
+// getMissingTablesPattern - return pattern which matches only backup tables absent in clickhouse
+func getMissingTablesPattern(ch *clickhouse.ClickHouse, metadataPath, tablePattern string, tablesMap map[metadata.TableTitle]metadata.TableTitle, databasesMap map[string]string) (string, error) {
+	tablesForRestore, err := parseSchemaPattern(metadataPath, tablePattern, false)
+	if err != nil {
+		return "", err
+	}
+	chTables, err := ch.GetTables()
+	if err != nil {
+		return "", err
+	}
+	existsTables := map[metadata.TableTitle]struct{}{}
+	for _, t := range chTables {
+		existsTables[metadata.TableTitle{Database: t.Database, Table: t.Name}] = struct{}{}
+	}
+	var missingTables []string
+	for _, t := range tablesForRestore {
+		log := apexLog.WithField("table", fmt.Sprintf("%s.%s", t.Database, t.Table))
+		if _, ok := existsTables[mapTable(tablesMap, databasesMap, t.Database, t.Table)]; ok {
+			log.Info("already exists, skipped")
+			continue
+		}
+		log.Info("missing, will be restored")
+		missingTables = append(missingTables, escapeTablePattern(fmt.Sprintf("%s.%s", t.Database, t.Table)))
+	}
+	return strings.Join(missingTables, ","), nil
+}
+
 func RestoreforAgent(cfg *config.Config, backupName string, restore_tables []clickhouse.TableParams, dropTable bool) error {
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
+	ch.SetQueryComment("restore", backupName)
 	if err := ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
@@ -83,18 +260,39 @@ func RestoreforAgent(cfg *config.Config, backupName string, restore_tables []cli
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
 	}
-	backupMetafileLocalPath := path.Join(defaultDataPath, "backup", backupName, "metadata.json")
+	if _, err := GetLocalBackup(cfg, backupName); errors.Is(err, ErrBackupBroken) {
+		return fmt.Errorf("can't restore: %v", err)
+	}
+	backupMetafileLocalPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata.json")
 	backupMetadataBody, err := ioutil.ReadFile(backupMetafileLocalPath)
 	if err == nil {
 		backupMetadata := metadata.BackupMetadata{}
 		if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
 			return err
 		}
-		for _, database := range backupMetadata.Databases {
-			if err := ch.CreateDatabaseFromQuery(database.Query); err != nil {
-				return err
+		if cfg.General.MetadataSigningKey != "" {
+			if err := verifyBackupSignature(cfg.General.MetadataSigningKey, path.Join(localBackupsPath(cfg, defaultDataPath), backupName)); err != nil {
+				return fmt.Errorf("can't restore '%s': %v", backupName, err)
 			}
 		}
+		if backupMetadata.DataOnly {
+			for _, table := range restore_tables {
+				if table.SchemaOnly || !table.DataOnly {
+					return fmt.Errorf("'%s' is data only backup, schema of '%s' can't be restored", backupName, table.Name)
+				}
+			}
+		}
+		checkMacros(ch, backupMetadata)
+		if err := checkDiskIDs(cfg, ch, backupMetadata); err != nil {
+			return err
+		}
+		databases, err := mapDatabases(backupMetadata.Databases, cfg.ClickHouse.RestoreDatabaseMapping)
+		if err != nil {
+			return err
+		}
+		if err := restoreDatabases(ch, databases, ""); err != nil {
+			return err
+		}
 		if len(backupMetadata.Tables) == 0 {
 			apexLog.Infof("'%s' is empty backup, nothing to do", backupName)
 			return nil
@@ -117,19 +315,168 @@ func RestoreforAgent(cfg *config.Config, backupName string, restore_tables []cli
 	meta_tables = strings.TrimPrefix(meta_tables, ",")
 	data_tables = strings.TrimPrefix(data_tables, ",")
 
-	if err := RestoreSchema(cfg, backupName, meta_tables, dropTable); err != nil {
+	if err := RestoreSchema(cfg, backupName, meta_tables, dropTable, "", "", nil); err != nil {
 		return err
 	}
 
-	if err := RestoreData(cfg, backupName, data_tables); err != nil {
+	if err := RestoreData(cfg, backupName, data_tables, nil, 0); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// RestoreSchema - restore schemas matched by tablePattern from backupName
-func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, dropTable bool) error {
+// databaseEngineOrder - Replicated databases replay tables from zookeeper and are created after local ones,
+// databases with unknown engines are created last
+func databaseEngineOrder(engine string) int {
+	switch engine {
+	case "Ordinary", "Atomic", "Lazy", "Memory":
+		return 0
+	case "Replicated":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// restoreDatabases - create databases from backup metadata before any table
+// Atomic databases get fresh UUID, databases which can't be safely recreated are reported
+func restoreDatabases(ch *clickhouse.ClickHouse, databases []metadata.DatabasesMeta, onCluster string) error {
+	sorted := make([]metadata.DatabasesMeta, len(databases))
+	copy(sorted, databases)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if databaseEngineOrder(sorted[i].Engine) != databaseEngineOrder(sorted[j].Engine) {
+			return databaseEngineOrder(sorted[i].Engine) < databaseEngineOrder(sorted[j].Engine)
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	var unsafeDatabases []string
+	for _, database := range sorted {
+		query := database.Query
+		if query == "" {
+			query = fmt.Sprintf("CREATE DATABASE `%s` ENGINE = %s", database.Name, database.Engine)
+		}
+		switch database.Engine {
+		case "Atomic":
+			query = clickhouse.RemoveDatabaseUUID(query)
+		case "Replicated":
+			if !strings.Contains(query, "{") {
+				unsafeDatabases = append(unsafeDatabases, fmt.Sprintf("%s (Replicated without macros in zookeeper path)", database.Name))
+			}
+		case "Ordinary", "Lazy", "Memory":
+		default:
+			unsafeDatabases = append(unsafeDatabases, fmt.Sprintf("%s (%s)", database.Name, database.Engine))
+		}
+		if err := ch.CreateDatabaseFromQuery(query, onCluster); err != nil {
+			return fmt.Errorf("can't create database '%s': %v", database.Name, err)
+		}
+	}
+	if len(unsafeDatabases) > 0 {
+		apexLog.Warnf("databases %s can't be safely recreated from backup, please check them", strings.Join(unsafeDatabases, ", "))
+	}
+	return nil
+}
+
+// dropChangedDatabases - drop existing databases which engine differs from backup, so they are recreated from backup,
+// database is dropped only when all its tables are restored, otherwise it is kept with warning.
+// Tables are checked on local node only, so with onCluster databases are never dropped
+func dropChangedDatabases(ch *clickhouse.ClickHouse, metadataPath, tablePattern string, tablesMap map[metadata.TableTitle]metadata.TableTitle, databasesMap map[string]string, databases []metadata.DatabasesMeta, onCluster string) error {
+	if tablePattern == "" {
+		tablePattern = "*"
+	}
+	tablesForRestore, err := parseSchemaPattern(metadataPath, tablePattern, true)
+	if err != nil {
+		return err
+	}
+	restoreSet := map[metadata.TableTitle]struct{}{}
+	for _, t := range tablesForRestore {
+		restoreSet[mapTable(tablesMap, databasesMap, t.Database, t.Table)] = struct{}{}
+	}
+	liveDatabases, err := ch.GetDatabases()
+	if err != nil {
+		return err
+	}
+	liveTables, err := ch.GetTables()
+	if err != nil {
+		return err
+	}
+	recreate, kept := databasesToRecreate(databases, liveDatabases, liveTables, restoreSet)
+	for _, database := range kept {
+		apexLog.WithField("database", database).Warn("engine differs from backup, database is not dropped because it has tables which are not restored")
+	}
+	for _, database := range recreate {
+		if onCluster != "" {
+			// tables are checked on local node only, other replicas may have tables which are not restored
+			apexLog.WithField("database", database).Warnf("engine differs from backup, database is not recreated with --on-cluster, drop it on all replicas of '%s' manually", onCluster)
+			continue
+		}
+		apexLog.WithField("database", database).Warn("engine differs from backup, drop database")
+		if err := ch.DropDatabase(database, ""); err != nil {
+			return fmt.Errorf("can't drop database '%s': %v", database, err)
+		}
+	}
+	return nil
+}
+
+// databasesToRecreate - existing databases which engine differs from backup, recreate contains databases
+// whose tables are all in restoreSet, the rest are kept
+func databasesToRecreate(databases []metadata.DatabasesMeta, liveDatabases []clickhouse.Database, liveTables []clickhouse.Table, restoreSet map[metadata.TableTitle]struct{}) (recreate []string, kept []string) {
+	liveEngines := map[string]string{}
+	for _, database := range liveDatabases {
+		liveEngines[database.Name] = database.Engine
+	}
+	notRestored := map[string]bool{}
+	for _, table := range liveTables {
+		if _, ok := restoreSet[metadata.TableTitle{Database: table.Database, Table: table.Name}]; !ok {
+			notRestored[table.Database] = true
+		}
+	}
+	for _, database := range databases {
+		engine, exists := liveEngines[database.Name]
+		if !exists || database.Engine == "" || engine == database.Engine {
+			continue
+		}
+		if notRestored[database.Name] {
+			kept = append(kept, database.Name)
+			continue
+		}
+		recreate = append(recreate, database.Name)
+	}
+	return recreate, kept
+}
+
+// checkMacros - warn when backup was created on another shard
+func checkMacros(ch *clickhouse.ClickHouse, backupMetadata metadata.BackupMetadata) {
+	backupShard, ok := backupMetadata.Macros["shard"]
+	if !ok {
+		return
+	}
+	macros, err := ch.GetMacros()
+	if err != nil {
+		apexLog.Warnf("%v", err)
+		return
+	}
+	if shard, ok := macros["shard"]; ok && shard != backupShard {
+		apexLog.Warnf("'%s' was created on shard '%s', but current node has shard '%s' in system.macros", backupMetadata.BackupName, backupShard, shard)
+	}
+}
+
+// checkStoragePolicy - storage policy for rewrite must exist in clickhouse
+func checkStoragePolicy(ch *clickhouse.ClickHouse, storagePolicy string) error {
+	policies, err := ch.GetStoragePolicies()
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		if policy == storagePolicy {
+			return nil
+		}
+	}
+	return fmt.Errorf("storage policy '%s' is not found in clickhouse, available: %s", storagePolicy, strings.Join(policies, ", "))
+}
+
+// RestoreSchema - restore schemas matched by tablePattern from backupName, tables from tablesMap are created under new names
+func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, dropTable bool, storagePolicy string, onCluster string, tablesMap map[metadata.TableTitle]metadata.TableTitle) error {
 	if backupName == "" {
 		_ = PrintLocalBackups(cfg, "all")
 		return fmt.Errorf("select backup for restore")
@@ -137,16 +484,27 @@ func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, d
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
+	ch.SetQueryComment("restore", backupName)
 	if err := ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
 	defer ch.Close()
+	if storagePolicy != "" {
+		if err := checkStoragePolicy(ch, storagePolicy); err != nil {
+			return err
+		}
+	}
+	if onCluster != "" {
+		if err := ch.CheckCluster(onCluster); err != nil {
+			return err
+		}
+	}
 
 	defaultDataPath, err := ch.GetDefaultPath()
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
 	}
-	metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
+	metadataPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata")
 	info, err := os.Stat(metadataPath)
 	if err != nil {
 		return err
@@ -165,6 +523,48 @@ func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, d
 		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
 	}
 
+	for i, schema := range tablesForRestore {
+		if dst := mapTable(tablesMap, cfg.ClickHouse.RestoreDatabaseMapping, schema.Database, schema.Table); dst.Database != schema.Database || dst.Table != schema.Table {
+			apexLog.Infof("'%s.%s' will be restored as '%s.%s'", schema.Database, schema.Table, dst.Database, dst.Table)
+			query, database := schema.Query, schema.Database
+			if dstDatabase, ok := cfg.ClickHouse.RestoreDatabaseMapping[schema.Database]; ok {
+				if query, err = clickhouse.RenameDatabaseInQuery(query, schema.Database, dstDatabase); err != nil {
+					return fmt.Errorf("can't restore '%s.%s' to database '%s': %v", schema.Database, schema.Table, dstDatabase, err)
+				}
+				database = dstDatabase
+			}
+			if tablesForRestore[i].Query, err = clickhouse.RenameTableInQuery(query, database, schema.Table, dst.Database, dst.Table); err != nil {
+				return fmt.Errorf("can't restore '%s.%s' as '%s.%s': %v", schema.Database, schema.Table, dst.Database, dst.Table, err)
+			}
+			tablesForRestore[i].Database, tablesForRestore[i].Table = dst.Database, dst.Table
+		}
+	}
+
+	liveTables, err := ch.GetTables()
+	if err != nil {
+		return err
+	}
+	liveTablesMap := map[metadata.TableTitle]struct{}{}
+	for _, t := range liveTables {
+		liveTablesMap[metadata.TableTitle{Database: t.Database, Table: t.Name}] = struct{}{}
+	}
+	var existingTables []string
+	for _, schema := range tablesForRestore {
+		if _, exists := liveTablesMap[metadata.TableTitle{Database: schema.Database, Table: schema.Table}]; !exists {
+			continue
+		}
+		if !dropTable {
+			existingTables = append(existingTables, fmt.Sprintf("'%s.%s'", schema.Database, schema.Table))
+			continue
+		}
+		apexLog.WithField("table", fmt.Sprintf("%s.%s", schema.Database, schema.Table)).Warn("already exists, drop and recreate from backup")
+	}
+	if len(existingTables) > 0 {
+		return fmt.Errorf("can't restore %s: %w", strings.Join(existingTables, ", "), ErrTableAlreadyExists)
+	}
+
+	checkDistributedClusters(ch, path.Join(localBackupsPath(cfg, defaultDataPath), backupName), tablesForRestore)
+
 	totalRetries := len(tablesForRestore)
 	restoreRetries := 0
 	var notRestoredTables RestoreTables
@@ -172,17 +572,20 @@ func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, d
 	for restoreRetries < totalRetries {
 		for _, schema := range tablesForRestore {
 			// if metadata.json doesn't contains "databases", we will re-create tables with default engine
-			if err = ch.CreateDatabase(schema.Database); err != nil {
+			if err = ch.CreateDatabase(schema.Database, onCluster); err != nil {
 				return fmt.Errorf("can't create database '%s': %v", schema.Database, err)
 			}
 			//materialized views should restore via ATTACH
 			schema.Query = strings.Replace(
 				schema.Query, "CREATE MATERIALIZED VIEW", "ATTACH MATERIALIZED VIEW", 1,
 			)
+			if storagePolicy != "" {
+				schema.Query = clickhouse.RewriteStoragePolicy(schema.Query, storagePolicy)
+			}
 			restoreErr = ch.CreateTable(clickhouse.Table{
 				Database: schema.Database,
 				Name:     schema.Table,
-			}, schema.Query, dropTable)
+			}, schema.Query, dropTable, onCluster)
 
 			if restoreErr != nil {
 				restoreRetries++
@@ -197,6 +600,10 @@ func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, d
 					)
 				}
 				notRestoredTables = append(notRestoredTables, schema)
+				continue
+			}
+			if err := ch.RestoreProjections(schema.Database, schema.Table, schema.Projections); err != nil {
+				return err
 			}
 		}
 		tablesForRestore = notRestoredTables
@@ -207,8 +614,11 @@ func RestoreSchema(cfg *config.Config, backupName string, tablePattern string, d
 	return nil
 }
 
-// RestoreData - restore data for tables matched by tablePattern from backupName
-func RestoreData(cfg *config.Config, backupName string, tablePattern string) error {
+// RestoreData - restore data for tables matched by tablePattern from backupName, data of tables from tablesMap is attached to new names
+func RestoreData(cfg *config.Config, backupName string, tablePattern string, tablesMap map[metadata.TableTitle]metadata.TableTitle, dropPartFraction float64) error {
+	if err := checkDropPartFraction(dropPartFraction); err != nil {
+		return err
+	}
 	if backupName == "" {
 		_ = PrintLocalBackups(cfg, "all")
 		return fmt.Errorf("select backup for restore")
@@ -220,6 +630,7 @@ func RestoreData(cfg *config.Config, backupName string, tablePattern string) err
 	ch := &clickhouse.ClickHouse{
 		Config: &cfg.ClickHouse,
 	}
+	ch.SetQueryComment("restore", backupName)
 	if err := ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
@@ -229,10 +640,10 @@ func RestoreData(cfg *config.Config, backupName string, tablePattern string) err
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
 	}
-	if clickhouse.IsClickhouseShadow(path.Join(defaulDataPath, "backup", backupName, "shadow")) {
+	if clickhouse.IsClickhouseShadow(path.Join(localBackupsPath(cfg, defaulDataPath), backupName, "shadow")) {
 		return fmt.Errorf("backups created in v0.0.1 is not supported now")
 	}
-	backup, err := getLocalBackup(cfg, backupName)
+	backup, err := GetLocalBackup(cfg, backupName)
 	if err != nil {
 		return fmt.Errorf("can't restore: %v", err)
 	}
@@ -240,7 +651,7 @@ func RestoreData(cfg *config.Config, backupName string, tablePattern string) err
 	if backup.Legacy {
 		tablesForRestore, err = ch.GetBackupTablesLegacy(backupName)
 	} else {
-		metadataPath := path.Join(defaulDataPath, "backup", backupName, "metadata")
+		metadataPath := path.Join(localBackupsPath(cfg, defaulDataPath), backupName, "metadata")
 		tablesForRestore, err = parseSchemaPattern(metadataPath, tablePattern, false)
 	}
 	if err != nil {
@@ -258,17 +669,18 @@ func RestoreData(cfg *config.Config, backupName string, tablePattern string) err
 	if err != nil {
 		return err
 	}
+	aliases, err := mapBackupDisks(getTablesDisks(tablesForRestore), disks, cfg.ClickHouse.RestoreDiskMapping)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		log.WithField("disk", alias.Name).Infof("restored to '%s' by restore_disk_mapping", cfg.ClickHouse.RestoreDiskMapping[alias.Name])
+	}
+	disks = append(disks, aliases...)
 	diskMap := map[string]string{}
 	for _, disk := range disks {
 		diskMap[disk.Name] = disk.Path
 	}
-	for _, t := range tablesForRestore {
-		for disk := range t.Parts {
-			if _, ok := diskMap[disk]; !ok {
-				return fmt.Errorf("table '%s.%s' require disk '%s' that not found in clickhouse, you can add nonexistent disks to disk_mapping config", t.Database, t.Table, disk)
-			}
-		}
-	}
 	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{}
 	for i := range chTables {
 		dstTablesMap[metadata.TableTitle{
@@ -279,35 +691,213 @@ func RestoreData(cfg *config.Config, backupName string, tablePattern string) err
 
 	var missingTables []string
 	for _, restoreTable := range tablesForRestore {
-		found := false
-		for _, chTable := range chTables {
-			if (restoreTable.Database == chTable.Database) && (restoreTable.Table == chTable.Name) {
-				found = true
-				break
-			}
-		}
+		dst := mapTable(tablesMap, cfg.ClickHouse.RestoreDatabaseMapping, restoreTable.Database, restoreTable.Table)
+		dstTable, found := dstTablesMap[dst]
 		if !found {
-			missingTables = append(missingTables, fmt.Sprintf("'%s.%s'", restoreTable.Database, restoreTable.Table))
+			missingTables = append(missingTables, fmt.Sprintf("'%s.%s'", dst.Database, dst.Table))
+			continue
+		}
+		if err := checkObjectStorageDisks(restoreTable, dstTable, disks); err != nil {
+			return err
 		}
 	}
 	if len(missingTables) > 0 {
 		return fmt.Errorf("%s is not created. Restore schema first or create missing tables manually", strings.Join(missingTables, ", "))
 	}
+	var mismatchedTables []string
+	for _, restoreTable := range tablesForRestore {
+		dst := mapTable(tablesMap, cfg.ClickHouse.RestoreDatabaseMapping, restoreTable.Database, restoreTable.Table)
+		// data only and legacy backups don't contain queries
+		if restoreTable.Query == "" {
+			continue
+		}
+		problems, ok := checkTableColumns(restoreTable.Query, dstTablesMap[dst].CreateTableQuery)
+		if !ok {
+			log.WithField("table", fmt.Sprintf("%s.%s", dst.Database, dst.Table)).Debug("columns can't be compared with backup, structure is not checked")
+			continue
+		}
+		if len(problems) > 0 {
+			mismatchedTables = append(mismatchedTables, fmt.Sprintf("'%s.%s' (%s)", dst.Database, dst.Table, strings.Join(problems, ", ")))
+		}
+	}
+	if len(mismatchedTables) > 0 {
+		return fmt.Errorf("structure of %s differs from backup, nothing is attached. Recreate tables with restore --schema --rm or align them with restore --schema-diff", strings.Join(mismatchedTables, ", "))
+	}
 
 	for _, table := range tablesForRestore {
-		log := log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table))
-		dstTableDataPaths := dstTablesMap[metadata.TableTitle{
-			Database: table.Database,
-			Table:    table.Table}].DataPaths
-		if err := ch.CopyData(backupName, table, disks, dstTableDataPaths); err != nil {
+		dst := mapTable(tablesMap, cfg.ClickHouse.RestoreDatabaseMapping, table.Database, table.Table)
+		log := log.WithField("table", fmt.Sprintf("%s.%s", dst.Database, dst.Table))
+		dstTableDataPaths := dstTablesMap[dst].DataPaths
+		if table.Dump != nil {
+			if err := restoreTableDump(cfg, ch, backupName, backup.ShadowLayout, table, dst, diskMap); err != nil {
+				return fmt.Errorf("can't restore '%s.%s': %v", table.Database, table.Table, err)
+			}
+			logTableDone(cfg, log.WithField("dump", table.Dump.File))
+			continue
+		}
+		if dropped := dropParts(backupName, &table, dropPartFraction); len(dropped) > 0 {
+			log.WithField("parts", strings.Join(dropped, ", ")).Warnf("fault injection, %d parts are not restored", len(dropped))
+		}
+		liveChecksums, err := getLiveChecksums(ch, dst.Database, dst.Table)
+		if err != nil {
+			return err
+		}
+		skipped := skipExistingParts(&table, func(disk string) string {
+			return backupShadowPath(localBackupsPath(cfg, diskMap[disk]), backupName, backup.ShadowLayout, disk, table.Database, table.Table)
+		}, liveChecksums)
+		if len(skipped) > 0 {
+			log.WithField("parts", strings.Join(skipped, ", ")).Debug("already attached, skipped")
+		}
+		// parts are read from shadow path of original table
+		if err := ch.CopyData(cfg.General.BackupDir, backupName, backup.ShadowLayout, table, disks, dstTableDataPaths); err != nil {
 			return fmt.Errorf("can't restore '%s.%s': %v", table.Database, table.Table, err)
 		}
 		log.Debugf("copied data to 'detached'")
-		if err := ch.AttachPartitions(table, disks); err != nil {
-			return fmt.Errorf("can't attach partitions for table '%s.%s': %v", table.Database, table.Table, err)
+		dstTable := table
+		dstTable.Database, dstTable.Table = dst.Database, dst.Table
+		if err := ch.AttachPartitions(dstTable, disks); err != nil {
+			return fmt.Errorf("can't attach partitions for table '%s.%s': %v", dst.Database, dst.Table, err)
+		}
+		logTableDone(cfg, log.WithFields(apexLog.Fields{
+			"attached": countParts(table),
+			"skipped":  len(skipped),
+		}))
+	}
+	log.Info("done")
+	return nil
+}
+
+// checkObjectStorageDisks - parts are restored by copying files to 'detached' of destination disk,
+// it doesn't work for disks which store data in object storage, so restore is refused before anything is copied
+func checkObjectStorageDisks(table metadata.TableMetadata, dstTable clickhouse.Table, disks []clickhouse.Disk) error {
+	dstDataPaths := clickhouse.GetDisksByPaths(disks, dstTable.DataPaths)
+	for disk, parts := range table.Parts {
+		if len(parts) == 0 {
+			continue
 		}
-		log.Debugf("attached parts")
-		log.Info("done")
+		dstDataPath, ok := dstDataPaths[disk]
+		if !ok {
+			if len(dstTable.DataPaths) == 0 {
+				continue
+			}
+			dstDataPath = dstTable.DataPaths[0]
+		}
+		dstDiskName := clickhouse.GetDiskByPath(disks, dstDataPath)
+		for _, dstDisk := range disks {
+			if dstDisk.Name == dstDiskName && dstDisk.IsObjectStorage() {
+				return fmt.Errorf(
+					"can't restore '%s.%s' to disk '%s' with type '%s', parts can be copied only to local disks, "+
+						"restore to local disk with --storage-policy and move parts by ALTER TABLE `%s`.`%s` MOVE PART '<part>' TO DISK '%s'",
+					dstTable.Database, dstTable.Name, dstDisk.Name, dstDisk.Type, dstTable.Database, dstTable.Name, dstDisk.Name,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// getBackupTableMetadata - return local backup and metadata of one table from it
+func getBackupTableMetadata(cfg *config.Config, ch *clickhouse.ClickHouse, backupName, database, table string) (*BackupLocal, *metadata.TableMetadata, error) {
+	backup, err := getLocalBackup(cfg, backupName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if backup.Legacy {
+		return nil, nil, fmt.Errorf("'%s' is legacy backup, it doesn't contain parts metadata", backupName)
+	}
+	defaultDataPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return nil, nil, ErrUnknownClickhouseDataPath
+	}
+	metadataPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata")
+	tables, err := parseSchemaPattern(metadataPath, escapeTablePattern(fmt.Sprintf("%s.%s", database, table)), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tables) == 0 {
+		return nil, nil, fmt.Errorf("table '%s.%s' is not found in '%s'", database, table, backupName)
+	}
+	return backup, &tables[0], nil
+}
+
+// RestoreParts - copy to detached and attach only partNames of table from backupName,
+// table must exist and all parts must be present in backup
+func RestoreParts(cfg *config.Config, backupName, database, table string, partNames []string) error {
+	if len(partNames) == 0 {
+		return fmt.Errorf("part names are required")
+	}
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore_parts",
+		"table":     fmt.Sprintf("%s.%s", database, table),
+	})
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	ch.SetQueryComment("restore", backupName)
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+
+	backup, tableMetadata, err := getBackupTableMetadata(cfg, ch, backupName, database, table)
+	if err != nil {
+		return err
+	}
+	if tableMetadata.Dump != nil {
+		return fmt.Errorf("'%s.%s' is stored in '%s' as dump of rows by backup_non_merge_tree_data, it has no parts to attach, use restore --data", database, table, backupName)
+	}
+	requiredParts := map[string]bool{}
+	for _, name := range partNames {
+		requiredParts[name] = false
+	}
+	parts := map[string][]metadata.Part{}
+	for disk, diskParts := range tableMetadata.Parts {
+		for _, part := range diskParts {
+			if _, ok := requiredParts[part.Name]; ok {
+				requiredParts[part.Name] = true
+				parts[disk] = append(parts[disk], part)
+			}
+		}
+	}
+	var missingParts []string
+	for _, name := range partNames {
+		if !requiredParts[name] {
+			missingParts = append(missingParts, name)
+		}
+	}
+	if len(missingParts) > 0 {
+		return fmt.Errorf("parts %s are not found in '%s' for table '%s.%s'", strings.Join(missingParts, ", "), backupName, database, table)
+	}
+	tableMetadata.Parts = parts
+
+	chTables, err := ch.GetTables()
+	if err != nil {
+		return err
+	}
+	var dstTable *clickhouse.Table
+	for i := range chTables {
+		if chTables[i].Database == database && chTables[i].Name == table {
+			dstTable = &chTables[i]
+			break
+		}
+	}
+	if dstTable == nil {
+		return fmt.Errorf("'%s.%s' is not created. Restore schema first or create table manually", database, table)
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	if err := checkObjectStorageDisks(*tableMetadata, *dstTable, disks); err != nil {
+		return err
+	}
+	if err := ch.CopyData(cfg.General.BackupDir, backupName, backup.ShadowLayout, *tableMetadata, disks, dstTable.DataPaths); err != nil {
+		return fmt.Errorf("can't restore parts of '%s.%s': %v", database, table, err)
+	}
+	log.Debugf("copied %d parts to 'detached'", len(partNames))
+	if err := ch.AttachPartitions(*tableMetadata, disks); err != nil {
+		return fmt.Errorf("can't attach parts for table '%s.%s': %v", database, table, err)
 	}
 	log.Info("done")
 	return nil
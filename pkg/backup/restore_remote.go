@@ -1,8 +1,9 @@
 package backup
 
-func (b *Backuper) RestoreFromRemote(backupName string, tablePattern string, schemaOnly bool, dataOnly bool, dropTable bool) error {
-	if err := b.Download(backupName, tablePattern, schemaOnly); err != nil {
+// RestoreFromRemote - download backup and restore it, schema only restore downloads only metadata
+func (b *Backuper) RestoreFromRemote(backupName string, opts RestoreOptions) error {
+	if err := b.Download(backupName, opts.TablePattern, opts.SchemaOnly, opts.IgnoreSignature); err != nil {
 		return err
 	}
-	return Restore(b.cfg, backupName, tablePattern, schemaOnly, dataOnly, dropTable)
+	return Restore(b.cfg, backupName, opts)
 }
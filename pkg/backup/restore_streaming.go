@@ -0,0 +1,365 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+
+	apexLog "github.com/apex/log"
+)
+
+// streamingRestoreRetries - attempts to download one part or archive of parts
+const streamingRestoreRetries = 3
+
+// RestoreFromRemoteStreaming - download schema of remote backup, create tables and restore data part by part,
+// every part or archive of parts is downloaded, moved to 'detached' and attached before the next one,
+// so local disk needs space for one archive instead of whole backup. Metadata is checked as Download does.
+// Schema is staged in local backup with the same name, it is removed when restore finishes or fails unless keepLocal is set.
+// Only TablePattern, DropTable and IgnoreSignature of opts are supported
+func (b *Backuper) RestoreFromRemoteStreaming(backupName string, opts RestoreOptions, keepLocal bool) error {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore_streaming",
+	})
+	if b.cfg.General.RemoteStorage == "none" {
+		return fmt.Errorf("remote storage is 'none'")
+	}
+	if backupName == "" {
+		_ = PrintRemoteBackups(b.cfg, "all")
+		return fmt.Errorf("select backup for restore")
+	}
+	if opts.SchemaOnly || opts.DataOnly || opts.OnlyMissing || opts.StoragePolicy != "" || opts.OnCluster != "" || len(opts.TableMapping) > 0 || opts.DropPartFraction != 0 {
+		return fmt.Errorf("streaming restore can't be used with schema only, data only, only missing, storage policy, on cluster and table mapping")
+	}
+	if len(b.cfg.ClickHouse.RestoreDatabaseMapping) > 0 {
+		return fmt.Errorf("streaming restore doesn't support restore_database_mapping, use restore_remote without --streaming")
+	}
+	remoteBackup, err := b.getRemoteBackup(backupName)
+	if err != nil {
+		return err
+	}
+	if remoteBackup.Legacy {
+		return fmt.Errorf("'%s' is old format backup and doesn't support streaming restore", backupName)
+	}
+	// tables metadata is read from remote storage again after Download, so it is checked here too
+	verifier, err := b.loadRemoteMetadataVerifier(backupName, opts.IgnoreSignature)
+	if err != nil {
+		return err
+	}
+	if err := b.verifyRemoteBackupMetadata(&remoteBackup, verifier); err != nil {
+		return err
+	}
+	if remoteBackup.RequiredBackup != "" {
+		return fmt.Errorf("'%s' is incremental backup of '%s' and doesn't support streaming restore, use restore_remote", backupName, remoteBackup.RequiredBackup)
+	}
+	if err := checkBackupEncryption(b.cfg, remoteBackup.BackupMetadata); err != nil {
+		return err
+	}
+	if err := b.Download(backupName, opts.TablePattern, true, opts.IgnoreSignature); err != nil {
+		// existing local backup is not staged by this restore
+		if !keepLocal && !errors.Is(err, ErrBackupIsAlreadyExists) {
+			removeStagedBackup(b.cfg, log, backupName)
+		}
+		return err
+	}
+	if !keepLocal {
+		defer removeStagedBackup(b.cfg, log, backupName)
+	}
+	if !remoteBackup.DataOnly {
+		if err := Restore(b.cfg, backupName, RestoreOptions{TablePattern: opts.TablePattern, SchemaOnly: true, DropTable: opts.DropTable, IgnoreSignature: opts.IgnoreSignature}); err != nil {
+			return err
+		}
+	}
+
+	b.ch.SetQueryComment("restore", backupName)
+	if err := b.ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer b.ch.Close()
+	if err := b.init(); err != nil {
+		return err
+	}
+	chTables, err := b.ch.GetTables()
+	if err != nil {
+		return err
+	}
+	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{}
+	for _, t := range chTables {
+		dstTablesMap[metadata.TableTitle{Database: t.Database, Table: t.Name}] = t
+	}
+	disks, err := b.ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	for _, title := range parseTablePatternForDownload(remoteBackup.Tables, opts.TablePattern) {
+		table, err := b.getRemoteTableMetadata(backupName, title, verifier)
+		if err != nil {
+			return err
+		}
+		dstTable, ok := dstTablesMap[title]
+		if !ok {
+			return fmt.Errorf("'%s.%s' is not created, restore schema first or create missing table manually", title.Database, title.Table)
+		}
+		if err := checkObjectStorageDisks(table, dstTable, disks); err != nil {
+			return err
+		}
+		if err := b.mapBackupDisks([]metadata.TableMetadata{table}); err != nil {
+			return err
+		}
+		if err := b.restoreTableStreaming(remoteBackup.BackupMetadata, table, dstTable, disks); err != nil {
+			return fmt.Errorf("can't restore '%s.%s': %v", title.Database, title.Table, err)
+		}
+		logTableDone(b.cfg, log.WithField("table", fmt.Sprintf("%s.%s", title.Database, title.Table)))
+	}
+	log.Info("done")
+	return nil
+}
+
+// removeStagedBackup - remove local backup with schema downloaded by streaming restore
+func removeStagedBackup(cfg *config.Config, log *apexLog.Entry, backupName string) {
+	if err := RemoveBackupLocal(cfg, backupName); err != nil {
+		log.Warnf("can't remove local backup '%s' staged for streaming restore: %v", backupName, err)
+	}
+}
+
+// getRemoteBackup - find backup on remote storage by name
+func (b *Backuper) getRemoteBackup(backupName string) (new_storage.Backup, error) {
+	if err := b.ch.Connect(); err != nil {
+		return new_storage.Backup{}, fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer b.ch.Close()
+	if err := b.init(); err != nil {
+		return new_storage.Backup{}, err
+	}
+	remoteBackups, err := b.dst.BackupList()
+	if err != nil {
+		return new_storage.Backup{}, err
+	}
+	for _, remoteBackup := range remoteBackups {
+		if remoteBackup.BackupName == backupName {
+			return remoteBackup, nil
+		}
+	}
+	return new_storage.Backup{}, fmt.Errorf("'%s' is not found on remote storage", backupName)
+}
+
+// restoreTableStreaming - download parts of table to backup directory on the same disk one part or archive at a time,
+// move them to 'detached' of destination table and attach
+func (b *Backuper) restoreTableStreaming(remoteBackup metadata.BackupMetadata, table metadata.TableMetadata, dstTable clickhouse.Table, disks []clickhouse.Disk) error {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    remoteBackup.BackupName,
+		"operation": "restore_streaming",
+		"table":     fmt.Sprintf("%s.%s", table.Database, table.Table),
+	})
+	if table.Dump != nil {
+		return b.restoreTableDumpStreaming(log, remoteBackup, table)
+	}
+	dstDataPaths := clickhouse.GetDisksByPaths(disks, dstTable.DataPaths)
+	total := 0
+	for _, parts := range table.Parts {
+		total += len(parts)
+	}
+	liveChecksums, err := getLiveChecksums(b.ch, dstTable.Database, dstTable.Name)
+	if err != nil {
+		return err
+	}
+	restored, skipped := 0, 0
+	for disk, parts := range table.Parts {
+		if len(parts) == 0 {
+			continue
+		}
+		diskPath, ok := b.DiskMap[disk]
+		if !ok {
+			return fmt.Errorf("disk '%s' is not found in clickhouse, you can add nonexistent disks to disk_mapping config", disk)
+		}
+		dstDataPath, ok := dstDataPaths[disk]
+		if !ok {
+			// disk of backup is mapped to disk with the same path by restore_disk_mapping
+			dstDataPath, ok = dstDataPaths[clickhouse.GetDiskByPath(disks, diskPath)]
+		}
+		if !ok {
+			if len(dstTable.DataPaths) == 0 {
+				return fmt.Errorf("can't find data path for disk '%s'", disk)
+			}
+			dstDataPath = dstTable.DataPaths[0]
+		}
+		stagingPath := backupShadowPath(localBackupsPath(b.cfg, diskPath), remoteBackup.BackupName, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
+		remoteTablePath := path.Join(remoteBackup.BackupName, clickhouse.ShadowPath(remoteBackup.ShadowLayout, disk, table.Database, table.Table))
+		partVersions := map[string]string{}
+		for _, part := range parts {
+			partVersions[part.Name] = part.MetadataVersion
+		}
+		attach := func(partName string) error {
+			if partExists(path.Join(stagingPath, partName), liveChecksums) {
+				if err := os.RemoveAll(path.Join(stagingPath, partName)); err != nil {
+					return err
+				}
+				restored++
+				skipped++
+				log.WithFields(apexLog.Fields{
+					"disk":     disk,
+					"part":     partName,
+					"progress": fmt.Sprintf("%d/%d", restored, total),
+				}).Info("already attached, skipped")
+				return nil
+			}
+			if err := b.attachStreamedPart(table, disk, stagingPath, dstDataPath, partName, partVersions[partName]); err != nil {
+				return err
+			}
+			restored++
+			log.WithFields(apexLog.Fields{
+				"disk":     disk,
+				"part":     partName,
+				"progress": fmt.Sprintf("%d/%d", restored, total),
+			}).Info("attached")
+			return nil
+		}
+		if remoteBackup.DataFormat == "directory" {
+			for _, part := range parts {
+				err := retryStreamingDownload(log.WithField("part", part.Name), func() error {
+					if err := os.RemoveAll(path.Join(stagingPath, part.Name)); err != nil {
+						return err
+					}
+					return b.dst.DownloadPath(0, path.Join(remoteTablePath, part.Name), path.Join(stagingPath, part.Name), remoteBackup.Encryption != "")
+				})
+				if err != nil {
+					return err
+				}
+				if err := attach(part.Name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		partNames := map[string]struct{}{}
+		for _, part := range parts {
+			partNames[part.Name] = struct{}{}
+		}
+		for _, archiveFile := range table.Files[disk] {
+			remoteArchive := path.Join(remoteBackup.BackupName, "shadow", clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table), archiveFile)
+			err := retryStreamingDownload(log.WithField("archive", archiveFile), func() error {
+				if err := os.RemoveAll(stagingPath); err != nil {
+					return err
+				}
+				return b.dst.CompressedStreamDownload(remoteArchive, stagingPath, remoteBackup.DataFormat, remoteBackup.Encryption != "")
+			})
+			if err != nil {
+				return err
+			}
+			entries, err := ioutil.ReadDir(stagingPath)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if _, ok := partNames[entry.Name()]; !ok || !entry.IsDir() {
+					continue
+				}
+				if err := attach(entry.Name()); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.RemoveAll(stagingPath); err != nil {
+			return err
+		}
+	}
+	log.WithFields(apexLog.Fields{
+		"attached": restored - skipped,
+		"skipped":  skipped,
+	}).Info("parts restored")
+	return nil
+}
+
+// restoreTableDumpStreaming - download dump pseudo part of not MergeTree table and insert its rows as restore does
+func (b *Backuper) restoreTableDumpStreaming(log *apexLog.Entry, remoteBackup metadata.BackupMetadata, table metadata.TableMetadata) error {
+	disk := table.Dump.Disk
+	diskPath, ok := b.DiskMap[disk]
+	if !ok {
+		return fmt.Errorf("disk '%s' is not found in clickhouse, you can add nonexistent disks to disk_mapping config", disk)
+	}
+	stagingPath := backupShadowPath(localBackupsPath(b.cfg, diskPath), remoteBackup.BackupName, remoteBackup.ShadowLayout, disk, table.Database, table.Table)
+	defer func() {
+		if err := os.RemoveAll(stagingPath); err != nil {
+			log.Warnf("can't remove '%s': %v", stagingPath, err)
+		}
+	}()
+	if remoteBackup.DataFormat == "directory" {
+		remotePartPath := path.Join(remoteBackup.BackupName, clickhouse.ShadowPath(remoteBackup.ShadowLayout, disk, table.Database, table.Table), table.Dump.Part)
+		err := retryStreamingDownload(log.WithField("part", table.Dump.Part), func() error {
+			if err := os.RemoveAll(path.Join(stagingPath, table.Dump.Part)); err != nil {
+				return err
+			}
+			return b.dst.DownloadPath(0, remotePartPath, path.Join(stagingPath, table.Dump.Part), remoteBackup.Encryption != "")
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, archiveFile := range table.Files[disk] {
+			remoteArchive := path.Join(remoteBackup.BackupName, "shadow", clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table), archiveFile)
+			err := retryStreamingDownload(log.WithField("archive", archiveFile), func() error {
+				return b.dst.CompressedStreamDownload(remoteArchive, stagingPath, remoteBackup.DataFormat, remoteBackup.Encryption != "")
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	dst := metadata.TableTitle{Database: table.Database, Table: table.Table}
+	if err := restoreTableDump(b.cfg, b.ch, remoteBackup.BackupName, remoteBackup.ShadowLayout, table, dst, b.DiskMap); err != nil {
+		return err
+	}
+	log.WithField("dump", table.Dump.File).Info("rows restored")
+	return nil
+}
+
+// attachStreamedPart - move downloaded part to 'detached', fix owner and metadata version and attach it
+func (b *Backuper) attachStreamedPart(table metadata.TableMetadata, disk, stagingPath, dstDataPath, partName, metadataVersion string) error {
+	detachedParentDir := path.Join(dstDataPath, "detached")
+	if err := b.ch.MkdirAll(detachedParentDir); err != nil {
+		return err
+	}
+	detachedPath := path.Join(detachedParentDir, partName)
+	if err := os.Rename(path.Join(stagingPath, partName), detachedPath); err != nil {
+		return fmt.Errorf("can't move part '%s' to 'detached': %v", partName, err)
+	}
+	if err := filepath.Walk(detachedPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return b.ch.Chown(filePath)
+	}); err != nil {
+		return err
+	}
+	if err := b.ch.RestoreMetadataVersion(detachedPath, metadataVersion); err != nil {
+		return err
+	}
+	return b.ch.AttachPartitions(metadata.TableMetadata{
+		Database: table.Database,
+		Table:    table.Table,
+		Parts:    map[string][]metadata.Part{disk: {{Name: partName}}},
+	}, []clickhouse.Disk{{Name: disk}})
+}
+
+func retryStreamingDownload(log *apexLog.Entry, download func() error) error {
+	var err error
+	for attempt := 1; attempt <= streamingRestoreRetries; attempt++ {
+		if err = download(); err == nil {
+			return nil
+		}
+		if attempt < streamingRestoreRetries {
+			log.Warnf("download attempt %d of %d failed: %v", attempt, streamingRestoreRetries, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
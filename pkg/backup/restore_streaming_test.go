@@ -0,0 +1,22 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryStreamingDownload(t *testing.T) {
+	attempts := 0
+	err := retryStreamingDownload(apexLog.WithField("part", "all_1_1_0"), func() error {
+		attempts++
+		if attempts == 1 {
+			return fmt.Errorf("connection reset")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+}
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTableMapping(t *testing.T) {
+	tablesMap, err := parseTableMapping([]string{"prod.events:prod.events_restored", "prod.users:users_restored"})
+	require.NoError(t, err)
+	assert.Equal(t, metadata.TableTitle{Database: "prod", Table: "events_restored"}, mapTable(tablesMap, nil, "prod", "events"))
+	assert.Equal(t, metadata.TableTitle{Database: "prod", Table: "users_restored"}, mapTable(tablesMap, nil, "prod", "users"))
+	assert.Equal(t, metadata.TableTitle{Database: "prod", Table: "orders"}, mapTable(tablesMap, nil, "prod", "orders"))
+
+	databasesMap := map[string]string{"prod": "prod_test"}
+	assert.Equal(t, metadata.TableTitle{Database: "prod", Table: "events_restored"}, mapTable(tablesMap, databasesMap, "prod", "events"))
+	assert.Equal(t, metadata.TableTitle{Database: "prod_test", Table: "orders"}, mapTable(tablesMap, databasesMap, "prod", "orders"))
+	assert.Equal(t, metadata.TableTitle{Database: "stage", Table: "orders"}, mapTable(tablesMap, databasesMap, "stage", "orders"))
+
+	for _, mapping := range [][]string{{"events:prod.events2"}, {"prod.events"}, {"prod.events:"}, {"prod.a:prod.c", "prod.b:prod.c"}, {"prod.a:prod.b", "prod.a:prod.c"}} {
+		_, err := parseTableMapping(mapping)
+		assert.Error(t, err, mapping)
+	}
+}
+
+func TestMapDatabases(t *testing.T) {
+	databases := []metadata.DatabasesMeta{
+		{Name: "prod", Engine: "Atomic", Query: "CREATE DATABASE prod UUID '3a1f6ec4-8c0b-4b8b-9c0e-6a4c2a1e3f11' ENGINE = Atomic"},
+		{Name: "legacy", Engine: "Ordinary"},
+		{Name: "stage", Engine: "Atomic", Query: "CREATE DATABASE stage ENGINE = Atomic"},
+	}
+	mapped, err := mapDatabases(databases, map[string]string{"prod": "prod_test", "legacy": "legacy_test"})
+	require.NoError(t, err)
+	assert.Equal(t, []metadata.DatabasesMeta{
+		{Name: "prod_test", Engine: "Atomic", Query: "CREATE DATABASE `prod_test` UUID '3a1f6ec4-8c0b-4b8b-9c0e-6a4c2a1e3f11' ENGINE = Atomic"},
+		{Name: "legacy_test", Engine: "Ordinary"},
+		databases[2],
+	}, mapped)
+	assert.Equal(t, "prod", databases[0].Name)
+
+	_, err = mapDatabases([]metadata.DatabasesMeta{
+		{Name: "prod", Engine: "Replicated", Query: "CREATE DATABASE prod ENGINE = Replicated('/clickhouse/databases/main', '{shard}', '{replica}')"},
+	}, map[string]string{"prod": "prod_test"})
+	assert.Error(t, err)
+}
+
+func TestDatabasesToRecreate(t *testing.T) {
+	databases := []metadata.DatabasesMeta{
+		{Name: "prod", Engine: "Atomic"},
+		{Name: "stage", Engine: "Atomic"},
+		{Name: "same", Engine: "Atomic"},
+		{Name: "new", Engine: "Atomic"},
+	}
+	liveDatabases := []clickhouse.Database{
+		{Name: "prod", Engine: "Ordinary"},
+		{Name: "stage", Engine: "Ordinary"},
+		{Name: "same", Engine: "Atomic"},
+	}
+	liveTables := []clickhouse.Table{
+		{Database: "prod", Name: "events"},
+		{Database: "stage", Name: "events"},
+		{Database: "stage", Name: "manual"},
+		{Database: "same", Name: "events"},
+	}
+	restoreSet := map[metadata.TableTitle]struct{}{
+		{Database: "prod", Table: "events"}:  {},
+		{Database: "stage", Table: "events"}: {},
+		{Database: "same", Table: "events"}:  {},
+	}
+	recreate, kept := databasesToRecreate(databases, liveDatabases, liveTables, restoreSet)
+	assert.Equal(t, []string{"prod"}, recreate)
+	assert.Equal(t, []string{"stage"}, kept)
+}
+
+func TestCheckObjectStorageDisks(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/", Type: "local"},
+		{Name: "s3", Path: "/var/lib/clickhouse/disks/s3/", Type: "s3"},
+	}
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+	}
+	localTable := clickhouse.Table{Database: "db", Name: "t", DataPaths: []string{"/var/lib/clickhouse/store/abc/abcdef/"}}
+	assert.NoError(t, checkObjectStorageDisks(table, localTable, disks))
+
+	s3Table := clickhouse.Table{Database: "db", Name: "t", DataPaths: []string{"/var/lib/clickhouse/disks/s3/store/abc/abcdef/"}}
+	err := checkObjectStorageDisks(table, s3Table, disks)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "disk 's3' with type 's3'")
+}
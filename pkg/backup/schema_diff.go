@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+
+	apexLog "github.com/apex/log"
+)
+
+// SchemaAlter - ALTER query which brings live table closer to schema stored in backup
+type SchemaAlter struct {
+	Query string
+	// Destructive - column is dropped or its type is changed, data can be lost
+	Destructive bool
+}
+
+var tableUUIDRE = regexp.MustCompile(`(?i)\sUUID\s+'[^']+'`)
+var whitespaceRE = regexp.MustCompile(`\s+`)
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+// diffTableSchema - ALTER queries for columns of live table which differ from backup,
+// ok is false when columns can't be parsed from one of queries
+func diffTableSchema(database, table, backupQuery, liveQuery string) (alters []SchemaAlter, restDiffers bool, ok bool) {
+	backupColumns, backupRest, ok := clickhouse.ParseColumns(tableUUIDRE.ReplaceAllString(backupQuery, ""))
+	if !ok {
+		return nil, false, false
+	}
+	liveColumns, liveRest, ok := clickhouse.ParseColumns(tableUUIDRE.ReplaceAllString(liveQuery, ""))
+	if !ok {
+		return nil, false, false
+	}
+	alterPrefix := fmt.Sprintf("ALTER TABLE %s.%s ", quoteIdentifier(database), quoteIdentifier(table))
+	liveColumnsMap := map[string]clickhouse.Column{}
+	for _, column := range liveColumns {
+		liveColumnsMap[column.Name] = column
+	}
+	backupColumnsMap := map[string]struct{}{}
+	for i, column := range backupColumns {
+		backupColumnsMap[column.Name] = struct{}{}
+		liveColumn, exists := liveColumnsMap[column.Name]
+		switch {
+		case !exists:
+			position := "FIRST"
+			if i > 0 {
+				position = "AFTER " + quoteIdentifier(backupColumns[i-1].Name)
+			}
+			alters = append(alters, SchemaAlter{
+				Query: fmt.Sprintf("%sADD COLUMN %s %s %s", alterPrefix, quoteIdentifier(column.Name), column.Definition, position),
+			})
+		case liveColumn.Definition != column.Definition:
+			alters = append(alters, SchemaAlter{
+				Query:       fmt.Sprintf("%sMODIFY COLUMN %s %s", alterPrefix, quoteIdentifier(column.Name), column.Definition),
+				Destructive: liveColumn.Type != column.Type,
+			})
+		}
+	}
+	for _, column := range liveColumns {
+		if _, exists := backupColumnsMap[column.Name]; !exists {
+			alters = append(alters, SchemaAlter{
+				Query:       fmt.Sprintf("%sDROP COLUMN %s", alterPrefix, quoteIdentifier(column.Name)),
+				Destructive: true,
+			})
+		}
+	}
+	restDiffers = whitespaceRE.ReplaceAllString(backupRest, " ") != whitespaceRE.ReplaceAllString(liveRest, " ")
+	return alters, restDiffers, true
+}
+
+// checkTableColumns - differences of names and types of columns between table in backup and live table
+// which prevent parts from being attached, defaults and codecs are not compared. ok is false when columns
+// can't be parsed from one of queries, e.g. for views or tables created by CREATE TABLE AS
+func checkTableColumns(backupQuery, liveQuery string) (problems []string, ok bool) {
+	backupColumns, _, ok := clickhouse.ParseColumns(tableUUIDRE.ReplaceAllString(backupQuery, ""))
+	if !ok {
+		return nil, false
+	}
+	liveColumns, _, ok := clickhouse.ParseColumns(tableUUIDRE.ReplaceAllString(liveQuery, ""))
+	if !ok {
+		return nil, false
+	}
+	liveColumnsMap := map[string]clickhouse.Column{}
+	for _, column := range liveColumns {
+		liveColumnsMap[column.Name] = column
+	}
+	backupColumnsMap := map[string]struct{}{}
+	for _, column := range backupColumns {
+		backupColumnsMap[column.Name] = struct{}{}
+		liveColumn, exists := liveColumnsMap[column.Name]
+		switch {
+		case !exists:
+			problems = append(problems, fmt.Sprintf("column %s is missing", quoteIdentifier(column.Name)))
+		case liveColumn.Type != column.Type:
+			problems = append(problems, fmt.Sprintf("column %s has type %s, backup has %s", quoteIdentifier(column.Name), liveColumn.Type, column.Type))
+		}
+	}
+	for _, column := range liveColumns {
+		if _, exists := backupColumnsMap[column.Name]; !exists {
+			problems = append(problems, fmt.Sprintf("column %s is not in backup", quoteIdentifier(column.Name)))
+		}
+	}
+	return problems, true
+}
+
+// RestoreSchemaDiff - print ALTER queries which bring columns of existing tables to schema stored in backup,
+// queries are executed only with apply. Engine, ORDER BY and SETTINGS differences are reported but never altered
+func RestoreSchemaDiff(cfg *config.Config, backupName, tablePattern string, apply bool) error {
+	if backupName == "" {
+		_ = PrintLocalBackups(cfg, "all")
+		return fmt.Errorf("select backup for restore")
+	}
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore",
+	})
+	backup, err := getLocalBackup(cfg, backupName)
+	if err != nil {
+		return fmt.Errorf("can't restore: %v", err)
+	}
+	if backup.Legacy {
+		return fmt.Errorf("'%s' is old format backup and doesn't support schema diff", backupName)
+	}
+	if backup.DataOnly {
+		return fmt.Errorf("'%s' is data only backup and doesn't contain schema", backupName)
+	}
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	ch.SetQueryComment("restore", backupName)
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+	defaultDataPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	tablesForRestore, err := parseSchemaPattern(path.Join(localBackupsPath(cfg, defaultDataPath), backupName, "metadata"), tablePattern, false)
+	if err != nil {
+		return err
+	}
+	liveTables, err := ch.GetTables()
+	if err != nil {
+		return err
+	}
+	liveTablesMap := map[metadata.TableTitle]clickhouse.Table{}
+	for _, t := range liveTables {
+		liveTablesMap[metadata.TableTitle{Database: t.Database, Table: t.Name}] = t
+	}
+	var alters []SchemaAlter
+	for _, t := range tablesForRestore {
+		log := log.WithField("table", fmt.Sprintf("%s.%s", t.Database, t.Table))
+		liveTable, exists := liveTablesMap[metadata.TableTitle{Database: t.Database, Table: t.Table}]
+		if !exists {
+			log.Warn("doesn't exist, use restore --schema to create it")
+			continue
+		}
+		tableAlters, restDiffers, ok := diffTableSchema(t.Database, t.Table, t.Query, liveTable.CreateTableQuery)
+		if !ok {
+			log.Warn("columns can't be compared, skipped")
+			continue
+		}
+		if restDiffers {
+			log.Warn("engine, keys or settings differ from backup, they are not altered")
+		}
+		alters = append(alters, tableAlters...)
+	}
+	if len(alters) == 0 {
+		log.Info("schema of tables matches backup, nothing to do")
+		return nil
+	}
+	for _, alter := range alters {
+		if alter.Destructive {
+			fmt.Printf("%s; -- DESTRUCTIVE\n", alter.Query)
+		} else {
+			fmt.Printf("%s;\n", alter.Query)
+		}
+	}
+	if !apply {
+		log.Infof("%d ALTER queries generated, use --apply to execute them", len(alters))
+		return nil
+	}
+	for _, alter := range alters {
+		if alter.Destructive {
+			log.Warnf("execute destructive %s", alter.Query)
+		}
+		if _, err := ch.Query(alter.Query); err != nil {
+			return fmt.Errorf("can't execute '%s': %v", alter.Query, err)
+		}
+	}
+	log.Info("done")
+	return nil
+}
@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffTableSchema(t *testing.T) {
+	backupQuery := "CREATE TABLE db.t UUID 'a' (`id` UInt64, `name` String, `value` UInt32) ENGINE = MergeTree ORDER BY id"
+	liveQuery := "CREATE TABLE db.t UUID 'b' (`id` UInt64, `value` UInt64, `extra` String) ENGINE = MergeTree ORDER BY id"
+	alters, restDiffers, ok := diffTableSchema("db", "t", backupQuery, liveQuery)
+	assert.True(t, ok)
+	assert.False(t, restDiffers)
+	assert.Equal(t, []SchemaAlter{
+		{Query: "ALTER TABLE `db`.`t` ADD COLUMN `name` String AFTER `id`"},
+		{Query: "ALTER TABLE `db`.`t` MODIFY COLUMN `value` UInt32", Destructive: true},
+		{Query: "ALTER TABLE `db`.`t` DROP COLUMN `extra`", Destructive: true},
+	}, alters)
+
+	alters, restDiffers, ok = diffTableSchema("db", "t", backupQuery, backupQuery+" SETTINGS index_granularity = 1024")
+	assert.True(t, ok)
+	assert.True(t, restDiffers)
+	assert.Empty(t, alters)
+}
+
+func TestCheckTableColumns(t *testing.T) {
+	backupQuery := "CREATE TABLE db.t UUID 'a' (`id` UInt64, `name` String DEFAULT 'x', `value` UInt32) ENGINE = MergeTree ORDER BY id"
+	problems, ok := checkTableColumns(backupQuery, "CREATE TABLE db.t UUID 'b' (`id` UInt64, `name` String CODEC(ZSTD(1)), `value` UInt32) ENGINE = MergeTree ORDER BY id")
+	assert.True(t, ok)
+	assert.Empty(t, problems)
+
+	problems, ok = checkTableColumns(backupQuery, "CREATE TABLE db.t (`id` UInt64, `value` UInt64, `extra` String) ENGINE = MergeTree ORDER BY id")
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"column `name` is missing",
+		"column `value` has type UInt64, backup has UInt32",
+		"column `extra` is not in backup",
+	}, problems)
+
+	_, ok = checkTableColumns("CREATE VIEW db.v AS SELECT 1", backupQuery)
+	assert.False(t, ok)
+}
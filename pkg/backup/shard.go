@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+)
+
+// ShardSelector - TableSelector which keeps only tables of shard "i/n", shards are numbered from 0,
+// table is assigned by FNV-1a hash of "database.table" so assignment doesn't depend on other tables
+func ShardSelector(shard string) (TableSelector, error) {
+	fields := strings.SplitN(shard, "/", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid shard '%s', expected <i>/<n>", shard)
+	}
+	i, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard '%s': %v", shard, err)
+	}
+	n, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard '%s': %v", shard, err)
+	}
+	if n == 0 || i >= n {
+		return nil, fmt.Errorf("invalid shard '%s', shard number must be from 0 to %d", shard, n-1)
+	}
+	return func(tables []clickhouse.Table) ([]clickhouse.Table, error) {
+		var result []clickhouse.Table
+		for _, t := range tables {
+			if tableShard(t.Database, t.Name, uint32(n)) == uint32(i) {
+				result = append(result, t)
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+func tableShard(database, table string, shards uint32) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("%s.%s", database, table)))
+	return h.Sum32() % shards
+}
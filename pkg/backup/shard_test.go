@@ -0,0 +1,40 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardSelector(t *testing.T) {
+	var tables []clickhouse.Table
+	for i := 0; i < 100; i++ {
+		tables = append(tables, clickhouse.Table{Database: "db", Name: fmt.Sprintf("t%d", i)})
+	}
+	seen := map[string]int{}
+	for i := 0; i < 3; i++ {
+		selector, err := ShardSelector(fmt.Sprintf("%d/3", i))
+		require.NoError(t, err)
+		selected, err := selector(tables)
+		require.NoError(t, err)
+		assert.NotEmpty(t, selected)
+		for _, table := range selected {
+			seen[table.Name]++
+		}
+		// assignment of table doesn't depend on other tables
+		single, err := selector(tables[:1])
+		require.NoError(t, err)
+		assert.Equal(t, tableShard("db", "t0", 3) == uint32(i), len(single) == 1)
+	}
+	assert.Len(t, seen, len(tables))
+	for _, count := range seen {
+		assert.Equal(t, 1, count)
+	}
+	for _, shard := range []string{"", "1", "3/3", "a/3", "0/0", "-1/3"} {
+		_, err := ShardSelector(shard)
+		assert.Error(t, err, shard)
+	}
+}
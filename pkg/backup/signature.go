@@ -0,0 +1,294 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+
+	apexLog "github.com/apex/log"
+)
+
+// SignatureFileName - sidecar of metadata.json with HMAC-SHA256 of every metadata file of backup
+const SignatureFileName = "metadata.json.sig"
+
+// metadataSignature - relative path inside backup directory: hex HMAC-SHA256 of file content
+type metadataSignature map[string]string
+
+func signMetadataBody(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// collectMetadataFiles - metadata.json and all per-table metadata files relative to backup directory
+func collectMetadataFiles(backupPath string) ([]string, error) {
+	files := []string{MetaFileName}
+	metadataPath := path.Join(backupPath, "metadata")
+	err := filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == metadataPath {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(backupPath, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(relativePath))
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// marshal - one "<hmac>  <file>" line per file, same layout as sha256sum
+func (s metadataSignature) marshal() []byte {
+	files := make([]string, 0, len(s))
+	for file := range s {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var buf bytes.Buffer
+	for _, file := range files {
+		fmt.Fprintf(&buf, "%s  %s\n", s[file], file)
+	}
+	return buf.Bytes()
+}
+
+func parseMetadataSignature(body []byte) (metadataSignature, error) {
+	s := metadataSignature{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line '%s'", line)
+		}
+		s[fields[1]] = fields[0]
+	}
+	return s, scanner.Err()
+}
+
+// signBackupLocal - sign exact bytes of metadata files written to disk, do nothing when metadata_signing_key is empty
+func signBackupLocal(cfg *config.Config, ch *clickhouse.ClickHouse, backupPath string) error {
+	if cfg.General.MetadataSigningKey == "" {
+		return nil
+	}
+	files, err := collectMetadataFiles(backupPath)
+	if err != nil {
+		return fmt.Errorf("can't sign backup metadata: %v", err)
+	}
+	signature := metadataSignature{}
+	for _, file := range files {
+		body, err := ioutil.ReadFile(path.Join(backupPath, file))
+		if err != nil {
+			return fmt.Errorf("can't sign backup metadata: %v", err)
+		}
+		signature[file] = signMetadataBody(cfg.General.MetadataSigningKey, body)
+	}
+	signatureFile := path.Join(backupPath, SignatureFileName)
+	if err := ioutil.WriteFile(signatureFile, signature.marshal(), 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", SignatureFileName, err)
+	}
+	return ch.Chown(signatureFile)
+}
+
+// VerifyBackupLocal - check metadata.json of local backup against metadata.json.sha256 and part files against files.txt,
+// when metadata_signing_key is configured all metadata files are checked against metadata.json.sig too,
+// added, removed or changed metadata files are reported
+func VerifyBackupLocal(cfg *config.Config, backupName string) error {
+	ch := &clickhouse.ClickHouse{
+		Config: &cfg.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer ch.Close()
+	defaultDataPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return err
+	}
+	backupPath := path.Join(localBackupsPath(cfg, defaultDataPath), backupName)
+	if err := verifyMetadataChecksum(backupPath); err != nil {
+		return err
+	}
+	if err := verifyBackupFiles(cfg, backupPath, backupName); err != nil {
+		return err
+	}
+	if cfg.General.MetadataSigningKey == "" {
+		return nil
+	}
+	return verifyBackupSignature(cfg.General.MetadataSigningKey, backupPath)
+}
+
+func verifyBackupSignature(key, backupPath string) error {
+	body, err := ioutil.ReadFile(path.Join(backupPath, SignatureFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("backup is not signed, %s not found", SignatureFileName)
+		}
+		return err
+	}
+	signature, err := parseMetadataSignature(body)
+	if err != nil {
+		return fmt.Errorf("can't parse %s: %v", SignatureFileName, err)
+	}
+	files, err := collectMetadataFiles(backupPath)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, file := range files {
+		expected, ok := signature[file]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("'%s' is not signed", file))
+			continue
+		}
+		delete(signature, file)
+		body, err := ioutil.ReadFile(path.Join(backupPath, file))
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(expected), []byte(signMetadataBody(key, body))) {
+			problems = append(problems, fmt.Sprintf("'%s' signature mismatch", file))
+		}
+	}
+	for file := range signature {
+		problems = append(problems, fmt.Sprintf("'%s' is missing", file))
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("backup metadata was modified: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// uploadMetadataSidecars - put metadata.json.sha256 and, with metadata_signing_key, metadata.json.sig of exact uploaded bytes,
+// signature already contains uploaded tables metadata. Sidecars are uploaded before metadata.json which completes backup
+func (b *Backuper) uploadMetadataSidecars(backupName string, signature metadataSignature, metadataBody []byte) error {
+	sum := sha256.Sum256(metadataBody)
+	checksumBody := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), MetaFileName)
+	if err := b.dst.PutFile(path.Join(backupName, ChecksumFileName), ioutil.NopCloser(strings.NewReader(checksumBody))); err != nil {
+		return fmt.Errorf("can't upload %s: %v", ChecksumFileName, err)
+	}
+	if signature == nil {
+		return nil
+	}
+	signature[MetaFileName] = signMetadataBody(b.cfg.General.MetadataSigningKey, metadataBody)
+	if err := b.dst.PutFile(path.Join(backupName, SignatureFileName), ioutil.NopCloser(bytes.NewReader(signature.marshal()))); err != nil {
+		return fmt.Errorf("can't upload %s: %v", SignatureFileName, err)
+	}
+	return nil
+}
+
+// remoteMetadataVerifier - check metadata files downloaded from remote storage against uploaded metadata.json.sha256
+// and metadata.json.sig before they are saved, with ignoreSignature problems are only logged
+type remoteMetadataVerifier struct {
+	key       string
+	checksum  string
+	signature metadataSignature
+	ignore    bool
+}
+
+// newRemoteMetadataVerifier - checksumBody and signatureBody are nil when sidecar is absent on remote storage,
+// backups uploaded by older versions have no metadata.json.sha256, it is not required
+func newRemoteMetadataVerifier(key string, checksumBody, signatureBody []byte, ignoreSignature bool) (*remoteMetadataVerifier, error) {
+	v := &remoteMetadataVerifier{key: key, ignore: ignoreSignature}
+	if checksumBody != nil {
+		fields := strings.Fields(string(checksumBody))
+		if len(fields) != 2 || fields[1] != MetaFileName {
+			if err := v.fail(fmt.Errorf("can't parse %s", ChecksumFileName)); err != nil {
+				return nil, err
+			}
+		} else {
+			v.checksum = fields[0]
+		}
+	}
+	if key == "" {
+		return v, nil
+	}
+	if signatureBody == nil {
+		return v, v.fail(fmt.Errorf("backup is not signed, %s not found on remote storage", SignatureFileName))
+	}
+	signature, err := parseMetadataSignature(signatureBody)
+	if err != nil {
+		return v, v.fail(fmt.Errorf("can't parse %s: %v", SignatureFileName, err))
+	}
+	v.signature = signature
+	return v, nil
+}
+
+// verify - file is path relative to backup directory, e.g. metadata/db/table.json
+func (v *remoteMetadataVerifier) verify(file string, body []byte) error {
+	if v == nil {
+		return nil
+	}
+	if file == MetaFileName && v.checksum != "" {
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != v.checksum {
+			if err := v.fail(fmt.Errorf("checksum of %s doesn't match %s, backup is corrupted", MetaFileName, ChecksumFileName)); err != nil {
+				return err
+			}
+		}
+	}
+	if v.signature == nil {
+		return nil
+	}
+	expected, ok := v.signature[file]
+	if !ok {
+		return v.fail(fmt.Errorf("backup metadata was modified: '%s' is not signed", file))
+	}
+	if !hmac.Equal([]byte(expected), []byte(signMetadataBody(v.key, body))) {
+		return v.fail(fmt.Errorf("backup metadata was modified: '%s' signature mismatch", file))
+	}
+	return nil
+}
+
+func (v *remoteMetadataVerifier) fail(err error) error {
+	if v.ignore {
+		apexLog.Warnf("%v, ignored", err)
+		return nil
+	}
+	return fmt.Errorf("%v, use --ignore-signature to download it anyway", err)
+}
+
+// loadRemoteMetadataVerifier - read metadata.json.sha256 and metadata.json.sig of remote backup
+func (b *Backuper) loadRemoteMetadataVerifier(backupName string, ignoreSignature bool) (*remoteMetadataVerifier, error) {
+	checksumBody, err := b.readRemoteFile(path.Join(backupName, ChecksumFileName))
+	if err != nil {
+		apexLog.Debugf("%s is not downloaded: %v", ChecksumFileName, err)
+	}
+	signatureBody, err := b.readRemoteFile(path.Join(backupName, SignatureFileName))
+	if err != nil {
+		apexLog.Debugf("%s is not downloaded: %v", SignatureFileName, err)
+	}
+	return newRemoteMetadataVerifier(b.cfg.General.MetadataSigningKey, checksumBody, signatureBody, ignoreSignature)
+}
+
+func (b *Backuper) readRemoteFile(remotePath string) ([]byte, error) {
+	reader, err := b.dst.GetFileReader(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyBackupSignature(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "clickhouse-backup-signature")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(backupPath, "metadata", "db"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, MetaFileName), []byte(`{"backup_name":"test"}`), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, "metadata", "db", "table.json"), []byte(`{"table":"table"}`), 0640))
+
+	assert.Error(t, verifyBackupSignature("key", backupPath), "unsigned backup")
+
+	files, err := collectMetadataFiles(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{MetaFileName, "metadata/db/table.json"}, files)
+	signature := metadataSignature{}
+	for _, file := range files {
+		body, err := ioutil.ReadFile(filepath.Join(backupPath, file))
+		require.NoError(t, err)
+		signature[file] = signMetadataBody("key", body)
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, SignatureFileName), signature.marshal(), 0640))
+	assert.NoError(t, verifyBackupSignature("key", backupPath))
+	assert.Error(t, verifyBackupSignature("another key", backupPath))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, "metadata", "db", "table.json"), []byte(`{"table":"table2"}`), 0640))
+	assert.Error(t, verifyBackupSignature("key", backupPath))
+	require.NoError(t, os.Remove(filepath.Join(backupPath, "metadata", "db", "table.json")))
+	assert.Error(t, verifyBackupSignature("key", backupPath))
+}
+
+func TestRemoteMetadataVerifier(t *testing.T) {
+	key := "secret"
+	metadataBody := []byte(`{"backup_name":"b1"}`)
+	tableBody := []byte(`{"table":"t1"}`)
+	tableFile := "metadata/db/t1.json"
+	sum := sha256.Sum256(metadataBody)
+	checksumBody := []byte(hex.EncodeToString(sum[:]) + "  metadata.json\n")
+	signatureBody := metadataSignature{
+		MetaFileName: signMetadataBody(key, metadataBody),
+		tableFile:    signMetadataBody(key, tableBody),
+	}.marshal()
+
+	v, err := newRemoteMetadataVerifier(key, checksumBody, signatureBody, false)
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(MetaFileName, metadataBody))
+	assert.NoError(t, v.verify(tableFile, tableBody))
+	assert.Error(t, v.verify(MetaFileName, []byte(`{"backup_name":"b2"}`)))
+	assert.Error(t, v.verify(tableFile, []byte(`{"table":"t2"}`)))
+	assert.Error(t, v.verify("metadata/db/t2.json", tableBody))
+
+	// signature is required with metadata_signing_key
+	_, err = newRemoteMetadataVerifier(key, checksumBody, nil, false)
+	assert.Error(t, err)
+	v, err = newRemoteMetadataVerifier(key, checksumBody, nil, true)
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(tableFile, []byte(`{"table":"t2"}`)))
+
+	// checksum is checked without key, backups uploaded by older versions have no checksum
+	v, err = newRemoteMetadataVerifier("", checksumBody, nil, false)
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(MetaFileName, metadataBody))
+	assert.Error(t, v.verify(MetaFileName, []byte(`{}`)))
+	v, err = newRemoteMetadataVerifier("", nil, nil, false)
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(MetaFileName, []byte(`{}`)))
+
+	// with ignoreSignature problems are only logged
+	v, err = newRemoteMetadataVerifier(key, checksumBody, signatureBody, true)
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(MetaFileName, []byte(`{}`)))
+}
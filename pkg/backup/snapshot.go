@@ -0,0 +1,209 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// checkSnapshotDataPath - snapshot mount must exist and be readable before we start backup
+func checkSnapshotDataPath(snapshotDataPath string) error {
+	info, err := os.Stat(snapshotDataPath)
+	if err != nil {
+		return fmt.Errorf("can't use snapshot_data_path: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("snapshot_data_path '%s' is not a directory", snapshotDataPath)
+	}
+	d, err := os.Open(snapshotDataPath)
+	if err != nil {
+		return fmt.Errorf("snapshot_data_path '%s' is not readable: %v", snapshotDataPath, err)
+	}
+	defer d.Close()
+	if _, err := d.Readdirnames(1); err != nil {
+		return fmt.Errorf("snapshot_data_path '%s' is not readable: %v", snapshotDataPath, err)
+	}
+	return nil
+}
+
+// addTableFromSnapshot - copy active parts of table from read-only filesystem snapshot of default disk
+// FREEZE is not used, the snapshot is the consistency point
+func addTableFromSnapshot(cfg *config.Config, ch *clickhouse.ClickHouse, backupName string, table *clickhouse.Table, diskList []clickhouse.Disk) (map[string][]metadata.Part, map[string]int64, error) {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "create",
+		"table":     fmt.Sprintf("%s.%s", table.Database, table.Name),
+	})
+	realSize := map[string]int64{}
+	partitions := map[string][]metadata.Part{}
+	diskMap := map[string]string{}
+	for _, disk := range diskList {
+		diskMap[disk.Name] = disk.Path
+	}
+	for diskName, dataPath := range clickhouse.GetDisksByPaths(diskList, table.DataPaths) {
+		if diskName != "default" {
+			return nil, nil, fmt.Errorf("snapshot_data_path supports only tables on 'default' disk, but data path '%s' is on disk '%s'", dataPath, diskName)
+		}
+		snapshotTablePath := path.Join(ch.Config.SnapshotDataPath, strings.TrimPrefix(dataPath, diskMap[diskName]))
+		if _, err := os.Stat(snapshotTablePath); err != nil {
+			if os.IsNotExist(err) {
+				log.WithField("path", snapshotTablePath).Debug("not found in snapshot, skipped")
+				continue
+			}
+			return nil, nil, err
+		}
+		backupPartsPath := backupShadowPath(localBackupsPath(cfg, diskMap[diskName]), backupName, cfg.General.ShadowLayout, diskName, table.Database, table.Name)
+		if err := ch.MkdirAll(backupPartsPath); err != nil && !os.IsExist(err) {
+			return nil, nil, err
+		}
+		var parts []metadata.Part
+		var size int64
+		err := withIOPriority(cfg.General.IOPriority, func() error {
+			var copyErr error
+			parts, size, copyErr = copySnapshotParts(snapshotTablePath, backupPartsPath, cfg.General.ExcludePartFiles, cfg.General.VerifyCopiedParts, ch.Chown)
+			return copyErr
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		realSize[diskName] = size
+		partitions[diskName] = parts
+		log.WithField("disk", diskName).Debug("snapshot copied")
+	}
+	return partitions, realSize, nil
+}
+
+// copySnapshotParts - copy parts from table data path inside snapshot, outdated parts covered by merged ones are skipped,
+// chown is called for every created directory and file
+func copySnapshotParts(snapshotTablePath, backupPartsPath string, excludePartFiles []string, verifyCopy bool, chown func(string) error) ([]metadata.Part, int64, error) {
+	entries, err := ioutil.ReadDir(snapshotTablePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == "detached" || strings.HasPrefix(entry.Name(), "tmp") {
+			continue
+		}
+		if _, err := os.Stat(path.Join(snapshotTablePath, entry.Name(), "checksums.txt")); err != nil {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	size := int64(0)
+	parts := []metadata.Part{}
+	for _, name := range filterCoveredParts(names) {
+		partPath := path.Join(snapshotTablePath, name)
+		err := filepath.Walk(partPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			dstFilePath := path.Join(backupPartsPath, name, strings.TrimPrefix(filePath, partPath))
+			if info.IsDir() {
+				if err := os.MkdirAll(dstFilePath, 0750); err != nil {
+					return err
+				}
+				return chown(dstFilePath)
+			}
+			if !info.Mode().IsRegular() {
+				apexLog.Debugf("'%s' is not a regular file, skipping", filePath)
+				return nil
+			}
+			if isExcludedPartFile(info.Name(), excludePartFiles) {
+				apexLog.Debugf("'%s' is matched by exclude_part_files, skipping", filePath)
+				return nil
+			}
+			if err := copyPartFile(filePath, dstFilePath, verifyCopy); err != nil {
+				return err
+			}
+			size += info.Size()
+			return chown(dstFilePath)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		parts = append(parts, metadata.Part{
+			Name:            name,
+			MetadataVersion: getMetadataVersion([]string{partPath}),
+		})
+	}
+	return parts, size, nil
+}
+
+type partInfo struct {
+	name      string
+	partition string
+	min       int64
+	max       int64
+	level     int64
+	mutation  int64
+}
+
+// parsePartName - parse <partition_id>_<min_block>_<max_block>_<level>[_<mutation>]
+func parsePartName(name string) (partInfo, bool) {
+	fields := strings.Split(name, "_")
+	if len(fields) != 4 && len(fields) != 5 {
+		return partInfo{}, false
+	}
+	numbers := make([]int64, 4)
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return partInfo{}, false
+		}
+		numbers[i] = n
+	}
+	return partInfo{
+		name:      name,
+		partition: fields[0],
+		min:       numbers[0],
+		max:       numbers[1],
+		level:     numbers[2],
+		mutation:  numbers[3],
+	}, true
+}
+
+func (p partInfo) covers(other partInfo) bool {
+	if p.name == other.name || p.partition != other.partition {
+		return false
+	}
+	if p.min > other.min || p.max < other.max {
+		return false
+	}
+	return p.min < other.min || p.max > other.max || p.level > other.level || p.mutation > other.mutation
+}
+
+// filterCoveredParts - snapshot contains outdated parts which are still not removed after merge
+func filterCoveredParts(names []string) []string {
+	parsed := make([]partInfo, 0, len(names))
+	var result []string
+	for _, name := range names {
+		if p, ok := parsePartName(name); ok {
+			parsed = append(parsed, p)
+			continue
+		}
+		result = append(result, name)
+	}
+	for _, p := range parsed {
+		covered := false
+		for _, other := range parsed {
+			if other.covers(p) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, p.name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,144 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePartName(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected partInfo
+		ok       bool
+	}{
+		{name: "all_1_1_0", expected: partInfo{name: "all_1_1_0", partition: "all", min: 1, max: 1}, ok: true},
+		{name: "202101_1_5_2", expected: partInfo{name: "202101_1_5_2", partition: "202101", min: 1, max: 5, level: 2}, ok: true},
+		{name: "202101_1_5_2_7", expected: partInfo{name: "202101_1_5_2_7", partition: "202101", min: 1, max: 5, level: 2, mutation: 7}, ok: true},
+		{name: "a1b2c3d4e5f6_3_3_0", expected: partInfo{name: "a1b2c3d4e5f6_3_3_0", partition: "a1b2c3d4e5f6", min: 3, max: 3}, ok: true},
+		{name: "all_1_1"},
+		{name: "all_1_1_0_1_2"},
+		{name: "all_1_x_0"},
+		{name: "all_1_1_0_x"},
+		{name: "format_version.txt"},
+		{name: ""},
+	} {
+		p, ok := parsePartName(tc.name)
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.expected, p, tc.name)
+	}
+}
+
+func TestPartInfoCovers(t *testing.T) {
+	for _, tc := range []struct {
+		part    string
+		other   string
+		covers  bool
+		comment string
+	}{
+		{part: "all_1_3_1", other: "all_1_1_0", covers: true, comment: "merged covers source part"},
+		{part: "all_1_3_1", other: "all_3_3_0", covers: true, comment: "merged covers last source part"},
+		{part: "all_1_1_0_5", other: "all_1_1_0", covers: true, comment: "mutated covers original part"},
+		{part: "all_1_3_2", other: "all_1_3_1", covers: true, comment: "merge of the same range with higher level"},
+		{part: "all_1_1_0", other: "all_1_3_1", comment: "source part doesn't cover merged"},
+		{part: "all_1_1_0", other: "all_1_1_0_5", comment: "original doesn't cover mutated"},
+		{part: "all_1_3_1", other: "all_1_3_1", comment: "part doesn't cover itself"},
+		{part: "all_1_3_1", other: "all_3_5_1", comment: "overlapping ranges don't cover each other"},
+		{part: "all_3_5_1", other: "all_1_3_1", comment: "overlapping ranges don't cover each other"},
+		{part: "202101_1_3_1", other: "202102_1_1_0", comment: "different partitions"},
+		{part: "all_4_6_1", other: "all_1_3_1", comment: "disjoint ranges"},
+	} {
+		p, ok := parsePartName(tc.part)
+		require.True(t, ok, tc.part)
+		other, ok := parsePartName(tc.other)
+		require.True(t, ok, tc.other)
+		assert.Equal(t, tc.covers, p.covers(other), "%s covers %s: %s", tc.part, tc.other, tc.comment)
+	}
+}
+
+func TestFilterCoveredParts(t *testing.T) {
+	for _, tc := range []struct {
+		names    []string
+		expected []string
+	}{
+		{names: nil, expected: nil},
+		{names: []string{"all_1_1_0", "all_2_2_0"}, expected: []string{"all_1_1_0", "all_2_2_0"}},
+		{names: []string{"all_1_1_0", "all_2_2_0", "all_1_2_1"}, expected: []string{"all_1_2_1"}},
+		{names: []string{"all_1_1_0", "all_1_1_0_3", "all_2_2_0"}, expected: []string{"all_1_1_0_3", "all_2_2_0"}},
+		{names: []string{"all_1_1_0", "all_2_2_0", "all_1_2_1", "all_1_2_1_4"}, expected: []string{"all_1_2_1_4"}},
+		{names: []string{"all_1_3_1", "all_3_5_1"}, expected: []string{"all_1_3_1", "all_3_5_1"}},
+		{names: []string{"202101_1_1_0", "202102_1_1_0", "202101_1_2_1", "202101_2_2_0"}, expected: []string{"202101_1_2_1", "202102_1_1_0"}},
+		{names: []string{"not_a_part", "all_1_1_0"}, expected: []string{"all_1_1_0", "not_a_part"}},
+	} {
+		result := filterCoveredParts(tc.names)
+		sort.Strings(result)
+		assert.Equal(t, tc.expected, result, strings.Join(tc.names, ","))
+	}
+}
+
+func TestCopySnapshotParts(t *testing.T) {
+	snapshotTablePath, err := ioutil.TempDir("", "clickhouse-backup-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(snapshotTablePath)
+	backupPartsPath, err := ioutil.TempDir("", "clickhouse-backup-snapshot-parts")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPartsPath)
+	writePart := func(name string, files map[string]string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(snapshotTablePath, name), 0750))
+		for fileName, body := range files {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(snapshotTablePath, name, fileName), []byte(body), 0640))
+		}
+	}
+	// all_1_1_0 and all_2_2_0 are merged to all_1_2_1 and it is mutated to all_1_2_1_3, all_3_3_0 is new
+	writePart("all_1_1_0", map[string]string{"checksums.txt": "1", "data.bin": "1"})
+	writePart("all_2_2_0", map[string]string{"checksums.txt": "2", "data.bin": "2"})
+	writePart("all_1_2_1", map[string]string{"checksums.txt": "12", "data.bin": "12"})
+	writePart("all_1_2_1_3", map[string]string{"checksums.txt": "123", "data.bin": "123", clickhouse.MetadataVersionFileName: "3\n"})
+	writePart("all_3_3_0", map[string]string{"checksums.txt": "3", "data.bin": "3", "data.cmrk2": "3"})
+	// part without checksums.txt is not completely written, detached and tmp parts are not active
+	writePart("all_4_4_0", map[string]string{"data.bin": "4"})
+	writePart("tmp_insert_all_5_5_0", map[string]string{"checksums.txt": "5"})
+	writePart(filepath.Join("detached", "all_6_6_0"), map[string]string{"checksums.txt": "6"})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(snapshotTablePath, "format_version.txt"), []byte("1"), 0640))
+
+	var chowned []string
+	parts, size, err := copySnapshotParts(snapshotTablePath, backupPartsPath, []string{"*.cmrk2"}, true, func(name string) error {
+		chowned = append(chowned, strings.TrimPrefix(name, backupPartsPath))
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Name < parts[j].Name
+	})
+	assert.Equal(t, []metadata.Part{
+		{Name: "all_1_2_1_3", MetadataVersion: "3"},
+		{Name: "all_3_3_0"},
+	}, parts)
+	assert.Equal(t, int64(len("123")*2+len("3\n")+len("3")*2), size)
+	sort.Strings(chowned)
+	assert.Equal(t, []string{
+		"/all_1_2_1_3",
+		"/all_1_2_1_3/checksums.txt",
+		"/all_1_2_1_3/data.bin",
+		"/all_1_2_1_3/metadata_version.txt",
+		"/all_3_3_0",
+		"/all_3_3_0/checksums.txt",
+		"/all_3_3_0/data.bin",
+	}, chowned)
+	entries, err := ioutil.ReadDir(backupPartsPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	data, err := ioutil.ReadFile(filepath.Join(backupPartsPath, "all_1_2_1_3", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "123", string(data))
+	_, err = os.Stat(filepath.Join(backupPartsPath, "all_3_3_0", "data.cmrk2"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// tableMatcher - comma separated globs matched against "database.table",
+// globs with leading "!" exclude tables which are matched by other globs
+type tableMatcher struct {
+	include []string
+	exclude []string
+}
+
+// newTableMatcher - empty tablePattern or only exclusions include all tables
+func newTableMatcher(tablePattern string) tableMatcher {
+	m := tableMatcher{}
+	if tablePattern != "" {
+		for _, pattern := range strings.Split(tablePattern, ",") {
+			if strings.HasPrefix(pattern, "!") {
+				m.exclude = append(m.exclude, strings.TrimPrefix(pattern, "!"))
+				continue
+			}
+			m.include = append(m.include, pattern)
+		}
+	}
+	if len(m.include) == 0 {
+		m.include = []string{"*"}
+	}
+	return m
+}
+
+func (m tableMatcher) match(tableName string) bool {
+	included := false
+	for _, pattern := range m.include {
+		if matched, _ := filepath.Match(pattern, tableName); matched {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range m.exclude {
+		if matched, _ := filepath.Match(pattern, tableName); matched {
+			return false
+		}
+	}
+	return true
+}
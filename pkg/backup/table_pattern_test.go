@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterTablesByPatternExclude(t *testing.T) {
+	tables := []clickhouse.Table{
+		{Database: "default", Name: "events"},
+		{Database: "default", Name: "tmp_events"},
+		{Database: "staging", Name: "events"},
+		{Database: "prod", Name: "users"},
+	}
+	names := func(tables []clickhouse.Table) []string {
+		var result []string
+		for _, t := range tables {
+			result = append(result, t.Database+"."+t.Name)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"default.events", "prod.users"}, names(filterTablesByPattern(tables, "*.*,!staging.*,!default.tmp_*", nil)))
+	assert.Equal(t, []string{"default.events", "default.tmp_events", "prod.users"}, names(filterTablesByPattern(tables, "!staging.*", nil)))
+	assert.Equal(t, []string{"default.events"}, names(filterTablesByPattern(tables, "default.*,!default.tmp_*", nil)))
+	assert.Equal(t, []string{"default.events", "default.tmp_events"}, names(filterTablesByPattern(tables, "default.*,default.events", nil)))
+	assert.Equal(t, tables, filterTablesByPattern(tables, "", nil))
+}
+
+func TestFilterTablesByPatternSkipDatabases(t *testing.T) {
+	tables := []clickhouse.Table{
+		{Database: "default", Name: "events"},
+		{Database: "system", Name: "query_log"},
+		{Database: "INFORMATION_SCHEMA", Name: "tables"},
+		{Database: "information_schema", Name: "columns"},
+		{Database: "Information_Schema", Name: "views"},
+		{Database: "System", Name: "users"},
+	}
+	skipDatabases := config.DefaultConfig().General.SkipDatabases
+	assert.Equal(t, []clickhouse.Table{tables[0], tables[5]}, filterTablesByPattern(tables, "", skipDatabases))
+	assert.Empty(t, filterTablesByPattern(tables, "system.*", skipDatabases))
+	// explicit pattern opts back in when default list is cleared
+	assert.Equal(t, []clickhouse.Table{tables[1]}, filterTablesByPattern(tables, "system.*", []string{}))
+}
+
+func TestFilterTablesByPatternKeepsSkip(t *testing.T) {
+	tables := []clickhouse.Table{
+		{Database: "default", Name: "events"},
+		{Database: "default", Name: "tmp_events", Skip: true},
+	}
+	// clickhouse.skip_tables wins over matching --tables pattern
+	assert.Equal(t, tables, filterTablesByPattern(tables, "default.*", nil))
+	assert.Equal(t, tables[1:], filterTablesByPattern(tables, "default.tmp_events", nil))
+}
+
+func TestParseTablePatternForDownloadExclude(t *testing.T) {
+	tables := []metadata.TableTitle{{Database: "default", Table: "events"}, {Database: "staging", Table: "events"}}
+	assert.Equal(t, []metadata.TableTitle{{Database: "default", Table: "events"}}, parseTablePatternForDownload(tables, "!staging.*"))
+	assert.Equal(t, tables, parseTablePatternForDownload(tables, ""))
+}
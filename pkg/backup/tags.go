@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxTagLength - max length of one backup tag
+const MaxTagLength = 128
+
+// normalizeTags - trim tags and remove duplicates keeping order, result is never nil, so metadata.json has "tags": []
+func normalizeTags(tags []string) ([]string, error) {
+	result := make([]string, 0, len(tags))
+	seen := map[string]struct{}{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, fmt.Errorf("tag can't be empty")
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tag '%s' is too long, %d bytes allowed", tag, MaxTagLength)
+		}
+		if strings.ContainsAny(tag, ", \t\n") {
+			return nil, fmt.Errorf("tag '%s' can't contain commas or whitespace", tag)
+		}
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		result = append(result, tag)
+	}
+	return result, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
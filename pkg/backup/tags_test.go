@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, tags)
+	body, err := json.Marshal(metadata.BackupMetadata{Tags: tags})
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"tags":[]`)
+
+	tags, err = normalizeTags([]string{" daily", "type=scheduled", "daily"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"daily", "type=scheduled"}, tags)
+
+	for _, tag := range []string{"", " ", "a,b", "a b", strings.Repeat("a", MaxTagLength+1)} {
+		_, err := normalizeTags([]string{tag})
+		assert.Error(t, err, tag)
+	}
+}
+
+func TestBackupSummaryMatchTag(t *testing.T) {
+	s := BackupSummary{Tags: []string{"daily", "shard=1"}}
+	assert.True(t, s.match(ListOptions{}))
+	assert.True(t, s.match(ListOptions{Tag: "daily"}))
+	assert.False(t, s.match(ListOptions{Tag: "day"}))
+	assert.False(t, BackupSummary{}.match(ListOptions{Tag: "daily"}))
+}
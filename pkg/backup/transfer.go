@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"context"
+	"sync"
+)
+
+// runTransfers - call transfer for 0..count-1 by concurrency workers, the first error is returned
+// and transfers which are not started yet are cancelled, running ones are waited for
+func runTransfers(ctx context.Context, count, concurrency int, transfer func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workersCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < count; i++ {
+		slots <- struct{}{}
+		if workersCtx.Err() != nil {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := transfer(i); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTransfers(t *testing.T) {
+	var running, maxRunning int32
+	sizes := make([]int64, 20)
+	err := runTransfers(context.Background(), len(sizes), 3, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		sizes[i] = int64(i)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, maxRunning, int32(3))
+	for i, size := range sizes {
+		assert.Equal(t, int64(i), size)
+	}
+}
+
+func TestRunTransfersError(t *testing.T) {
+	var started int32
+	err := runTransfers(context.Background(), 10, 1, func(i int) error {
+		atomic.AddInt32(&started, 1)
+		if i == 2 {
+			return fmt.Errorf("upload failed")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "upload failed")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&started))
+
+	// with concurrency only transfers running at the moment of error are finished
+	started = 0
+	err = runTransfers(context.Background(), 100, 4, func(i int) error {
+		atomic.AddInt32(&started, 1)
+		if i == 0 {
+			return fmt.Errorf("download failed")
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	assert.EqualError(t, err, "download failed")
+	assert.Less(t, atomic.LoadInt32(&started), int32(100))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, runTransfers(ctx, 5, 2, func(i int) error {
+		return nil
+	}))
+}
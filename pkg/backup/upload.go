@@ -2,6 +2,7 @@ package backup
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,12 +14,13 @@ import (
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
 	"github.com/AlexAkulov/clickhouse-backup/utils"
 
 	apexLog "github.com/apex/log"
 )
 
-func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom string, schemaOnly bool) error {
+func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom string, schemaOnly, full bool) error {
 	if b.cfg.General.RemoteStorage == "none" {
 		fmt.Println("Upload aborted: RemoteStorage set to \"none\"")
 		return nil
@@ -35,6 +37,7 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 		"operation": "upload",
 	})
 	startUpload := time.Now()
+	b.ch.SetQueryComment("upload", backupName)
 	if err := b.ch.Connect(); err != nil {
 		return fmt.Errorf("can't connect to clickhouse: %v", err)
 	}
@@ -42,7 +45,7 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 	if err := b.init(); err != nil {
 		return err
 	}
-	if _, err := getLocalBackup(b.cfg, backupName); err != nil {
+	if _, err := GetLocalBackup(b.cfg, backupName); err != nil {
 		return fmt.Errorf("can't upload: %v", err)
 	}
 	remoteBackups, err := b.dst.BackupList()
@@ -54,13 +57,35 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 			return fmt.Errorf("'%s' already exists on remote", backupName)
 		}
 	}
+	if diffFrom == "" && b.cfg.General.AutoIncremental && !full {
+		localBackups, err := GetLocalBackups(b.cfg)
+		if err != nil {
+			return err
+		}
+		if diffFrom = selectIncrementalBase(backupName, localBackups, remoteBackups, b.cfg.General.AutoIncrementalMaxChain); diffFrom != "" {
+			log.WithField("diff_from", diffFrom).Info("auto incremental")
+		} else {
+			log.Info("no base for auto incremental or auto_incremental_max_chain is reached, upload full backup")
+		}
+	}
 	backupMetadata, err := b.ReadBackupMetadata(backupName)
 	if err != nil {
 		return err
 	}
+	// parts of local incremental backup are hardlinked from its base, so they are compared with diffFrom again
+	localRequiredBackup := backupMetadata.RequiredBackup
+	backupMetadata.RequiredBackup = ""
+	if localRequiredBackup != "" && diffFrom == "" && !full {
+		if isUploadedLocalBackup(localRequiredBackup, localBackupsPath(b.cfg, b.DefaultDataPath), remoteBackups) {
+			diffFrom = localRequiredBackup
+			log.WithField("diff_from", diffFrom).Info("upload incremental backup")
+		} else {
+			log.Warnf("base backup '%s' is not uploaded, upload full backup", localRequiredBackup)
+		}
+	}
 	var tablesForUpload RestoreTables
 	if len(backupMetadata.Tables) != 0 {
-		metadataPath := path.Join(b.DefaultDataPath, "backup", backupName, "metadata")
+		metadataPath := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, "metadata")
 		tablesForUpload, err = parseSchemaPattern(metadataPath, tablePattern, false)
 		if err != nil {
 			return err
@@ -68,6 +93,11 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 	}
 	compressedDataSize := int64(0)
 	metadataSize := int64(0)
+	// signature of exact bytes of uploaded metadata, local metadata.json.sig doesn't match them
+	var signature metadataSignature
+	if b.cfg.General.MetadataSigningKey != "" {
+		signature = metadataSignature{}
+	}
 	var diffFromBackup *metadata.BackupMetadata
 	tablesForUploadFromDiff := map[metadata.TableTitle]metadata.TableMetadata{}
 	if diffFrom != "" {
@@ -77,7 +107,7 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 		}
 		if len(diffFromBackup.Tables) != 0 {
 			backupMetadata.RequiredBackup = diffFrom
-			metadataPath := path.Join(b.DefaultDataPath, "backup", diffFrom, "metadata")
+			metadataPath := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), diffFrom, "metadata")
 			diffTablesList, err := parseSchemaPattern(metadataPath, tablePattern, false)
 			if err != nil {
 				return err
@@ -97,21 +127,22 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 		start := time.Now()
 		var uploadedBytes int64
 		if !schemaOnly {
+			clearRequiredParts(&table)
 			if diffTable, ok := tablesForUploadFromDiff[metadata.TableTitle{
 				Database: table.Database,
 				Table:    table.Table,
 			}]; ok {
-				b.markDuplicatedParts(backupMetadata, &diffTable, &table)
+				b.markDuplicatedParts(backupMetadata, diffFromBackup, &diffTable, &table)
 			}
 			var files map[string][]string
-			files, uploadedBytes, err = b.uploadTableData(backupName, table)
+			files, uploadedBytes, err = b.uploadTableData(backupMetadata, table)
 			if err != nil {
 				return err
 			}
 			compressedDataSize += uploadedBytes
 			table.Files = files
 		}
-		tableMetadataSize, err := b.uploadTableMetadata(backupName, table)
+		tableMetadataSize, err := b.uploadTableMetadata(backupName, table, signature)
 		if err != nil {
 			return err
 		}
@@ -125,6 +156,10 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 
 	// заливаем метадату для бэкапа
 	backupMetadata.CompressedSize = compressedDataSize
+	if b.cfg.GetCompressionFormat() == "tar" && !schemaOnly {
+		// parts are archived without compression
+		backupMetadata.CompressedSize = backupMetadata.DataSize
+	}
 	backupMetadata.MetadataSize = metadataSize
 	tt := []metadata.TableTitle{}
 	for i := range tablesForUpload {
@@ -139,10 +174,39 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 	} else {
 		backupMetadata.DataFormat = "directory"
 	}
+	backupMetadata.Encryption = ""
+	if !schemaOnly {
+		key, err := b.cfg.GetEncryptionKey()
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			backupMetadata.Encryption = new_storage.EncryptionAlgorithm
+		}
+	}
 	newBackupMetadataBody, err := json.MarshalIndent(backupMetadata, "", "\t")
 	if err != nil {
 		return err
 	}
+	clustersFile := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, ClustersFileName)
+	if clustersBody, err := ioutil.ReadFile(clustersFile); err == nil {
+		if err := b.dst.PutFile(path.Join(backupName, ClustersFileName), ioutil.NopCloser(bytes.NewReader(clustersBody))); err != nil {
+			return fmt.Errorf("can't upload: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	manifestPath := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, FilesManifestName)
+	if manifestBody, err := ioutil.ReadFile(manifestPath); err == nil {
+		if err := b.dst.PutFile(path.Join(backupName, FilesManifestName), ioutil.NopCloser(bytes.NewReader(manifestBody))); err != nil {
+			return fmt.Errorf("can't upload: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := b.uploadMetadataSidecars(backupName, signature, newBackupMetadataBody); err != nil {
+		return err
+	}
 	remoteBackupMetaFile := path.Join(backupName, "metadata.json")
 	if err := b.dst.PutFile(remoteBackupMetaFile,
 		ioutil.NopCloser(bytes.NewReader(newBackupMetadataBody))); err != nil {
@@ -154,60 +218,145 @@ func (b *Backuper) Upload(backupName string, tablePattern string, diffFrom strin
 		Info("done")
 
 	// Clean
-	if err := b.dst.RemoveOldBackups(b.cfg.General.BackupsToKeepRemote); err != nil {
+	if err := removeOldBackupsRemote(b.cfg, b.dst); err != nil {
 		return fmt.Errorf("can't remove old backups on remote storage: %v", err)
 	}
 	return nil
 }
 
-func (b *Backuper) uploadTableData(backupName string, table metadata.TableMetadata) (map[string][]string, int64, error) {
-	uuid := path.Join(clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table))
+// isUploadedLocalBackup - backup exists locally and on remote storage, so it can be used as diffFrom
+func isUploadedLocalBackup(backupName, backupsPath string, remoteBackups []new_storage.Backup) bool {
+	if _, err := os.Stat(path.Join(backupsPath, backupName, MetaFileName)); err != nil {
+		return false
+	}
+	for _, remoteBackup := range remoteBackups {
+		if remoteBackup.BackupName == backupName && !remoteBackup.Legacy && remoteBackup.Broken == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// clearRequiredParts - all parts of local backup are present on disk, required flag is set again by markDuplicatedParts
+func clearRequiredParts(table *metadata.TableMetadata) {
+	for _, parts := range table.Parts {
+		for i := range parts {
+			parts[i].Required = false
+		}
+	}
+}
+
+// selectIncrementalBase - newest valid local backup created before backupName which is already uploaded,
+// remote copy is required because download of increment fetches its base from remote storage.
+// Empty base means full backup, it is also returned when the base already has maxChain increments over the last full backup
+func selectIncrementalBase(backupName string, localBackups []BackupLocal, remoteBackups []new_storage.Backup, maxChain int) string {
+	uploaded := map[string]string{}
+	for _, remoteBackup := range remoteBackups {
+		if !remoteBackup.Legacy && remoteBackup.Broken == "" {
+			uploaded[remoteBackup.BackupName] = remoteBackup.RequiredBackup
+		}
+	}
+	// chainLength - increments between backup and full backup, increment of backup would be chainLength+1
+	chainLength := func(name string) int {
+		length := 0
+		for required := uploaded[name]; required != "" && length <= len(uploaded); required = uploaded[required] {
+			length++
+		}
+		return length
+	}
+	var current *BackupLocal
+	for i := range localBackups {
+		if localBackups[i].BackupName == backupName {
+			current = &localBackups[i]
+		}
+	}
+	for i := len(localBackups) - 1; i >= 0; i-- {
+		candidate := localBackups[i]
+		if candidate.BackupName == backupName || candidate.Legacy || candidate.Broken != "" || candidate.InProgress != nil {
+			continue
+		}
+		if current != nil && !candidate.CreationDate.Before(current.CreationDate) {
+			continue
+		}
+		if _, ok := uploaded[candidate.BackupName]; ok {
+			if maxChain > 0 && chainLength(candidate.BackupName)+1 > maxChain {
+				return ""
+			}
+			return candidate.BackupName
+		}
+	}
+	return ""
+}
+
+func (b *Backuper) uploadTableData(backup *metadata.BackupMetadata, table metadata.TableMetadata) (map[string][]string, int64, error) {
+	backupName := backup.BackupName
 	metdataFiles := map[string][]string{}
-	var uploadedBytes int64
+	type archive struct {
+		backupPath string
+		files      []string
+		remoteFile string
+	}
+	var archives []archive
+	remoteDataPath := path.Join(backupName, "shadow", clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table))
 	for disk := range table.Parts {
-		backupPath := path.Join(b.DiskMap[disk], "backup", backupName, "shadow", uuid, disk)
+		backupPath := backupShadowPath(localBackupsPath(b.cfg, b.DiskMap[disk]), backupName, backup.ShadowLayout, disk, table.Database, table.Table)
 		parts, err := separateParts(backupPath, table.Parts[disk], b.cfg.General.MaxFileSize)
 		if err != nil {
 			return nil, 0, err
 		}
 		for i, p := range parts {
-			remoteDataPath := path.Join(backupName, "shadow", clickhouse.TablePathEncode(table.Database), clickhouse.TablePathEncode(table.Table))
 			// Disabled temporary
 			// if b.cfg.GetCompressionFormat() == "none" {
 			// 	err = b.dst.UploadPath(0, backupPath, p, path.Join(remoteDataPath, disk))
 			// } else {
 			fileName := fmt.Sprintf("%s_%d.%s", disk, i+1, b.cfg.GetArchiveExtension())
 			metdataFiles[disk] = append(metdataFiles[disk], fileName)
-			remoteDataFile := path.Join(remoteDataPath, fileName)
-			if err := b.dst.CompressedStreamUpload(backupPath, p, remoteDataFile); err != nil {
-				return nil, 0, fmt.Errorf("can't upload: %v", err)
-			}
-			remoteFile, err := b.dst.StatFile(remoteDataFile)
-			if err != nil {
-				return nil, 0, fmt.Errorf("can't check uploaded file: %v", err)
-			}
-			uploadedBytes += remoteFile.Size()
+			archives = append(archives, archive{backupPath: backupPath, files: p, remoteFile: path.Join(remoteDataPath, fileName)})
 		}
 	}
+	// every worker writes only own size, they are summed after all uploads are finished
+	sizes := make([]int64, len(archives))
+	err := runTransfers(context.Background(), len(archives), b.cfg.General.UploadConcurrency, func(i int) error {
+		if err := b.dst.CompressedStreamUpload(archives[i].backupPath, archives[i].files, archives[i].remoteFile); err != nil {
+			return fmt.Errorf("can't upload: %v", err)
+		}
+		remoteFile, err := b.dst.StatFile(archives[i].remoteFile)
+		if err != nil {
+			return fmt.Errorf("can't check uploaded file: %v", err)
+		}
+		sizes[i] = remoteFile.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	var uploadedBytes int64
+	for _, size := range sizes {
+		uploadedBytes += size
+	}
 	return metdataFiles, uploadedBytes, nil
 }
 
-func (b *Backuper) uploadTableMetadata(backupName string, table metadata.TableMetadata) (int64, error) {
+// uploadTableMetadata - HMAC of uploaded content is added to signature when it is not nil
+func (b *Backuper) uploadTableMetadata(backupName string, table metadata.TableMetadata, signature metadataSignature) (int64, error) {
 	// заливаем метадату для таблицы
 	tableMetafile := table
 	content, err := json.MarshalIndent(&tableMetafile, "", "\t")
 	if err != nil {
 		return 0, fmt.Errorf("can't marshal json: %v", err)
 	}
-	remoteTableMetaFile := path.Join(backupName, "metadata", clickhouse.TablePathEncode(table.Database), fmt.Sprintf("%s.%s", clickhouse.TablePathEncode(table.Table), "json"))
-	if err := b.dst.PutFile(remoteTableMetaFile,
+	relativeMetaFile := path.Join("metadata", clickhouse.TablePathEncode(table.Database), fmt.Sprintf("%s.%s", clickhouse.TablePathEncode(table.Table), "json"))
+	if err := b.dst.PutFile(path.Join(backupName, relativeMetaFile),
 		ioutil.NopCloser(bytes.NewReader(content))); err != nil {
 		return 0, fmt.Errorf("can't upload: %v", err)
 	}
+	if signature != nil {
+		signature[relativeMetaFile] = signMetadataBody(b.cfg.General.MetadataSigningKey, content)
+	}
 	return int64(len(content)), nil
 }
 
-func (b *Backuper) markDuplicatedParts(backup *metadata.BackupMetadata, existsTable *metadata.TableMetadata, newTable *metadata.TableMetadata) {
+func (b *Backuper) markDuplicatedParts(backup, requiredBackup *metadata.BackupMetadata, existsTable *metadata.TableMetadata, newTable *metadata.TableMetadata) {
 	for disk, newParts := range newTable.Parts {
 		if _, ok := existsTable.Parts[disk]; ok {
 			if len(existsTable.Parts[disk]) == 0 {
@@ -221,9 +370,8 @@ func (b *Backuper) markDuplicatedParts(backup *metadata.BackupMetadata, existsTa
 				if _, ok := existsPartsMap[newParts[i].Name]; !ok {
 					continue
 				}
-				uuid := path.Join(clickhouse.TablePathEncode(existsTable.Database), clickhouse.TablePathEncode(existsTable.Table))
-				existsPath := path.Join(b.DiskMap[disk], "backup", backup.RequiredBackup, "shadow", uuid, disk, newParts[i].Name)
-				newPath := path.Join(b.DiskMap[disk], "backup", backup.BackupName, "shadow", uuid, disk, newParts[i].Name)
+				existsPath := path.Join(backupShadowPath(localBackupsPath(b.cfg, b.DiskMap[disk]), requiredBackup.BackupName, requiredBackup.ShadowLayout, disk, existsTable.Database, existsTable.Table), newParts[i].Name)
+				newPath := path.Join(backupShadowPath(localBackupsPath(b.cfg, b.DiskMap[disk]), backup.BackupName, backup.ShadowLayout, disk, newTable.Database, newTable.Table), newParts[i].Name)
 
 				if err := isDuplicatedParts(existsPath, newPath); err != nil {
 					apexLog.Debugf("part '%s' and '%s' must be the same: %v", existsPath, newPath, err)
@@ -274,7 +422,7 @@ func isDuplicatedParts(part1, part2 string) error {
 }
 
 func (b *Backuper) ReadBackupMetadata(backupName string) (*metadata.BackupMetadata, error) {
-	backupMetadataPath := path.Join(b.DefaultDataPath, "backup", backupName, "metadata.json")
+	backupMetadataPath := path.Join(localBackupsPath(b.cfg, b.DefaultDataPath), backupName, "metadata.json")
 	backupMetadataBody, err := ioutil.ReadFile(backupMetadataPath)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/new_storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectIncrementalBase(t *testing.T) {
+	now := time.Now()
+	local := func(name string, age time.Duration) BackupLocal {
+		return BackupLocal{BackupMetadata: metadata.BackupMetadata{BackupName: name, CreationDate: now.Add(-age)}}
+	}
+	remote := func(name string) new_storage.Backup {
+		return new_storage.Backup{BackupMetadata: metadata.BackupMetadata{BackupName: name}}
+	}
+	broken := local("broken", 2*time.Hour)
+	broken.Broken = BrokenPartiallyDeleted
+	localBackups := []BackupLocal{
+		local("oldest", 4*time.Hour),
+		local("uploaded", 3*time.Hour),
+		broken,
+		local("not_uploaded", time.Hour),
+		local("current", 0),
+		local("newer", -time.Hour),
+	}
+	remoteBackups := []new_storage.Backup{remote("oldest"), remote("uploaded"), remote("broken"), remote("newer")}
+
+	assert.Equal(t, "uploaded", selectIncrementalBase("current", localBackups, remoteBackups, 0))
+	assert.Equal(t, "oldest", selectIncrementalBase("uploaded", localBackups, remoteBackups, 0))
+	assert.Equal(t, "", selectIncrementalBase("oldest", localBackups, remoteBackups, 0))
+	assert.Equal(t, "", selectIncrementalBase("current", localBackups, nil, 0))
+}
+
+func TestSelectIncrementalBaseMaxChain(t *testing.T) {
+	now := time.Now()
+	var localBackups []BackupLocal
+	var remoteBackups []new_storage.Backup
+	// daily backups uploaded by auto_incremental with auto_incremental_max_chain: 2
+	for day := 0; day < 9; day++ {
+		name := fmt.Sprintf("day%d", day)
+		creationDate := now.Add(time.Duration(day-9) * 24 * time.Hour)
+		localBackups = append(localBackups, BackupLocal{BackupMetadata: metadata.BackupMetadata{BackupName: name, CreationDate: creationDate}})
+		base := selectIncrementalBase(name, localBackups, remoteBackups, 2)
+		remoteBackups = append(remoteBackups, new_storage.Backup{BackupMetadata: metadata.BackupMetadata{BackupName: name, CreationDate: creationDate, RequiredBackup: base}})
+	}
+	var required []string
+	for _, backup := range remoteBackups {
+		required = append(required, backup.RequiredBackup)
+	}
+	assert.Equal(t, []string{"", "day0", "day1", "", "day3", "day4", "", "day6", "day7"}, required)
+
+	// old chains are removed by backups_to_keep_remote, the chain of kept backups stays
+	var expired []string
+	for _, backup := range getExpiredRemoteBackups(remoteBackups, 2, 0, nil, now) {
+		expired = append(expired, backup.BackupName)
+	}
+	assert.ElementsMatch(t, []string{"day0", "day1", "day2", "day3", "day4", "day5"}, expired)
+
+	// without limit the whole history is one chain which is never removed
+	remoteBackups = remoteBackups[:0]
+	for _, backup := range localBackups {
+		base := selectIncrementalBase(backup.BackupName, localBackups, remoteBackups, 0)
+		remoteBackups = append(remoteBackups, new_storage.Backup{BackupMetadata: metadata.BackupMetadata{BackupName: backup.BackupName, CreationDate: backup.CreationDate, RequiredBackup: base}})
+	}
+	assert.Empty(t, getExpiredRemoteBackups(remoteBackups, 2, 0, nil, now))
+}
@@ -1,21 +1,126 @@
 package backup
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/utils"
 	apexLog "github.com/apex/log"
 )
 
-func moveShadow(shadowPath, backupPartsPath string) ([]metadata.Part, int64, error) {
+// logTableDone - per-table success line, general.quiet moves it to debug level to reduce logs volume
+func logTableDone(cfg *config.Config, log *apexLog.Entry) {
+	if cfg.General.Quiet {
+		log.Debug("done")
+		return
+	}
+	log.Info("done")
+}
+
+// localBackupsPath - directory of local backups on disk, general.backup_dir is used instead of it for all disks
+func localBackupsPath(cfg *config.Config, diskPath string) string {
+	if cfg.General.BackupDir != "" {
+		return cfg.General.BackupDir
+	}
+	return path.Join(diskPath, "backup")
+}
+
+// backupShadowPath - return path to parts of table inside local backup, backupsPath is localBackupsPath of disk,
+// layout is defined by general.shadow_layout
+func backupShadowPath(backupsPath, backupName, shadowLayout, diskName, database, table string) string {
+	return path.Join(backupsPath, backupName, clickhouse.ShadowPath(shadowLayout, diskName, database, table))
+}
+
+// requiredPartFiles - ClickHouse part files which are never excluded by general.exclude_part_files
+var requiredPartFiles = []string{
+	"checksums.txt", "columns.txt", "count.txt", "primary.idx", "partition.dat",
+	"default_compression_codec.txt", "ttl.txt", "minmax_*.idx", "skp_idx_*", "*.bin", "*.mrk*",
+}
+
+// isExcludedPartFile - match file name inside part by general.exclude_part_files, required part files are always kept
+func isExcludedPartFile(name string, excludePartFiles []string) bool {
+	if len(excludePartFiles) == 0 {
+		return false
+	}
+	for _, pattern := range requiredPartFiles {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+	for _, pattern := range excludePartFiles {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// getMetadataVersion - read metadata_version.txt from table data paths, the file is absent on older ClickHouse
+func getMetadataVersion(dataPaths []string) string {
+	for _, dataPath := range dataPaths {
+		data, err := ioutil.ReadFile(filepath.Join(dataPath, clickhouse.MetadataVersionFileName))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				apexLog.Warnf("can't read '%s': %v", filepath.Join(dataPath, clickhouse.MetadataVersionFileName), err)
+			}
+			continue
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+const (
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+)
+
+// parseIOPriority - "idle", "best-effort" or "best-effort:<0-7>" to I/O scheduling class and level
+func parseIOPriority(priority string) (int, int, error) {
+	switch {
+	case priority == "idle":
+		return ioprioClassIdle, 0, nil
+	case priority == "best-effort":
+		return ioprioClassBestEffort, 4, nil
+	case strings.HasPrefix(priority, "best-effort:"):
+		level, err := strconv.Atoi(strings.TrimPrefix(priority, "best-effort:"))
+		if err != nil || level < 0 || level > 7 {
+			return 0, 0, fmt.Errorf("wrong io_priority '%s', level must be from 0 to 7", priority)
+		}
+		return ioprioClassBestEffort, level, nil
+	}
+	return 0, 0, fmt.Errorf("wrong io_priority '%s', use idle, best-effort or best-effort:<0-7>", priority)
+}
+
+// moveShadow - move parts from shadow increment to backup
+// shadowPath is resolved like ClickHouse resolves disk paths, so symlinked disks are traversed.
+// Symlinks inside parts are skipped, with followSymlinks content of symlinked files is copied,
+// symlinked directories are never traversed
+func moveShadow(shadowPath, backupPartsPath string, excludePartFiles []string, followSymlinks, forceCopy, verifyCopy bool) ([]metadata.Part, int64, error) {
 	size := int64(0)
 	partitions := []metadata.Part{}
-	err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+	shadowPath, err := filepath.EvalSymlinks(shadowPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		relativePath := strings.Trim(strings.TrimPrefix(filePath, shadowPath), "/")
 		pathParts := strings.SplitN(relativePath, "/", 4)
 		// [store 1f9 1f9dc899-0de9-41f8-b95c-26c1f0d67d93 20181023_2_2_0/partition.dat]
@@ -25,20 +130,100 @@ func moveShadow(shadowPath, backupPartsPath string) ([]metadata.Part, int64, err
 		dstFilePath := filepath.Join(backupPartsPath, pathParts[3])
 		if info.IsDir() {
 			partitions = append(partitions, metadata.Part{
-				Name: pathParts[3],
+				Name:            pathParts[3],
+				MetadataVersion: getMetadataVersion([]string{filePath}),
 			})
-			return os.MkdirAll(dstFilePath, 0750)
+			if err := os.MkdirAll(dstFilePath, 0750); err != nil {
+				return err
+			}
+			return preserveFileAttrs(dstFilePath, info)
+		}
+		isSymlink := info.Mode()&os.ModeSymlink != 0
+		if isSymlink {
+			if !followSymlinks {
+				apexLog.Debugf("'%s' is symlink, skipping", filePath)
+				return nil
+			}
+			if info, err = os.Stat(filePath); err != nil {
+				return err
+			}
 		}
 		if !info.Mode().IsRegular() {
 			apexLog.Debugf("'%s' is not a regular file, skipping", filePath)
 			return nil
 		}
+		if isExcludedPartFile(info.Name(), excludePartFiles) {
+			apexLog.Debugf("'%s' is matched by exclude_part_files, skipping", filePath)
+			return nil
+		}
 		size += info.Size()
-		return os.Rename(filePath, dstFilePath)
+		// files of shadow are hardlinks to live parts, moving them keeps the same inodes
+		if isSymlink || forceCopy {
+			if err := copyPartFile(filePath, dstFilePath, verifyCopy); err != nil {
+				return err
+			}
+			return preserveFileAttrs(dstFilePath, info)
+		}
+		return moveFile(filePath, dstFilePath, info, verifyCopy)
 	})
 	return partitions, size, err
 }
 
+// moveFile - rename file, or copy and remove it when destination is on another filesystem
+func moveFile(srcFile, dstFile string, info os.FileInfo, verify bool) error {
+	if err := renameFile(srcFile, dstFile); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+		// backup directory is on another filesystem than source, e.g. separate volume mounted to <disk>/backup
+		apexLog.Debugf("'%s' is on another device, copying", dstFile)
+		return copyAndRemoveFile(srcFile, dstFile, info, verify)
+	}
+	return nil
+}
+
+// chownTree - apply chown to every directory and file under root, symlinks are left as is
+func chownTree(root string, chown func(string) error) error {
+	return filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return chown(filePath)
+	})
+}
+
+// renameFile - os.Rename, replaced in tests to simulate EXDEV
+var renameFile = os.Rename
+
+// copyAndRemoveFile - move file across filesystems, mode and owner of source are preserved
+func copyAndRemoveFile(srcFile, dstFile string, info os.FileInfo, verify bool) error {
+	if err := copyPartFile(srcFile, dstFile, verify); err != nil {
+		return err
+	}
+	if err := preserveFileAttrs(dstFile, info); err != nil {
+		return err
+	}
+	return os.Remove(srcFile)
+}
+
+// preserveFileAttrs - apply permission bits and owner of source to copied file or directory,
+// owner can be changed only by root, otherwise it stays the current user
+func preserveFileAttrs(dst string, info os.FileInfo) error {
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if os.Getuid() != 0 {
+		return nil
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(dst, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
+
 func copyFile(srcFile string, dstFile string) error {
 	if err := os.MkdirAll(path.Dir(dstFile), os.ModePerm); err != nil {
 		return err
@@ -52,9 +237,64 @@ func copyFile(srcFile string, dstFile string) error {
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
-	return err
+	// write errors of copied part can be reported only by Sync or Close, so they are not deferred
+	if _, err = io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		_ = dst.Close()
+		return fmt.Errorf("can't sync '%s': %v", dstFile, err)
+	}
+	if err = dst.Close(); err != nil {
+		return fmt.Errorf("can't close '%s': %v", dstFile, err)
+	}
+	return nil
+}
+
+// logFrozenSize - data size of frozen parts is additional disk space only when parts are copied,
+// moved hardlinks share blocks with live parts until ClickHouse merges or drops them
+func logFrozenSize(cfg *config.Config, log *apexLog.Entry, frozenSize int64) {
+	if cfg.General.ForceCopyOverHardlink || cfg.ClickHouse.SnapshotDataPath != "" {
+		log.WithField("size", utils.FormatBytes(frozenSize)).Info("parts copied, additional disk space is used")
+		return
+	}
+	log.WithField("size", utils.FormatBytes(frozenSize)).Debug("parts hardlinked, disk space is shared with live parts")
+}
+
+// copyPartFile - copy file and optionally compare SHA256 of the copy with source
+func copyPartFile(srcFile, dstFile string, verify bool) error {
+	if err := copyFile(srcFile, dstFile); err != nil {
+		return err
+	}
+	if !verify {
+		return nil
+	}
+	srcSum, err := fileSHA256(srcFile)
+	if err != nil {
+		return err
+	}
+	dstSum, err := fileSHA256(dstFile)
+	if err != nil {
+		return err
+	}
+	if srcSum != dstSum {
+		return fmt.Errorf("checksum of '%s' doesn't match '%s' after copy", dstFile, srcFile)
+	}
+	return nil
+}
+
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func GetBackupsToDelete(backups []BackupLocal, keep int) []BackupLocal {
@@ -0,0 +1,168 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// prepareSymlinkedShadow - disk path is symlink to real disk, part contains symlink to file outside of shadow
+func prepareSymlinkedShadow(t *testing.T) (string, string) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-shadow")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	partPath := filepath.Join(root, "realDisk", "shadow", "1", "store", "abc", "abc11111-2222-3333-4444-555566667777", "all_1_1_0")
+	require.NoError(t, os.MkdirAll(partPath, 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "checksums.txt"), []byte("checksums"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "data.bin"), []byte("data"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "columns.txt"), []byte("columns"), 0640))
+	require.NoError(t, os.Symlink(filepath.Join(root, "columns.txt"), filepath.Join(partPath, "columns.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "realDisk"), filepath.Join(root, "disk")))
+
+	backupPartsPath := filepath.Join(root, "backup")
+	require.NoError(t, os.MkdirAll(backupPartsPath, 0750))
+	return filepath.Join(root, "disk", "shadow", "1"), backupPartsPath
+}
+
+func TestMoveShadowSymlinkedDisk(t *testing.T) {
+	shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+	parts, size, err := moveShadow(shadowPath, backupPartsPath, nil, false, false, false)
+	require.NoError(t, err)
+	assert.Len(t, parts, 1)
+	assert.Equal(t, "all_1_1_0", parts[0].Name)
+	assert.Equal(t, int64(len("checksums")+len("data")), size)
+	assert.FileExists(t, filepath.Join(backupPartsPath, "all_1_1_0", "data.bin"))
+	_, err = os.Lstat(filepath.Join(backupPartsPath, "all_1_1_0", "columns.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMoveShadowFollowSymlinks(t *testing.T) {
+	shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+	parts, size, err := moveShadow(shadowPath, backupPartsPath, nil, true, false, false)
+	require.NoError(t, err)
+	assert.Len(t, parts, 1)
+	assert.Equal(t, int64(len("checksums")+len("data")+len("columns")), size)
+	info, err := os.Lstat(filepath.Join(backupPartsPath, "all_1_1_0", "columns.txt"))
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+	data, err := ioutil.ReadFile(filepath.Join(backupPartsPath, "all_1_1_0", "columns.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "columns", string(data))
+}
+
+func TestMoveShadowForceCopy(t *testing.T) {
+	shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+	_, size, err := moveShadow(shadowPath, backupPartsPath, nil, false, true, true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("checksums")+len("data")), size)
+	srcInfo, err := os.Stat(filepath.Join(shadowPath, "store", "abc", "abc11111-2222-3333-4444-555566667777", "all_1_1_0", "data.bin"))
+	require.NoError(t, err)
+	dstInfo, err := os.Stat(filepath.Join(backupPartsPath, "all_1_1_0", "data.bin"))
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(srcInfo, dstInfo))
+}
+
+func TestMoveShadowCrossDevice(t *testing.T) {
+	shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+	renameFile = func(oldPath, newPath string) error {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EXDEV}
+	}
+	defer func() { renameFile = os.Rename }()
+	srcFile := filepath.Join(shadowPath, "store", "abc", "abc11111-2222-3333-4444-555566667777", "all_1_1_0", "data.bin")
+	require.NoError(t, os.Chmod(srcFile, 0600))
+
+	parts, size, err := moveShadow(shadowPath, backupPartsPath, nil, false, false, true)
+	require.NoError(t, err)
+	assert.Len(t, parts, 1)
+	assert.Equal(t, "all_1_1_0", parts[0].Name)
+	assert.Equal(t, int64(len("checksums")+len("data")), size)
+	_, err = os.Stat(srcFile)
+	assert.True(t, os.IsNotExist(err))
+	info, err := os.Stat(filepath.Join(backupPartsPath, "all_1_1_0", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := ioutil.ReadFile(filepath.Join(backupPartsPath, "all_1_1_0", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestMoveShadowPreservesAttrs(t *testing.T) {
+	for _, forceCopy := range []bool{false, true} {
+		shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+		partPath := filepath.Join(shadowPath, "store", "abc", "abc11111-2222-3333-4444-555566667777", "all_1_1_0")
+		srcFile := filepath.Join(partPath, "data.bin")
+		require.NoError(t, os.Chmod(srcFile, 0604))
+		require.NoError(t, os.Chmod(partPath, 0710))
+		uid, gid := os.Getuid(), os.Getgid()
+		if uid == 0 {
+			uid, gid = 1234, 1235
+			require.NoError(t, os.Chown(srcFile, uid, gid))
+			require.NoError(t, os.Chown(partPath, uid, gid))
+		}
+
+		_, _, err := moveShadow(shadowPath, backupPartsPath, nil, false, forceCopy, false)
+		require.NoError(t, err)
+		for _, item := range []struct {
+			path string
+			mode os.FileMode
+		}{
+			{filepath.Join(backupPartsPath, "all_1_1_0"), 0710},
+			{filepath.Join(backupPartsPath, "all_1_1_0", "data.bin"), 0604},
+		} {
+			info, err := os.Stat(item.path)
+			require.NoError(t, err)
+			assert.Equal(t, item.mode, info.Mode().Perm(), "forceCopy=%v %s", forceCopy, item.path)
+			stat := info.Sys().(*syscall.Stat_t)
+			assert.Equal(t, uid, int(stat.Uid), "forceCopy=%v %s", forceCopy, item.path)
+			assert.Equal(t, gid, int(stat.Gid), "forceCopy=%v %s", forceCopy, item.path)
+		}
+
+		var chowned []string
+		require.NoError(t, chownTree(backupPartsPath, func(name string) error {
+			chowned = append(chowned, strings.TrimPrefix(name, backupPartsPath))
+			return nil
+		}))
+		assert.Equal(t, []string{"", "/all_1_1_0", "/all_1_1_0/checksums.txt", "/all_1_1_0/data.bin"}, chowned)
+	}
+}
+
+func TestMoveShadowRenameError(t *testing.T) {
+	shadowPath, backupPartsPath := prepareSymlinkedShadow(t)
+	renameFile = func(oldPath, newPath string) error {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EACCES}
+	}
+	defer func() { renameFile = os.Rename }()
+	_, _, err := moveShadow(shadowPath, backupPartsPath, nil, false, false, false)
+	assert.Error(t, err)
+}
+
+func TestMoveShadowPartMetadataVersion(t *testing.T) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-shadow")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	shadowPath := filepath.Join(root, "shadow", "1")
+	for part, version := range map[string]string{"all_1_1_0": "2\n", "all_2_2_0": ""} {
+		partPath := filepath.Join(shadowPath, "store", "abc", "abc11111-2222-3333-4444-555566667777", part)
+		require.NoError(t, os.MkdirAll(partPath, 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "data.bin"), []byte("data"), 0640))
+		if version != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "metadata_version.txt"), []byte(version), 0640))
+		}
+	}
+	backupPartsPath := filepath.Join(root, "backup")
+	parts, _, err := moveShadow(shadowPath, backupPartsPath, nil, false, false, false)
+	require.NoError(t, err)
+	versions := map[string]string{}
+	for _, part := range parts {
+		versions[part.Name] = part.MetadataVersion
+	}
+	// only part which had own metadata_version.txt gets the version
+	assert.Equal(t, map[string]string{"all_1_1_0": "2", "all_2_2_0": ""}, versions)
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// ValidationFinding - problem found by StaticValidateBackup, Table is empty for problems of whole backup
+type ValidationFinding struct {
+	Table   string `json:"table,omitempty"`
+	Problem string `json:"problem"`
+}
+
+func (f ValidationFinding) String() string {
+	if f.Table == "" {
+		return f.Problem
+	}
+	return fmt.Sprintf("%s: %s", f.Table, f.Problem)
+}
+
+// StaticValidateBackup - check local backup metadata without ClickHouse: every table of metadata.json
+// has metadata file with well-formed CREATE query and parts only on disks known by backup,
+// it doesn't prove backup is restorable but catches missing and corrupted metadata
+func StaticValidateBackup(cfg *config.Config, backupName string) ([]ValidationFinding, error) {
+	if backupName == "" {
+		return nil, fmt.Errorf("backup name is required")
+	}
+	return validateBackup(offlineBackupPath(cfg, backupName))
+}
+
+func validateBackup(backupPath string) ([]ValidationFinding, error) {
+	if _, err := os.Stat(path.Join(backupPath, DeletingMetaFileName)); err == nil {
+		return []ValidationFinding{{Problem: BrokenPartiallyDeleted}}, nil
+	}
+	body, err := ioutil.ReadFile(path.Join(backupPath, MetaFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("'%s' is not found or is old format backup without %s", path.Base(backupPath), MetaFileName)
+		}
+		return nil, err
+	}
+	var backupMetadata metadata.BackupMetadata
+	if err := json.Unmarshal(body, &backupMetadata); err != nil {
+		return []ValidationFinding{{Problem: fmt.Sprintf("can't parse %s: %v", MetaFileName, err)}}, nil
+	}
+	var findings []ValidationFinding
+	if _, ok := backupMetadata.Disks["default"]; !ok {
+		findings = append(findings, ValidationFinding{Problem: "disk 'default' is not listed in disks"})
+	}
+	for _, title := range backupMetadata.Tables {
+		tableName := fmt.Sprintf("%s.%s", title.Database, title.Table)
+		addFinding := func(format string, args ...interface{}) {
+			findings = append(findings, ValidationFinding{Table: tableName, Problem: fmt.Sprintf(format, args...)})
+		}
+		metadataFile := path.Join(backupPath, "metadata", clickhouse.TablePathEncode(title.Database), fmt.Sprintf("%s.json", clickhouse.TablePathEncode(title.Table)))
+		body, err := ioutil.ReadFile(metadataFile)
+		if err != nil {
+			addFinding("can't read metadata file: %v", err)
+			continue
+		}
+		var table metadata.TableMetadata
+		if err := json.Unmarshal(body, &table); err != nil {
+			addFinding("can't parse metadata file: %v", err)
+			continue
+		}
+		if table.Database != title.Database || table.Table != title.Table {
+			addFinding("metadata file describes '%s.%s'", table.Database, table.Table)
+		}
+		if table.DataOnly || backupMetadata.DataOnly {
+			if table.Query != "" {
+				addFinding("data only table contains query")
+			}
+		} else if err := clickhouse.ValidateCreateQuery(table.Query); err != nil {
+			addFinding("invalid query: %v", err)
+		}
+		for disk, parts := range table.Parts {
+			if _, ok := backupMetadata.Disks[disk]; !ok && len(parts) > 0 {
+				addFinding("%d parts on disk '%s' which is not listed in disks", len(parts), disk)
+			}
+		}
+	}
+	return findings, nil
+}
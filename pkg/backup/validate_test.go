@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateBackup(t *testing.T) {
+	backupPath, err := ioutil.TempDir("", "clickhouse-backup-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(backupPath, "metadata", "db"), 0750))
+	writeJSON := func(file string, v interface{}) {
+		body, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, file), body, 0640))
+	}
+	writeJSON(MetaFileName, metadata.BackupMetadata{
+		BackupName: "test",
+		Disks:      map[string]string{"default": "/var/lib/clickhouse"},
+		Tables: []metadata.TableTitle{
+			{Database: "db", Table: "ok"},
+			{Database: "db", Table: "broken"},
+			{Database: "db", Table: "missing"},
+		},
+	})
+	writeJSON("metadata/db/ok.json", metadata.TableMetadata{
+		Database: "db",
+		Table:    "ok",
+		Query:    "CREATE TABLE db.ok (`id` UInt64) ENGINE = MergeTree ORDER BY id",
+		Parts:    map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}},
+	})
+	writeJSON("metadata/db/broken.json", metadata.TableMetadata{
+		Database: "db",
+		Table:    "broken",
+		Query:    "CREATE TABLE db.broken (`id` UInt64",
+		Parts:    map[string][]metadata.Part{"hdd": {{Name: "all_1_1_0"}}},
+	})
+
+	findings, err := validateBackup(backupPath)
+	require.NoError(t, err)
+	require.Len(t, findings, 3)
+	assert.Equal(t, ValidationFinding{Table: "db.broken", Problem: "invalid query: unbalanced parentheses or quotes"}, findings[0])
+	assert.Equal(t, ValidationFinding{Table: "db.broken", Problem: "1 parts on disk 'hdd' which is not listed in disks"}, findings[1])
+	assert.Equal(t, "db.missing", findings[2].Table)
+}
@@ -0,0 +1,210 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/AlexAkulov/clickhouse-backup/utils"
+
+	apexLog "github.com/apex/log"
+)
+
+// cronDescriptors - shortcuts of standard cron
+var cronDescriptors = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// cronSchedule - parsed "<minute> <hour> <day of month> <month> <day of week>", values are matched in local time
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar, dowStar - with both fields restricted day matches either of them as in standard cron
+	domStar, dowStar bool
+}
+
+// parseCronSchedule - fields support *, lists, ranges and steps, e.g. "0 */6 * * 1-5", day of week 7 is sunday
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	if descriptor, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = descriptor
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad schedule '%s', expected 5 fields: minute hour day_of_month month day_of_week", expr)
+	}
+	s := &cronSchedule{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	limits := []struct {
+		name     string
+		min, max int
+		bits     *uint64
+	}{
+		{"minute", 0, 59, &s.minute},
+		{"hour", 0, 23, &s.hour},
+		{"day of month", 1, 31, &s.dom},
+		{"month", 1, 12, &s.month},
+		{"day of week", 0, 7, &s.dow},
+	}
+	for i, limit := range limits {
+		bits, err := parseCronField(fields[i], limit.min, limit.max)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s in schedule '%s': %v", limit.name, expr, err)
+		}
+		*limit.bits = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in '%s'", item)
+			}
+			rangePart = item[:i]
+		}
+		from, to := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("bad range '%s'", item)
+			}
+		default:
+			var err error
+			if from, err = strconv.Atoi(rangePart); err != nil {
+				return 0, fmt.Errorf("bad value '%s'", item)
+			}
+			if step == 1 {
+				to = from
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", item, min, max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next - first time after t which matches schedule, zero time when schedule never matches, e.g. "0 0 30 2 *"
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// WatchBackups - create backup at every tick of cron schedule until ctx is cancelled, with remote storage backup
+// is uploaded as create_remote does, local and remote retention are applied after every backup.
+// Tick is skipped with warning while previous backup is still running, running backup is cancelled with ctx
+func WatchBackups(ctx context.Context, cfg *config.Config, schedule, tablePattern, version string) error {
+	s, err := parseCronSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	if s.next(time.Now()).IsZero() {
+		return fmt.Errorf("schedule '%s' never matches", schedule)
+	}
+	apexLog.WithField("schedule", schedule).Info("watching")
+	runScheduled(ctx, s.next, func(ctx context.Context) error {
+		return watchBackup(ctx, cfg, tablePattern, version)
+	})
+	apexLog.Info("watch stopped")
+	return nil
+}
+
+func watchBackup(ctx context.Context, cfg *config.Config, tablePattern, version string) error {
+	backupName := NewBackupName()
+	opts := CreateOptions{TablePattern: tablePattern, Version: version}
+	if cfg.General.RemoteStorage == "none" {
+		// CreateBackup applies backups_to_keep_local itself
+		return CreateBackup(ctx, cfg, backupName, opts)
+	}
+	return NewBackuper(cfg).CreateToRemote(ctx, backupName, "", false, opts)
+}
+
+// runScheduled - call run at every time returned by next until ctx is cancelled, tick is skipped while run is in progress,
+// waits for running call before return
+func runScheduled(ctx context.Context, next func(time.Time) time.Time, run func(ctx context.Context) error) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	running := make(chan struct{}, 1)
+	for {
+		tick := next(time.Now())
+		if tick.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(tick))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case running <- struct{}{}:
+		default:
+			apexLog.WithField("tick", tick.Format(time.RFC3339)).Warn("previous backup is still running, skipped")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-running
+				wg.Done()
+			}()
+			start := time.Now()
+			err := run(ctx)
+			if err != nil && ctx.Err() != nil {
+				apexLog.Warnf("scheduled backup cancelled: %v", err)
+				return
+			}
+			if err != nil {
+				apexLog.WithField("duration", utils.HumanizeDuration(time.Since(start))).Errorf("scheduled backup failed: %v", err)
+				return
+			}
+			apexLog.WithField("duration", utils.HumanizeDuration(time.Since(start))).Info("scheduled backup done")
+		}()
+	}
+}
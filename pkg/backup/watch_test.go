@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2021-03-10 is wednesday
+	now := time.Date(2021, 3, 10, 14, 7, 30, 0, time.UTC)
+	testCases := []struct {
+		schedule string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2021, 3, 10, 14, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, 3, 10, 14, 15, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2021, 3, 11, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2021, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * 0", time.Date(2021, 3, 14, 2, 30, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2021, 3, 14, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 */6 *", time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"5,10 9-17/4 * * 1-5", time.Date(2021, 3, 10, 17, 5, 0, 0, time.UTC)},
+		{"5,10 9-17/4 * * 4", time.Date(2021, 3, 11, 9, 5, 0, 0, time.UTC)},
+		// both days restricted, either of them matches
+		{"0 0 15 * 5", time.Date(2021, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		s, err := parseCronSchedule(tc.schedule)
+		require.NoError(t, err, tc.schedule)
+		assert.Equal(t, tc.expected, s.next(now), tc.schedule)
+	}
+
+	s, err := parseCronSchedule("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, s.next(now).IsZero())
+
+	for _, schedule := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every 1h"} {
+		_, err := parseCronSchedule(schedule)
+		assert.Error(t, err, schedule)
+	}
+}
+
+func TestRunScheduled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	next := func(now time.Time) time.Time {
+		return now.Add(10 * time.Millisecond)
+	}
+	var runs, cancelled int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runScheduled(ctx, next, func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			// the run spans several ticks, they are skipped
+			select {
+			case <-time.After(35 * time.Millisecond):
+			case <-ctx.Done():
+				atomic.AddInt32(&cancelled, 1)
+			}
+			return ctx.Err()
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runScheduled is not stopped by cancellation")
+	}
+	n := atomic.LoadInt32(&runs)
+	assert.True(t, n >= 1 && n <= 3, "runs: %d", n)
+	assert.True(t, atomic.LoadInt32(&cancelled) <= 1)
+}
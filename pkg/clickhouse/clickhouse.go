@@ -1,14 +1,18 @@
 package clickhouse
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,17 +20,44 @@ import (
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/apex/log"
 
-	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
 
+// ErrConnectTimeout - ClickHouse doesn't respond within clickhouse.connect_timeout
+var ErrConnectTimeout = errors.New("can't connect to clickhouse")
+
+// RunID - identify queries of current clickhouse-backup process in system.query_log
+var RunID = strings.ReplaceAll(uuid.New().String(), "-", "")[:16]
+
 // ClickHouse - provide
 type ClickHouse struct {
-	Config *config.ClickHouseConfig
-	conn   *sqlx.DB
-	uid    *int
-	gid    *int
-	disks  []Disk
+	Config       *config.ClickHouseConfig
+	conn         *sqlx.DB
+	uid          *int
+	gid          *int
+	disks        []Disk
+	queryComment string
+	querySeq     uint64
+}
+
+// SetQueryComment - queries will have query_id <query_comment_prefix>:<operation>:<backupName>:<RunID>:<seq>
+func (ch *ClickHouse) SetQueryComment(operation, backupName string) {
+	ch.queryComment = fmt.Sprintf("%s:%s:%s", operation, backupName, RunID)
+}
+
+func (ch *ClickHouse) queryContext() context.Context {
+	ctx := context.Background()
+	if ch.Config.QueryCommentPrefix == "" {
+		return ctx
+	}
+	comment := ch.queryComment
+	if comment == "" {
+		comment = fmt.Sprintf("::%s", RunID)
+	}
+	seq := atomic.AddUint64(&ch.querySeq, 1)
+	return clickhouse.WithQueryID(ctx, fmt.Sprintf("%s:%s:%d", ch.Config.QueryCommentPrefix, comment, seq))
 }
 
 // Connect - establish connection to ClickHouse
@@ -43,6 +74,7 @@ func (ch *ClickHouse) Connect() error {
 	params.Add("database", "system")
 	params.Add("receive_timeout", timeoutSeconds)
 	params.Add("send_timeout", timeoutSeconds)
+	params.Add("timeout", strconv.FormatFloat(ch.connectTimeout().Seconds(), 'f', -1, 64))
 	if ch.Config.Secure {
 		params.Add("secure", "true")
 		params.Add("skip_verify", strconv.FormatBool(ch.Config.SkipVerify))
@@ -54,7 +86,40 @@ func (ch *ClickHouse) Connect() error {
 	if ch.conn, err = sqlx.Open("clickhouse", connectionString); err != nil {
 		return err
 	}
-	return ch.conn.Ping()
+	// callers don't Close after failed Connect, Ping stuck on half-open connection is released by closing the pool
+	if err = ch.WithConnectTimeout(ch.conn.Ping); err != nil {
+		ch.Close()
+		return err
+	}
+	return nil
+}
+
+// connectTimeout - clickhouse.connect_timeout, 10s when it is not set or invalid
+func (ch *ClickHouse) connectTimeout() time.Duration {
+	timeout, err := time.ParseDuration(ch.Config.ConnectTimeout)
+	if err != nil || timeout <= 0 {
+		return 10 * time.Second
+	}
+	return timeout
+}
+
+// WithConnectTimeout - return ErrConnectTimeout when f doesn't finish within clickhouse.connect_timeout,
+// used for Ping and first queries after Connect, half-open connection would block them until receive_timeout.
+// f keeps running in background after timeout
+func (ch *ClickHouse) WithConnectTimeout(f func() error) error {
+	timeout := ch.connectTimeout()
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w within %s", ErrConnectTimeout, timeout)
+	}
 }
 
 // GetDisks - return data from system.disks table
@@ -158,12 +223,7 @@ func (ch *ClickHouse) GetTables() ([]Table, error) {
 		return nil, err
 	}
 	for i, t := range tables {
-		for _, filter := range ch.Config.SkipTables {
-			if matched, _ := filepath.Match(filter, fmt.Sprintf("%s.%s", t.Database, t.Name)); matched {
-				t.Skip = true
-				break
-			}
-		}
+		t.Skip = IsSkippedTable(ch.Config.SkipTables, t.Database, t.Name)
 		tables[i] = ch.fixVariousVersions(t)
 	}
 	if len(tables) == 0 {
@@ -273,6 +333,95 @@ func (ch *ClickHouse) GetVersionDescribe() string {
 	return result[0]
 }
 
+// buildInfoFlags - rows of system.build_options stored in backup metadata, missing ones are skipped
+var buildInfoFlags = []string{"VERSION_INTEGER", "VERSION_GITHASH", "VERSION_OFFICIAL", "BUILD_TYPE", "SYSTEM_PROCESSOR"}
+
+// GetBuildInfo - return numeric revision and build flags, describe string from GetVersionDescribe is not suitable for compatibility checks
+func (ch *ClickHouse) GetBuildInfo() (BuildInfo, error) {
+	var result []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}
+	query := fmt.Sprintf("SELECT name, value FROM `system`.`build_options` WHERE name IN ('VERSION_REVISION', '%s')", strings.Join(buildInfoFlags, "', '"))
+	if err := ch.Select(&result, query); err != nil {
+		return BuildInfo{}, fmt.Errorf("can't get build options: %w", err)
+	}
+	options := make(map[string]string, len(result))
+	for _, option := range result {
+		options[option.Name] = option.Value
+	}
+	return newBuildInfo(options)
+}
+
+func newBuildInfo(options map[string]string) (BuildInfo, error) {
+	info := BuildInfo{
+		Flags: map[string]string{},
+	}
+	if revision, ok := options["VERSION_REVISION"]; ok {
+		var err error
+		if info.Revision, err = strconv.Atoi(revision); err != nil {
+			return BuildInfo{}, fmt.Errorf("can't parse VERSION_REVISION '%s': %w", revision, err)
+		}
+	}
+	for _, name := range buildInfoFlags {
+		if value, ok := options[name]; ok && value != "" {
+			info.Flags[name] = value
+		}
+	}
+	return info, nil
+}
+
+// GetMacros - return macros from system.macros, like shard and replica
+func (ch *ClickHouse) GetMacros() (map[string]string, error) {
+	var result []struct {
+		Macro        string `db:"macro"`
+		Substitution string `db:"substitution"`
+	}
+	if err := ch.Select(&result, "SELECT macro, substitution FROM system.macros"); err != nil {
+		return nil, fmt.Errorf("can't get macros: %w", err)
+	}
+	macros := make(map[string]string, len(result))
+	for _, m := range result {
+		macros[m.Macro] = m.Substitution
+	}
+	return macros, nil
+}
+
+// GetTablesModifiedSince - return tables which have active parts modified after since
+// tables without parts are not returned
+func (ch *ClickHouse) GetTablesModifiedSince(since time.Time) (map[metadata.TableTitle]struct{}, error) {
+	var result []struct {
+		Database string `db:"database"`
+		Table    string `db:"table"`
+	}
+	query := fmt.Sprintf("SELECT database, table FROM system.parts WHERE active GROUP BY database, table HAVING max(modification_time) > toDateTime(%d)", since.Unix())
+	if err := ch.Select(&result, query); err != nil {
+		return nil, fmt.Errorf("can't get modified tables: %w", err)
+	}
+	tables := make(map[metadata.TableTitle]struct{}, len(result))
+	for _, t := range result {
+		tables[metadata.TableTitle{Database: t.Database, Table: t.Table}] = struct{}{}
+	}
+	return tables, nil
+}
+
+// FlushTable - move in-flight data of Buffer and Distributed tables into destination tables
+func (ch *ClickHouse) FlushTable(table *Table) error {
+	var query string
+	switch table.Engine {
+	case "Buffer":
+		query = fmt.Sprintf("OPTIMIZE TABLE `%s`.`%s`", table.Database, table.Name)
+	case "Distributed":
+		query = fmt.Sprintf("SYSTEM FLUSH DISTRIBUTED `%s`.`%s`", table.Database, table.Name)
+	default:
+		return nil
+	}
+	if _, err := ch.Query(query); err != nil {
+		return fmt.Errorf("can't flush '%s.%s': %w", table.Database, table.Name, err)
+	}
+	return nil
+}
+
 // FreezeTableOldWay - freeze all partitions in table one by one
 // This way using for ClickHouse below v19.1
 func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string) error {
@@ -280,7 +429,10 @@ func (ch *ClickHouse) FreezeTableOldWay(table *Table, name string) error {
 		PartitionID string `db:"partition_id"`
 	}
 	q := fmt.Sprintf("SELECT DISTINCT partition_id FROM `system`.`parts` WHERE database='%s' AND table='%s'", table.Database, table.Name)
-	if err := ch.conn.Select(&partitions, q); err != nil {
+	release := ch.acquireQuery()
+	err := ch.conn.SelectContext(ch.queryContext(), &partitions, q)
+	release()
+	if err != nil {
 		return fmt.Errorf("can't get partitions for '%s.%s': %w", table.Database, table.Name, err)
 	}
 	withNameQuery := ""
@@ -318,14 +470,7 @@ func (ch *ClickHouse) FreezeTable(table *Table, name string) error {
 	if err != nil {
 		return err
 	}
-	if strings.HasPrefix(table.Engine, "Replicated") && ch.Config.SyncReplicatedTables {
-		query := fmt.Sprintf("SYSTEM SYNC REPLICA `%s`.`%s`;", table.Database, table.Name)
-		if _, err := ch.Query(query); err != nil {
-			log.Warnf("can't sync replica: %v", err)
-		} else {
-			log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name)).Debugf("replica synced")
-		}
-	}
+	ch.syncReplica(table)
 	if version < 19001005 || ch.Config.FreezeByPart {
 		return ch.FreezeTableOldWay(table, name)
 	}
@@ -340,6 +485,38 @@ func (ch *ClickHouse) FreezeTable(table *Table, name string) error {
 	return nil
 }
 
+// FreezeTablePartitions - freeze only listed partitions of table, partitions are partition_id from system.parts
+func (ch *ClickHouse) FreezeTablePartitions(table *Table, name string, partitions []string) error {
+	ch.syncReplica(table)
+	withNameQuery := ""
+	if name != "" {
+		withNameQuery = fmt.Sprintf("WITH NAME '%s'", name)
+	}
+	for _, partitionID := range partitions {
+		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE PARTITION ID '%s' %s;", table.Database, table.Name, partitionID, withNameQuery)
+		if partitionID == "all" {
+			query = fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE PARTITION tuple() %s;", table.Database, table.Name, withNameQuery)
+		}
+		if _, err := ch.Query(query); err != nil {
+			return fmt.Errorf("can't freeze partition '%s': %w", partitionID, err)
+		}
+	}
+	return nil
+}
+
+// syncReplica - fetch all parts of Replicated table before FREEZE when sync_replicated_tables is enabled
+func (ch *ClickHouse) syncReplica(table *Table) {
+	if !strings.HasPrefix(table.Engine, "Replicated") || !ch.Config.SyncReplicatedTables {
+		return
+	}
+	query := fmt.Sprintf("SYSTEM SYNC REPLICA `%s`.`%s`;", table.Database, table.Name)
+	if _, err := ch.Query(query); err != nil {
+		log.Warnf("can't sync replica: %v", err)
+	} else {
+		log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name)).Debugf("replica synced")
+	}
+}
+
 func (ch *ClickHouse) CleanShadow(name string) error {
 	disks, err := ch.GetDisks()
 	if err != nil {
@@ -381,6 +558,23 @@ func (ch *ClickHouse) Chown(filename string) error {
 	return os.Chown(filename, *ch.uid, *ch.gid)
 }
 
+// RestoreMetadataVersion - put metadata_version.txt captured from the part during backup to detached part,
+// otherwise ATTACH fails with metadata version mismatch for tables which was ALTERed.
+// Part's own metadata_version.txt always wins, parts without captured version are left as is
+func (ch *ClickHouse) RestoreMetadataVersion(detachedPath, metadataVersion string) error {
+	if metadataVersion == "" {
+		return nil
+	}
+	versionFile := filepath.Join(detachedPath, MetadataVersionFileName)
+	if _, err := os.Stat(versionFile); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(versionFile, []byte(metadataVersion), 0640); err != nil {
+		return fmt.Errorf("can't write '%s': %w", versionFile, err)
+	}
+	return ch.Chown(versionFile)
+}
+
 func (ch *ClickHouse) Mkdir(name string) error {
 	if err := os.Mkdir(name, 0750); err != nil && !os.IsExist(err) {
 		return err
@@ -434,15 +628,38 @@ func (ch *ClickHouse) MkdirAll(path string) error {
 	return nil
 }
 
+// GetStoragePolicies - return names of storage policies from system.storage_policies
+func (ch *ClickHouse) GetStoragePolicies() ([]string, error) {
+	var policies []string
+	if err := ch.Select(&policies, "SELECT DISTINCT policy_name FROM system.storage_policies"); err != nil {
+		return nil, fmt.Errorf("can't get storage policies: %w", err)
+	}
+	return policies, nil
+}
+
 // CopyData - copy partitions for specific table to detached folder
-func (ch *ClickHouse) CopyData(backupName string, backupTable metadata.TableMetadata, disks []Disk, tableDataPaths []string) error {
+// shadowLayout is taken from metadata of backup, backupDir is general.backup_dir, empty means backup directory of each disk
+func (ch *ClickHouse) CopyData(backupDir, backupName, shadowLayout string, backupTable metadata.TableMetadata, disks []Disk, tableDataPaths []string) error {
 	// TODO: проверить если диск есть в бэкапе но нет в ClickHouse
 	dstDataPaths := GetDisksByPaths(disks, tableDataPaths)
 	for _, backupDisk := range disks {
 		if len(backupTable.Parts[backupDisk.Name]) == 0 {
 			continue
 		}
-		detachedParentDir := filepath.Join(dstDataPaths[backupDisk.Name], "detached")
+		dstDataPath, ok := dstDataPaths[backupDisk.Name]
+		if !ok {
+			// disk of backup is mapped to disk with the same path by restore_disk_mapping
+			dstDataPath, ok = dstDataPaths[GetDiskByPath(disks, backupDisk.Path)]
+		}
+		if !ok {
+			// table storage policy doesn't contain this disk, e.g. storage_policy was rewritten on restore
+			if len(tableDataPaths) == 0 {
+				return fmt.Errorf("can't find data path for '%s.%s'", backupTable.Database, backupTable.Table)
+			}
+			dstDataPath = tableDataPaths[0]
+			log.Warnf("disk '%s' is not used by '%s.%s', parts will be restored to '%s'", backupDisk.Name, backupTable.Database, backupTable.Table, dstDataPath)
+		}
+		detachedParentDir := filepath.Join(dstDataPath, "detached")
 		// os.MkdirAll(detachedParentDir, 0750)
 		// ch.Chown(detachedParentDir)
 		for _, partition := range backupTable.Parts[backupDisk.Name] {
@@ -463,10 +680,14 @@ func (ch *ClickHouse) CopyData(backupName string, backupTable metadata.TableMeta
 			// if backupTable.UUID != "" {
 			// 	uuid = path.Join(backupTable.UUID[0:3], backupTable.UUID)
 			// }
-			partitionPath := path.Join(backupDisk.Path, "backup", backupName, "shadow", uuid, backupDisk.Name, partition.Name)
+			backupsPath := backupDir
+			if backupsPath == "" {
+				backupsPath = path.Join(backupDisk.Path, "backup")
+			}
+			partitionPath := path.Join(backupsPath, backupName, ShadowPath(shadowLayout, backupDisk.Name, backupTable.Database, backupTable.Table), partition.Name)
 			// Legacy backup support
 			if _, err := os.Stat(partitionPath); os.IsNotExist(err) {
-				partitionPath = path.Join(backupDisk.Path, "backup", backupName, "shadow", uuid, partition.Name)
+				partitionPath = path.Join(backupsPath, backupName, "shadow", uuid, partition.Name)
 			}
 			if err := filepath.Walk(partitionPath, func(filePath string, info os.FileInfo, err error) error {
 				if err != nil {
@@ -482,12 +703,21 @@ func (ch *ClickHouse) CopyData(backupName string, backupTable metadata.TableMeta
 					return nil
 				}
 				if err := os.Link(filePath, dstFilePath); err != nil {
-					return fmt.Errorf("failed to crete hard link '%s' -> '%s': %w", filePath, dstFilePath, err)
+					if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+						return fmt.Errorf("failed to crete hard link '%s' -> '%s': %w", filePath, dstFilePath, err)
+					}
+					// data path is on another disk than backup
+					if err := copyFile(filePath, dstFilePath); err != nil {
+						return fmt.Errorf("failed to copy '%s' -> '%s': %w", filePath, dstFilePath, err)
+					}
 				}
 				return ch.Chown(dstFilePath)
 			}); err != nil {
 				return fmt.Errorf("error during filepath.Walk for partition '%s': %w", partition.Name, err)
 			}
+			if err := ch.RestoreMetadataVersion(detachedPath, partition.MetadataVersion); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -512,16 +742,62 @@ func (ch *ClickHouse) ShowCreateTable(database, name string) string {
 		Statement string `db:"statement"`
 	}
 	query := fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`;", database, name)
-	if err := ch.conn.Select(&result, query); err != nil {
+	defer ch.acquireQuery()()
+	if err := ch.conn.SelectContext(ch.queryContext(), &result, query); err != nil || len(result) == 0 {
 		return ""
 	}
 	return result[0].Statement
 }
 
+// RestoreProjections - add projections which are absent in table, projections are supported since 21.6
+func (ch *ClickHouse) RestoreProjections(database, table string, projections map[string]string) error {
+	if len(projections) == 0 {
+		return nil
+	}
+	version, err := ch.GetVersion()
+	if err != nil {
+		return err
+	}
+	if version < 21006000 {
+		log.Warnf("projections of '%s.%s' are skipped, they are not supported by clickhouse %d", database, table, version)
+		return nil
+	}
+	existsProjections := ParseProjections(ch.ShowCreateTable(database, table))
+	var partsCount []uint64
+	query := fmt.Sprintf("SELECT count() FROM system.parts WHERE database='%s' AND table='%s' AND active=1", database, table)
+	if err := ch.Select(&partsCount, query); err != nil {
+		return err
+	}
+	for name, definition := range projections {
+		if _, ok := existsProjections[name]; ok {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` ADD PROJECTION `%s` (%s)", database, table, name, definition)
+		if _, err := ch.Query(query); err != nil {
+			return fmt.Errorf("can't add projection '%s': %v", name, err)
+		}
+		if len(partsCount) > 0 && partsCount[0] > 0 {
+			query = fmt.Sprintf("ALTER TABLE `%s`.`%s` MATERIALIZE PROJECTION `%s`", database, table, name)
+			if _, err := ch.Query(query); err != nil {
+				return fmt.Errorf("can't materialize projection '%s': %v", name, err)
+			}
+		}
+		log.WithField("table", fmt.Sprintf("%s.%s", database, table)).WithField("projection", name).Debug("projection added")
+	}
+	return nil
+}
+
 // CreateDatabase - create ClickHouse database
-func (ch *ClickHouse) CreateDatabase(database string) error {
+func (ch *ClickHouse) CreateDatabase(database string, cluster string) error {
 	query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database)
-	_, err := ch.Query(query)
+	_, err := ch.Query(AddOnCluster(query, cluster))
+	return err
+}
+
+// DropDatabase - drop ClickHouse database with all its tables
+func (ch *ClickHouse) DropDatabase(database string, cluster string) error {
+	query := fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", database)
+	_, err := ch.Query(AddOnCluster(query, cluster))
 	return err
 }
 
@@ -531,16 +807,47 @@ func (ch *ClickHouse) CreateDatabaseWithEngine(database string, engine string) e
 	return err
 }
 
-func (ch *ClickHouse) CreateDatabaseFromQuery(query string) error {
+func (ch *ClickHouse) CreateDatabaseFromQuery(query string, cluster string) error {
 	if !strings.HasPrefix(query, "CREATE DATABASE IF NOT EXISTS") {
 		query = strings.Replace(query, "CREATE DATABASE", "CREATE DATABASE IF NOT EXISTS", 1)
 	}
-	_, err := ch.Query(query)
+	_, err := ch.Query(AddOnCluster(query, cluster))
 	return err
 }
 
+// CheckCluster - cluster for ON CLUSTER must be defined in system.clusters
+func (ch *ClickHouse) CheckCluster(cluster string) error {
+	var count []uint64
+	if err := ch.Select(&count, "SELECT count() FROM system.clusters WHERE cluster = ?", cluster); err != nil {
+		return fmt.Errorf("can't get clusters: %w", err)
+	}
+	if len(count) == 0 || count[0] == 0 {
+		return fmt.Errorf("cluster '%s' is not found in system.clusters", cluster)
+	}
+	return nil
+}
+
+// GetClusters - return hosts of all clusters defined in remote_servers
+func (ch *ClickHouse) GetClusters() ([]ClusterHost, error) {
+	var result []ClusterHost
+	if err := ch.Select(&result, "SELECT cluster, shard_num, replica_num, host_name, port FROM system.clusters ORDER BY cluster, shard_num, replica_num"); err != nil {
+		return nil, fmt.Errorf("can't get clusters: %w", err)
+	}
+	return result, nil
+}
+
+// GetActiveParts - return names and paths of active parts of table
+func (ch *ClickHouse) GetActiveParts(database, table string) ([]ActivePart, error) {
+	var result []ActivePart
+	if err := ch.Select(&result, "SELECT name, path FROM system.parts WHERE database = ? AND table = ? AND active", database, table); err != nil {
+		return nil, fmt.Errorf("can't get parts of '%s.%s': %w", database, table, err)
+	}
+	return result, nil
+}
+
 // CreateTable - create ClickHouse table
-func (ch *ClickHouse) CreateTable(table Table, query string, dropTable bool) error {
+// When onCluster is not empty DROP and CREATE will be executed ON CLUSTER
+func (ch *ClickHouse) CreateTable(table Table, query string, dropTable bool, onCluster string) error {
 	var isAtomic bool
 	var err error
 	if isAtomic, err = ch.IsAtomic(table.Database); err != nil {
@@ -551,7 +858,7 @@ func (ch *ClickHouse) CreateTable(table Table, query string, dropTable bool) err
 		if strings.HasPrefix(query, "CREATE DICTIONARY") {
 			kind = "DICTIONARY"
 		}
-		dropQuery := fmt.Sprintf("DROP %s IF EXISTS `%s`.`%s`", kind, table.Database, table.Name)
+		dropQuery := AddOnCluster(fmt.Sprintf("DROP %s IF EXISTS `%s`.`%s`", kind, table.Database, table.Name), onCluster)
 		if isAtomic {
 			dropQuery += " NO DELAY"
 		}
@@ -559,7 +866,7 @@ func (ch *ClickHouse) CreateTable(table Table, query string, dropTable bool) err
 			return err
 		}
 	}
-	if _, err := ch.Query(query); err != nil {
+	if _, err := ch.Query(AddOnCluster(query, onCluster)); err != nil {
 		return err
 	}
 	return nil
@@ -641,15 +948,23 @@ func (ch *ClickHouse) GetPartitions(database, table string) (map[string][]metada
 }
 
 func (ch *ClickHouse) Query(query string, args ...interface{}) (sql.Result, error) {
-	return ch.conn.Exec(ch.LogQuery(query), args...)
+	defer ch.acquireQuery()()
+	return ch.conn.ExecContext(ch.queryContext(), ch.LogQuery(query), args...)
 }
 
+// Queryx - rows are read after return, so caller must hold slot of max_concurrent_queries by acquireQuery until rows are closed
 func (ch *ClickHouse) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
-	return ch.conn.Queryx(ch.LogQuery(query), args...)
+	return ch.conn.QueryxContext(ch.queryContext(), ch.LogQuery(query), args...)
 }
 
 func (ch *ClickHouse) Select(dest interface{}, query string, args ...interface{}) error {
-	return ch.conn.Select(dest, ch.LogQuery(query), args...)
+	defer ch.acquireQuery()()
+	return ch.conn.SelectContext(ch.queryContext(), dest, ch.LogQuery(query), args...)
+}
+
+// acquireQuery - wait for free slot of clickhouse.max_concurrent_queries and return function which releases it
+func (ch *ClickHouse) acquireQuery() func() {
+	return queryLimiter.acquire(ch.Config.MaxConcurrentQueries)
 }
 
 func (ch *ClickHouse) LogQuery(query string) string {
@@ -0,0 +1,59 @@
+package clickhouse
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithConnectTimeout(t *testing.T) {
+	ch := &ClickHouse{Config: &config.ClickHouseConfig{ConnectTimeout: "10ms"}}
+	release := make(chan struct{})
+	defer close(release)
+	err := ch.WithConnectTimeout(func() error {
+		<-release
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrConnectTimeout))
+	assert.EqualError(t, err, "can't connect to clickhouse within 10ms")
+
+	queryErr := errors.New("query failed")
+	assert.Equal(t, queryErr, ch.WithConnectTimeout(func() error { return queryErr }))
+	assert.NoError(t, ch.WithConnectTimeout(func() error { return nil }))
+}
+
+func TestConnectClosesOnTimeout(t *testing.T) {
+	// server accepts connection, but never answers handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	ch := &ClickHouse{Config: &config.ClickHouseConfig{Host: addr.IP.String(), Port: uint(addr.Port), Timeout: "5s", ConnectTimeout: "50ms"}}
+	err = ch.Connect()
+	assert.True(t, errors.Is(err, ErrConnectTimeout))
+	assert.EqualError(t, ch.conn.Ping(), "sql: database is closed")
+}
+
+func TestConnectTimeoutDefault(t *testing.T) {
+	assert.Equal(t, 10*time.Second, (&ClickHouse{Config: &config.ClickHouseConfig{}}).connectTimeout())
+	assert.Equal(t, time.Minute, (&ClickHouse{Config: &config.ClickHouseConfig{ConnectTimeout: "1m"}}).connectTimeout())
+}
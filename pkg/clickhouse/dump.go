@@ -0,0 +1,75 @@
+package clickhouse
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DumpFormat - format of data of not MergeTree tables, keeps types of columns as is
+const DumpFormat = "Native"
+
+// GetUserFilesPath - directory where file() table function reads and writes files,
+// clickhouse.user_files_path or user_files of default disk like in default config of ClickHouse
+func (ch *ClickHouse) GetUserFilesPath() (string, error) {
+	if ch.Config.UserFilesPath != "" {
+		return ch.Config.UserFilesPath, nil
+	}
+	defaultPath, err := ch.GetDefaultPath()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(defaultPath, "user_files"), nil
+}
+
+// GetTableStructure - columns of table in format of structure argument of file() table function,
+// ALIAS and MATERIALIZED columns are not returned by SELECT * and are skipped
+func (ch *ClickHouse) GetTableStructure(database, table string) (string, error) {
+	var columns []struct {
+		Name string `db:"name"`
+		Type string `db:"type"`
+	}
+	query := "SELECT name, type FROM system.columns WHERE database = ? AND table = ? AND default_kind NOT IN ('ALIAS', 'MATERIALIZED', 'EPHEMERAL')"
+	if err := ch.Select(&columns, query, database, table); err != nil {
+		return "", err
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("'%s.%s' has no columns", database, table)
+	}
+	structure := make([]Column, len(columns))
+	for i := range columns {
+		structure[i] = Column{Name: columns[i].Name, Type: columns[i].Type}
+	}
+	return FormatTableStructure(structure), nil
+}
+
+// FormatTableStructure - "`name` Type, ..." for file() table function
+func FormatTableStructure(columns []Column) string {
+	result := make([]string, len(columns))
+	for i, c := range columns {
+		result[i] = fmt.Sprintf("`%s` %s", strings.ReplaceAll(c.Name, "`", "\\`"), c.Type)
+	}
+	return strings.Join(result, ", ")
+}
+
+// DumpTable - write all rows of table to fileName relative to user_files_path by ClickHouse server
+func (ch *ClickHouse) DumpTable(database, table, fileName, format, structure string) error {
+	query := fmt.Sprintf("INSERT INTO FUNCTION file('%s', '%s', '%s') SELECT * FROM `%s`.`%s`", escapeString(fileName), format, escapeString(structure), database, table)
+	if _, err := ch.Query(query); err != nil {
+		return fmt.Errorf("can't dump '%s.%s': %v", database, table, err)
+	}
+	return nil
+}
+
+// RestoreDump - insert rows from fileName relative to user_files_path, rows are appended to existing ones
+func (ch *ClickHouse) RestoreDump(database, table, fileName, format, structure string) error {
+	query := fmt.Sprintf("INSERT INTO `%s`.`%s` SELECT * FROM file('%s', '%s', '%s')", database, table, escapeString(fileName), format, escapeString(structure))
+	if _, err := ch.Query(query); err != nil {
+		return fmt.Errorf("can't insert dump to '%s.%s': %v", database, table, err)
+	}
+	return nil
+}
+
+func escapeString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
@@ -0,0 +1,35 @@
+package clickhouse
+
+import "sync"
+
+// querySemaphore - bound number of queries running at the same time, safe for concurrent use
+type querySemaphore struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+}
+
+// queryLimiter - clickhouse.max_concurrent_queries is shared by all connections of this process
+var queryLimiter = newQuerySemaphore()
+
+func newQuerySemaphore() *querySemaphore {
+	s := &querySemaphore{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire - wait while limit queries are running and return function which releases the slot, limit <= 0 means unlimited
+func (s *querySemaphore) acquire(limit int) func() {
+	s.mu.Lock()
+	for limit > 0 && s.active >= limit {
+		s.cond.Wait()
+	}
+	s.active++
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+		s.cond.Signal()
+	}
+}
@@ -0,0 +1,46 @@
+package clickhouse
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuerySemaphore(t *testing.T) {
+	s := newQuerySemaphore()
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := s.acquire(3)
+			defer release()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, maxRunning, int32(3))
+	assert.Equal(t, 0, s.active)
+
+	// limit <= 0 is unlimited
+	releases := make([]func(), 0, 5)
+	for i := 0; i < 5; i++ {
+		releases = append(releases, s.acquire(0))
+	}
+	assert.Equal(t, 5, s.active)
+	for _, release := range releases {
+		release()
+	}
+}
@@ -32,6 +32,37 @@ type Disk struct {
 	Type string `db:"type"`
 }
 
+// objectStorageDiskTypes - system.disks types which keep only metadata of part files in local path
+var objectStorageDiskTypes = map[string]struct{}{
+	"s3":                 {},
+	"s3_plain":           {},
+	"web":                {},
+	"hdfs":               {},
+	"azure_blob_storage": {},
+	"ObjectStorage":      {},
+}
+
+// IsObjectStorage - files copied into path of such disk are not data of parts, ClickHouse doesn't manage them as local
+func (d Disk) IsObjectStorage() bool {
+	_, ok := objectStorageDiskTypes[d.Type]
+	return ok
+}
+
+// ClusterHost - one replica of cluster from system.clusters
+type ClusterHost struct {
+	Cluster    string `db:"cluster" json:"cluster"`
+	ShardNum   uint32 `db:"shard_num" json:"shard_num"`
+	ReplicaNum uint32 `db:"replica_num" json:"replica_num"`
+	HostName   string `db:"host_name" json:"host_name"`
+	Port       uint16 `db:"port" json:"port"`
+}
+
+// BuildInfo - revision and build flags of ClickHouse server from system.build_options
+type BuildInfo struct {
+	Revision int
+	Flags    map[string]string
+}
+
 // Database - Clickhouse system.databases struct
 type Database struct {
 	Name   string `db:"name"`
@@ -86,6 +117,12 @@ type partition struct {
 	DataUncompressedBytes             int64     `db:"data_uncompressed_bytes"`
 }
 
+// ActivePart - active part of live table from system.parts
+type ActivePart struct {
+	Name string `db:"name"`
+	Path string `db:"path"`
+}
+
 // PartDiff - Data part discrepancies infos
 type PartDiff struct {
 	BTable           metadata.TableMetadata
@@ -2,19 +2,58 @@ package clickhouse
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/jmoiron/sqlx/reflectx"
 )
 
+// GetDiskByPath - disk with the longest path which is prefix of dataPath,
+// paths of disks can be nested, e.g. /var/lib/clickhouse/disks/s3/ is inside path of default disk
 func GetDiskByPath(disks []Disk, dataPath string) string {
+	result, resultPath := "unknown", ""
 	for _, disk := range disks {
-		if strings.HasPrefix(dataPath, disk.Path) {
-			return disk.Name
+		if strings.HasPrefix(dataPath, disk.Path) && len(disk.Path) > len(resultPath) {
+			result, resultPath = disk.Name, disk.Path
 		}
 	}
-	return "unknown"
+	return result
+}
+
+// IsSkippedTable - table is matched by one of clickhouse.skip_tables globs,
+// skipped tables stay skipped even when they are matched by --tables pattern
+func IsSkippedTable(skipTables []string, database, table string) bool {
+	for _, filter := range skipTables {
+		if matched, _ := filepath.Match(filter, fmt.Sprintf("%s.%s", database, table)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// ShadowLayoutTable - shadow/<encoded-db>/<encoded-table>/<disk>, default
+	ShadowLayoutTable = "table"
+	// ShadowLayoutDisk - shadow/<disk>/<encoded-db>/<encoded-table>
+	ShadowLayoutDisk = "disk"
+)
+
+// MetadataVersionFileName - ALTER metadata version of table and part, absent on older ClickHouse
+const MetadataVersionFileName = "metadata_version.txt"
+
+// ShadowPath - return path to parts of table on disk relative to backup directory,
+// empty layout means ShadowLayoutTable for backups created before shadow_layout was introduced
+func ShadowPath(layout, diskName, database, table string) string {
+	if layout == ShadowLayoutDisk {
+		return path.Join("shadow", diskName, TablePathEncode(database), TablePathEncode(table))
+	}
+	return path.Join("shadow", TablePathEncode(database), TablePathEncode(table), diskName)
 }
 
 func GetDisksByPaths(disks []Disk, dataPaths []string) map[string]string {
@@ -25,7 +64,504 @@ func GetDisksByPaths(disks []Disk, dataPaths []string) map[string]string {
 	return result
 }
 
+var ddlQueryNameRE = regexp.MustCompile("(?is)^\\s*((?:(?:CREATE|ATTACH)\\s+(?:OR\\s+REPLACE\\s+)?(?:DATABASE|TABLE|VIEW|LIVE\\s+VIEW|MATERIALIZED\\s+VIEW|DICTIONARY)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?|" +
+	"DROP\\s+(?:DATABASE|TABLE|VIEW|DICTIONARY)\\s+(?:IF\\s+EXISTS\\s+)?)" +
+	"(?:`[^`]+`|\"[^\"]+\"|\\w+)(?:\\.(?:`[^`]+`|\"[^\"]+\"|\\w+))?(?:\\s+UUID\\s+'[^']+')?)")
+var onClusterRE = regexp.MustCompile(`(?i)^\s+ON\s+CLUSTER\s`)
+
+// AddOnCluster - insert ON CLUSTER clause after object name in CREATE, ATTACH and DROP queries,
+// queries which already contain ON CLUSTER are returned as is
+func AddOnCluster(query, cluster string) string {
+	if cluster == "" {
+		return query
+	}
+	loc := ddlQueryNameRE.FindStringSubmatchIndex(query)
+	if loc == nil {
+		return query
+	}
+	if onClusterRE.MatchString(query[loc[3]:]) {
+		return query
+	}
+	return fmt.Sprintf("%s ON CLUSTER `%s`%s", query[:loc[3]], cluster, query[loc[3]:])
+}
+
+var bufferEngineRE = regexp.MustCompile(`(?i)ENGINE\s*=\s*(Buffer|Distributed)\s*\(`)
+
+// ParseEngineTarget - return engine and destination table for Buffer and Distributed tables,
+// database is empty when it is defined by currentDatabase()
+func ParseEngineTarget(query string) (engine, database, table string, ok bool) {
+	loc := bufferEngineRE.FindStringSubmatchIndex(query)
+	if loc == nil {
+		return "", "", "", false
+	}
+	engineArgs, ok := balancedParentheses(query[loc[1]-1:])
+	if !ok {
+		return "", "", "", false
+	}
+	var args []string
+	for _, arg := range strings.Split(engineArgs, ",") {
+		args = append(args, strings.Trim(strings.TrimSpace(arg), "'\"`"))
+	}
+	engine = query[loc[2]:loc[3]]
+	if engine == "Distributed" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return "", "", "", false
+	}
+	database = args[0]
+	if strings.HasPrefix(database, "currentDatabase") {
+		database = ""
+	}
+	return engine, database, args[1], true
+}
+
+var databaseUUIDRE = regexp.MustCompile(`(?i)^(\s*(?:CREATE|ATTACH)\s+DATABASE\s+(?:IF\s+NOT\s+EXISTS\s+)?(?:` + "`[^`]+`" + `|"[^"]+"|\w+))\s+UUID\s+'[^']+'`)
+
+// RemoveDatabaseUUID - remove UUID clause from CREATE DATABASE query, ClickHouse will generate new one
+func RemoveDatabaseUUID(query string) string {
+	return databaseUUIDRE.ReplaceAllString(query, "$1")
+}
+
+var tableNameRE = regexp.MustCompile("(?is)^(\\s*(?:CREATE|ATTACH)\\s+(?:OR\\s+REPLACE\\s+)?(?:TABLE|VIEW|LIVE\\s+VIEW|MATERIALIZED\\s+VIEW|DICTIONARY)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?)" +
+	"(?:`[^`]+`|\"[^\"]+\"|\\w+)(?:\\.(?:`[^`]+`|\"[^\"]+\"|\\w+))?(?:\\s+UUID\\s+'[^']+')?")
+
+// RenameTableInQuery - replace object name database.table in CREATE or ATTACH query with newDatabase.newTable,
+// UUID clause is removed because it belongs to original table. Segments of ZooKeeper path of Replicated engine
+// equal to database or table are replaced too, path which doesn't change and depends on neither changed name
+// nor {uuid} macro can't be rewritten safely, both tables would share it
+func RenameTableInQuery(query, database, table, newDatabase, newTable string) (string, error) {
+	loc := tableNameRE.FindStringSubmatchIndex(query)
+	if loc == nil {
+		return query, nil
+	}
+	query = fmt.Sprintf("%s`%s`.`%s`%s", query[:loc[3]], newDatabase, newTable, query[loc[1]:])
+	pathLoc := replicatedPathRE.FindStringSubmatchIndex(query)
+	if pathLoc == nil || (database == newDatabase && table == newTable) {
+		return query, nil
+	}
+	zkPath := query[pathLoc[2]:pathLoc[3]]
+	segments := strings.Split(zkPath, "/")
+	for i := range segments {
+		switch segments[i] {
+		case database:
+			segments[i] = newDatabase
+		case table:
+			segments[i] = newTable
+		}
+	}
+	newZkPath := strings.Join(segments, "/")
+	distinct := newZkPath != zkPath || strings.Contains(zkPath, "{uuid}") ||
+		(table != newTable && strings.Contains(zkPath, "{table}")) ||
+		(database != newDatabase && strings.Contains(zkPath, "{database}"))
+	if !distinct {
+		return "", fmt.Errorf("ZooKeeper path '%s' doesn't depend on renamed table, it would be shared with '%s.%s'", zkPath, database, table)
+	}
+	return query[:pathLoc[2]] + newZkPath + query[pathLoc[3]:], nil
+}
+
+var databaseNameRE = regexp.MustCompile(`(?i)^(\s*(?:CREATE|ATTACH)\s+DATABASE\s+(?:IF\s+NOT\s+EXISTS\s+)?)(?:` + "`[^`]+`" + `|"[^"]+"|\w+)`)
+var replicatedPathRE = regexp.MustCompile(`(?is)\sENGINE\s*=\s*Replicated\w*\s*\(\s*'([^']*)'`)
+
+// RenameDatabaseInQuery - replace database in name of CREATE DATABASE query, in qualified names of objects
+// and in segments of ZooKeeper paths, cluster of ON CLUSTER and columns are not changed.
+// Database used as string literal, e.g. in arguments of Distributed or Merge engine, can't be rewritten safely,
+// as well as Replicated engine with ZooKeeper path which depends neither on database nor on {database} or {uuid} macro
+func RenameDatabaseInQuery(query, database, newDatabase string) (string, error) {
+	quotedNewDatabase := fmt.Sprintf("`%s`", newDatabase)
+	if loc := databaseNameRE.FindStringSubmatchIndex(query); loc != nil {
+		query = query[:loc[3]] + quotedNewDatabase + query[loc[1]:]
+	}
+	var result strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '`' || c == '"':
+			end, _, _ := queryToken(query, i)
+			content := strings.TrimSuffix(query[i+1:end], string(c))
+			switch {
+			case c == '\'' && content == database:
+				return "", fmt.Errorf("database '%s' is used as string literal, it can't be rewritten safely", database)
+			case c == '\'' && strings.HasPrefix(content, "/"):
+				segments := strings.Split(content, "/")
+				for j := range segments {
+					if segments[j] == database {
+						segments[j] = newDatabase
+					}
+				}
+				result.WriteString("'" + strings.Join(segments, "/") + "'")
+			case c != '\'' && content == database && isQualifier(query, i, end):
+				result.WriteString(quotedNewDatabase)
+			default:
+				result.WriteString(query[i:end])
+			}
+			i = end
+		case isIdentifierChar(c):
+			end := i
+			for end < len(query) && isIdentifierChar(query[end]) {
+				end++
+			}
+			if query[i:end] == database && isQualifier(query, i, end) {
+				result.WriteString(quotedNewDatabase)
+			} else {
+				result.WriteString(query[i:end])
+			}
+			i = end
+		default:
+			result.WriteByte(c)
+			i++
+		}
+	}
+	rewritten := result.String()
+	if m := replicatedPathRE.FindStringSubmatch(rewritten); m != nil {
+		zkPath := m[1]
+		if !strings.Contains(zkPath, "{database}") && !strings.Contains(zkPath, "{uuid}") && !strings.Contains("/"+zkPath+"/", "/"+newDatabase+"/") {
+			return "", fmt.Errorf("ZooKeeper path '%s' contains neither database name nor {database} or {uuid} macro, it would be shared with '%s'", zkPath, database)
+		}
+	}
+	return rewritten, nil
+}
+
+// queryToken - position after token which starts at start, string literal, quoted identifier or single byte.
+// quote is opening quote of quoted token and zero for others, closed is false when quoted token isn't terminated,
+// backslash escapes the next byte inside quotes, parsers of this file scan queries with it
+func queryToken(query string, start int) (end int, quote byte, closed bool) {
+	c := query[start]
+	if c != '\'' && c != '`' && c != '"' {
+		return start + 1, 0, true
+	}
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case c:
+			return i + 1, c, true
+		}
+	}
+	return len(query), c, false
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isQualifier - name between start and end is followed by dot and isn't a part of qualified name itself
+func isQualifier(query string, start, end int) bool {
+	return end < len(query) && query[end] == '.' && (start == 0 || query[start-1] != '.')
+}
+
+var engineClauseRE = regexp.MustCompile(`(?i)\sENGINE\s*=\s*\w+`)
+var viewSelectRE = regexp.MustCompile(`(?is)\sAS\s+\(?\s*(?:SELECT|WITH)\s`)
+
+// ValidateCreateQuery - check that query is CREATE or ATTACH of table, view or dictionary with balanced
+// parentheses and quotes, tables must have ENGINE and views must have AS SELECT, query is not fully parsed
+func ValidateCreateQuery(query string) error {
+	loc := tableNameRE.FindStringSubmatchIndex(query)
+	if loc == nil {
+		return fmt.Errorf("not a CREATE TABLE, VIEW or DICTIONARY query")
+	}
+	if !isBalancedQuery(query) {
+		return fmt.Errorf("unbalanced parentheses or quotes")
+	}
+	kind := strings.ToUpper(query[loc[2]:loc[3]])
+	switch {
+	case strings.Contains(kind, "DICTIONARY"):
+	case strings.Contains(kind, "VIEW"):
+		if !viewSelectRE.MatchString(query) {
+			return fmt.Errorf("view without AS SELECT")
+		}
+	default:
+		if !engineClauseRE.MatchString(query) {
+			return fmt.Errorf("table without ENGINE")
+		}
+	}
+	return nil
+}
+
+func isBalancedQuery(query string) bool {
+	depth := 0
+	for i := 0; i < len(query); {
+		end, quote, closed := queryToken(query, i)
+		switch {
+		case !closed:
+			return false
+		case quote != 0:
+		case query[i] == '(':
+			depth++
+		case query[i] == ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+		i = end
+	}
+	return depth == 0
+}
+
+var storagePolicyRE = regexp.MustCompile(`(?i)(,\s*)?storage_policy\s*=\s*'[^']*'(\s*,\s*)?`)
+var emptySettingsRE = regexp.MustCompile(`(?i)\s+SETTINGS\s*(COMMENT\b|$)`)
+
+// RewriteStoragePolicy - replace storage_policy setting in create table query,
+// the setting is removed when policy is 'default'
+func RewriteStoragePolicy(query, policy string) string {
+	query = storagePolicyRE.ReplaceAllStringFunc(query, func(setting string) string {
+		m := storagePolicyRE.FindStringSubmatch(setting)
+		if policy != "default" {
+			return fmt.Sprintf("%sstorage_policy = '%s'%s", m[1], policy, m[2])
+		}
+		if m[1] != "" && m[2] != "" {
+			return ", "
+		}
+		return ""
+	})
+	return strings.TrimRight(emptySettingsRE.ReplaceAllString(query, " $1"), " ")
+}
+
+func copyFile(srcFile, dstFile string) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstFile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// ParseProjections - extract "PROJECTION name (SELECT ...)" definitions from create table query
+func ParseProjections(query string) map[string]string {
+	result := map[string]string{}
+	keyword := "PROJECTION "
+	pos := 0
+	for {
+		i := strings.Index(query[pos:], keyword)
+		if i < 0 {
+			return result
+		}
+		pos += i + len(keyword)
+		rest := strings.TrimLeft(query[pos:], " ")
+		var name string
+		if strings.HasPrefix(rest, "`") {
+			end := strings.Index(rest[1:], "`")
+			if end < 0 {
+				return result
+			}
+			name = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " (")
+			if end < 0 {
+				return result
+			}
+			name = rest[:end]
+			rest = rest[end:]
+		}
+		rest = strings.TrimLeft(rest, " ")
+		if !strings.HasPrefix(rest, "(") {
+			continue
+		}
+		if body, ok := balancedParentheses(rest); ok {
+			result[name] = body
+		}
+	}
+}
+
+// balancedParentheses - return content of (...) group which starts at the beginning of s, quotes are respected
+func balancedParentheses(s string) (string, bool) {
+	depth := 0
+	for i := 0; i < len(s); {
+		end, quote, _ := queryToken(s, i)
+		switch {
+		case quote != 0:
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+			if depth == 0 {
+				return s[1:i], true
+			}
+		}
+		i = end
+	}
+	return "", false
+}
+
+// Column - column of CREATE TABLE query, Definition is Type with DEFAULT, CODEC, TTL and COMMENT clauses
+type Column struct {
+	Name       string
+	Type       string
+	Definition string
+}
+
+var createTableRE = regexp.MustCompile(`(?is)^\s*(?:CREATE|ATTACH)\s+TABLE\s`)
+var createTableAsRE = regexp.MustCompile(`(?is)\s(?:AS|ENGINE)[\s=]`)
+var columnClauseRE = regexp.MustCompile(`(?i)\s(?:DEFAULT|MATERIALIZED|ALIAS|EPHEMERAL|CODEC|TTL|COMMENT)\b`)
+var columnsElementRE = regexp.MustCompile(`(?i)^(?:INDEX|PROJECTION|CONSTRAINT|PRIMARY\s+KEY)\s`)
+var whitespaceRE = regexp.MustCompile(`\s+`)
+
+// ParseColumns - parse columns of CREATE TABLE query, indexes, projections and constraints are skipped,
+// rest is the part of query after columns list. ok is false for views, dictionaries and CREATE TABLE ... AS
+func ParseColumns(query string) (columns []Column, rest string, ok bool) {
+	if !createTableRE.MatchString(query) {
+		return nil, "", false
+	}
+	start := strings.Index(query, "(")
+	if start < 0 || createTableAsRE.MatchString(query[:start]) {
+		return nil, "", false
+	}
+	body, ok := balancedParentheses(query[start:])
+	if !ok {
+		return nil, "", false
+	}
+	for _, element := range splitTopLevel(body) {
+		element = strings.TrimSpace(element)
+		if element == "" || columnsElementRE.MatchString(element) {
+			continue
+		}
+		var name, definition string
+		if strings.HasPrefix(element, "`") {
+			end := strings.Index(element[1:], "`")
+			if end < 0 {
+				return nil, "", false
+			}
+			name, definition = element[1:end+1], element[end+2:]
+		} else {
+			fields := strings.SplitN(element, " ", 2)
+			if len(fields) != 2 {
+				return nil, "", false
+			}
+			name, definition = fields[0], fields[1]
+		}
+		definition = whitespaceRE.ReplaceAllString(strings.TrimSpace(definition), " ")
+		columnType := definition
+		if loc := columnClauseRE.FindStringIndex(definition); loc != nil {
+			columnType = definition[:loc[0]]
+		}
+		columns = append(columns, Column{
+			Name:       name,
+			Type:       columnType,
+			Definition: definition,
+		})
+	}
+	return columns, strings.TrimSpace(query[start+len(body)+2:]), true
+}
+
+// splitTopLevel - split by commas which are not inside parentheses or quotes
+func splitTopLevel(s string) []string {
+	var result []string
+	depth := 0
+	last := 0
+	for i := 0; i < len(s); {
+		end, quote, _ := queryToken(s, i)
+		switch {
+		case quote != 0:
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		case s[i] == ',' && depth == 0:
+			result = append(result, s[last:i])
+			last = i + 1
+		}
+		i = end
+	}
+	return append(result, s[last:])
+}
+
+const identifierPattern = "(?:`[^`]+`|\\w+)(?:\\.(?:`[^`]+`|\\w+))?"
+
+var sourceTableRE = regexp.MustCompile(`(?i)\b(?:FROM|JOIN)\s+(` + identifierPattern + `)(\s*\()?`)
+var viewTargetRE = regexp.MustCompile(`(?is)^\s*(?:CREATE|ATTACH)\s+MATERIALIZED\s+VIEW\s+(?:IF\s+NOT\s+EXISTS\s+)?` + identifierPattern + `(?:\s+UUID\s+'[^']+')?\s+TO\s+(` + identifierPattern + `)`)
+
+var identifierPartsRE = regexp.MustCompile("^(`[^`]+`|\\w+)(?:\\.(`[^`]+`|\\w+))?$")
+
+func parseTableTitle(name string) metadata.TableTitle {
+	m := identifierPartsRE.FindStringSubmatch(name)
+	if m == nil || m[2] == "" {
+		return metadata.TableTitle{Table: strings.Trim(name, "`")}
+	}
+	return metadata.TableTitle{Database: strings.Trim(m[1], "`"), Table: strings.Trim(m[2], "`")}
+}
+
+// ParseViewSources - return tables used in FROM and JOIN clauses and TO table of views,
+// database is empty for unqualified names, table functions and subqueries are skipped
+func ParseViewSources(query string) []metadata.TableTitle {
+	var result []metadata.TableTitle
+	if m := viewTargetRE.FindStringSubmatch(query); m != nil {
+		result = append(result, parseTableTitle(m[1]))
+	}
+	for _, m := range sourceTableRE.FindAllStringSubmatch(query, -1) {
+		if m[2] != "" {
+			continue
+		}
+		result = append(result, parseTableTitle(m[1]))
+	}
+	return result
+}
+
+var mergeEngineRE = regexp.MustCompile(`(?i)ENGINE\s*=\s*Merge\s*\(`)
+
+// ParseMergeEngine - return database and tables regexp of Merge engine, database is regexp when
+// it is defined by REGEXP(), database is empty when it is defined by currentDatabase()
+func ParseMergeEngine(query string) (database string, databaseIsRegexp bool, tablesRegexp string, ok bool) {
+	loc := mergeEngineRE.FindStringIndex(query)
+	if loc == nil {
+		return "", false, "", false
+	}
+	engineArgs, ok := balancedParentheses(query[loc[1]-1:])
+	if !ok {
+		return "", false, "", false
+	}
+	args := splitTopLevel(engineArgs)
+	if len(args) != 2 {
+		return "", false, "", false
+	}
+	unquote := func(s string) string {
+		return strings.ReplaceAll(strings.Trim(strings.TrimSpace(s), "'\"`"), "\\\\", "\\")
+	}
+	database = strings.TrimSpace(args[0])
+	switch {
+	case strings.HasPrefix(strings.ToUpper(database), "REGEXP"):
+		if inner, ok := balancedParentheses(database[len("REGEXP"):]); ok {
+			database, databaseIsRegexp = unquote(inner), true
+		}
+	case strings.HasPrefix(database, "currentDatabase"):
+		database = ""
+	default:
+		database = unquote(database)
+	}
+	return database, databaseIsRegexp, unquote(args[1]), true
+}
+
+var distributedEngineRE = regexp.MustCompile(`(?i)ENGINE\s*=\s*Distributed\s*\(`)
+
+// ParseDistributedCluster - return cluster name from first argument of Distributed engine, macros are not substituted
+func ParseDistributedCluster(query string) (string, bool) {
+	loc := distributedEngineRE.FindStringIndex(query)
+	if loc == nil {
+		return "", false
+	}
+	engineArgs, ok := balancedParentheses(query[loc[1]-1:])
+	if !ok {
+		return "", false
+	}
+	args := splitTopLevel(engineArgs)
+	if len(args) < 3 {
+		return "", false
+	}
+	cluster := strings.Trim(strings.TrimSpace(args[0]), "'\"`")
+	return cluster, cluster != ""
+}
+
 func (ch *ClickHouse) softSelect(dest interface{}, query string) error {
+	defer ch.acquireQuery()()
 	rows, err := ch.Queryx(query)
 	if err != nil {
 		return err
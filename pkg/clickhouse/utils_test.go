@@ -0,0 +1,233 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowPath(t *testing.T) {
+	assert.Equal(t, "shadow/db/table/default", ShadowPath("", "default", "db", "table"))
+	assert.Equal(t, "shadow/db/table/hdd", ShadowPath(ShadowLayoutTable, "hdd", "db", "table"))
+	assert.Equal(t, "shadow/hdd/db/table", ShadowPath(ShadowLayoutDisk, "hdd", "db", "table"))
+	assert.Equal(t, "shadow/default/db%2D1/table%2E1", ShadowPath(ShadowLayoutDisk, "default", "db-1", "table.1"))
+}
+
+func TestIsSkippedTable(t *testing.T) {
+	skipTables := []string{"system.*", "default.tmp_*"}
+	assert.True(t, IsSkippedTable(skipTables, "system", "query_log"))
+	assert.True(t, IsSkippedTable(skipTables, "default", "tmp_events"))
+	assert.False(t, IsSkippedTable(skipTables, "default", "events"))
+	assert.False(t, IsSkippedTable(nil, "system", "query_log"))
+}
+
+func TestFormatTableStructure(t *testing.T) {
+	columns := []Column{{Name: "id", Type: "UInt64"}, {Name: "na`me", Type: "Nullable(String)"}}
+	assert.Equal(t, "`id` UInt64, `na\\`me` Nullable(String)", FormatTableStructure(columns))
+}
+
+func TestRemoveDatabaseUUID(t *testing.T) {
+	assert.Equal(t, "CREATE DATABASE db ENGINE = Atomic", RemoveDatabaseUUID("CREATE DATABASE db UUID '3a1f6ec4-8c0b-4b8b-9c0e-6a4c2a1e3f11' ENGINE = Atomic"))
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `db` ENGINE = Atomic", RemoveDatabaseUUID("CREATE DATABASE IF NOT EXISTS `db` UUID 'abc' ENGINE = Atomic"))
+	assert.Equal(t, "CREATE DATABASE db\nENGINE = Atomic", RemoveDatabaseUUID("CREATE DATABASE db\nENGINE = Atomic"))
+}
+
+func TestRenameTableInQuery(t *testing.T) {
+	testCases := []struct {
+		query, database, table, newDatabase, newTable string
+		expected                                      string
+	}{
+		{"CREATE TABLE db.t UUID '3a1f6ec4-8c0b-4b8b-9c0e-6a4c2a1e3f11' (`id` UInt64) ENGINE = MergeTree ORDER BY id", "db", "t", "db", "t2", "CREATE TABLE `db`.`t2` (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{"ATTACH MATERIALIZED VIEW `db`.`mv` TO db.t AS SELECT id FROM db.src", "db", "mv", "db2", "mv2", "ATTACH MATERIALIZED VIEW `db2`.`mv2` TO db.t AS SELECT id FROM db.src"},
+		{"CREATE TABLE IF NOT EXISTS t AS db.t", "db", "t", "db", "t2", "CREATE TABLE IF NOT EXISTS `db`.`t2` AS db.t"},
+		{"SELECT 1", "db", "t", "db", "t2", "SELECT 1"},
+		{"CREATE TABLE db.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db/t', '{replica}') ORDER BY id", "db", "t", "db2", "t2", "CREATE TABLE `db2`.`t2` (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db2/t2', '{replica}') ORDER BY id"},
+		{"CREATE TABLE db.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}') ORDER BY id", "db", "t", "db", "t2", "CREATE TABLE `db`.`t2` (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}') ORDER BY id"},
+		{"CREATE TABLE db.t UUID 'abc' (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}') ORDER BY id", "db", "t", "db", "t2", "CREATE TABLE `db`.`t2` (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}') ORDER BY id"},
+		// path of table which is restored with the same name is not checked
+		{"CREATE TABLE db.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/events', '{replica}') ORDER BY id", "db", "t", "db", "t", "CREATE TABLE `db`.`t` (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/events', '{replica}') ORDER BY id"},
+	}
+	for _, tc := range testCases {
+		rewritten, err := RenameTableInQuery(tc.query, tc.database, tc.table, tc.newDatabase, tc.newTable)
+		assert.NoError(t, err, tc.query)
+		assert.Equal(t, tc.expected, rewritten)
+	}
+	for _, query := range []string{
+		"CREATE TABLE db.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/events', '{replica}') ORDER BY id",
+		"CREATE TABLE db.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}', '{replica}') ORDER BY id",
+	} {
+		_, err := RenameTableInQuery(query, "db", "t", "db", "t2")
+		assert.Error(t, err, query)
+	}
+}
+
+func TestRenameDatabaseInQuery(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{
+			"ATTACH MATERIALIZED VIEW prod.mv TO `prod`.t AS SELECT prod.src.id, 'x.prod' FROM prod.src JOIN other.prod ON 1",
+			"ATTACH MATERIALIZED VIEW `prod_test`.mv TO `prod_test`.t AS SELECT `prod_test`.src.id, 'x.prod' FROM `prod_test`.src JOIN other.prod ON 1",
+		},
+		// cluster and column with the same name as database are not renamed
+		{
+			"CREATE TABLE prod.t ON CLUSTER prod (`prod` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/prod/t', '{replica}') ORDER BY prod",
+			"CREATE TABLE `prod_test`.t ON CLUSTER prod (`prod` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/prod_test/t', '{replica}') ORDER BY prod",
+		},
+		{
+			"CREATE TABLE prod.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}') ORDER BY id",
+			"CREATE TABLE `prod_test`.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}') ORDER BY id",
+		},
+		{
+			"CREATE DATABASE prod UUID '3a1f6ec4-8c0b-4b8b-9c0e-6a4c2a1e3f11' ENGINE = Replicated('/clickhouse/databases/prod', '{shard}', '{replica}')",
+			"CREATE DATABASE `prod_test` UUID '3a1f6ec4-8c0b-4b8b-9c0e-6a4c2a1e3f11' ENGINE = Replicated('/clickhouse/databases/prod_test', '{shard}', '{replica}')",
+		},
+	}
+	for _, tc := range testCases {
+		rewritten, err := RenameDatabaseInQuery(tc.query, "prod", "prod_test")
+		assert.NoError(t, err, tc.query)
+		assert.Equal(t, tc.expected, rewritten)
+	}
+	for _, query := range []string{
+		"CREATE TABLE prod.d (id UInt64) ENGINE = Distributed('cluster', 'prod', 't', rand())",
+		"CREATE TABLE prod.t (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/t', '{replica}') ORDER BY id",
+	} {
+		_, err := RenameDatabaseInQuery(query, "prod", "prod_test")
+		assert.Error(t, err, query)
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	columns, rest, ok := ParseColumns("CREATE TABLE db.t UUID 'abc' (`id` UInt64, `name` String DEFAULT 'a,b' CODEC(ZSTD(1)), `m` Map(String, UInt8) COMMENT 'x', INDEX idx name TYPE bloom_filter GRANULARITY 1) ENGINE = MergeTree ORDER BY id")
+	assert.True(t, ok)
+	assert.Equal(t, []Column{
+		{Name: "id", Type: "UInt64", Definition: "UInt64"},
+		{Name: "name", Type: "String", Definition: "String DEFAULT 'a,b' CODEC(ZSTD(1))"},
+		{Name: "m", Type: "Map(String, UInt8)", Definition: "Map(String, UInt8) COMMENT 'x'"},
+	}, columns)
+	assert.Equal(t, "ENGINE = MergeTree ORDER BY id", rest)
+	_, _, ok = ParseColumns("CREATE TABLE db.t AS db.t2 ENGINE = MergeTree() ORDER BY id")
+	assert.False(t, ok)
+	_, _, ok = ParseColumns("CREATE VIEW db.v (`id` UInt64) AS SELECT id FROM db.t")
+	assert.False(t, ok)
+}
+
+func TestParseViewSources(t *testing.T) {
+	assert.Equal(t, []metadata.TableTitle{
+		{Database: "db", Table: "events"},
+		{Database: "", Table: "users"},
+	}, ParseViewSources("CREATE VIEW db.v (`id` UInt64) AS SELECT id FROM db.events AS e LEFT JOIN users USING id WHERE id IN (SELECT id FROM numbers(10))"))
+	assert.Equal(t, []metadata.TableTitle{
+		{Database: "db", Table: "dst"},
+		{Database: "db 1", Table: "src"},
+	}, ParseViewSources("CREATE MATERIALIZED VIEW db.mv UUID 'abc' TO db.dst (`id` UInt64) AS SELECT id FROM `db 1`.`src`"))
+}
+
+func TestParseMergeEngine(t *testing.T) {
+	database, isRegexp, tables, ok := ParseMergeEngine("CREATE TABLE db.m (`id` UInt64) ENGINE = Merge('db', '^events_\\\\d+$')")
+	assert.True(t, ok)
+	assert.Equal(t, "db", database)
+	assert.False(t, isRegexp)
+	assert.Equal(t, "^events_\\d+$", tables)
+	database, isRegexp, tables, ok = ParseMergeEngine("CREATE TABLE db.m (`id` UInt64) ENGINE = Merge(REGEXP('^db_'), 'events')")
+	assert.True(t, ok)
+	assert.Equal(t, "^db_", database)
+	assert.True(t, isRegexp)
+	assert.Equal(t, "events", tables)
+	database, _, _, ok = ParseMergeEngine("CREATE TABLE db.m (`id` UInt64) ENGINE = Merge(currentDatabase(), 'events')")
+	assert.True(t, ok)
+	assert.Equal(t, "", database)
+	_, _, _, ok = ParseMergeEngine("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id")
+	assert.False(t, ok)
+}
+
+func TestValidateCreateQuery(t *testing.T) {
+	assert.NoError(t, ValidateCreateQuery("CREATE TABLE db.t UUID 'abc' (`id` UInt64, `s` String DEFAULT ')') ENGINE = MergeTree ORDER BY id"))
+	assert.NoError(t, ValidateCreateQuery("ATTACH MATERIALIZED VIEW db.mv TO db.t (`id` UInt64) AS SELECT id FROM db.src"))
+	assert.NoError(t, ValidateCreateQuery("CREATE DICTIONARY db.d (`id` UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(TABLE 't')) LAYOUT(FLAT()) LIFETIME(0)"))
+	assert.Error(t, ValidateCreateQuery(""))
+	assert.Error(t, ValidateCreateQuery("CREATE TABLE db.t (`id` UInt64"))
+	assert.Error(t, ValidateCreateQuery("CREATE TABLE db.t (`id` UInt64)"))
+	assert.Error(t, ValidateCreateQuery("CREATE VIEW db.v (`id` UInt64)"))
+}
+
+func TestQueryToken(t *testing.T) {
+	end, quote, closed := queryToken("'a\\'b' x", 0)
+	assert.Equal(t, 6, end)
+	assert.Equal(t, byte('\''), quote)
+	assert.True(t, closed)
+	_, _, closed = queryToken("`a", 0)
+	assert.False(t, closed)
+	end, quote, _ = queryToken("(x", 0)
+	assert.Equal(t, 1, end)
+	assert.Equal(t, byte(0), quote)
+
+	// all parsers skip parentheses and commas inside literals and quoted identifiers
+	body, ok := balancedParentheses("(`a)` UInt8, \"b,(\" String) ENGINE = Log")
+	assert.True(t, ok)
+	assert.Equal(t, "`a)` UInt8, \"b,(\" String", body)
+	assert.Equal(t, []string{"`a)` UInt8", " \"b,(\" String"}, splitTopLevel(body))
+	assert.True(t, isBalancedQuery("SELECT '(', `)`"))
+	assert.False(t, isBalancedQuery("SELECT '("))
+}
+
+func TestNewBuildInfo(t *testing.T) {
+	info, err := newBuildInfo(map[string]string{
+		"VERSION_REVISION": "54449",
+		"BUILD_TYPE":       "RelWithDebInfo",
+		"VERSION_OFFICIAL": "",
+		"CXX_FLAGS":        "-O2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 54449, info.Revision)
+	assert.Equal(t, map[string]string{"BUILD_TYPE": "RelWithDebInfo"}, info.Flags)
+
+	info, err = newBuildInfo(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, info.Revision)
+
+	_, err = newBuildInfo(map[string]string{"VERSION_REVISION": "unknown"})
+	assert.Error(t, err)
+}
+
+func TestGetDiskByPath(t *testing.T) {
+	disks := []Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/"},
+		{Name: "s3", Path: "/var/lib/clickhouse/disks/s3/"},
+	}
+	assert.Equal(t, "default", GetDiskByPath(disks, "/var/lib/clickhouse/store/abc/abcdef/"))
+	assert.Equal(t, "s3", GetDiskByPath(disks, "/var/lib/clickhouse/disks/s3/store/abc/abcdef/"))
+	assert.Equal(t, "unknown", GetDiskByPath(disks, "/mnt/hdd/store/abc/abcdef/"))
+}
+
+func TestParseDistributedCluster(t *testing.T) {
+	cluster, ok := ParseDistributedCluster("CREATE TABLE db.dist (id UInt64) ENGINE = Distributed('{cluster}', 'db', 'local', rand())")
+	assert.True(t, ok)
+	assert.Equal(t, "{cluster}", cluster)
+	cluster, ok = ParseDistributedCluster("CREATE TABLE db.dist (id UInt64) ENGINE = Distributed(main, db, local)")
+	assert.True(t, ok)
+	assert.Equal(t, "main", cluster)
+	_, ok = ParseDistributedCluster("CREATE TABLE db.local (id UInt64) ENGINE = MergeTree ORDER BY id")
+	assert.False(t, ok)
+}
+
+func TestAddOnCluster(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{query: "CREATE DATABASE IF NOT EXISTS `db`", expected: "CREATE DATABASE IF NOT EXISTS `db` ON CLUSTER `c`"},
+		{query: "CREATE TABLE db.t UUID 'abc' (a Int8) ENGINE=Memory", expected: "CREATE TABLE db.t UUID 'abc' ON CLUSTER `c` (a Int8) ENGINE=Memory"},
+		{query: "ATTACH MATERIALIZED VIEW `db`.`mv` TO db.t AS SELECT 1", expected: "ATTACH MATERIALIZED VIEW `db`.`mv` ON CLUSTER `c` TO db.t AS SELECT 1"},
+		{query: "CREATE TABLE db.t ON CLUSTER other (a Int8) ENGINE=Memory", expected: "CREATE TABLE db.t ON CLUSTER other (a Int8) ENGINE=Memory"},
+		{query: "DROP DATABASE IF EXISTS `db`", expected: "DROP DATABASE IF EXISTS `db` ON CLUSTER `c`"},
+		{query: "DROP DICTIONARY IF EXISTS `db`.`d`", expected: "DROP DICTIONARY IF EXISTS `db`.`d` ON CLUSTER `c`"},
+		{query: "DROP TABLE db.t", expected: "DROP TABLE db.t ON CLUSTER `c`"},
+		{query: "SELECT 1", expected: "SELECT 1"},
+	} {
+		assert.Equal(t, tc.expected, AddOnCluster(tc.query, "c"), tc.query)
+		assert.Equal(t, tc.query, AddOnCluster(tc.query, ""), tc.query)
+	}
+}
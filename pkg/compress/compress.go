@@ -0,0 +1,129 @@
+package compress
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mholt/archiver/v3"
+)
+
+// Factory - create archive writer with compression level and archive reader for one format
+type Factory func(level int) (archiver.Writer, archiver.Reader)
+
+type compressor struct {
+	extension string
+	factory   Factory
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]compressor{}
+)
+
+func init() {
+	RegisterCompressor("tar", "tar", func(level int) (archiver.Writer, archiver.Reader) {
+		return archiver.NewTar(), archiver.NewTar()
+	})
+	RegisterCompressor("lz4", "tar.lz4", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarLz4{CompressionLevel: level, Tar: archiver.NewTar()}, archiver.NewTarLz4()
+	})
+	RegisterCompressor("bzip2", "tar.bz2", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarBz2{CompressionLevel: level, Tar: archiver.NewTar()}, archiver.NewTarBz2()
+	})
+	RegisterCompressor("gzip", "tar.gz", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarGz{CompressionLevel: level, Tar: archiver.NewTar()}, archiver.NewTarGz()
+	})
+	RegisterCompressor("sz", "tar.sz", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarSz{Tar: archiver.NewTar()}, archiver.NewTarSz()
+	})
+	RegisterCompressor("xz", "tar.xz", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarXz{Tar: archiver.NewTar()}, archiver.NewTarXz()
+	})
+	brotli := func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarBrotli{Quality: level, Tar: archiver.NewTar()}, archiver.NewTarBrotli()
+	}
+	RegisterCompressor("br", "tar.br", brotli)
+	RegisterCompressor("brotli", "tar.br", brotli)
+	RegisterCompressor("zstd", "tar.zstd", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarZstd{Tar: archiver.NewTar()}, archiver.NewTarZstd()
+	})
+}
+
+// RegisterCompressor - make compression format available for all options which name an algorithm,
+// registration with existing name replaces previous one
+func RegisterCompressor(name, extension string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = compressor{
+		extension: extension,
+		factory:   factory,
+	}
+}
+
+func get(name string) (compressor, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := registry[name]
+	if !ok {
+		return compressor{}, fmt.Errorf("'%s' is unsupported compression format, supported: %s", name, strings.Join(names(), ", "))
+	}
+	return c, nil
+}
+
+// names - must be called with registryMu locked
+func names() []string {
+	result := make([]string, 0, len(registry))
+	for name := range registry {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Validate - check that compression format is registered
+func Validate(name string) error {
+	_, err := get(name)
+	return err
+}
+
+// Extension - file extension of archives in compression format, empty for unknown format
+func Extension(name string) string {
+	c, err := get(name)
+	if err != nil {
+		return ""
+	}
+	return c.extension
+}
+
+// Extensions - file extensions of all registered formats
+func Extensions() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	result := make([]string, 0, len(registry))
+	for _, name := range names() {
+		result = append(result, registry[name].extension)
+	}
+	return result
+}
+
+// NewWriter - archive writer for compression format
+func NewWriter(name string, level int) (archiver.Writer, error) {
+	c, err := get(name)
+	if err != nil {
+		return nil, err
+	}
+	w, _ := c.factory(level)
+	return w, nil
+}
+
+// NewReader - archive reader for compression format
+func NewReader(name string) (archiver.Reader, error) {
+	c, err := get(name)
+	if err != nil {
+		return nil, err
+	}
+	_, r := c.factory(0)
+	return r, nil
+}
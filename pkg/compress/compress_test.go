@@ -0,0 +1,24 @@
+package compress
+
+import (
+	"testing"
+
+	"github.com/mholt/archiver/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterCompressor(t *testing.T) {
+	assert.Error(t, Validate("custom"))
+	assert.Equal(t, "", Extension("custom"))
+	RegisterCompressor("custom", "tar.custom", func(level int) (archiver.Writer, archiver.Reader) {
+		return &archiver.TarGz{CompressionLevel: level, Tar: archiver.NewTar()}, archiver.NewTarGz()
+	})
+	assert.NoError(t, Validate("custom"))
+	assert.Equal(t, "tar.custom", Extension("custom"))
+	assert.Contains(t, Extensions(), "tar.custom")
+	w, err := NewWriter("custom", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, w.(*archiver.TarGz).CompressionLevel)
+	_, err = NewReader("unknown")
+	assert.Error(t, err)
+}
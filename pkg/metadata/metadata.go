@@ -14,15 +14,28 @@ type BackupMetadata struct {
 	Disks                   map[string]string `json:"disks"` // "default": "/var/lib/clickhouse"
 	ClickhouseBackupVersion string            `json:"version"`
 	CreationDate            time.Time         `json:"creation_date"`
-	Tags                    string            `json:"tags,omitempty"` // "type=manual", "type=sheduled", "hostname": "", "shard="
+	Tags                    []string          `json:"tags"` // labels set by --tag, e.g. "daily", always a list for stable JSON
 	ClickHouseVersion       string            `json:"clickhouse_version,omitempty"`
-	DataSize                int64             `json:"data_size,omitempty"`
+	ClickHouseRevision      int               `json:"clickhouse_revision,omitempty"`
+	ClickHouseBuildFlags    map[string]string `json:"clickhouse_build_flags,omitempty"`
+	Macros                  map[string]string `json:"macros,omitempty"`          // "shard": "01", "replica": "host-1"
+	SkippedDisks            []string          `json:"skipped_disks,omitempty"`   // unwritable disks skipped by general.skip_unwritable_disks
+	DiskIDs                 map[string]string `json:"disk_ids,omitempty"`        // "default": uuid from marker file in backup directory
+	BuffersFlushed          bool              `json:"buffers_flushed,omitempty"` // Buffer and Distributed tables were flushed by general.flush_buffers_before_backup
+	ShadowLayout            string            `json:"shadow_layout,omitempty"`   // "table" or "disk", empty for backups created before general.shadow_layout
+	DataSize                int64             `json:"data_size,omitempty"`       // physical size, real bytes of parts in backup on all disks
+	TotalBytes              int64             `json:"total_bytes,omitempty"`     // logical size reported by system.tables
 	MetadataSize            int64             `json:"metadata_size"`
 	CompressedSize          int64             `json:"compressed_size,omitempty"`
 	Databases               []DatabasesMeta   `json:"databases,omitempty"`
 	Tables                  []TableTitle      `json:"tables"`
+	FailedTables            []TableTitle      `json:"failed_tables,omitempty"` // tables skipped by general.continue_on_error
 	DataFormat              string            `json:"data_format"`
 	RequiredBackup          string            `json:"required_backup,omitempty"`
+	ModifiedSince           string            `json:"modified_since,omitempty"` // only tables with parts modified after this time are included
+	Description             string            `json:"description,omitempty"`    // human note set by --note, e.g. "pre-migration-v42"
+	DataOnly                bool              `json:"data_only,omitempty"`      // created with general.data_only_backup, contains no schema
+	Encryption              string            `json:"encryption,omitempty"`     // algorithm of uploaded data files, e.g. "aes-256-gcm", empty when not encrypted
 }
 
 type DatabasesMeta struct {
@@ -39,6 +52,7 @@ type TableMetadata struct {
 	IncrementOf string            `json:"increment_of,omitempty"`
 	Parts       map[string][]Part `json:"parts"`
 	Query       string            `json:"query"`
+	Projections map[string]string `json:"projections,omitempty"` // name: "SELECT ... ORDER BY ..."
 	// UUID        string            `json:"uuid,omitempty"`
 	// Macros ???
 	Size                 map[string]int64 `json:"size"`                  // сколько занимает бэкап на каждом диске
@@ -46,6 +60,19 @@ type TableMetadata struct {
 	DependencesTable     string           `json:"dependencies_table,omitempty"`
 	DependenciesDatabase string           `json:"dependencies_database,omitempty"`
 	MetadataOnly         bool             `json:"metadata_only"`
+	MetadataVersion      string           `json:"metadata_version,omitempty"` // content of metadata_version.txt, empty on older ClickHouse
+	DataOnly             bool             `json:"data_only,omitempty"`        // query is not stored, table must exist before restore
+	SourceTables         []string         `json:"source_tables,omitempty"`    // tables which hold data of View or Merge table, filled by expand_dependencies
+	Dump                 *DataDump        `json:"dump,omitempty"`             // data of not MergeTree table exported by SELECT, see general.backup_non_merge_tree_data
+}
+
+// DataDump - rows of table in file File of part Part on disk Disk, restored by INSERT ... SELECT FROM file()
+type DataDump struct {
+	Disk      string `json:"disk"`
+	Part      string `json:"part"`
+	File      string `json:"file"`
+	Format    string `json:"format"`
+	Structure string `json:"structure"`
 }
 
 type Part struct {
@@ -59,5 +86,6 @@ type Part struct {
 	PartitionID                       string     `json:"partition_id,omitempty"`
 	ModificationTime                  *time.Time `json:"modification_time,omitempty"`
 	Size                              int64      `json:"size,omitempty"`
+	MetadataVersion                   string     `json:"metadata_version,omitempty"` // content of metadata_version.txt of part, empty on older ClickHouse
 	// bytes_on_disk, data_compressed_bytes, data_uncompressed_bytes
 }
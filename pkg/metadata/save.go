@@ -14,9 +14,13 @@ func (tm *TableMetadata) Save(location string, metadataOnly bool) (int, error) {
 		Database:             tm.Database,
 		IncrementOf:          tm.IncrementOf,
 		Query:                tm.Query,
+		Projections:          tm.Projections,
 		DependencesTable:     tm.DependencesTable,
 		DependenciesDatabase: tm.DependenciesDatabase,
 		MetadataOnly:         true,
+		MetadataVersion:      tm.MetadataVersion,
+		DataOnly:             tm.DataOnly,
+		SourceTables:         tm.SourceTables,
 	}
 	parts := map[string][]Part{}
 	for disk, p := range tm.Parts {
@@ -46,6 +50,9 @@ func (tm *TableMetadata) Save(location string, metadataOnly bool) (int, error) {
 }
 
 func (bm *BackupMetadata) Save(location string) error {
+	if bm.Tags == nil {
+		bm.Tags = []string{}
+	}
 	tbBody, err := json.MarshalIndent(bm, "", "\t")
 	if err != nil {
 		return fmt.Errorf("can't marshall backup metadata: %v", err)
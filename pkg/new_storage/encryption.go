@@ -0,0 +1,218 @@
+package new_storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EncryptionAlgorithm - written to metadata.json of backup uploaded with general.encryption_key
+const EncryptionAlgorithm = "aes-256-gcm"
+
+// encryptionChunkSize - data is sealed by chunks, so stream is decrypted without buffering whole file
+const encryptionChunkSize = 64 * 1024
+
+// encryptionMagic - first bytes of encrypted file, followed by random nonce of the file
+var encryptionMagic = []byte("CHBKAES1")
+
+var (
+	// ErrEncryptionKeyRequired - data is encrypted and general.encryption_key is not set
+	ErrEncryptionKeyRequired = errors.New("data is encrypted, general.encryption_key or general.encryption_key_file is required")
+	// ErrDecryptionFailed - authentication of chunk failed, key is wrong or file is damaged or truncated
+	ErrDecryptionFailed = errors.New("can't decrypt data, encryption key is wrong or data is damaged")
+	// ErrNotEncrypted - data file of backup uploaded with encryption has no encryption header, it was replaced
+	ErrNotEncrypted = errors.New("data of encrypted backup is not encrypted, it was replaced on remote storage")
+)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce - nonce of file with number of chunk xored into its last bytes, additional data marks the last chunk,
+// so truncated file can't be decrypted
+func chunkNonce(nonce []byte, counter uint64) []byte {
+	result := make([]byte, len(nonce))
+	copy(result, nonce)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	for i := range c {
+		result[len(result)-8+i] ^= c[i]
+	}
+	return result
+}
+
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// isLastChunk - chunk is the last one when source has no more bytes after it
+func isLastChunk(r *bufio.Reader, readErr error) (bool, error) {
+	if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+		return true, nil
+	}
+	if readErr != nil {
+		return false, readErr
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+type encryptReader struct {
+	src     io.ReadCloser
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	chunk   []byte
+	out     []byte
+	done    bool
+}
+
+// newEncryptReader - header with random nonce and sealed chunks of r
+func newEncryptReader(r io.ReadCloser, key []byte) (io.ReadCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte{}, encryptionMagic...), nonce...)
+	return &encryptReader{
+		src:    r,
+		reader: bufio.NewReaderSize(r, encryptionChunkSize),
+		aead:   aead,
+		nonce:  nonce,
+		chunk:  make([]byte, encryptionChunkSize),
+		out:    header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.reader, e.chunk)
+		last, err := isLastChunk(e.reader, err)
+		if err != nil {
+			return 0, err
+		}
+		e.out = e.aead.Seal(e.out[:0], chunkNonce(e.nonce, e.counter), e.chunk[:n], chunkAdditionalData(last))
+		e.counter++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) Close() error {
+	return e.src.Close()
+}
+
+type decryptReader struct {
+	src     io.ReadCloser
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	chunk   []byte
+	out     []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.reader, d.chunk)
+		last, err := isLastChunk(d.reader, err)
+		if err != nil {
+			return 0, err
+		}
+		d.out, err = d.aead.Open(d.out[:0], chunkNonce(d.nonce, d.counter), d.chunk[:n], chunkAdditionalData(last))
+		if err != nil {
+			return 0, ErrDecryptionFailed
+		}
+		d.counter++
+		d.done = last
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+type bufferedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// newDecryptReader - decrypt r when it begins with encryption header. With encrypted, which is set for files of backup
+// with encryption in metadata.json, the header is required, otherwise files are returned as is,
+// so backups uploaded without encryption, including bases of encrypted increments, are downloaded as before
+func newDecryptReader(r io.ReadCloser, key []byte, encrypted bool) (io.ReadCloser, error) {
+	reader := bufio.NewReaderSize(r, encryptionChunkSize)
+	header, err := reader.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(header, encryptionMagic) {
+		if encrypted {
+			return nil, ErrNotEncrypted
+		}
+		return bufferedReadCloser{Reader: reader, Closer: r}, nil
+	}
+	if key == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := reader.Discard(len(encryptionMagic)); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return nil, fmt.Errorf("can't read nonce of encrypted data: %v", err)
+	}
+	return &decryptReader{
+		src:    r,
+		reader: reader,
+		aead:   aead,
+		nonce:  nonce,
+		chunk:  make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// encryptFile - r is encrypted when key is set
+func encryptFile(r io.ReadCloser, key []byte) (io.ReadCloser, error) {
+	if key == nil {
+		return r, nil
+	}
+	return newEncryptReader(r, key)
+}
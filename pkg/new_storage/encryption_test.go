@@ -0,0 +1,113 @@
+package new_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptionTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func encryptBytes(t *testing.T, data, key []byte) []byte {
+	r, err := newEncryptReader(ioutil.NopCloser(bytes.NewReader(data)), key)
+	require.NoError(t, err)
+	encrypted, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	return encrypted
+}
+
+func decryptBytes(data, key []byte, encrypted bool) ([]byte, error) {
+	r, err := newDecryptReader(ioutil.NopCloser(bytes.NewReader(data)), key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := encryptionTestKey(t)
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 7} {
+		data := bytes.Repeat([]byte("c"), size)
+		encrypted := encryptBytes(t, data, key)
+		assert.True(t, bytes.HasPrefix(encrypted, encryptionMagic))
+		assert.NotContains(t, string(encrypted[len(encryptionMagic)+12:]), "cccccccc")
+		decrypted, err := decryptBytes(encrypted, key, true)
+		require.NoError(t, err, size)
+		assert.Equal(t, data, decrypted, size)
+	}
+	// nonce is random, so the same data is encrypted differently
+	assert.NotEqual(t, encryptBytes(t, []byte("data"), key), encryptBytes(t, []byte("data"), key))
+}
+
+func TestDecryptionErrors(t *testing.T) {
+	key := encryptionTestKey(t)
+	data := bytes.Repeat([]byte("clickhouse "), encryptionChunkSize/4)
+	encrypted := encryptBytes(t, data, key)
+
+	_, err := decryptBytes(encrypted, encryptionTestKey(t), true)
+	assert.True(t, errors.Is(err, ErrDecryptionFailed))
+	_, err = decryptBytes(encrypted, nil, true)
+	assert.True(t, errors.Is(err, ErrEncryptionKeyRequired))
+	// file cut at chunk boundary has no last chunk
+	_, err = decryptBytes(encrypted[:len(encryptionMagic)+12+encryptionChunkSize+16], key, true)
+	assert.True(t, errors.Is(err, ErrDecryptionFailed))
+	damaged := append([]byte{}, encrypted...)
+	damaged[len(damaged)-1] ^= 1
+	_, err = decryptBytes(damaged, key, true)
+	assert.True(t, errors.Is(err, ErrDecryptionFailed))
+
+	// not encrypted files are read as is with and without key, unless backup is encrypted
+	for _, plain := range [][]byte{data, []byte("tar"), nil} {
+		decrypted, err := decryptBytes(plain, key, false)
+		require.NoError(t, err)
+		assert.Equal(t, string(plain), string(decrypted))
+		_, err = decryptBytes(plain, key, true)
+		assert.True(t, errors.Is(err, ErrNotEncrypted))
+	}
+}
+
+func TestCompressedStreamEncrypted(t *testing.T) {
+	partPath, err := ioutil.TempDir("", "clickhouse-backup-encrypted")
+	require.NoError(t, err)
+	defer os.RemoveAll(partPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(partPath, "all_1_1_0"), 0750))
+	body := bytes.Repeat([]byte("clickhouse "), 10000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "all_1_1_0", "data.bin"), body, 0640))
+	storage := &memoryStorage{files: map[string][]byte{}}
+	key := encryptionTestKey(t)
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", disableProgressBar: true, encryptionKey: key}
+	require.NoError(t, bd.CompressedStreamUpload(partPath, []string{"all_1_1_0/data.bin"}, "backup/shadow/default_1.tar"))
+	assert.True(t, bytes.HasPrefix(storage.files["backup/shadow/default_1.tar"], encryptionMagic))
+	assert.False(t, bytes.Contains(storage.files["backup/shadow/default_1.tar"], body[:100]))
+
+	localPath := filepath.Join(partPath, "download")
+	require.NoError(t, bd.CompressedStreamDownload("backup/shadow/default_1.tar", localPath, "", true))
+	downloaded, err := ioutil.ReadFile(filepath.Join(localPath, "all_1_1_0", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, body, downloaded)
+
+	bd.encryptionKey = nil
+	err = bd.CompressedStreamDownload("backup/shadow/default_1.tar", filepath.Join(partPath, "no_key"), "", true)
+	assert.True(t, errors.Is(err, ErrEncryptionKeyRequired))
+
+	// archive of encrypted backup replaced by plaintext one is refused even with key
+	require.NoError(t, bd.CompressedStreamUpload(partPath, []string{"all_1_1_0/data.bin"}, "backup/shadow/default_2.tar"))
+	bd.encryptionKey = key
+	err = bd.CompressedStreamDownload("backup/shadow/default_2.tar", filepath.Join(partPath, "replaced"), "", true)
+	assert.True(t, errors.Is(err, ErrNotEncrypted))
+	require.NoError(t, bd.CompressedStreamDownload("backup/shadow/default_2.tar", filepath.Join(partPath, "plain"), "", false))
+}
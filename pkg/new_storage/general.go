@@ -16,6 +16,7 @@ import (
 
 	"github.com/AlexAkulov/clickhouse-backup/config"
 	"github.com/AlexAkulov/clickhouse-backup/internal/progressbar"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/compress"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"golang.org/x/sync/errgroup"
 
@@ -43,6 +44,8 @@ type BackupDestination struct {
 	compressionFormat  string
 	compressionLevel   int
 	disableProgressBar bool
+	// encryptionKey - when not nil uploaded data files are encrypted, see EncryptionAlgorithm
+	encryptionKey []byte
 }
 
 func (bd *BackupDestination) RemoveOldBackups(keep int) error {
@@ -66,6 +69,8 @@ func (bd *BackupDestination) RemoveOldBackups(keep int) error {
 	return nil
 }
 
+// RemoveBackup - delete all objects of backup, metadata.json is deleted first,
+// so interrupted removal leaves backup which is listed as broken instead of damaged complete one
 func (bd *BackupDestination) RemoveBackup(backup Backup) error {
 	if bd.Kind() == "SFTP" {
 		return bd.DeleteFile(backup.BackupName)
@@ -74,13 +79,18 @@ func (bd *BackupDestination) RemoveBackup(backup Backup) error {
 		archiveName := fmt.Sprintf("%s.%s", backup.BackupName, backup.FileExtension)
 		return bd.DeleteFile(archiveName)
 	}
+	if backup.Broken == "" {
+		if err := bd.DeleteFile(path.Join(backup.BackupName, "metadata.json")); err != nil {
+			return fmt.Errorf("can't delete metadata.json of '%s': %v", backup.BackupName, err)
+		}
+	}
 	return bd.Walk(backup.BackupName+"/", true, func(f RemoteFile) error {
 		return bd.DeleteFile(path.Join(backup.BackupName, f.Name()))
 	})
 }
 
 func isLegacyBackup(backupName string) (bool, string, string) {
-	for _, suffix := range config.ArchiveExtensions {
+	for _, suffix := range compress.Extensions() {
 		if strings.HasSuffix(backupName, "."+suffix) {
 			return true, strings.TrimSuffix(backupName, "."+suffix), suffix
 		}
@@ -133,6 +143,7 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 		}
 		b, err := ioutil.ReadAll(r)
 		if err != nil {
+			_ = r.Close()
 			result = append(result, Backup{
 				metadata.BackupMetadata{
 					BackupName: strings.Trim(o.Name(), "/"),
@@ -171,7 +182,13 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 	return result, err
 }
 
-func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPath string) error {
+// CompressedStreamDownload - extract archive uploaded in compressionFormat recorded in metadata.json of backup,
+// so backup is downloaded after compression_format is changed, empty format is compression_format of config.
+// encrypted - metadata.json of backup has encryption, archive without encryption header is refused
+func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPath string, compressionFormat string, encrypted bool) error {
+	if compressionFormat == "" {
+		compressionFormat = bd.compressionFormat
+	}
 	if err := os.MkdirAll(localPath, 0750); err != nil {
 		return err
 	}
@@ -187,13 +204,17 @@ func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPa
 		return err
 	}
 	defer reader.Close()
+	dataReader, err := newDecryptReader(reader, bd.encryptionKey, encrypted)
+	if err != nil {
+		return err
+	}
 
 	bar := progressbar.StartNewByteBar(!bd.disableProgressBar, filesize)
 	buf := buffer.New(BufferSize)
 	defer bar.Finish()
-	bufReader := nio.NewReader(reader, buf)
+	bufReader := nio.NewReader(dataReader, buf)
 	proxyReader := bar.NewProxyReader(bufReader)
-	z, err := getArchiveReader(bd.compressionFormat)
+	z, err := getArchiveReader(compressionFormat)
 	if err != nil {
 		return err
 	}
@@ -299,12 +320,17 @@ func (bd *BackupDestination) CompressedStreamUpload(baseLocalPath string, files
 		return nil
 	})
 	g.Go(func() error {
-		return bd.PutFile(remotePath, body)
+		data, err := encryptFile(body, bd.encryptionKey)
+		if err != nil {
+			return err
+		}
+		return bd.PutFile(remotePath, data)
 	})
 	return g.Wait()
 }
 
-func (bd *BackupDestination) DownloadPath(size int64, remotePath string, localPath string) error {
+// DownloadPath - download files of remotePath, with encrypted files without encryption header are refused
+func (bd *BackupDestination) DownloadPath(size int64, remotePath string, localPath string, encrypted bool) error {
 	totalBytes := size
 	if size == 0 {
 		if err := bd.Walk(remotePath, true, func(f RemoteFile) error {
@@ -322,11 +348,17 @@ func (bd *BackupDestination) DownloadPath(size int64, remotePath string, localPa
 	})
 	return bd.Walk(remotePath, true, func(f RemoteFile) error {
 		// TODO: return err приостанавливает загрузку, нужно научить Walk обратывать ошибки или добавить какие-то ретраи
-		r, err := bd.GetFileReader(path.Join(remotePath, f.Name()))
+		remoteReader, err := bd.GetFileReader(path.Join(remotePath, f.Name()))
 		if err != nil {
 			log.Error(err.Error())
 			return err
 		}
+		r, err := newDecryptReader(remoteReader, bd.encryptionKey, encrypted)
+		if err != nil {
+			remoteReader.Close()
+			log.Error(err.Error())
+			return err
+		}
 		dstFilePath := path.Join(localPath, f.Name())
 		dstDirPath, _ := path.Split(dstFilePath)
 		if err := os.MkdirAll(dstDirPath, 0750); err != nil {
@@ -376,7 +408,12 @@ func (bd *BackupDestination) UploadPath(size int64, baseLocalPath string, files
 		if err != nil {
 			return err
 		}
-		if err := bd.PutFile(path.Join(remotePath, filename), f); err != nil {
+		data, err := encryptFile(f, bd.encryptionKey)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err := bd.PutFile(path.Join(remotePath, filename), data); err != nil {
 			return err
 		}
 		fi, err := f.Stat()
@@ -391,6 +428,10 @@ func (bd *BackupDestination) UploadPath(size int64, baseLocalPath string, files
 }
 
 func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
+	encryptionKey, err := cfg.GetEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
 	switch cfg.General.RemoteStorage {
 	case "azblob":
 		azblobStorage := &AzureBlob{Config: &cfg.AzureBlob}
@@ -399,6 +440,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.AzureBlob.CompressionFormat,
 			cfg.AzureBlob.CompressionLevel,
 			cfg.General.DisableProgressBar,
+			encryptionKey,
 		}, nil
 	case "s3":
 		s3Storage := &S3{
@@ -411,6 +453,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.S3.CompressionFormat,
 			cfg.S3.CompressionLevel,
 			cfg.General.DisableProgressBar,
+			encryptionKey,
 		}, nil
 	case "gcs":
 		googleCloudStorage := &GCS{Config: &cfg.GCS}
@@ -419,6 +462,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.GCS.CompressionFormat,
 			cfg.GCS.CompressionLevel,
 			cfg.General.DisableProgressBar,
+			encryptionKey,
 		}, nil
 	case "cos":
 		tencentStorage := &COS{
@@ -430,6 +474,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.COS.CompressionFormat,
 			cfg.COS.CompressionLevel,
 			cfg.General.DisableProgressBar,
+			encryptionKey,
 		}, nil
 	case "ftp":
 		ftpStorage := &FTP{
@@ -441,6 +486,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.FTP.CompressionFormat,
 			cfg.FTP.CompressionLevel,
 			cfg.General.DisableProgressBar,
+			encryptionKey,
 		}, nil
 	case "sftp":
 		sftpStorage := &SFTP{
@@ -451,6 +497,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.SFTP.CompressionFormat,
 			cfg.SFTP.CompressionLevel,
 			cfg.General.DisableProgressBar,
+			encryptionKey,
 		}, nil
 	default:
 		return nil, fmt.Errorf("storage type '%s' is not supported", cfg.General.RemoteStorage)
@@ -0,0 +1,231 @@
+package new_storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryFile struct {
+	name string
+	size int64
+}
+
+func (f memoryFile) Size() int64             { return f.size }
+func (f memoryFile) Name() string            { return f.name }
+func (f memoryFile) LastModified() time.Time { return time.Time{} }
+
+// memoryStorage - RemoteStorage which keeps uploaded files in memory
+type memoryStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memoryStorage) Kind() string   { return "memory" }
+func (m *memoryStorage) Connect() error { return nil }
+
+func (m *memoryStorage) StatFile(key string) (RemoteFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, ok := m.files[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return memoryFile{name: key, size: int64(len(body))}, nil
+}
+
+func (m *memoryStorage) DeleteFile(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, key)
+	return nil
+}
+
+// Walk - not recursive walk returns first level directories with trailing slash like S3 common prefixes
+func (m *memoryStorage) Walk(prefix string, recursive bool, fn func(RemoteFile) error) error {
+	prefix = strings.TrimPrefix(prefix, "/")
+	m.mu.Lock()
+	seen := map[string]struct{}{}
+	var found []RemoteFile
+	for key, body := range m.files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, prefix)
+		size := int64(len(body))
+		if i := strings.Index(name, "/"); !recursive && i >= 0 {
+			name, size = name[:i+1], 0
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		found = append(found, memoryFile{name: name, size: size})
+	}
+	m.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool { return found[i].Name() < found[j].Name() })
+	for _, f := range found {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) GetFileReader(key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, ok := m.files[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (m *memoryStorage) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[key] = body
+	return nil
+}
+
+func TestCompressedStreamUploadSize(t *testing.T) {
+	partPath, err := ioutil.TempDir("", "clickhouse-backup-compressed")
+	require.NoError(t, err)
+	defer os.RemoveAll(partPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(partPath, "all_1_1_0"), 0750))
+	files := []string{"all_1_1_0/data.bin", "all_1_1_0/checksums.txt"}
+	dataSize := int64(0)
+	for _, f := range files {
+		body := bytes.Repeat([]byte("clickhouse "), 10000)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, f), body, 0640))
+		dataSize += int64(len(body))
+	}
+	bd := &BackupDestination{RemoteStorage: &memoryStorage{files: map[string][]byte{}}, compressionFormat: "gzip", compressionLevel: 1, disableProgressBar: true}
+	require.NoError(t, bd.CompressedStreamUpload(partPath, files, "backup/shadow/default_1.tar.gz"))
+	remoteFile, err := bd.StatFile("backup/shadow/default_1.tar.gz")
+	require.NoError(t, err)
+	assert.True(t, remoteFile.Size() > 0)
+	assert.True(t, remoteFile.Size() <= dataSize, "compressed %d bytes of %d", remoteFile.Size(), dataSize)
+}
+
+func TestBackupListBroken(t *testing.T) {
+	storage := &memoryStorage{files: map[string][]byte{
+		"b1/metadata.json":              []byte(`{"backup_name":"b1","data_size":100,"tables":[{"database":"db","table":"t1"}]}`),
+		"b1/shadow/db/t1/default_1.tar": []byte("data"),
+		"b2/metadata.json":              []byte("{"),
+		"b3/shadow/db/t1/default_1.tar": []byte("data"),
+	}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", disableProgressBar: true}
+	backups, err := bd.BackupList()
+	require.NoError(t, err)
+	byName := map[string]Backup{}
+	for _, backup := range backups {
+		byName[backup.BackupName] = backup
+	}
+	require.Len(t, byName, 3)
+	assert.Empty(t, byName["b1"].Broken)
+	assert.Equal(t, int64(100), byName["b1"].DataSize)
+	assert.Len(t, byName["b1"].Tables, 1)
+	assert.Equal(t, "broken (bad metadata.json)", byName["b2"].Broken)
+	assert.Equal(t, "broken (can't stat metadata.json)", byName["b3"].Broken)
+}
+
+func TestRemoveBackupDeletesPrefix(t *testing.T) {
+	storage := &memoryStorage{files: map[string][]byte{
+		"b1/metadata.json":              []byte("{}"),
+		"b1/metadata/db/t1.json":        []byte("{}"),
+		"b1/shadow/db/t1/default_1.tar": []byte("data"),
+		"b10/metadata.json":             []byte("{}"),
+	}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "tar", disableProgressBar: true}
+	require.NoError(t, bd.RemoveBackup(Backup{BackupMetadata: metadata.BackupMetadata{BackupName: "b1"}}))
+	assert.Equal(t, map[string][]byte{"b10/metadata.json": []byte("{}")}, storage.files)
+}
+
+func TestCompressedStreamDownloadRecordedFormat(t *testing.T) {
+	partPath, err := ioutil.TempDir("", "clickhouse-backup-compressed")
+	require.NoError(t, err)
+	defer os.RemoveAll(partPath)
+	require.NoError(t, os.MkdirAll(filepath.Join(partPath, "all_1_1_0"), 0750))
+	body := bytes.Repeat([]byte("clickhouse "), 10000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "all_1_1_0", "data.bin"), body, 0640))
+	storage := &memoryStorage{files: map[string][]byte{}}
+	uploader := &BackupDestination{RemoteStorage: storage, compressionFormat: "gzip", compressionLevel: 1, disableProgressBar: true}
+	require.NoError(t, uploader.CompressedStreamUpload(partPath, []string{"all_1_1_0/data.bin"}, "backup/shadow/default_1.tar.gz"))
+
+	// compression_format is changed after upload
+	downloader := &BackupDestination{RemoteStorage: storage, compressionFormat: "zstd", disableProgressBar: true}
+	localPath := filepath.Join(partPath, "download")
+	require.NoError(t, downloader.CompressedStreamDownload("backup/shadow/default_1.tar.gz", localPath, "gzip", false))
+	downloaded, err := ioutil.ReadFile(filepath.Join(localPath, "all_1_1_0", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, body, downloaded)
+	assert.Error(t, downloader.CompressedStreamDownload("backup/shadow/default_1.tar.gz", filepath.Join(partPath, "zstd"), "", false))
+}
+
+// TestConcurrentCompressedStreamTransfers - upload_concurrency and download_concurrency share one BackupDestination,
+// run with -race
+func TestConcurrentCompressedStreamTransfers(t *testing.T) {
+	partPath, err := ioutil.TempDir("", "clickhouse-backup-concurrent")
+	require.NoError(t, err)
+	defer os.RemoveAll(partPath)
+	const archives = 8
+	var files [][]string
+	for i := 0; i < archives; i++ {
+		part := fmt.Sprintf("all_%d_%d_0", i, i)
+		require.NoError(t, os.MkdirAll(filepath.Join(partPath, part), 0750))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, part, "data.bin"), bytes.Repeat([]byte(part), 1000), 0640))
+		files = append(files, []string{path.Join(part, "data.bin")})
+	}
+	storage := &memoryStorage{files: map[string][]byte{}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "gzip", compressionLevel: 1, disableProgressBar: true}
+	runConcurrently := func(transfer func(i int) error) {
+		var wg sync.WaitGroup
+		errs := make([]error, archives)
+		for i := 0; i < archives; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = transfer(i)
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+	}
+	runConcurrently(func(i int) error {
+		return bd.CompressedStreamUpload(partPath, files[i], fmt.Sprintf("backup/shadow/default_%d.tar.gz", i))
+	})
+	assert.Len(t, storage.files, archives)
+
+	downloadPath := filepath.Join(partPath, "download")
+	runConcurrently(func(i int) error {
+		return bd.CompressedStreamDownload(fmt.Sprintf("backup/shadow/default_%d.tar.gz", i), downloadPath, "gzip", false)
+	})
+	for i := 0; i < archives; i++ {
+		part := fmt.Sprintf("all_%d_%d_0", i, i)
+		body, err := ioutil.ReadFile(filepath.Join(downloadPath, part, "data.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte(part), 1000), body)
+	}
+}
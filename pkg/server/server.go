@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -45,6 +46,10 @@ type APIServer struct {
 	metrics                 Metrics
 	routes                  []string
 	clickhouseBackupVersion string
+	// ctx - cancelled on SIGTERM, cancellable operations are tracked by running
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
 }
 
 type AsyncStatus struct {
@@ -128,7 +133,11 @@ func Server(c *cli.App, configPath string, clickhouseBackupVersion string) error
 		ch.GetConn().Close()
 		break
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	api := APIServer{
+		ctx:                     ctx,
+		cancel:                  cancel,
 		c:                       c,
 		configPath:              configPath,
 		config:                  cfg,
@@ -172,6 +181,8 @@ func Server(c *cli.App, configPath string, clickhouseBackupVersion string) error
 			apexLog.Info("Reloaded by SIGHUP")
 		case <-sigterm:
 			apexLog.Info("Stopping API server")
+			api.cancel()
+			api.running.Wait()
 			return api.server.Close()
 		}
 	}
@@ -392,7 +403,9 @@ func (api *APIServer) httpTablesHandler(w http.ResponseWriter, _ *http.Request)
 // CREATE TABLE system.backup_list (name String, created DateTime, size Int64, location String, desc String) ENGINE=URL('http://127.0.0.1:7171/backup/list?user=user&pass=pass', JSONEachRow)
 // ??? INSERT INTO system.backup_list (name,location) VALUES ('backup_name', 'remote') - upload backup
 // ??? INSERT INTO system.backup_list (name) VALUES ('backup_name') - create backup
-func (api *APIServer) httpListHandler(w http.ResponseWriter, _ *http.Request) {
+// Query arguments tag, created-after, created-before, offset and limit select page of local backups as 'list local' does,
+// remote backups are not listed with them, total count of matched local backups is returned in X-Total-Count header
+func (api *APIServer) httpListHandler(w http.ResponseWriter, r *http.Request) {
 	type backupJSON struct {
 		Name     string `json:"name"`
 		Created  string `json:"created"`
@@ -406,19 +419,50 @@ func (api *APIServer) httpListHandler(w http.ResponseWriter, _ *http.Request) {
 		writeError(w, http.StatusInternalServerError, "list", err)
 		return
 	}
-	localBackups, err := backup.GetLocalBackups(cfg)
+	query := r.URL.Query()
+	opts, err := backup.NewListOptions(query.Get("tag"), query.Get("created-after"), query.Get("created-before"), false)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "list", err)
+		return
+	}
+	var offset, limit int
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if v := query.Get(name); v != "" {
+			if *value, err = strconv.Atoi(v); err != nil {
+				writeError(w, http.StatusBadRequest, "list", fmt.Errorf("bad %s: %v", name, err))
+				return
+			}
+		}
+	}
+	paged := opts.Tag != "" || !opts.CreatedAfter.IsZero() || !opts.CreatedBefore.IsZero() || offset != 0 || limit != 0
+	localBackups, total, err := backup.ListBackupsPaged(cfg, offset, limit, opts)
 	if err != nil && !os.IsNotExist(err) {
 		writeError(w, http.StatusInternalServerError, "list", err)
 		return
 	}
+	if paged {
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
 	for _, b := range localBackups {
 		description := b.DataFormat
 		if b.Legacy {
 			description = "old-format"
 		}
+		if b.FailedTables > 0 {
+			description = fmt.Sprintf("partial, %d tables failed", b.FailedTables)
+		}
 		if b.Broken != "" {
 			description = b.Broken
 		}
+		if b.InProgress != nil {
+			description = b.InProgress.String()
+		}
+		if len(b.Tags) > 0 {
+			description = fmt.Sprintf("%s, tags: %s", description, strings.Join(b.Tags, ","))
+		}
+		if b.Description != "" {
+			description = fmt.Sprintf("%s, %s", description, b.Description)
+		}
 		backupsJSON = append(backupsJSON, backupJSON{
 			Name:     b.BackupName,
 			Created:  b.CreationDate.Format(APITimeFormat),
@@ -427,7 +471,7 @@ func (api *APIServer) httpListHandler(w http.ResponseWriter, _ *http.Request) {
 			Desc:     description,
 		})
 	}
-	if cfg.General.RemoteStorage != "none" {
+	if cfg.General.RemoteStorage != "none" && !paged {
 		remoteBackups, err := backup.GetRemoteBackups(cfg)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "list", err)
@@ -441,6 +485,15 @@ func (api *APIServer) httpListHandler(w http.ResponseWriter, _ *http.Request) {
 			if b.Broken != "" {
 				description = b.Broken
 			}
+			if b.CompressedSize > 0 && b.CompressedSize != b.DataSize {
+				description = fmt.Sprintf("%s, compressed %d of %d bytes", description, b.CompressedSize, b.DataSize)
+			}
+			if len(b.Tags) > 0 {
+				description = fmt.Sprintf("%s, tags: %s", description, strings.Join(b.Tags, ","))
+			}
+			if b.Description != "" {
+				description = fmt.Sprintf("%s, %s", description, b.Description)
+			}
 			backupsJSON = append(backupsJSON, backupJSON{
 				Name:     b.BackupName,
 				Created:  b.CreationDate.Format(APITimeFormat),
@@ -468,6 +521,14 @@ func (api *APIServer) httpCreateHandler(w http.ResponseWriter, r *http.Request)
 	tablePattern := ""
 	backupName := backup.NewBackupName()
 	schemaOnly := false
+	force := false
+	modifiedSince := ""
+	note := ""
+	var tags []string
+	var selector backup.TableSelector
+	var expectMetadataVersion []string
+	var partitions []string
+	diffFrom := ""
 	fullCommand := "create"
 	query := r.URL.Query()
 	if tp, exist := query["table"]; exist {
@@ -478,18 +539,93 @@ func (api *APIServer) httpCreateHandler(w http.ResponseWriter, r *http.Request)
 		schemaOnly, _ = strconv.ParseBool(schema[0])
 		fullCommand = fmt.Sprintf("%s --schema", fullCommand)
 	}
+	if ms, exist := query["modified-since"]; exist {
+		modifiedSince = ms[0]
+		fullCommand = fmt.Sprintf("%s --modified-since=\"%s\"", fullCommand, modifiedSince)
+	}
+	if n, exist := query["note"]; exist {
+		note = n[0]
+		fullCommand = fmt.Sprintf("%s --note=\"%s\"", fullCommand, note)
+	}
+	if t, exist := query["tag"]; exist {
+		tags = t
+		for _, tag := range tags {
+			fullCommand = fmt.Sprintf("%s --tag=%s", fullCommand, tag)
+		}
+	}
+	if shard, exist := query["shard"]; exist {
+		if selector, err = backup.ShardSelector(shard[0]); err != nil {
+			writeError(w, http.StatusBadRequest, "create", err)
+			return
+		}
+		fullCommand = fmt.Sprintf("%s --shard=%s", fullCommand, shard[0])
+	}
+	if engines, exist := query["engines"]; exist {
+		engineSelector, err := backup.EngineSelector(engines)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "create", err)
+			return
+		}
+		selector = backup.ChainSelectors(selector, engineSelector)
+		for _, engine := range engines {
+			fullCommand = fmt.Sprintf("%s --engines=%s", fullCommand, engine)
+		}
+	}
+	if versions, exist := query["expect-metadata-version"]; exist {
+		expectMetadataVersion = versions
+		for _, v := range versions {
+			fullCommand = fmt.Sprintf("%s --expect-metadata-version=%s", fullCommand, v)
+		}
+	}
+	if p, exist := query["partitions"]; exist {
+		partitions = p
+		for _, v := range partitions {
+			fullCommand = fmt.Sprintf("%s --partitions=%s", fullCommand, v)
+		}
+	}
+	if df, exist := query["diff-from"]; exist {
+		if schemaOnly || modifiedSince != "" || len(partitions) > 0 {
+			writeError(w, http.StatusBadRequest, "create", fmt.Errorf("diff-from can't be used with schema, modified-since or partitions"))
+			return
+		}
+		diffFrom = df[0]
+		fullCommand = fmt.Sprintf("%s --diff-from=%s", fullCommand, diffFrom)
+	}
+	if _, exist := query["force"]; exist {
+		force = true
+		fullCommand = fmt.Sprintf("%s --force", fullCommand)
+	}
 	if name, exist := query["name"]; exist {
 		backupName = name[0]
 		fullCommand = fmt.Sprintf("%s %s", fullCommand, backupName)
 	}
 
+	api.running.Add(1)
 	go func() {
+		defer api.running.Done()
 		api.status.start(fullCommand)
 		start := time.Now()
 		api.metrics.LastStart["create"].Set(float64(start.Unix()))
 		defer api.metrics.LastDuration["create"].Set(float64(time.Since(start).Nanoseconds()))
 		defer api.metrics.LastFinish["create"].Set(float64(time.Now().Unix()))
-		err := backup.CreateBackup(cfg, backupName, tablePattern, schemaOnly, api.clickhouseBackupVersion)
+		opts := backup.CreateOptions{
+			TablePattern:          tablePattern,
+			ModifiedSince:         modifiedSince,
+			Note:                  note,
+			Tags:                  tags,
+			Selector:              selector,
+			ExpectMetadataVersion: expectMetadataVersion,
+			Partitions:            partitions,
+			SchemaOnly:            schemaOnly,
+			Force:                 force,
+			Version:               api.clickhouseBackupVersion,
+		}
+		var err error
+		if diffFrom != "" {
+			err = backup.CreateIncrementalBackup(api.ctx, cfg, backupName, diffFrom, opts)
+		} else {
+			err = backup.CreateBackup(api.ctx, cfg, backupName, opts)
+		}
 		defer api.status.stop(err)
 		if err != nil {
 			api.metrics.FailedCounter["create"].Inc()
@@ -546,6 +682,11 @@ func (api *APIServer) httpUploadHandler(w http.ResponseWriter, r *http.Request)
 		schemaOnly, _ = strconv.ParseBool(schema[0])
 		fullCommand += " --schema"
 	}
+	full := false
+	if f, exist := query["full"]; exist {
+		full, _ = strconv.ParseBool(f[0])
+		fullCommand += " --full"
+	}
 	fullCommand = fmt.Sprint(fullCommand, " ", name)
 
 	go func() {
@@ -555,7 +696,7 @@ func (api *APIServer) httpUploadHandler(w http.ResponseWriter, r *http.Request)
 		defer api.metrics.LastDuration["upload"].Set(float64(time.Since(start).Nanoseconds()))
 		defer api.metrics.LastFinish["upload"].Set(float64(time.Now().Unix()))
 		b := backup.NewBackuper(cfg)
-		err := b.Upload(name, tablePattern, diffFrom, schemaOnly)
+		err := b.Upload(name, tablePattern, diffFrom, schemaOnly, full)
 		api.status.stop(err)
 		if err != nil {
 			apexLog.Errorf("Upload error: %+v\n", err)
@@ -601,6 +742,11 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 	schemaOnly := false
 	dataOnly := false
 	dropTable := false
+	onlyMissing := false
+	storagePolicy := ""
+	onCluster := ""
+	ignoreSignature := false
+	var tableMapping []string
 	fullCommand := "restore"
 
 	query := r.URL.Query()
@@ -624,6 +770,28 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		dropTable = true
 		fullCommand += " --rm"
 	}
+	if _, exist := query["only-missing"]; exist {
+		onlyMissing = true
+		fullCommand += " --only-missing"
+	}
+	if sp, exist := query["storage-policy"]; exist {
+		storagePolicy = sp[0]
+		fullCommand = fmt.Sprintf("%s --storage-policy=%s", fullCommand, storagePolicy)
+	}
+	if cluster, exist := query["on-cluster"]; exist {
+		onCluster = cluster[0]
+		fullCommand = fmt.Sprintf("%s --on-cluster=%s", fullCommand, onCluster)
+	}
+	if _, exist := query["ignore-signature"]; exist {
+		ignoreSignature = true
+		fullCommand += " --ignore-signature"
+	}
+	if mapping, exist := query["map-table"]; exist {
+		tableMapping = mapping
+		for _, m := range mapping {
+			fullCommand = fmt.Sprintf("%s --map-table=%s", fullCommand, m)
+		}
+	}
 	name := vars["name"]
 	fullCommand = fmt.Sprintf(fullCommand, " ", name)
 
@@ -633,7 +801,17 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		api.metrics.LastStart["restore"].Set(float64(start.Unix()))
 		defer api.metrics.LastDuration["restore"].Set(float64(time.Since(start).Nanoseconds()))
 		defer api.metrics.LastFinish["restore"].Set(float64(time.Now().Unix()))
-		err := backup.Restore(cfg, name, tablePattern, schemaOnly, dataOnly, dropTable)
+		err := backup.Restore(cfg, name, backup.RestoreOptions{
+			TablePattern:    tablePattern,
+			SchemaOnly:      schemaOnly,
+			DataOnly:        dataOnly,
+			DropTable:       dropTable,
+			OnlyMissing:     onlyMissing,
+			StoragePolicy:   storagePolicy,
+			OnCluster:       onCluster,
+			IgnoreSignature: ignoreSignature,
+			TableMapping:    tableMapping,
+		})
 		api.status.stop(err)
 		if err != nil {
 			apexLog.Errorf("Download error: %+v\n", err)
@@ -672,6 +850,7 @@ func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request
 	query := r.URL.Query()
 	tablePattern := ""
 	schemaOnly := false
+	ignoreSignature := false
 	fullCommand := "download"
 
 	if tp, exist := query["table"]; exist {
@@ -682,6 +861,10 @@ func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request
 		schemaOnly = true
 		fullCommand += " --schema"
 	}
+	if _, exist := query["ignore-signature"]; exist {
+		ignoreSignature = true
+		fullCommand += " --ignore-signature"
+	}
 	fullCommand = fmt.Sprintf(fullCommand, " ", name)
 
 	go func() {
@@ -691,7 +874,7 @@ func (api *APIServer) httpDownloadHandler(w http.ResponseWriter, r *http.Request
 		defer api.metrics.LastDuration["download"].Set(float64(time.Since(start).Nanoseconds()))
 		defer api.metrics.LastFinish["download"].Set(float64(time.Now().Unix()))
 		b := backup.NewBackuper(cfg)
-		err := b.Download(name, tablePattern, schemaOnly)
+		err := b.Download(name, tablePattern, schemaOnly, ignoreSignature)
 		api.status.stop(err)
 		if err != nil {
 			apexLog.Errorf("Download error: %+v\n", err)
@@ -944,9 +1127,37 @@ func setupMetrics() Metrics {
 	m.LastStatus["create_remote"].Set(2)
 	m.LastStatus["restore_remote"].Set(2)
 
+	setupEventMetrics()
 	return m
 }
 
+// setupEventMetrics - count lifecycle events of all backups created by server and register them as prometheus counters
+func setupEventMetrics() {
+	events := &backup.CounterEventHandler{}
+	backup.SetEventHandler(events)
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value func(backup.EventCounters) int64
+	}{
+		{"backups_started", "Counter of started backups", func(c backup.EventCounters) int64 { return c.BackupsStarted }},
+		{"backups_done", "Counter of finished backups", func(c backup.EventCounters) int64 { return c.BackupsDone }},
+		{"backups_failed", "Counter of failed backups", func(c backup.EventCounters) int64 { return c.BackupsFailed }},
+		{"tables_done", "Counter of tables backed up", func(c backup.EventCounters) int64 { return c.TablesDone }},
+		{"bytes_done", "Counter of data bytes of tables backed up", func(c backup.EventCounters) int64 { return c.BytesDone }},
+	} {
+		value := counter.value
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "clickhouse_backup",
+			Subsystem: "events",
+			Name:      counter.name,
+			Help:      counter.help,
+		}, func() float64 {
+			return float64(value(events.Counters()))
+		}))
+	}
+}
+
 func (api *APIServer) CreateIntegrationTables() error {
 	ch := &clickhouse.ClickHouse{
 		Config: &api.config.ClickHouse,
@@ -968,11 +1179,11 @@ func (api *APIServer) CreateIntegrationTables() error {
 		schema = "https"
 	}
 	query := fmt.Sprintf("CREATE TABLE system.backup_actions (command String, start DateTime, finish DateTime, status String, error String) ENGINE=URL('%s://127.0.0.1:%s/backup/actions%s', JSONEachRow)", schema, port, auth)
-	if err := ch.CreateTable(clickhouse.Table{Database: "system", Name: "backup_actions"}, query, true); err != nil {
+	if err := ch.CreateTable(clickhouse.Table{Database: "system", Name: "backup_actions"}, query, true, ""); err != nil {
 		return err
 	}
 	query = fmt.Sprintf("CREATE TABLE system.backup_list (name String, created DateTime, size Int64, location String, desc String) ENGINE=URL('%s://127.0.0.1:%s/backup/list%s', JSONEachRow)", schema, port, auth)
-	if err := ch.CreateTable(clickhouse.Table{Database: "system", Name: "backup_list"}, query, true); err != nil {
+	if err := ch.CreateTable(clickhouse.Table{Database: "system", Name: "backup_list"}, query, true, ""); err != nil {
 		return err
 	}
 	return nil
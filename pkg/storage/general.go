@@ -49,6 +49,7 @@ type BackupDestination struct {
 	compressionLevel   int
 	disableProgressBar bool
 	backupsToKeep      int
+	tempDir            string
 }
 
 func (bd *BackupDestination) RemoveOldBackups(keep int) error {
@@ -326,7 +327,7 @@ func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffF
 				ferr = fmt.Errorf("can't marshal json: %v", err)
 				return
 			}
-			tmpfile, err := ioutil.TempFile("", MetaFileName)
+			tmpfile, err := ioutil.TempFile(bd.tempDir, MetaFileName)
 			if err != nil {
 				ferr = fmt.Errorf("can't create meta.info: %v", err)
 				return
@@ -381,6 +382,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.AzureBlob.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.GetTempDir(),
 		}, nil
 	case "s3":
 		s3Storage := &S3{
@@ -394,6 +396,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.S3.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.GetTempDir(),
 		}, nil
 	case "gcs":
 		googleCloudStorage := &GCS{Config: &cfg.GCS}
@@ -404,6 +407,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.GCS.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.GetTempDir(),
 		}, nil
 	case "cos":
 		tencentStorage := &COS{
@@ -417,6 +421,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.COS.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.GetTempDir(),
 		}, nil
 	case "ftp":
 		ftpStorage := &FTP{
@@ -430,6 +435,7 @@ func NewBackupDestination(cfg *config.Config) (*BackupDestination, error) {
 			cfg.FTP.CompressionLevel,
 			cfg.General.DisableProgressBar,
 			cfg.General.BackupsToKeepRemote,
+			cfg.GetTempDir(),
 		}, nil
 	default:
 		return nil, fmt.Errorf("storage type '%s' not supported", cfg.General.RemoteStorage)
@@ -586,7 +586,7 @@ func (ch *TestClickHouse) createTestSchema(data TestDataStruct) error {
 			return err
 		}
 	} else {
-		if err := ch.chbackup.CreateDatabase(data.Database); err != nil {
+		if err := ch.chbackup.CreateDatabase(data.Database, ""); err != nil {
 			return err
 		}
 	}
@@ -616,6 +616,7 @@ func (ch *TestClickHouse) createTestSchema(data TestDataStruct) error {
 		},
 		createSQL,
 		false,
+		"",
 	)
 	return err
 }